@@ -0,0 +1,113 @@
+package grpcmon
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AnomalyConfig configures latency anomaly detection. See
+// WithLatencyAnomalies.
+type AnomalyConfig struct {
+	// Short is the window whose mean latency is compared with the
+	// baseline, for example a minute.
+	Short time.Duration
+	// Baseline is the window the baseline is computed over, for example
+	// an hour. It is rounded down to a multiple of Short.
+	Baseline time.Duration
+	// Factor is the number of standard deviations above the baseline mean
+	// at which the short window mean is anomalous, for example 3.
+	Factor float64
+	// ClearFactor is the number of standard deviations above the baseline
+	// mean below which an anomaly ends. It is lower than Factor so that
+	// anomalies do not flap.
+	ClearFactor float64
+	// MinBaseline and MinShort are the number of RPCs the baseline and the
+	// short window need before they are compared.
+	MinBaseline int
+	MinShort    int
+	// Callback is called when an anomaly of a method starts and when it
+	// ends. It is called from a new goroutine, with panics recovered.
+	Callback func(Anomaly)
+}
+
+// Anomaly describes the start or end of a latency anomaly of a method.
+type Anomaly struct {
+	Service string
+	Method  string
+	// Active is true when the anomaly starts and false when it ends.
+	Active bool
+	// Mean is the mean latency over the short window.
+	Mean time.Duration
+	// BaselineMean and BaselineStdDev describe the latency over the
+	// baseline window, excluding the short window.
+	BaselineMean   time.Duration
+	BaselineStdDev time.Duration
+}
+
+// anomalyDetector compares the latest slot of a rolling window with the
+// rest of it.
+type anomalyDetector struct {
+	cfg     AnomalyConfig
+	rolling *rolling
+	self    *SelfMetrics
+
+	mu     sync.Mutex
+	active map[rpcName]bool
+}
+
+func newAnomalyDetector(cfg AnomalyConfig) *anomalyDetector {
+	slots := int(cfg.Baseline / cfg.Short)
+	if slots < 2 {
+		slots = 2
+	}
+	return &anomalyDetector{
+		cfg:     cfg,
+		rolling: newRolling(slots, cfg.Short),
+		active:  make(map[rpcName]bool),
+	}
+}
+
+// observe records an RPC of the given method and checks the method for
+// anomalies.
+func (a *anomalyDetector) observe(name rpcName, d time.Duration) {
+	a.rolling.observe(name, d, false)
+	current, baseline, ok := a.rolling.split(name)
+	if !ok || current.count < int64(a.cfg.MinShort) || baseline.count < int64(a.cfg.MinBaseline) {
+		return
+	}
+	mean := current.sum / float64(current.count)
+	bmean := baseline.sum / float64(baseline.count)
+	stddev := math.Sqrt(math.Max(baseline.sumSq/float64(baseline.count)-bmean*bmean, 0))
+
+	a.mu.Lock()
+	active := a.active[name]
+	switch {
+	case !active && mean > bmean+a.cfg.Factor*stddev:
+		active = true
+	case active && mean < bmean+a.cfg.ClearFactor*stddev:
+		active = false
+	default:
+		a.mu.Unlock()
+		return
+	}
+	if active {
+		a.active[name] = true
+	} else {
+		delete(a.active, name)
+	}
+	a.mu.Unlock()
+
+	info := Anomaly{
+		Service:        name.server,
+		Method:         name.method,
+		Active:         active,
+		Mean:           seconds(mean),
+		BaselineMean:   seconds(bmean),
+		BaselineStdDev: seconds(stddev),
+	}
+	go func() {
+		defer a.self.recoverSinkError()
+		a.cfg.Callback(info)
+	}()
+}
@@ -0,0 +1,58 @@
+package grpcmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetector(t *testing.T) {
+	events := make(chan Anomaly, 10)
+	a := newAnomalyDetector(AnomalyConfig{
+		Short:       time.Minute,
+		Baseline:    10 * time.Minute,
+		Factor:      3,
+		ClearFactor: 1,
+		MinBaseline: 20,
+		MinShort:    5,
+		Callback:    func(info Anomaly) { events <- info },
+	})
+	now := time.Unix(60000, 0)
+	a.rolling.now = func() time.Time { return now }
+	name := rpcName{server: "s", method: "m"}
+
+	// Baseline of 10ms and 12ms.
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 10; j++ {
+			a.observe(name, time.Duration(10+2*(j%2))*time.Millisecond)
+		}
+		now = now.Add(time.Minute)
+	}
+	select {
+	case info := <-events:
+		t.Fatalf("unexpected anomaly %+v", info)
+	default:
+	}
+
+	for i := 0; i < 10; i++ {
+		a.observe(name, 50*time.Millisecond)
+	}
+	info := <-events
+	if !info.Active || info.BaselineMean != 11*time.Millisecond || info.BaselineStdDev != time.Millisecond {
+		t.Errorf("got %+v, want an active anomaly against 11ms±1ms", info)
+	}
+	// Still anomalous, no repeated callback.
+	a.observe(name, 50*time.Millisecond)
+
+	now = now.Add(time.Minute)
+	for i := 0; i < 5; i++ {
+		a.observe(name, 10*time.Millisecond)
+	}
+	if info := <-events; info.Active {
+		t.Errorf("got %+v, want the anomaly to end", info)
+	}
+	select {
+	case info := <-events:
+		t.Errorf("unexpected callback %+v", info)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,55 @@
+package grpcmon
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// deadlineTolerance is how long before its deadline a server RPC may be
+// canceled and still be taken to have hit the deadline. Clients cancel RPCs
+// as their own deadline expires, which servers may see slightly before
+// theirs.
+const deadlineTolerance = 10 * time.Millisecond
+
+// cancelWatch records when the context of a server RPC is done, for
+// ClientCancellations. It is not part of rpcInfo, which may be reused by
+// the time the context is done.
+type cancelWatch struct {
+	// at is when the context was canceled before its deadline, in
+	// nanoseconds since the Unix epoch, or zero.
+	at   atomic.Int64
+	stop func() bool
+}
+
+// watchCancel returns a cancelWatch of ctx, the context of a server RPC
+// with the given deadline.
+func watchCancel(ctx context.Context, deadline time.Time) *cancelWatch {
+	w := new(cancelWatch)
+	w.stop = context.AfterFunc(ctx, func() {
+		w.done(ctx, deadline, time.Now())
+	})
+	return w
+}
+
+// done records that ctx, with the given deadline, was done at t.
+func (w *cancelWatch) done(ctx context.Context, deadline, t time.Time) {
+	if ctx.Err() != context.Canceled {
+		return
+	}
+	if !deadline.IsZero() && !t.Before(deadline.Add(-deadlineTolerance)) {
+		return
+	}
+	w.at.CompareAndSwap(0, t.UnixNano())
+}
+
+// canceled reports whether the context of the RPC of w, which ended without
+// its trailer being sent, was canceled by the client.
+func (w *cancelWatch) canceled(ctx context.Context, deadline time.Time) bool {
+	if !w.stop() && w.at.Load() == 0 {
+		// The context is done, but the function recording it may not have
+		// run yet.
+		w.done(ctx, deadline, time.Now())
+	}
+	return w.at.Load() != 0
+}
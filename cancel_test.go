@@ -0,0 +1,81 @@
+package grpcmon_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+// swallowingFrontend waits for the context of every query to be done, then
+// returns OK regardless.
+type swallowingFrontend struct {
+	done chan struct{}
+}
+
+func (f *swallowingFrontend) Query(ctx context.Context, _ *pb.QueryRequest) (*pb.QueryResponse, error) {
+	<-ctx.Done()
+	close(f.done)
+	return &pb.QueryResponse{}, nil
+}
+
+func TestClientCancellations(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		want float64
+	}{
+		{"canceled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			return ctx, cancel
+		}, 1},
+		{"canceled with deadline", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			time.AfterFunc(20*time.Millisecond, cancel)
+			return ctx, cancel
+		}, 1},
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 20*time.Millisecond)
+		}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := grpcmontest.NewHarness(t)
+			fe := &swallowingFrontend{done: make(chan struct{})}
+			pb.RegisterFrontendServer(h.Server, fe)
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			if _, err := pb.NewFrontendClient(h.Conn()).Query(ctx, &pb.QueryRequest{}); err == nil {
+				t.Fatal("query succeeded, want it to fail")
+			}
+			<-fe.done
+			h.Stop()
+
+			method := []string{"service", "frontend.Frontend", "method", "Query"}
+			if got := h.ServerRecorder.CounterValue(grpcmontest.ClientCancellations, method...); got != tt.want {
+				t.Errorf("client cancellations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientCancellationsCompleted(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+	client := pb.NewFrontendClient(h.Conn())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		if _, err := client.Query(ctx, &pb.QueryRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.Stop()
+
+	method := []string{"service", "frontend.Frontend", "method", "Query"}
+	if got := h.ServerRecorder.CounterValue(grpcmontest.ClientCancellations, method...); got != 0 {
+		t.Errorf("client cancellations of completed queries = %v, want 0", got)
+	}
+}
@@ -0,0 +1,226 @@
+package grpcmon
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/stats"
+)
+
+// maxCapturedEvents is the maximum number of events captured per RPC.
+// Further events of long streams are dropped.
+const maxCapturedEvents = 256
+
+// CapturedRPC is a completed RPC recorded by Handler.Capture.
+type CapturedRPC struct {
+	Service string          `json:"service"`
+	Method  string          `json:"method"`
+	Code    string          `json:"code"`
+	Events  []CapturedEvent `json:"events"`
+	// Dropped is the number of events beyond the capture limit.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// CapturedEvent is a stats event of a CapturedRPC.
+type CapturedEvent struct {
+	// Type is the name of the event type, such as "InPayload".
+	Type string `json:"type"`
+	// Time is the time the handler saw the event.
+	Time time.Time `json:"time"`
+	// WireLength is the wire size of the frame of the event, if any.
+	WireLength int `json:"wire_length,omitempty"`
+}
+
+// capture holds the last completed RPCs of a method.
+type capture struct {
+	name rpcName
+	self *SelfMetrics
+
+	mu   sync.Mutex
+	rpcs []*rpcTrace // ring of length n
+	next int
+	full bool
+}
+
+// rpcTrace accumulates the events of an RPC being captured.
+type rpcTrace struct {
+	mu  sync.Mutex
+	rpc CapturedRPC
+}
+
+// record adds the event of an RPC of the given method to its trace, and
+// moves the trace to the ring once the RPC ends.
+func (c *capture) record(v *rpcInfo, name rpcName, stat stats.RPCStats) {
+	if name != c.name {
+		return
+	}
+	t := v.trace.Load()
+	if t == nil {
+		t = &rpcTrace{rpc: CapturedRPC{Service: name.server, Method: name.method}}
+		if !v.trace.CompareAndSwap(nil, t) {
+			t = v.trace.Load()
+		}
+	}
+	t.mu.Lock()
+	if len(t.rpc.Events) < maxCapturedEvents {
+		t.rpc.Events = append(t.rpc.Events, CapturedEvent{
+			Type:       eventType(stat),
+			Time:       time.Now(),
+			WireLength: wireLength(stat),
+		})
+	} else {
+		t.rpc.Dropped++
+		c.self.dropped(DropCapture)
+	}
+	end, ok := stat.(*stats.End)
+	if ok {
+		t.rpc.Code = codeLabel(end.Error)
+	}
+	t.mu.Unlock()
+	if !ok || !v.trace.CompareAndSwap(t, nil) {
+		return
+	}
+	c.mu.Lock()
+	c.rpcs[c.next] = t
+	c.next++
+	if c.next == len(c.rpcs) {
+		c.next = 0
+		c.full = true
+	}
+	c.mu.Unlock()
+}
+
+// contents returns copies of the RPCs in the ring, oldest first.
+func (c *capture) contents() []CapturedRPC {
+	c.mu.Lock()
+	var traces []*rpcTrace
+	if c.full {
+		traces = append(traces, c.rpcs[c.next:]...)
+	}
+	traces = append(traces, c.rpcs[:c.next]...)
+	c.mu.Unlock()
+	res := make([]CapturedRPC, len(traces))
+	for i, t := range traces {
+		t.mu.Lock()
+		res[i] = t.rpc
+		res[i].Events = append([]CapturedEvent(nil), t.rpc.Events...)
+		t.mu.Unlock()
+	}
+	return res
+}
+
+func eventType(stat stats.RPCStats) string {
+	switch stat.(type) {
+	case *stats.Begin:
+		return "Begin"
+	case *stats.End:
+		return "End"
+	case *stats.InHeader:
+		return "InHeader"
+	case *stats.InPayload:
+		return "InPayload"
+	case *stats.InTrailer:
+		return "InTrailer"
+	case *stats.OutHeader:
+		return "OutHeader"
+	case *stats.OutPayload:
+		return "OutPayload"
+	case *stats.OutTrailer:
+		return "OutTrailer"
+	case *stats.PickerUpdated:
+		return "PickerUpdated"
+	default:
+		return "Unknown"
+	}
+}
+
+func wireLength(stat stats.RPCStats) int {
+	switch s := stat.(type) {
+	case *stats.InHeader:
+		return s.WireLength
+	case *stats.InPayload:
+		return s.WireLength
+	case *stats.InTrailer:
+		return s.WireLength
+	case *stats.OutPayload:
+		return s.WireLength
+	case *stats.OutTrailer:
+		return s.WireLength
+	default:
+		return 0
+	}
+}
+
+// Capture starts recording the events of the RPCs of the given method,
+// keeping the last n completed ones, and discards any previous capture. If n
+// is zero or less, recording stops but the last capture is kept. Capturing a
+// method costs a few allocations per event of its RPCs; other methods and
+// handlers that capture nothing only pay for an atomic load.
+func (h *Handler) Capture(service, method string, n int) {
+	if n <= 0 {
+		h.capturing.Store(nil)
+		return
+	}
+	c := &capture{name: rpcName{server: service, method: method}, self: h.opts.self, rpcs: make([]*rpcTrace, n)}
+	h.captured.Store(c)
+	h.capturing.Store(c)
+}
+
+// Captured returns the RPCs recorded by the last call to Capture, oldest
+// first.
+func (h *Handler) Captured() []CapturedRPC {
+	c := h.captured.Load()
+	if c == nil {
+		return nil
+	}
+	return c.contents()
+}
+
+var captureTemplate = template.Must(template.New("capture").Funcs(template.FuncMap{
+	"since": func(begin, t time.Time) time.Duration { return t.Sub(begin) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Captured gRPC requests</title></head>
+<body>
+<h1>Captured gRPC requests</h1>
+{{range .}}{{$begin := (index .Events 0).Time}}<h2>{{.Service}}/{{.Method}} {{.Code}}</h2>
+<table>
+<tr><th>Offset</th><th>Event</th><th>Wire length</th></tr>
+{{range .Events}}<tr><td>{{since $begin .Time}}</td><td>{{.Type}}</td><td>{{.WireLength}}</td></tr>
+{{end}}</table>
+{{if .Dropped}}<p>{{.Dropped}} more events dropped.</p>
+{{end}}{{else}}<p>Nothing captured.</p>
+{{end}}</body>
+</html>
+`))
+
+// CaptureHandler returns an http.Handler that renders the RPCs recorded by
+// Handler.Capture with the offsets of their events from the first one, as
+// HTML, or as JSON if the format query parameter is "json". Requests with the
+// service, method and n query parameters start a new capture first, and n=0
+// stops capturing.
+func CaptureHandler(h *Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if s := q.Get("n"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+			h.Capture(q.Get("service"), q.Get("method"), n)
+		}
+		rpcs := h.Captured()
+		if q.Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(rpcs)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		captureTemplate.Execute(w, rpcs)
+	})
+}
@@ -0,0 +1,46 @@
+package grpcmon
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+// DialOptionWith is like DialOption, but chains the instrumentation with
+// next, since a client connection only accepts one stats.Handler.
+func DialOptionWith(metrics *Metrics, next stats.Handler, opts ...Option) grpc.DialOption {
+	return grpc.WithStatsHandler(&chain{Handler: newHandler(metrics, true, opts), next: next})
+}
+
+// ServerOptionWith is like ServerOption, but chains the instrumentation with
+// next, since a server only accepts one stats.Handler.
+func ServerOptionWith(metrics *Metrics, next stats.Handler, opts ...Option) grpc.ServerOption {
+	return grpc.StatsHandler(&chain{Handler: newHandler(metrics, false, opts), next: next})
+}
+
+// chain calls next after the embedded Handler. The contexts returned by the
+// Tag methods of both are preserved, since each stores its values under its
+// own keys.
+type chain struct {
+	*Handler
+	next stats.Handler
+}
+
+func (c *chain) TagRPC(ctx context.Context, v *stats.RPCTagInfo) context.Context {
+	return c.next.TagRPC(c.Handler.TagRPC(ctx, v), v)
+}
+
+func (c *chain) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+	c.Handler.HandleRPC(ctx, stat)
+	c.next.HandleRPC(ctx, stat)
+}
+
+func (c *chain) TagConn(ctx context.Context, v *stats.ConnTagInfo) context.Context {
+	return c.next.TagConn(c.Handler.TagConn(ctx, v), v)
+}
+
+func (c *chain) HandleConn(ctx context.Context, stat stats.ConnStats) {
+	c.Handler.HandleConn(ctx, stat)
+	c.next.HandleConn(ctx, stat)
+}
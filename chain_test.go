@@ -0,0 +1,186 @@
+package grpcmon_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+type tagKey struct{}
+
+// tagHandler stores the method in the context of every RPC and records the
+// method found in the context of End events.
+type tagHandler struct {
+	mu    sync.Mutex
+	ended []string
+	conns int
+}
+
+func (h *tagHandler) TagRPC(ctx context.Context, v *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, tagKey{}, v.FullMethodName)
+}
+
+func (h *tagHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if _, ok := s.(*stats.End); ok {
+		name, _ := ctx.Value(tagKey{}).(string)
+		h.mu.Lock()
+		h.ended = append(h.ended, name)
+		h.mu.Unlock()
+	}
+}
+
+func (h *tagHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *tagHandler) HandleConn(_ context.Context, s stats.ConnStats) {
+	if _, ok := s.(*stats.ConnBegin); ok {
+		h.mu.Lock()
+		h.conns++
+		h.mu.Unlock()
+	}
+}
+
+func TestChain(t *testing.T) {
+	serverMetrics, serverRec := grpcmontest.NewRecorder()
+	clientMetrics, clientRec := grpcmontest.NewRecorder()
+	var serverNext, clientNext tagHandler
+
+	srv := grpc.NewServer(grpcmon.ServerOptionWith(serverMetrics, &serverNext))
+	pb.RegisterFrontendServer(srv, &frontend{})
+	go srv.Serve(listen("chain"))
+
+	conn, err := grpc.Dial("chain",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dial),
+		grpcmon.DialOptionWith(clientMetrics, &clientNext),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	srv.GracefulStop()
+
+	labels := map[string]string{"service": "frontend.Frontend", "method": "Query", "code": "OK"}
+	clientRec.AssertCounterDelta(t, grpcmontest.ReqsTotal, labels, 1)
+	serverRec.AssertCounterDelta(t, grpcmontest.ReqsTotal, labels, 1)
+	for side, h := range map[string]*tagHandler{"client": &clientNext, "server": &serverNext} {
+		h.mu.Lock()
+		if len(h.ended) != 1 || h.ended[0] != "/frontend.Frontend/Query" {
+			t.Errorf("%s: next handler saw ends %q, want the tagged method once", side, h.ended)
+		}
+		if h.conns != 1 {
+			t.Errorf("%s: next handler saw %d connections, want 1", side, h.conns)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// spanHandler embeds a Handler, overriding TagRPC to store a span name in
+// the context, before or after calling the Handler.
+type spanHandler struct {
+	*grpcmon.Handler
+	after bool
+
+	mu    sync.Mutex
+	spans []string
+}
+
+func (h *spanHandler) TagRPC(ctx context.Context, v *stats.RPCTagInfo) context.Context {
+	if h.after {
+		return context.WithValue(h.Handler.TagRPC(ctx, v), tagKey{}, v.FullMethodName)
+	}
+	return h.Handler.TagRPC(context.WithValue(ctx, tagKey{}, v.FullMethodName), v)
+}
+
+func (h *spanHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if _, ok := s.(*stats.End); ok {
+		name, _ := ctx.Value(tagKey{}).(string)
+		h.mu.Lock()
+		h.spans = append(h.spans, name)
+		h.mu.Unlock()
+	}
+	h.Handler.HandleRPC(ctx, s)
+}
+
+func TestEmbeddedHandler(t *testing.T) {
+	for _, after := range []bool{false, true} {
+		serverMetrics, serverRec := grpcmontest.NewRecorder()
+		clientMetrics, clientRec := grpcmontest.NewRecorder()
+		server := &spanHandler{Handler: grpcmon.ServerStatsHandler(serverMetrics), after: after}
+		client := &spanHandler{Handler: grpcmon.ClientStatsHandler(clientMetrics), after: after}
+
+		srv := grpc.NewServer(grpc.StatsHandler(server))
+		pb.RegisterFrontendServer(srv, &frontend{})
+		go srv.Serve(listen("embedded"))
+		conn, err := grpc.Dial("embedded",
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(dial),
+			grpc.WithStatsHandler(client),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		srv.GracefulStop()
+
+		labels := map[string]string{"service": "frontend.Frontend", "method": "Query", "code": "OK"}
+		clientRec.AssertCounterDelta(t, grpcmontest.ReqsTotal, labels, 1)
+		serverRec.AssertCounterDelta(t, grpcmontest.ReqsTotal, labels, 1)
+		for side, h := range map[string]*spanHandler{"client": client, "server": server} {
+			h.mu.Lock()
+			if len(h.spans) != 1 || h.spans[0] != "/frontend.Frontend/Query" {
+				t.Errorf("%s, tagging after %v: ended spans %q, want the tagged method once", side, after, h.spans)
+			}
+			h.mu.Unlock()
+			if got := h.InFlight("frontend.Frontend", "Query"); got != 0 {
+				t.Errorf("%s, tagging after %v: %d RPCs in flight, want 0", side, after, got)
+			}
+		}
+	}
+}
+
+func TestStackedHandlers(t *testing.T) {
+	first, firstRec := grpcmontest.NewRecorder()
+	second, secondRec := grpcmontest.NewRecorder()
+	_, selfRec := grpcmontest.NewRecorder()
+
+	srv := grpc.NewServer()
+	pb.RegisterFrontendServer(srv, &frontend{})
+	go srv.Serve(listen("stacked"))
+	defer srv.Stop()
+	conn, err := grpc.Dial("stacked",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dial),
+		grpc.WithStatsHandler(grpcmon.ClientStatsHandler(first, grpcmon.WithSelfMetrics(selfRec.SelfMetrics()))),
+		grpc.WithStatsHandler(grpcmon.ClientStatsHandler(second, grpcmon.WithSelfMetrics(selfRec.SelfMetrics()))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"service": "frontend.Frontend", "method": "Query", "code": "OK"}
+	firstRec.AssertCounterDelta(t, grpcmontest.ReqsTotal, labels, 1)
+	secondRec.AssertCounterDelta(t, grpcmontest.ReqsTotal, labels, 1)
+	if got := selfRec.CounterValue(grpcmontest.UnattributedEvents); got != 0 {
+		t.Errorf("%v events left unattributed by stacked handlers, want none", got)
+	}
+}
@@ -0,0 +1,167 @@
+package grpcmon
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxChurnPeers is the maximum number of remote hosts counted per interval
+// by the churn detector. Connections from further hosts are not attributed.
+const maxChurnPeers = 1000
+
+// ChurnConfig configures connection churn detection. See WithConnChurn.
+type ChurnConfig struct {
+	// Interval is the period connections are counted over, for example
+	// ten seconds.
+	Interval time.Duration
+	// Threshold is the number of connections opened in an interval above
+	// which churn is reported. Zero disables the threshold.
+	Threshold int
+	// Factor is the ratio of the connections opened in an interval to
+	// those opened in the previous one above which churn is reported, for
+	// example 3. Zero disables the comparison, which is also skipped when
+	// no connection was opened in the previous interval.
+	Factor float64
+	// TopPeers is the number of remote hosts opening the most connections
+	// reported with churn. Zero disables counting connections per host.
+	TopPeers int
+	// Callback is called when churn starts, from a new goroutine, with
+	// panics recovered.
+	Callback func(ConnChurn)
+}
+
+// ConnChurn describes a spike of connections.
+type ConnChurn struct {
+	// Client reports whether the connections were made by a client.
+	Client bool
+	// Opened is the number of connections opened in the current interval
+	// when the spike was detected, and Previous the number opened in the
+	// previous interval.
+	Opened   int
+	Previous int
+	// TopPeers are the remote hosts that opened the most connections in
+	// the current interval, most first.
+	TopPeers []PeerConns
+}
+
+// PeerConns is the number of connections opened by a remote host.
+type PeerConns struct {
+	Host  string
+	Conns int
+}
+
+// churnDetector counts the connections opened per interval. A spike is
+// reported once, when the counts first exceed the configuration, and is
+// over after an interval that does not.
+type churnDetector struct {
+	cfg  ChurnConfig
+	now  func() time.Time
+	self *SelfMetrics
+
+	mu       sync.Mutex
+	index    int64
+	cur      int
+	prev     int
+	peers    map[string]int
+	exceeded bool // in the current interval
+	active   bool
+}
+
+func newChurnDetector(cfg ChurnConfig) *churnDetector {
+	d := &churnDetector{cfg: cfg, now: time.Now}
+	if cfg.TopPeers > 0 {
+		d.peers = make(map[string]int)
+	}
+	return d
+}
+
+// observe records a connection opened by host, which is empty if unknown,
+// and reports the churn it starts, if any.
+func (d *churnDetector) observe(host string) (ConnChurn, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	index := d.now().UnixNano() / int64(d.cfg.Interval)
+	if index != d.index {
+		if !d.exceeded || index != d.index+1 {
+			d.active = false
+		}
+		if index == d.index+1 {
+			d.prev = d.cur
+		} else {
+			d.prev = 0
+		}
+		d.index = index
+		d.cur = 0
+		d.exceeded = false
+		if d.peers != nil {
+			clear(d.peers)
+		}
+	}
+	d.cur++
+	if d.peers != nil && host != "" {
+		if _, ok := d.peers[host]; ok || len(d.peers) < maxChurnPeers {
+			d.peers[host]++
+		} else {
+			d.self.labelOverflow()
+		}
+	}
+	if d.exceeded || !d.exceeds() {
+		return ConnChurn{}, false
+	}
+	d.exceeded = true
+	if d.active {
+		return ConnChurn{}, false
+	}
+	d.active = true
+	return ConnChurn{Opened: d.cur, Previous: d.prev, TopPeers: d.top()}, true
+}
+
+func (d *churnDetector) exceeds() bool {
+	if d.cfg.Threshold > 0 && d.cur > d.cfg.Threshold {
+		return true
+	}
+	return d.cfg.Factor > 0 && d.prev > 0 && float64(d.cur) > d.cfg.Factor*float64(d.prev)
+}
+
+// top returns the hosts that opened the most connections in the current
+// interval.
+func (d *churnDetector) top() []PeerConns {
+	if len(d.peers) == 0 {
+		return nil
+	}
+	res := make([]PeerConns, 0, len(d.peers))
+	for host, n := range d.peers {
+		res = append(res, PeerConns{Host: host, Conns: n})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Conns != res[j].Conns {
+			return res[i].Conns > res[j].Conns
+		}
+		return res[i].Host < res[j].Host
+	})
+	if len(res) > d.cfg.TopPeers {
+		res = res[:d.cfg.TopPeers]
+	}
+	return res
+}
+
+func (d *churnDetector) notify(info ConnChurn) {
+	go func() {
+		defer d.self.recoverSinkError()
+		d.cfg.Callback(info)
+	}()
+}
+
+// remoteHost returns the host of addr, without the port.
+func remoteHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,53 @@
+package grpcmon
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChurnDetector(t *testing.T) {
+	d := newChurnDetector(ChurnConfig{Interval: 10 * time.Second, Threshold: 3, Factor: 2, TopPeers: 2})
+	now := time.Unix(1000, 0)
+	d.now = func() time.Time { return now }
+	observe := func(hosts ...string) (reports []ConnChurn) {
+		for _, host := range hosts {
+			if info, ok := d.observe(host); ok {
+				reports = append(reports, info)
+			}
+		}
+		return reports
+	}
+
+	if got := observe("a", "b"); got != nil {
+		t.Errorf("reported %+v below the threshold", got)
+	}
+	got := observe("a", "c", "a", "b")
+	want := []ConnChurn{{Opened: 4, TopPeers: []PeerConns{{"a", 2}, {"b", 1}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// Still above the threshold in the next interval: the same spike.
+	now = now.Add(10 * time.Second)
+	if got := observe("a", "a", "a", "a"); got != nil {
+		t.Errorf("reported %+v during a spike", got)
+	}
+	// Calm for an interval ends the spike.
+	now = now.Add(10 * time.Second)
+	if got := observe("a"); got != nil {
+		t.Errorf("reported %+v while calm", got)
+	}
+	// A jump by the factor is a new spike, even below the threshold.
+	now = now.Add(10 * time.Second)
+	got = observe("b", "b", "b")
+	want = []ConnChurn{{Opened: 3, Previous: 1, TopPeers: []PeerConns{{"b", 3}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// Skipping intervals also ends the spike.
+	now = now.Add(time.Minute)
+	if got := observe("a", "a", "a", "a"); len(got) != 1 {
+		t.Errorf("got %d reports after a gap, want 1", len(got))
+	}
+}
@@ -0,0 +1,74 @@
+// Command grpcmon-bench measures the overhead of grpcmon instrumentation.
+//
+// It runs an in-process echo server and client with each of the selected
+// metric configurations and prints a comparison table of latency percentiles,
+// throughput and allocations per call.
+//
+// With -cardinality it instead synthesizes traffic across services × methods
+// × tenants and reports the number of series, their memory and scrape size,
+// and the time it takes to gather them.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Bo0mer/grpcmon/internal/bench"
+)
+
+func main() {
+	var (
+		configs     = flag.String("metrics", strings.Join(bench.Configs, ","), "comma separated list of metric configurations to compare")
+		concurrency = flag.Int("concurrency", 8, "number of concurrent callers")
+		payload     = flag.Int("payload", 1024, "request and response payload size in bytes")
+		duration    = flag.Duration("duration", 5*time.Second, "duration of each run")
+		cardinality = flag.String("cardinality", "", "measure series cost of `SxMxT` services, methods and tenants instead")
+	)
+	flag.Parse()
+	if *cardinality != "" {
+		runCardinality(*configs, *cardinality)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "metrics\tcalls\tp50\tp99\tcalls/s\tallocs/call\t")
+	for _, config := range strings.Split(*configs, ",") {
+		res, err := bench.Run(bench.Options{
+			Config:      config,
+			Concurrency: *concurrency,
+			PayloadSize: *payload,
+			Duration:    *duration,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%v\t%v\t%.0f\t%.1f\t\n", config, res.Calls, res.P50, res.P99, res.Throughput, res.AllocsPerCall)
+	}
+	w.Flush()
+}
+
+func runCardinality(configs, dims string) {
+	var opts bench.CardinalityOptions
+	if _, err := fmt.Sscanf(dims, "%dx%dx%d", &opts.Services, &opts.Methods, &opts.Tenants); err != nil {
+		log.Fatalf("invalid -cardinality %q: %v", dims, err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "metrics\trpcs\tseries\theap\tscrape\tgather\t")
+	for _, config := range strings.Split(configs, ",") {
+		if config == bench.None {
+			continue
+		}
+		opts.Config = config
+		res, err := bench.RunCardinality(opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%v\t\n", config, res.RPCs, res.Series, res.HeapBytes, res.ScrapeBytes, res.GatherTime)
+	}
+	w.Flush()
+}
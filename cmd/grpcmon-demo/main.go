@@ -0,0 +1,228 @@
+// Command grpcmon-demo runs an instrumented frontend and backend gRPC server
+// in one process and serves their metrics for Prometheus.
+//
+// The frontend calls the backend for every query it receives, so both client
+// and server instrumentation are exercised. Synthetic traffic, including
+// deliberate errors and a streaming call, is generated continuously.
+//
+// With -dashboard=server or -dashboard=client it instead prints a Grafana
+// dashboard for the metrics of that side and exits.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/dashboard"
+	bpb "github.com/Bo0mer/grpcmon/testdata/backend"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+func main() {
+	var (
+		metricsAddr = flag.String("metrics-addr", ":9090", "address to serve metrics on")
+		interval    = flag.Duration("interval", 100*time.Millisecond, "interval between synthetic requests")
+		side        = flag.String("dashboard", "", "print the Grafana dashboard of the `side` (server or client) and exit")
+	)
+	flag.Parse()
+	if *side != "" {
+		b, err := dashboard.Generate(dashboard.Config{Subsystem: *side})
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(append(b, '\n'))
+		return
+	}
+
+	lis, err := net.Listen("tcp", *metricsAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	log.Printf("serving metrics on http://%s/metrics", lis.Addr())
+	if err := run(ctx, lis, *interval); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run starts the servers, generates traffic and serves metrics on lis until
+// ctx is done.
+func run(ctx context.Context, lis net.Listener, interval time.Duration) error {
+	reg := prometheus.NewRegistry()
+	clientMetrics := newMetrics(reg, "client")
+	serverMetrics := newMetrics(reg, "server")
+
+	backendLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	backendSrv := grpc.NewServer(grpcmon.ServerOption(serverMetrics))
+	bpb.RegisterBackendServer(backendSrv, &backend{})
+	go backendSrv.Serve(backendLis)
+	defer backendSrv.Stop()
+
+	backendConn, err := dial(backendLis.Addr().String(), grpcmon.DialOption(clientMetrics))
+	if err != nil {
+		return err
+	}
+	defer backendConn.Close()
+
+	frontendLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	frontendSrv := grpc.NewServer(grpcmon.ServerOption(serverMetrics))
+	pb.RegisterFrontendServer(frontendSrv, &frontend{backend: bpb.NewBackendClient(backendConn)})
+	frontendSrv.RegisterService(&feedDesc, nil)
+	go frontendSrv.Serve(frontendLis)
+	defer frontendSrv.Stop()
+
+	frontendConn, err := dial(frontendLis.Addr().String(), grpcmon.DialOption(clientMetrics))
+	if err != nil {
+		return err
+	}
+	defer frontendConn.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	httpSrv := &http.Server{Handler: mux}
+	go httpSrv.Serve(lis)
+	defer httpSrv.Close()
+
+	generate(ctx, frontendConn, interval)
+	return nil
+}
+
+func dial(addr string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	return grpc.Dial(addr, opts...)
+}
+
+// generate issues queries to the frontend every interval, and a streaming
+// call every tenth interval, until ctx is done.
+func generate(ctx context.Context, conn *grpc.ClientConn, interval time.Duration) {
+	client := pb.NewFrontendClient(conn)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if i%10 == 0 {
+			go subscribe(ctx, conn)
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, time.Second)
+			defer cancel()
+			client.Query(ctx, &pb.QueryRequest{})
+		}()
+	}
+}
+
+// subscribe makes a streaming call to the feed service and reads all of its
+// messages.
+func subscribe(ctx context.Context, conn *grpc.ClientConn) {
+	stream, err := conn.NewStream(ctx, &feedDesc.Streams[0], "/demo.Feed/Subscribe")
+	if err != nil {
+		return
+	}
+	if err := stream.SendMsg(wrapperspb.UInt32(uint32(1 + rand.Intn(10)))); err != nil {
+		return
+	}
+	stream.CloseSend()
+	for {
+		if err := stream.RecvMsg(new(wrapperspb.StringValue)); err != nil {
+			return
+		}
+	}
+}
+
+type frontend struct {
+	backend bpb.BackendClient
+}
+
+func (f *frontend) Query(ctx context.Context, _ *pb.QueryRequest) (*pb.QueryResponse, error) {
+	if rand.Intn(20) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "synthetic bad request")
+	}
+	if _, err := f.backend.Query(ctx, &bpb.QueryRequest{}); err != nil {
+		return nil, err
+	}
+	return &pb.QueryResponse{}, nil
+}
+
+type backend struct{}
+
+func (*backend) Query(context.Context, *bpb.QueryRequest) (*bpb.QueryResponse, error) {
+	time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+	if rand.Intn(10) == 0 {
+		return nil, status.Error(codes.Unavailable, "synthetic outage")
+	}
+	return &bpb.QueryResponse{}, nil
+}
+
+// feedDesc describes a server streaming service that sends as many messages
+// as requested.
+var feedDesc = grpc.ServiceDesc{
+	ServiceName: "demo.Feed",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Subscribe",
+		ServerStreams: true,
+		Handler: func(_ interface{}, stream grpc.ServerStream) error {
+			n := new(wrapperspb.UInt32Value)
+			if err := stream.RecvMsg(n); err != nil {
+				return err
+			}
+			for i := uint32(0); i < n.Value; i++ {
+				time.Sleep(10 * time.Millisecond)
+				if err := stream.SendMsg(wrapperspb.String("update")); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}},
+}
+
+// newMetrics creates Prometheus backed metrics for side (client or server)
+// and registers them with reg.
+func newMetrics(reg prometheus.Registerer, side string) *grpcmon.Metrics {
+	connsOpen := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "grpc", Subsystem: side, Name: "connections_open", Help: "Number of gRPC " + side + " connections open."}, nil)
+	connsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "grpc", Subsystem: side, Name: "connections_total", Help: "Total number of gRPC " + side + " connections opened."}, nil)
+	reqsPending := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "grpc", Subsystem: side, Name: "requests_pending", Help: "Number of gRPC " + side + " requests pending."}, []string{"service", "method"})
+	reqsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "grpc", Subsystem: side, Name: "requests_total", Help: "Total number of gRPC " + side + " requests completed."}, []string{"service", "method", "code"})
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: "grpc", Subsystem: side, Name: "latency_seconds", Help: "Latency of gRPC " + side + " requests.", Buckets: grpcmon.DefaultLatencyBuckets}, []string{"service", "method", "code"})
+	bytesRecv := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: "grpc", Subsystem: side, Name: "recv_bytes", Help: "Bytes received in gRPC " + side + " messages.", Buckets: grpcmon.DefaultBytesBuckets}, []string{"service", "method", "frame"})
+	bytesSent := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: "grpc", Subsystem: side, Name: "sent_bytes", Help: "Bytes sent in gRPC " + side + " messages.", Buckets: grpcmon.DefaultBytesBuckets}, []string{"service", "method", "frame"})
+	reg.MustRegister(connsOpen, connsTotal, reqsPending, reqsTotal, latency, bytesRecv, bytesSent)
+	return &grpcmon.Metrics{
+		ConnsOpen:   kitprometheus.NewGauge(connsOpen),
+		ConnsTotal:  kitprometheus.NewCounter(connsTotal),
+		ReqsPending: kitprometheus.NewGauge(reqsPending),
+		ReqsTotal:   kitprometheus.NewCounter(reqsTotal),
+		Latency:     kitprometheus.NewHistogram(latency),
+		BytesRecv:   kitprometheus.NewHistogram(bytesRecv),
+		BytesSent:   kitprometheus.NewHistogram(bytesSent),
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSmoke(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, lis, 5*time.Millisecond) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	families := []string{
+		"grpc_client_connections_open",
+		"grpc_client_requests_total",
+		"grpc_client_latency_seconds",
+		"grpc_client_sent_bytes",
+		"grpc_server_connections_total",
+		"grpc_server_requests_pending",
+		"grpc_server_requests_total",
+		"grpc_server_recv_bytes",
+		`grpc_server_requests_total{code="OK",method="Query",service="frontend.Frontend"}`,
+		`grpc_server_requests_total{code="OK",method="Query",service="backend.Backend"}`,
+		`method="Subscribe",service="demo.Feed"`,
+	}
+	var body string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		body = scrape(t, "http://"+lis.Addr().String()+"/metrics")
+		if containsAll(body, families) {
+			return
+		}
+	}
+	for _, f := range families {
+		if !strings.Contains(body, f) {
+			t.Errorf("metrics do not contain %s", f)
+		}
+	}
+}
+
+func scrape(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func containsAll(s string, subs []string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
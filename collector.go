@@ -0,0 +1,186 @@
+package grpcmon
+
+import (
+	"reflect"
+	"time"
+
+	metrics "github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/multi"
+	"google.golang.org/grpc"
+)
+
+// Collector receives the events of the RPCs and connections of a client or
+// a server, for recording them without go-kit metrics. Its methods may be
+// called concurrently.
+type Collector interface {
+	// RPCBegin is called when an RPC begins.
+	RPCBegin(l RPCLabels)
+	// RPCEnd is called when an RPC ends, with the code label of the RPC and
+	// its latency, which is zero if its beginning was not seen.
+	RPCEnd(l RPCLabels, code string, latency time.Duration)
+	// Payload is called for every header, payload and trailer frame sent or
+	// received, with the frame label and the length of the frame on the
+	// wire.
+	Payload(l RPCLabels, dir Direction, frame string, wireBytes int)
+	// ConnOpen is called when a connection opens.
+	ConnOpen()
+	// ConnClose is called when a connection closes.
+	ConnClose()
+}
+
+// RPCLabels identifies the RPC an event passed to a Collector belongs to.
+type RPCLabels struct {
+	// Service and Method are the service and method label values.
+	Service string
+	Method  string
+	// Type is the type label value, one of unary, client_stream,
+	// server_stream and bidi, or empty if the beginning of the RPC was not
+	// seen.
+	Type string
+}
+
+// Direction is the direction of a frame passed to a Collector.
+type Direction int
+
+const (
+	// Inbound frames are received.
+	Inbound Direction = iota
+	// Outbound frames are sent.
+	Outbound
+)
+
+// String returns "inbound" or "outbound".
+func (d Direction) String() string {
+	if d == Outbound {
+		return "outbound"
+	}
+	return "inbound"
+}
+
+// WithCollector drives c with the events of the RPCs and connections
+// recorded, in addition to the metrics. Like the metrics, c does not see the
+// RPCs excluded by WithFilter, and sees the Begin and End events of untagged
+// RPCs under the unknown service and method.
+func WithCollector(c Collector) Option {
+	checkOption(c != nil, "WithCollector", "nil collector")
+	return func(o *options) {
+		o.collector = c
+	}
+}
+
+// DialOptionCollector is like DialOption, but drives c instead of recording
+// metrics.
+func DialOptionCollector(c Collector, opts ...Option) grpc.DialOption {
+	return DialOption(new(Metrics), append(opts, WithCollector(c))...)
+}
+
+// ServerOptionCollector is like ServerOption, but drives c instead of
+// recording metrics.
+func ServerOptionCollector(c Collector, opts ...Option) grpc.ServerOption {
+	return ServerOption(new(Metrics), append(opts, WithCollector(c))...)
+}
+
+// MetricsCollector returns a Collector recording the metrics of m, for
+// driving m and other Collectors together. Passed to WithCollector, m is
+// recorded by the handler along with its own Metrics, with the same labels
+// and observations under the options of the handler. Its methods, called
+// otherwise, record the connection, request, latency, message and byte
+// metrics of m as a handler without options does, which is all the events
+// of a Collector tell.
+func MetricsCollector(m *Metrics) Collector {
+	if m == nil {
+		m = new(Metrics)
+	}
+	return metricsCollector{m: m}
+}
+
+type metricsCollector struct {
+	m *Metrics
+}
+
+func (c metricsCollector) RPCBegin(l RPCLabels) {
+	if c.m.ReqsPending != nil {
+		c.m.ReqsPending.With("service", l.Service, "method", l.Method).Add(1)
+	}
+	if c.m.ReqsStarted != nil {
+		c.m.ReqsStarted.With("service", l.Service, "method", l.Method).Add(1)
+	}
+}
+
+func (c metricsCollector) RPCEnd(l RPCLabels, code string, latency time.Duration) {
+	// RPCs without a type were not seen beginning, nor counted as pending.
+	if c.m.ReqsPending != nil && l.Type != "" {
+		c.m.ReqsPending.With("service", l.Service, "method", l.Method).Add(-1)
+	}
+	if c.m.ReqsTotal != nil {
+		c.m.ReqsTotal.With("service", l.Service, "method", l.Method, "code", code).Add(1)
+	}
+	if c.m.Latency != nil && latency > 0 {
+		c.m.Latency.With("service", l.Service, "method", l.Method, "code", code).Observe(latency.Seconds())
+	}
+}
+
+func (c metricsCollector) Payload(l RPCLabels, dir Direction, frame string, wireBytes int) {
+	bytes, total, msgs := c.m.BytesRecv, c.m.BytesRecvTotal, c.m.MsgsRecv
+	if dir == Outbound {
+		bytes, total, msgs = c.m.BytesSent, c.m.BytesSentTotal, c.m.MsgsSent
+	}
+	if bytes != nil && (wireBytes > 0 || frame == payload) {
+		bytes.With("service", l.Service, "method", l.Method, "frame", frame).Observe(float64(wireBytes))
+	}
+	if total != nil {
+		total.With("service", l.Service, "method", l.Method).Add(float64(wireBytes))
+	}
+	if msgs != nil && frame == payload {
+		msgs.With("service", l.Service, "method", l.Method).Add(1)
+	}
+}
+
+func (c metricsCollector) ConnOpen() {
+	if c.m.ConnsOpen != nil {
+		c.m.ConnsOpen.Add(1)
+	}
+	if c.m.ConnsTotal != nil {
+		c.m.ConnsTotal.Add(1)
+	}
+}
+
+func (c metricsCollector) ConnClose() {
+	if c.m.ConnsOpen != nil {
+		c.m.ConnsOpen.Add(-1)
+	}
+}
+
+// teeMetrics returns a Metrics recording each of the metrics of a in the
+// one of b as well.
+func teeMetrics(a, b *Metrics) *Metrics {
+	c := *a
+	va, vb := reflect.ValueOf(&c).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		fa, fb := va.Field(i), vb.Field(i)
+		if fa.Kind() != reflect.Interface || fb.IsNil() {
+			continue
+		}
+		if fa.IsNil() {
+			fa.Set(fb)
+			continue
+		}
+		switch x, y := fa.Interface(), fb.Interface(); fa.Type() {
+		case reflect.TypeOf((*metrics.Counter)(nil)).Elem():
+			fa.Set(reflect.ValueOf(multi.NewCounter(x.(metrics.Counter), y.(metrics.Counter))))
+		case reflect.TypeOf((*metrics.Gauge)(nil)).Elem():
+			fa.Set(reflect.ValueOf(multi.NewGauge(x.(metrics.Gauge), y.(metrics.Gauge))))
+		case reflect.TypeOf((*metrics.Histogram)(nil)).Elem():
+			fa.Set(reflect.ValueOf(multi.NewHistogram(x.(metrics.Histogram), y.(metrics.Histogram))))
+		}
+	}
+	return &c
+}
+
+// collect calls the Payload method of the Collector of h, if any, for a
+// frame of the RPC v.
+func (h *Handler) collect(v *rpcInfo, server, method string, dir Direction, frame string, n int) {
+	if c := h.opts.collector; c != nil {
+		c.Payload(RPCLabels{Service: server, Method: method, Type: v.begin().typ}, dir, frame, n)
+	}
+}
@@ -0,0 +1,202 @@
+package grpcmon_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+// recordingCollector records the events it receives as strings.
+type recordingCollector struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (c *recordingCollector) record(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, fmt.Sprintf(format, args...))
+}
+
+func (c *recordingCollector) Events() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.events...)
+}
+
+func (c *recordingCollector) RPCBegin(l grpcmon.RPCLabels) {
+	c.record("begin %s/%s %s", l.Service, l.Method, l.Type)
+}
+
+func (c *recordingCollector) RPCEnd(l grpcmon.RPCLabels, code string, latency time.Duration) {
+	c.record("end %s/%s %s %v", l.Service, l.Method, code, latency)
+}
+
+func (c *recordingCollector) Payload(l grpcmon.RPCLabels, dir grpcmon.Direction, frame string, wireBytes int) {
+	c.record("%v %s %d", dir, frame, wireBytes)
+}
+
+func (c *recordingCollector) ConnOpen()  { c.record("open") }
+func (c *recordingCollector) ConnClose() { c.record("close") }
+
+func TestCollector(t *testing.T) {
+	for _, tc := range []struct {
+		seq  grpcmontest.Sequence
+		want []string
+	}{{
+		seq: grpcmontest.UnaryOK(false),
+		want: []string{
+			"open",
+			"begin grpcmontest.Test/Method unary",
+			"inbound header 40",
+			"inbound payload 15",
+			"outbound header 28",
+			"outbound payload 25",
+			"outbound trailer 12",
+			"end grpcmontest.Test/Method OK 3ms",
+			"close",
+		},
+	}, {
+		seq: grpcmontest.ServerStream(false, 2),
+		want: []string{
+			"open",
+			"begin grpcmontest.Test/Method server_stream",
+			"inbound header 40",
+			"inbound payload 15",
+			"outbound header 28",
+			"outbound payload 25",
+			"outbound payload 25",
+			"outbound trailer 12",
+			"end grpcmontest.Test/Method OK 4ms",
+			"close",
+		},
+	}} {
+		c := new(recordingCollector)
+		grpcmontest.Replay(grpcmon.ServerStatsHandler(new(grpcmon.Metrics), grpcmon.WithCollector(c)), tc.seq)
+		if got := c.Events(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: events = %q, want %q", tc.seq.Name, got, tc.want)
+		}
+	}
+}
+
+func TestServerOptionCollector(t *testing.T) {
+	c := new(recordingCollector)
+	srv := grpc.NewServer(grpcmon.ServerOptionCollector(c))
+	pb.RegisterFrontendServer(srv, &frontend{})
+	go srv.Serve(listen("collector"))
+	conn, err := grpc.Dial("collector", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	srv.GracefulStop()
+
+	// Servers see the request headers before the Begin event.
+	events := c.Events()
+	if len(events) != 9 || events[0] != "open" || events[2] != "begin frontend.Frontend/Query unary" || events[8] != "close" {
+		t.Fatalf("events = %q, want an open connection with a single RPC", events)
+	}
+	if end := events[7]; !strings.HasPrefix(end, "end frontend.Frontend/Query OK ") {
+		t.Errorf("last RPC event = %q, want its end with code OK", end)
+	}
+}
+
+func TestMetricsCollector(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(new(grpcmon.Metrics), grpcmon.WithCollector(grpcmon.MetricsCollector(m))), grpcmontest.UnaryOK(false))
+
+	method := []string{"service", "grpcmontest.Test", "method", "Method"}
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, append(method, "code", "OK")...); got != 1 {
+		t.Errorf("requests total = %v, want 1", got)
+	}
+	if got := rec.GaugeValue(grpcmontest.ReqsPending, method...); got != 0 {
+		t.Errorf("requests pending = %v, want 0", got)
+	}
+	if got := rec.Observations(grpcmontest.BytesRecv, append(method, "frame", "payload")...); !reflect.DeepEqual(got, []float64{15}) {
+		t.Errorf("payload bytes received = %v, want [15]", got)
+	}
+	if got := rec.CounterValue(grpcmontest.BytesSentTotal, method...); got != 65 {
+		t.Errorf("bytes sent total = %v, want 65", got)
+	}
+	if got := rec.CounterValue(grpcmontest.MsgsSent, method...); got != 1 {
+		t.Errorf("messages sent = %v, want 1", got)
+	}
+	if got := rec.CounterValue(grpcmontest.ConnsTotal); got != 1 {
+		t.Errorf("connections total = %v, want 1", got)
+	}
+	if got := rec.GaugeValue(grpcmontest.ConnsOpen); got != 0 {
+		t.Errorf("connections open = %v, want 0", got)
+	}
+}
+
+func TestMetricsCollectorSameSeries(t *testing.T) {
+	opts := []grpcmon.Option{
+		grpcmon.WithRPCTypeLabel(),
+		grpcmon.WithFailFastLabel(),
+		grpcmon.WithConstLabels(map[string]string{"env": "test"}),
+		grpcmon.WithCodeMapper(grpcmon.CodeClass),
+		grpcmon.WithLatencyUnit(time.Millisecond),
+		grpcmon.WithPayloadSampling(2),
+	}
+	for _, client := range []bool{false, true} {
+		for _, seq := range grpcmontest.Sequences(client) {
+			m, rec := grpcmontest.NewRecorder()
+			cm, crec := grpcmontest.NewRecorder()
+			h := grpcmon.ServerStatsHandler(m, append(opts, grpcmon.WithCollector(grpcmon.MetricsCollector(cm)))...)
+			if client {
+				h = grpcmon.ClientStatsHandler(m, append(opts, grpcmon.WithCollector(grpcmon.MetricsCollector(cm)))...)
+			}
+			grpcmontest.Replay(h, seq)
+			if rec.String() == "" {
+				t.Errorf("%s: nothing recorded", seq.Name)
+			}
+			if got, want := crec.String(), rec.String(); got != want {
+				t.Errorf("%s: MetricsCollector recorded\n%s\nthe handler recorded\n%s", seq.Name, got, want)
+			}
+		}
+	}
+}
+
+// hiddenCollector hides the type of the Collector it embeds from the
+// handler, so that its methods are called.
+type hiddenCollector struct {
+	grpcmon.Collector
+}
+
+func TestMetricsCollectorMethods(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		for _, seq := range grpcmontest.Sequences(client) {
+			m, rec := grpcmontest.NewRecorder()
+			cm, crec := grpcmontest.NewRecorder()
+			h := grpcmon.ServerStatsHandler(m, grpcmon.WithCollector(hiddenCollector{grpcmon.MetricsCollector(cm)}))
+			if client {
+				h = grpcmon.ClientStatsHandler(m, grpcmon.WithCollector(hiddenCollector{grpcmon.MetricsCollector(cm)}))
+			}
+			grpcmontest.Replay(h, seq)
+			// The methods record a subset of the series of the handler.
+			want := rec.String()
+			if crec.String() == "" {
+				t.Errorf("%s: MetricsCollector recorded nothing", seq.Name)
+			}
+			for _, line := range strings.SplitAfter(crec.String(), "\n") {
+				if !strings.Contains(want, line) {
+					t.Errorf("%s: MetricsCollector recorded %q, not recorded by the handler", seq.Name, line)
+				}
+			}
+		}
+	}
+}
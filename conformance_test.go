@@ -0,0 +1,284 @@
+//go:build conformance
+
+package grpcmon_test
+
+// The conformance test checks that grpcmon, with grpcprom.WithLegacyNames,
+// reports the same numbers as go-grpc-prometheus for the same traffic. It
+// needs github.com/grpc-ecosystem/go-grpc-prometheus, which grpcmon does not
+// otherwise depend on, and runs with
+//
+//	go test -tags conformance -run TestConformance .
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	grpcprometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcprom"
+)
+
+// conformanceLatencyTolerance is how much the handling_seconds sums of a
+// series may differ by per RPC: go-grpc-prometheus times its interceptors,
+// and grpcmon the stats events around them.
+const conformanceLatencyTolerance = 0.005
+
+// echoFail is the request value the methods of conformanceDesc fail with.
+const echoFail = "fail"
+
+var errEchoFail = status.Error(codes.InvalidArgument, "failed as requested")
+
+// conformanceDesc is a service with one method of each RPC shape, which echo
+// back the messages they receive, and fail once they receive echoFail.
+var conformanceDesc = grpc.ServiceDesc{
+	ServiceName: "conformance.Echo",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Unary",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(wrapperspb.StringValue)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			handler := func(_ context.Context, req interface{}) (interface{}, error) {
+				if req.(*wrapperspb.StringValue).Value == echoFail {
+					return nil, errEchoFail
+				}
+				return req, nil
+			}
+			return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/conformance.Echo/Unary"}, handler)
+		},
+	}},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "ServerStream", ServerStreams: true, Handler: func(_ interface{}, stream grpc.ServerStream) error {
+			in := new(wrapperspb.StringValue)
+			if err := stream.RecvMsg(in); err != nil {
+				return err
+			}
+			if in.Value == echoFail {
+				return errEchoFail
+			}
+			for range in.Value {
+				if err := stream.SendMsg(in); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{StreamName: "ClientStream", ClientStreams: true, Handler: func(_ interface{}, stream grpc.ServerStream) error {
+			last := new(wrapperspb.StringValue)
+			for {
+				in := new(wrapperspb.StringValue)
+				if err := stream.RecvMsg(in); err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+				if in.Value == echoFail {
+					return errEchoFail
+				}
+				last = in
+			}
+			return stream.SendMsg(last)
+		}},
+		{StreamName: "Bidi", ClientStreams: true, ServerStreams: true, Handler: func(_ interface{}, stream grpc.ServerStream) error {
+			for {
+				in := new(wrapperspb.StringValue)
+				if err := stream.RecvMsg(in); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if in.Value == echoFail {
+					return errEchoFail
+				}
+				if err := stream.SendMsg(in); err != nil {
+					return err
+				}
+			}
+		}},
+	},
+}
+
+// callEcho calls method of conformanceDesc with the given requests, and reads
+// the responses until the RPC ends.
+func callEcho(ctx context.Context, conn *grpc.ClientConn, method string, reqs ...string) error {
+	if method == "Unary" {
+		return conn.Invoke(ctx, "/conformance.Echo/Unary", wrapperspb.String(reqs[0]), new(wrapperspb.StringValue))
+	}
+	var desc *grpc.StreamDesc
+	for i := range conformanceDesc.Streams {
+		if d := &conformanceDesc.Streams[i]; d.StreamName == method {
+			desc = d
+		}
+	}
+	stream, err := conn.NewStream(ctx, desc, "/conformance.Echo/"+method)
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		if err := stream.SendMsg(wrapperspb.String(req)); err != nil {
+			break
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		if err := stream.RecvMsg(new(wrapperspb.StringValue)); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	want, got := prometheus.NewRegistry(), prometheus.NewRegistry()
+	legacyServer := grpcprometheus.NewServerMetrics()
+	legacyServer.EnableHandlingTimeHistogram()
+	legacyClient := grpcprometheus.NewClientMetrics()
+	legacyClient.EnableClientHandlingTimeHistogram()
+	want.MustRegister(legacyServer, legacyClient)
+	serverMetrics, err := grpcprom.NewServerMetrics(got, grpcprom.WithLegacyNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientMetrics, err := grpcprom.NewClientMetrics(got, grpcprom.WithLegacyNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(legacyServer.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(legacyServer.StreamServerInterceptor()),
+		grpcmon.ServerOption(serverMetrics.Metrics, grpcmon.WithRPCTypeLabel()),
+	)
+	srv.RegisterService(&conformanceDesc, nil)
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	defer srv.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithChainUnaryInterceptor(legacyClient.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(legacyClient.StreamClientInterceptor()),
+		grpcmon.DialOption(clientMetrics.Metrics, grpcmon.WithRPCTypeLabel()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	for _, rpc := range []struct {
+		method string
+		reqs   []string
+	}{
+		{"Unary", []string{"a"}},
+		{"Unary", []string{"b"}},
+		{"Unary", []string{echoFail}},
+		{"ServerStream", []string{"abc"}},
+		{"ServerStream", []string{echoFail}},
+		{"ClientStream", []string{"a", "b", "c"}},
+		{"ClientStream", []string{"a", echoFail}},
+		{"Bidi", []string{"a", "b", "c"}},
+		{"Bidi", []string{"a", "b", echoFail}},
+		{"Bidi", nil},
+	} {
+		err := callEcho(ctx, conn, rpc.method, rpc.reqs...)
+		failed := len(rpc.reqs) > 0 && rpc.reqs[len(rpc.reqs)-1] == echoFail
+		if failed != (status.Code(err) == codes.InvalidArgument) || !failed && err != nil {
+			t.Fatalf("%s%q: %v", rpc.method, rpc.reqs, err)
+		}
+	}
+	// Servers record the end of RPCs after their handlers return, which
+	// GracefulStop waits for.
+	conn.Close()
+	srv.GracefulStop()
+
+	wantSeries, gotSeries := gatherLegacy(t, want), gatherLegacy(t, got)
+	if len(wantSeries) == 0 {
+		t.Fatal("go-grpc-prometheus recorded nothing")
+	}
+	for key, w := range wantSeries {
+		g, ok := gotSeries[key]
+		switch {
+		case conformanceExempt(key):
+			continue
+		case !ok:
+			t.Errorf("%s = %v, missing", key, w)
+		case strings.Contains(key, "_sum{"):
+			if n := gotSeries[strings.Replace(key, "_sum{", "_count{", 1)]; math.Abs(g-w) > conformanceLatencyTolerance*n {
+				t.Errorf("%s = %v, want %v within %vs per RPC", key, g, w, conformanceLatencyTolerance)
+			}
+		case g != w:
+			t.Errorf("%s = %v, want %v", key, g, w)
+		}
+	}
+	for key, g := range gotSeries {
+		if _, ok := wantSeries[key]; !ok && !conformanceExempt(key) {
+			t.Errorf("%s = %v, not recorded by go-grpc-prometheus", key, g)
+		}
+	}
+}
+
+// conformanceExempt reports whether the series of key is known to differ.
+// go-grpc-prometheus counts a message received by unary client calls that
+// fail, and none by the ones that succeed, inverting its check of the error.
+func conformanceExempt(key string) bool {
+	return strings.HasPrefix(key, "grpc_client_msg_received_total{") && strings.Contains(key, `grpc_type="unary"`)
+}
+
+// gatherLegacy returns the values of the go-grpc-prometheus series gathered
+// from g, with the counts and sums of histograms as series of their own.
+// Buckets are not compared, since timings straddle their bounds.
+func gatherLegacy(t *testing.T, g prometheus.Gatherer) map[string]float64 {
+	t.Helper()
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := make(map[string]float64)
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			key := mf.GetName() + labelPairs(m.Label)
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				series[key] = m.Counter.GetValue()
+			case dto.MetricType_HISTOGRAM:
+				series[mf.GetName()+"_count"+labelPairs(m.Label)] = float64(m.Histogram.GetSampleCount())
+				series[mf.GetName()+"_sum"+labelPairs(m.Label)] = m.Histogram.GetSampleSum()
+			default:
+				t.Fatalf("%s: unexpected metric type %v", mf.GetName(), mf.GetType())
+			}
+		}
+	}
+	return series
+}
+
+func labelPairs(lps []*dto.LabelPair) string {
+	pairs := make([]string, len(lps))
+	for i, lp := range lps {
+		pairs[i] = fmt.Sprintf("%s=%q", lp.GetName(), lp.GetValue())
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
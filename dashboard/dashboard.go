@@ -0,0 +1,290 @@
+// Package dashboard generates Grafana dashboards for the metrics recorded by
+// grpcmon.
+//
+// The queries of the generated panels are built from the configured metric
+// and label names, so dashboards stay correct when metrics are registered
+// under a different namespace, subsystem or name.
+package dashboard // import "github.com/Bo0mer/grpcmon/dashboard"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Config describes the metrics a dashboard is generated for. Zero fields
+// take the defaults of the preset.
+type Config struct {
+	// Title is the title of the dashboard. Defaults to "gRPC <subsystem>".
+	Title string
+	// Preset selects the default names of the metrics and labels.
+	Preset Preset
+	// Namespace and Subsystem prefix metric names as in
+	// <namespace>_<subsystem>_<name>. Default to "grpc" and "server".
+	Namespace string
+	Subsystem string
+	// Names are the names of the metrics without prefix.
+	Names Names
+	// Labels are the names of the labels.
+	Labels Labels
+	// OK is the code label value of successful requests, which is the one
+	// grpcmon.WithCodeMapper maps codes.OK to if set, for example "ok" with
+	// grpcmon.CodeClass. Defaults to "OK".
+	OK string
+	// RateInterval is the range of rate queries. Defaults to "5m".
+	RateInterval string
+}
+
+// Preset is a set of default metric and label names.
+type Preset int
+
+const (
+	// Default takes the names of the metrics of grpcprom.NewServerMetrics
+	// and grpcprom.NewClientMetrics.
+	Default Preset = iota
+	// Legacy takes the names of the metrics created with
+	// grpcprom.WithLegacyNames, which are those of go-grpc-prometheus. They
+	// have no pending requests gauge, byte counters or connections gauge,
+	// so pending requests are the started requests that are not handled yet,
+	// and the bytes and connections panels are left out unless their names
+	// are set.
+	Legacy
+)
+
+// Names are the names of the metrics, without namespace and subsystem.
+// Empty names take the defaults of the preset, as follows for Default and
+// Legacy.
+type Names struct {
+	ConnsOpen      string // "connections_open", none.
+	ReqsPending    string // "requests_pending", none.
+	ReqsStarted    string // None, "started_total". Only queried without ReqsPending.
+	ReqsTotal      string // "requests_total", "handled_total".
+	Latency        string // "latency_seconds", "handling_seconds".
+	BytesSentTotal string // "sent_bytes_total", none.
+	BytesRecvTotal string // "recv_bytes_total", none.
+}
+
+// Labels are the names of the labels. Empty names take the defaults of the
+// preset, as follows for Default and Legacy.
+type Labels struct {
+	Service string // "service", "grpc_service".
+	Method  string // "method", "grpc_method".
+	Code    string // "code", "grpc_code".
+}
+
+func orDefault(p *string, def string) {
+	if *p == "" {
+		*p = def
+	}
+}
+
+func (c *Config) setDefaults() {
+	orDefault(&c.Namespace, "grpc")
+	orDefault(&c.Subsystem, "server")
+	orDefault(&c.Title, "gRPC "+c.Subsystem)
+	orDefault(&c.RateInterval, "5m")
+	orDefault(&c.OK, "OK")
+	if c.Preset == Legacy {
+		orDefault(&c.Names.ReqsStarted, "started_total")
+		orDefault(&c.Names.ReqsTotal, "handled_total")
+		orDefault(&c.Names.Latency, "handling_seconds")
+		orDefault(&c.Labels.Service, "grpc_service")
+		orDefault(&c.Labels.Method, "grpc_method")
+		orDefault(&c.Labels.Code, "grpc_code")
+		return
+	}
+	orDefault(&c.Names.ConnsOpen, "connections_open")
+	orDefault(&c.Names.ReqsPending, "requests_pending")
+	orDefault(&c.Names.ReqsTotal, "requests_total")
+	orDefault(&c.Names.Latency, "latency_seconds")
+	orDefault(&c.Names.BytesSentTotal, "sent_bytes_total")
+	orDefault(&c.Names.BytesRecvTotal, "recv_bytes_total")
+	orDefault(&c.Labels.Service, "service")
+	orDefault(&c.Labels.Method, "method")
+	orDefault(&c.Labels.Code, "code")
+}
+
+func (c *Config) metric(name string) string {
+	return c.Namespace + "_" + c.Subsystem + "_" + name
+}
+
+type dashboard struct {
+	Title         string     `json:"title"`
+	UID           string     `json:"uid"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Time          timeRange  `json:"time"`
+	Refresh       string     `json:"refresh"`
+	Templating    templating `json:"templating"`
+	Panels        []panel    `json:"panels"`
+}
+
+type timeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type templating struct {
+	List []variable `json:"list"`
+}
+
+type variable struct {
+	Name       string      `json:"name"`
+	Label      string      `json:"label"`
+	Type       string      `json:"type"`
+	Query      interface{} `json:"query"`
+	Datasource *datasource `json:"datasource,omitempty"`
+	Refresh    int         `json:"refresh,omitempty"`
+	IncludeAll bool        `json:"includeAll,omitempty"`
+	Multi      bool        `json:"multi,omitempty"`
+}
+
+type datasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type panel struct {
+	ID          int         `json:"id"`
+	Title       string      `json:"title"`
+	Type        string      `json:"type"`
+	Datasource  datasource  `json:"datasource"`
+	GridPos     gridPos     `json:"gridPos"`
+	FieldConfig fieldConfig `json:"fieldConfig"`
+	Targets     []target    `json:"targets"`
+}
+
+type gridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type fieldConfig struct {
+	Defaults fieldDefaults `json:"defaults"`
+}
+
+type fieldDefaults struct {
+	Unit string `json:"unit"`
+}
+
+type target struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+// Generate returns the JSON model of a Grafana dashboard for the metrics
+// described by cfg. The dashboard has panels for request rate, error ratio,
+// latency percentiles, bytes sent and received, pending requests and open
+// connections, short of the ones whose metrics the preset lacks, and
+// variables selecting the data source, service and method.
+func Generate(cfg Config) ([]byte, error) {
+	cfg.setDefaults()
+	if cfg.Labels.Service == cfg.Labels.Method || cfg.Labels.Method == cfg.Labels.Code || cfg.Labels.Service == cfg.Labels.Code {
+		return nil, errors.New("dashboard: label names must be distinct")
+	}
+
+	ds := datasource{Type: "prometheus", UID: "${datasource}"}
+	svc, meth := cfg.Labels.Service, cfg.Labels.Method
+	sel := fmt.Sprintf(`%s=~"$service", %s=~"$method"`, svc, meth)
+	by := svc + ", " + meth
+	legend := fmt.Sprintf("{{%s}}/{{%s}}", svc, meth)
+	rate := func(name, extra string) string {
+		s := sel
+		if extra != "" {
+			s += ", " + extra
+		}
+		return fmt.Sprintf("rate(%s{%s}[%s])", name, s, cfg.RateInterval)
+	}
+	total := cfg.metric(cfg.Names.ReqsTotal)
+	latency := cfg.metric(cfg.Names.Latency) + "_bucket"
+	quantile := func(q string) target {
+		return target{
+			Expr:         fmt.Sprintf("histogram_quantile(%s, sum by (%s, le) (%s))", q, by, rate(latency, "")),
+			LegendFormat: legend + " p" + q[2:],
+		}
+	}
+
+	type spec struct {
+		title, unit string
+		targets     []target
+	}
+	specs := []spec{
+		{"Request rate", "reqps", []target{{
+			Expr:         fmt.Sprintf("sum by (%s) (%s)", by, rate(total, "")),
+			LegendFormat: legend,
+		}}},
+		{"Error ratio", "percentunit", []target{{
+			Expr: fmt.Sprintf("sum by (%s) (%s) / sum by (%s) (%s)",
+				by, rate(total, fmt.Sprintf("%s!=%q", cfg.Labels.Code, cfg.OK)), by, rate(total, "")),
+			LegendFormat: legend,
+		}}},
+		{"Latency", "s", []target{quantile("0.5"), quantile("0.9"), quantile("0.99")}},
+	}
+	var bytes []target
+	if name := cfg.Names.BytesSentTotal; name != "" {
+		bytes = append(bytes, target{
+			Expr:         fmt.Sprintf("sum by (%s) (%s)", by, rate(cfg.metric(name), "")),
+			LegendFormat: legend + " sent",
+		})
+	}
+	if name := cfg.Names.BytesRecvTotal; name != "" {
+		bytes = append(bytes, target{
+			Expr:         fmt.Sprintf("sum by (%s) (%s)", by, rate(cfg.metric(name), "")),
+			LegendFormat: legend + " received",
+		})
+	}
+	if bytes != nil {
+		specs = append(specs, spec{"Bytes", "Bps", bytes})
+	}
+	switch {
+	case cfg.Names.ReqsPending != "":
+		specs = append(specs, spec{"Pending requests", "short", []target{{
+			Expr:         fmt.Sprintf("sum by (%s) (%s{%s})", by, cfg.metric(cfg.Names.ReqsPending), sel),
+			LegendFormat: legend,
+		}}})
+	case cfg.Names.ReqsStarted != "":
+		specs = append(specs, spec{"Pending requests", "short", []target{{
+			Expr: fmt.Sprintf("sum by (%s) (%s{%s}) - sum by (%s) (%s{%s})",
+				by, cfg.metric(cfg.Names.ReqsStarted), sel, by, total, sel),
+			LegendFormat: legend,
+		}}})
+	}
+	if cfg.Names.ConnsOpen != "" {
+		specs = append(specs, spec{"Open connections", "short", []target{{
+			Expr:         fmt.Sprintf("sum(%s)", cfg.metric(cfg.Names.ConnsOpen)),
+			LegendFormat: "open",
+		}}})
+	}
+
+	d := dashboard{
+		Title:         cfg.Title,
+		UID:           "grpcmon-" + cfg.Namespace + "-" + cfg.Subsystem,
+		SchemaVersion: 39,
+		Time:          timeRange{From: "now-1h", To: "now"},
+		Refresh:       "30s",
+		Templating: templating{List: []variable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+			{Name: "service", Label: "Service", Type: "query", Datasource: &ds, Refresh: 2, IncludeAll: true, Multi: true,
+				Query: fmt.Sprintf("label_values(%s, %s)", total, svc)},
+			{Name: "method", Label: "Method", Type: "query", Datasource: &ds, Refresh: 2, IncludeAll: true, Multi: true,
+				Query: fmt.Sprintf(`label_values(%s{%s=~"$service"}, %s)`, total, svc, meth)},
+		}},
+	}
+	for i, s := range specs {
+		for j := range s.targets {
+			s.targets[j].RefID = string(rune('A' + j))
+		}
+		d.Panels = append(d.Panels, panel{
+			ID:          i + 1,
+			Title:       s.title,
+			Type:        "timeseries",
+			Datasource:  ds,
+			GridPos:     gridPos{H: 8, W: 12, X: (i % 2) * 12, Y: (i / 2) * 8},
+			FieldConfig: fieldConfig{Defaults: fieldDefaults{Unit: s.unit}},
+			Targets:     s.targets,
+		})
+	}
+	return json.MarshalIndent(d, "", "  ")
+}
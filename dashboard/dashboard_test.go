@@ -0,0 +1,149 @@
+package dashboard_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/dashboard"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/grpcprom"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestGenerate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  dashboard.Config
+	}{
+		{"default", dashboard.Config{}},
+		{"custom", dashboard.Config{
+			Title:     "Payments",
+			Namespace: "payments",
+			Subsystem: "client",
+			Names:     dashboard.Names{ReqsTotal: "calls_total", Latency: "duration_seconds"},
+			Labels:    dashboard.Labels{Service: "grpc_service", Method: "grpc_method", Code: "grpc_code"},
+			OK:        "ok",
+		}},
+		{"legacy", dashboard.Config{Preset: dashboard.Legacy}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := dashboard.Generate(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !json.Valid(got) {
+				t.Fatal("generated invalid JSON")
+			}
+			path := filepath.Join("testdata", tc.name+".json")
+			if *update {
+				if err := os.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("dashboard differs from %s (run with -update to update):\n%s", path, got)
+			}
+		})
+	}
+}
+
+func TestGenerateUsesConfiguredNames(t *testing.T) {
+	got, err := dashboard.Generate(dashboard.Config{Namespace: "acme", Names: dashboard.Names{ReqsTotal: "rpcs_total"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "acme_server_rpcs_total") || strings.Contains(string(got), "grpc_server") {
+		t.Errorf("queries do not use the configured names:\n%s", got)
+	}
+}
+
+func TestGenerateDuplicateLabels(t *testing.T) {
+	if _, err := dashboard.Generate(dashboard.Config{Labels: dashboard.Labels{Service: "method"}}); err == nil {
+		t.Error("got nil error for duplicate label names")
+	}
+}
+
+func TestGenerateQueriesRecordedMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		preset  dashboard.Preset
+		opts    []grpcprom.Option
+		monOpts []grpcmon.Option
+	}{
+		{"default", dashboard.Default, nil, nil},
+		{"legacy", dashboard.Legacy, []grpcprom.Option{grpcprom.WithLegacyNames()}, []grpcmon.Option{grpcmon.WithRPCTypeLabel()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			m, err := grpcprom.NewServerMetrics(reg, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			grpcmontest.Replay(grpcmon.ServerStatsHandler(m.Metrics, tc.monOpts...), grpcmontest.UnaryOK(false))
+			names, labels := gathered(t, reg)
+
+			got, err := dashboard.Generate(dashboard.Config{Preset: tc.preset})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range metricName.FindAllString(string(got), -1) {
+				if !names[name] {
+					t.Errorf("dashboard queries %s, which is not recorded", name)
+				}
+			}
+			for _, by := range byLabels.FindAllStringSubmatch(string(got), -1) {
+				for _, label := range strings.Split(by[1], ", ") {
+					if label != "le" && !labels[label] {
+						t.Errorf("dashboard aggregates by %s, which is not recorded", label)
+					}
+				}
+			}
+		})
+	}
+}
+
+var (
+	metricName = regexp.MustCompile(`grpc_server_[a-z_]+`)
+	byLabels   = regexp.MustCompile(`by \(([^)]*)\)`)
+)
+
+// gathered returns the names of the series gathered from g, with those of
+// the buckets, sums and counts of histograms, and the names of their labels.
+func gathered(t *testing.T, g prometheus.Gatherer) (names, labels map[string]bool) {
+	t.Helper()
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, labels = make(map[string]bool), make(map[string]bool)
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+		if mf.GetType() == dto.MetricType_HISTOGRAM {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				names[mf.GetName()+suffix] = true
+			}
+		}
+		for _, m := range mf.Metric {
+			for _, lp := range m.Label {
+				labels[lp.GetName()] = true
+			}
+		}
+	}
+	return names, labels
+}
@@ -0,0 +1,21 @@
+package grpcmon
+
+import "time"
+
+// DeadlineOvershoot describes a server RPC that was still being handled
+// when the deadline of its client expired, so that the client saw
+// DeadlineExceeded whatever the server returned.
+type DeadlineOvershoot struct {
+	// Service, Method and Code are the values of the labels the RPC was
+	// recorded under.
+	Service string
+	Method  string
+	Code    string
+	// Budget is the time the client allowed for the RPC, from the start of
+	// its handling to the incoming deadline.
+	Budget time.Duration
+	// Duration is the handling time of the RPC.
+	Duration time.Duration
+	// Overshoot is the amount by which Duration exceeds Budget.
+	Overshoot time.Duration
+}
@@ -0,0 +1,106 @@
+package grpcmon
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// MethodStats are the rate, errors, latency and pending requests of a
+// method, as shown by DebugHandler.
+type MethodStats struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	// Rate is the number of completed RPCs per second over the window.
+	Rate float64 `json:"rate"`
+	// ErrorRatio is the ratio of failed RPCs over the window.
+	ErrorRatio float64       `json:"error_ratio"`
+	P50        time.Duration `json:"p50"`
+	P90        time.Duration `json:"p90"`
+	P99        time.Duration `json:"p99"`
+	// Pending is the number of RPCs in flight.
+	Pending int64 `json:"pending"`
+}
+
+// methodStats returns the stats of all methods with RPCs in the rolling
+// window or in flight, sorted by service and method.
+func (h *Handler) methodStats() []MethodStats {
+	if h.rolling == nil {
+		return nil
+	}
+	window := time.Duration(h.rolling.slots) * h.rolling.width
+	byName := make(map[rpcName]*MethodStats)
+	get := func(name rpcName) *MethodStats {
+		s, ok := byName[name]
+		if !ok {
+			s = &MethodStats{Service: name.server, Method: name.method}
+			byName[name] = s
+		}
+		return s
+	}
+	for name, agg := range h.rolling.snapshot() {
+		s := get(name)
+		s.Rate = float64(agg.count) / window.Seconds()
+		s.ErrorRatio = float64(agg.errors) / float64(agg.count)
+		s.P50 = seconds(agg.quantile(0.5))
+		s.P90 = seconds(agg.quantile(0.9))
+		s.P99 = seconds(agg.quantile(0.99))
+	}
+	for name, n := range h.pending.snapshot() {
+		get(name).Pending = n
+	}
+	res := make([]MethodStats, 0, len(byName))
+	for _, s := range byName {
+		res = append(res, *s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Service != res[j].Service {
+			return res[i].Service < res[j].Service
+		}
+		return res[i].Method < res[j].Method
+	})
+	return res
+}
+
+var debugTemplate = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"percent": func(f float64) float64 { return f * 100 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>gRPC requests</title></head>
+<body>
+<h1>gRPC requests</h1>
+<p>Over the last {{.Window}}.</p>
+<table>
+<tr><th>Service</th><th>Method</th><th>Rate (req/s)</th><th>Errors</th><th>p50</th><th>p90</th><th>p99</th><th>Pending</th></tr>
+{{range .Methods}}<tr><td>{{.Service}}</td><td>{{.Method}}</td><td>{{printf "%.2f" .Rate}}</td><td>{{printf "%.2f%%" (percent .ErrorRatio)}}</td><td>{{.P50}}</td><td>{{.P90}}</td><td>{{.P99}}</td><td>{{.Pending}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// DebugHandler returns an http.Handler that renders the request rate, error
+// ratio and latency percentiles of every method over the rolling window,
+// along with the number of requests in flight, as an HTML table, or as JSON
+// if the format query parameter is "json". The table is computed on every
+// request. It requires WithRollingWindow and shows nothing otherwise.
+func DebugHandler(h *Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods := h.methodStats()
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(methods)
+			return
+		}
+		var window time.Duration
+		if h.rolling != nil {
+			window = time.Duration(h.rolling.slots) * h.rolling.width
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		debugTemplate.Execute(w, struct {
+			Window  time.Duration
+			Methods []MethodStats
+		}{window, methods})
+	})
+}
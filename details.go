@@ -0,0 +1,46 @@
+package grpcmon
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/status"
+)
+
+// DefaultErrorDetailTypes are the error detail types counted by
+// ErrorDetails by default: the standard ones of the google.rpc package.
+var DefaultErrorDetailTypes = []string{
+	"google.rpc.ErrorInfo",
+	"google.rpc.RetryInfo",
+	"google.rpc.DebugInfo",
+	"google.rpc.QuotaFailure",
+	"google.rpc.PreconditionFailure",
+	"google.rpc.BadRequest",
+	"google.rpc.RequestInfo",
+	"google.rpc.ResourceInfo",
+	"google.rpc.Help",
+	"google.rpc.LocalizedMessage",
+}
+
+// errorDetailTypes returns the label values of the types of the details of
+// err. Types not in allowed are reported as "other". The details are not
+// unmarshaled.
+func errorDetailTypes(err error, allowed map[string]bool) []string {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+	details := st.Proto().GetDetails()
+	if len(details) == 0 {
+		return nil
+	}
+	types := make([]string, len(details))
+	for i, d := range details {
+		url := d.GetTypeUrl()
+		t := url[strings.LastIndex(url, "/")+1:]
+		if !allowed[t] {
+			t = "other"
+		}
+		types[i] = t
+	}
+	return types
+}
@@ -0,0 +1,40 @@
+package grpcmon
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// WithContextDialer returns a gRPC DialOption like grpc.WithContextDialer,
+// that dials with dial and records the DialErrors and DialLatency metrics of
+// m, labeled with the address dialed as target. Unlike ConnsTotal, these
+// show the clients of a backend that cannot be reached at all. A nil dial
+// dials TCP with a net.Dialer, as gRPC does by default without a proxy.
+// Dials canceled by gRPC, as when the connection is closed, are not
+// recorded.
+func WithContextDialer(m *Metrics, dial func(ctx context.Context, addr string) (net.Conn, error)) grpc.DialOption {
+	if dial == nil {
+		var d net.Dialer
+		dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}
+	}
+	return grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		begin := time.Now()
+		conn, err := dial(ctx, addr)
+		switch {
+		case err == nil:
+			if m.DialLatency != nil {
+				m.DialLatency.With("target", sanitizeLabelValue(addr)).Observe(time.Since(begin).Seconds())
+			}
+		case ctx.Err() == nil:
+			if m.DialErrors != nil {
+				m.DialErrors.With("target", sanitizeLabelValue(addr)).Add(1)
+			}
+		}
+		return conn, err
+	})
+}
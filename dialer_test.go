@@ -0,0 +1,76 @@
+package grpcmon_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+func TestWithContextDialerErrors(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	m, rec := grpcmontest.NewRecorder()
+	conn, err := grpc.Dial(addr, grpcmon.WithContextDialer(m, nil), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err == nil {
+		t.Fatal("query to an unreachable address succeeded")
+	}
+
+	if got := rec.CounterValue(grpcmontest.DialErrors, "target", addr); got < 1 {
+		t.Errorf("dial errors = %v, want at least 1", got)
+	}
+	if got := rec.HistogramCount(grpcmontest.DialLatency, "target", addr); got != 0 {
+		t.Errorf("dial latency observations = %d, want 0", got)
+	}
+}
+
+func TestWithContextDialerCustom(t *testing.T) {
+	srv := grpc.NewServer()
+	pb.RegisterFrontendServer(srv, &frontend{})
+	go srv.Serve(listen("dialer"))
+	defer srv.Stop()
+
+	m, rec := grpcmontest.NewRecorder()
+	var dials atomic.Int32
+	custom := func(ctx context.Context, addr string) (net.Conn, error) {
+		dials.Add(1)
+		return dial(ctx, addr)
+	}
+	conn, err := grpc.Dial("dialer", grpcmon.WithContextDialer(m, custom), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := pb.NewFrontendClient(conn).Query(ctx, &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := dials.Load(); got != 1 {
+		t.Errorf("custom dialer called %d times, want 1", got)
+	}
+	if got := rec.HistogramCount(grpcmontest.DialLatency, "target", "dialer"); got != 1 {
+		t.Errorf("dial latency observations = %d, want 1", got)
+	}
+	if got := rec.CounterValue(grpcmontest.DialErrors, "target", "dialer"); got != 0 {
+		t.Errorf("dial errors = %v, want 0", got)
+	}
+}
@@ -0,0 +1,69 @@
+package grpcmon
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorLogger logs failed RPCs, at most limit per code per second.
+type errorLogger struct {
+	logger *slog.Logger
+	limit  int64
+	now    func() time.Time
+
+	// windows holds the rate limiter state of each code. Codes out of
+	// range share the last window.
+	windows [codes.Unauthenticated + 2]logWindow
+}
+
+// logWindow counts the lines logged in the second starting at start.
+type logWindow struct {
+	start atomic.Int64
+	n     atomic.Int64
+}
+
+func newErrorLogger(logger *slog.Logger, limit int) *errorLogger {
+	return &errorLogger{logger: logger, limit: int64(limit), now: time.Now}
+}
+
+// allow reports whether a line for code may be logged now.
+func (l *errorLogger) allow(code codes.Code) bool {
+	i := int(code)
+	if i >= len(l.windows) {
+		i = len(l.windows) - 1
+	}
+	w := &l.windows[i]
+	sec := l.now().Unix()
+	if start := w.start.Load(); start != sec && w.start.CompareAndSwap(start, sec) {
+		w.n.Store(0)
+	}
+	return w.n.Add(1) <= l.limit
+}
+
+// log logs s if it failed and the rate limit allows.
+func (l *errorLogger) log(ctx context.Context, s RPCSummary) {
+	if s.Err == nil {
+		return
+	}
+	if !l.allow(status.Code(s.Err)) {
+		return
+	}
+	l.logger.LogAttrs(ctx, slog.LevelWarn, "gRPC request failed",
+		slog.Bool("client", s.Client),
+		slog.String("service", s.Service),
+		slog.String("method", s.Method),
+		slog.String("code", s.Code),
+		slog.String("error", s.Err.Error()),
+		slog.Time("begin", s.BeginTime),
+		slog.Duration("duration", s.Duration()),
+		slog.Int64("msgs_sent", s.MsgsSent),
+		slog.Int64("msgs_recv", s.MsgsRecv),
+		slog.Int64("bytes_sent", s.BytesSent),
+		slog.Int64("bytes_recv", s.BytesRecv),
+	)
+}
@@ -0,0 +1,41 @@
+package grpcmon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newErrorLogger(slog.New(slog.NewTextHandler(&buf, nil)), 2)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	unavailable := RPCSummary{Service: "s", Method: "m", Code: "Unavailable", Err: status.Error(codes.Unavailable, "down")}
+	for i := 0; i < 5; i++ {
+		l.log(context.Background(), unavailable)
+	}
+	l.log(context.Background(), RPCSummary{Code: "OK"})
+	l.log(context.Background(), RPCSummary{Code: "Unknown", Err: errors.New("boom")})
+	if got := strings.Count(buf.String(), "\n"); got != 3 {
+		t.Errorf("got %d lines, want 3:\n%s", got, buf.String())
+	}
+	if !strings.Contains(buf.String(), `service=s method=m code=Unavailable error="rpc error: code = Unavailable desc = down"`) {
+		t.Errorf("missing fields in:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	now = now.Add(time.Second)
+	l.log(context.Background(), unavailable)
+	if got := strings.Count(buf.String(), "\n"); got != 1 {
+		t.Errorf("got %d lines in the next second, want 1", got)
+	}
+}
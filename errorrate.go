@@ -0,0 +1,96 @@
+package grpcmon
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errorRateSlots is the number of slots the error rate window is made of.
+const errorRateSlots = 10
+
+// errorRates tracks the ratio of failed RPCs of each method over a rolling
+// window.
+type errorRates struct {
+	window time.Duration
+	now    func() time.Time
+	self   *SelfMetrics
+
+	mu      sync.Mutex // serializes the creation of methods
+	n       int
+	methods sync.Map // rpcName -> *errorRate
+}
+
+type errorRate struct {
+	mu   sync.Mutex
+	ring countRing
+
+	// rate holds the bits of the rate as of the last RPC, which ended at
+	// last, in Unix nanoseconds.
+	rate atomic.Uint64
+	last atomic.Int64
+}
+
+func newErrorRates(window time.Duration) *errorRates {
+	return &errorRates{window: window, now: time.Now}
+}
+
+// observe records an RPC of the given method and returns the updated error
+// rate, and whether the method is tracked.
+func (e *errorRates) observe(name rpcName, failed bool) (float64, bool) {
+	v, ok := e.methods.Load(name)
+	if !ok {
+		e.mu.Lock()
+		if v, ok = e.methods.Load(name); !ok {
+			if e.n >= maxRollingMethods {
+				e.mu.Unlock()
+				e.self.labelOverflow()
+				return 0, false
+			}
+			v = &errorRate{ring: countRing{
+				width: e.window / errorRateSlots,
+				slots: make([]countSlot, errorRateSlots),
+			}}
+			e.methods.Store(name, v)
+			e.n++
+		}
+		e.mu.Unlock()
+	}
+	r := v.(*errorRate)
+	now := e.now()
+	r.mu.Lock()
+	good, bad := r.ring.add(now, failed)
+	rate := float64(bad) / float64(good+bad)
+	r.rate.Store(math.Float64bits(rate))
+	r.last.Store(now.UnixNano())
+	r.mu.Unlock()
+	return rate, true
+}
+
+// get returns the error rate of the given method. It does not lock.
+func (e *errorRates) get(name rpcName) float64 {
+	v, ok := e.methods.Load(name)
+	if !ok {
+		return 0
+	}
+	r := v.(*errorRate)
+	if e.now().UnixNano()-r.last.Load() > int64(e.window) {
+		// Everything aged out since.
+		return 0
+	}
+	return math.Float64frombits(r.rate.Load())
+}
+
+// ErrorRate returns the ratio of RPCs of the given method that failed over
+// the window set with WithErrorRate, as of the last RPC of the method to
+// end. Failures are defined by WithFailure. It returns zero without a
+// window, for methods without RPCs in the window and for methods beyond the
+// tracking limit. It does not lock and is cheap enough to be called on every
+// RPC, for example by circuit breakers.
+func (h *Handler) ErrorRate(service, method string) float64 {
+	if h.errorRates == nil {
+		return 0
+	}
+	return h.errorRates.get(rpcName{server: service, method: method})
+}
@@ -0,0 +1,57 @@
+package grpcmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestErrorRates(t *testing.T) {
+	h := newHandler(&Metrics{}, false, []Option{WithErrorRate(10 * time.Second)})
+	now := time.Unix(1000, 0)
+	h.errorRates.now = func() time.Time { return now }
+	name := rpcName{server: "s", method: "m"}
+
+	for i := 0; i < 3; i++ {
+		h.errorRates.observe(name, false)
+	}
+	if rate, _ := h.errorRates.observe(name, true); rate != 0.25 {
+		t.Errorf("rate = %v, want 0.25", rate)
+	}
+	if got := h.ErrorRate("s", "m"); got != 0.25 {
+		t.Errorf("ErrorRate = %v, want 0.25", got)
+	}
+	if got := h.ErrorRate("s", "other"); got != 0 {
+		t.Errorf("ErrorRate of unknown method = %v, want 0", got)
+	}
+
+	// The failure ages out of the window first.
+	now = now.Add(9 * time.Second)
+	if rate, _ := h.errorRates.observe(name, true); rate != 0.4 {
+		t.Errorf("rate = %v, want 0.4", rate)
+	}
+	now = now.Add(5 * time.Second)
+	if rate, _ := h.errorRates.observe(name, false); rate != 0.5 {
+		t.Errorf("rate after aging = %v, want 0.5", rate)
+	}
+	now = now.Add(11 * time.Second)
+	if got := h.ErrorRate("s", "m"); got != 0 {
+		t.Errorf("ErrorRate after the window = %v, want 0", got)
+	}
+}
+
+func TestErrorRateWithoutWindow(t *testing.T) {
+	if got := newHandler(&Metrics{}, false, nil).ErrorRate("s", "m"); got != 0 {
+		t.Errorf("ErrorRate = %v, want 0", got)
+	}
+}
+
+func BenchmarkErrorRate(b *testing.B) {
+	h := newHandler(&Metrics{}, false, []Option{WithErrorRate(30 * time.Second)})
+	h.errorRates.observe(rpcName{server: "s", method: "m"}, true)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h.ErrorRate("s", "m")
+		}
+	})
+}
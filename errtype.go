@@ -0,0 +1,69 @@
+package grpcmon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error types returned by ErrorType.
+const (
+	ErrorTypeNone        = "none"
+	ErrorTypeApplication = "application"
+	ErrorTypeCanceled    = "canceled"
+	ErrorTypeDeadline    = "deadline"
+	ErrorTypeTransport   = "transport"
+)
+
+// transportMessages are the parts of the messages of the statuses grpc-go
+// fails RPCs with when their connection fails.
+var transportMessages = []string{
+	"transport",
+	"connection error",
+	"connection closed",
+	"error reading from server",
+	"error reading server preface",
+	"connection is draining",
+	"EOF",
+}
+
+// ErrorType classifies the error an RPC ended with, as recorded by the
+// error_type label of ErrorTypes: none for nil, canceled and deadline for
+// cancellations and expired deadlines, transport for failures of the
+// connection, such as a reset or io.EOF, and application for the other
+// errors, which the handler of the RPC returned. Since grpc-go reports
+// connection failures with statuses as well, the ones with the Unavailable,
+// Internal or Unknown code are told apart by their messages.
+func ErrorType(err error) string {
+	switch {
+	case err == nil:
+		return ErrorTypeNone
+	case errors.Is(err, context.Canceled):
+		return ErrorTypeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorTypeDeadline
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorTypeTransport
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return ErrorTypeApplication
+	}
+	switch st.Code() {
+	case codes.Canceled:
+		return ErrorTypeCanceled
+	case codes.DeadlineExceeded:
+		return ErrorTypeDeadline
+	case codes.Unavailable, codes.Internal, codes.Unknown:
+		for _, msg := range transportMessages {
+			if strings.Contains(st.Message(), msg) {
+				return ErrorTypeTransport
+			}
+		}
+	}
+	return ErrorTypeApplication
+}
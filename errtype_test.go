@@ -0,0 +1,135 @@
+package grpcmon_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+func TestErrorTypeClasses(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{nil, grpcmon.ErrorTypeNone},
+		{errors.New("boom"), grpcmon.ErrorTypeApplication},
+		{status.Error(codes.Internal, "boom"), grpcmon.ErrorTypeApplication},
+		{status.Error(codes.Unavailable, "backend down"), grpcmon.ErrorTypeApplication},
+		{status.Error(codes.NotFound, "transport"), grpcmon.ErrorTypeApplication},
+		{context.Canceled, grpcmon.ErrorTypeCanceled},
+		{fmt.Errorf("query: %w", context.Canceled), grpcmon.ErrorTypeCanceled},
+		{status.Error(codes.Canceled, "context canceled"), grpcmon.ErrorTypeCanceled},
+		{context.DeadlineExceeded, grpcmon.ErrorTypeDeadline},
+		{status.Error(codes.DeadlineExceeded, "context deadline exceeded"), grpcmon.ErrorTypeDeadline},
+		{io.EOF, grpcmon.ErrorTypeTransport},
+		{io.ErrUnexpectedEOF, grpcmon.ErrorTypeTransport},
+		{status.Error(codes.Unavailable, "error reading from server: EOF"), grpcmon.ErrorTypeTransport},
+		{status.Error(codes.Unavailable, "transport is closing"), grpcmon.ErrorTypeTransport},
+		{status.Error(codes.Internal, "connection error: desc = \"transport: reset\""), grpcmon.ErrorTypeTransport},
+	} {
+		if got := grpcmon.ErrorType(tt.err); got != tt.want {
+			t.Errorf("ErrorType(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// errorsDesc describes a unary service whose method fails according to the
+// value of its request: "application" returns an Internal status, "deadline"
+// returns once a deadline shorter than that of the client expires, and
+// "block" blocks until the RPC is done.
+var errorsDesc = grpc.ServiceDesc{
+	ServiceName: "grpcmontest.Errors",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Fail",
+		Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			v := new(wrapperspb.StringValue)
+			if err := dec(v); err != nil {
+				return nil, err
+			}
+			switch v.Value {
+			case "deadline":
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+				defer cancel()
+				fallthrough
+			case "block":
+				<-ctx.Done()
+				return nil, status.FromContextError(ctx.Err()).Err()
+			}
+			return nil, status.Error(codes.Internal, "boom")
+		},
+	}},
+}
+
+// waitErrorType waits for rec to count an RPC of errorsDesc failed with
+// errType.
+func waitErrorType(t *testing.T, rec *grpcmontest.Recorder, side, errType string) {
+	t.Helper()
+	labels := []string{"service", "grpcmontest.Errors", "method", "Fail", "error_type", errType}
+	for deadline := time.Now().Add(5 * time.Second); rec.CounterValue(grpcmontest.ErrorTypes, labels...) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got := rec.CounterValue(grpcmontest.ErrorTypes, labels...); got != 1 {
+		t.Errorf("%s: %s errors = %v, want 1", side, errType, got)
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	h.Server.RegisterService(&errorsDesc, nil)
+	fail := func(ctx context.Context, value string) error {
+		return h.Conn().Invoke(ctx, "/grpcmontest.Errors/Fail", wrapperspb.String(value), new(wrapperspb.StringValue))
+	}
+
+	if err := fail(context.Background(), "application"); status.Code(err) != codes.Internal {
+		t.Fatalf("application error = %v, want Internal", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if err := fail(ctx, "block"); status.Code(err) != codes.Canceled {
+		t.Fatalf("canceled error = %v, want Canceled", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := fail(ctx, "deadline"); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("deadline error = %v, want DeadlineExceeded", err)
+	}
+
+	for side, rec := range map[string]*grpcmontest.Recorder{"client": h.ClientRecorder, "server": h.ServerRecorder} {
+		for _, errType := range []string{grpcmon.ErrorTypeApplication, grpcmon.ErrorTypeCanceled, grpcmon.ErrorTypeDeadline} {
+			waitErrorType(t, rec, side, errType)
+		}
+	}
+	h.Stop()
+}
+
+func TestErrorTypeTransport(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	h.Server.RegisterService(&errorsDesc, nil)
+	conn := h.Conn()
+	// Stop the server, closing the connection, once the RPC is in flight.
+	go func() {
+		method := []string{"service", "grpcmontest.Errors", "method", "Fail"}
+		for h.ServerRecorder.CounterValue(grpcmontest.ReqsStarted, method...) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		h.Server.Stop()
+	}()
+	err := conn.Invoke(context.Background(), "/grpcmontest.Errors/Fail", wrapperspb.String("block"), new(wrapperspb.StringValue))
+	if got := grpcmon.ErrorType(err); got != grpcmon.ErrorTypeTransport {
+		t.Fatalf("ErrorType(%v) = %q, want %q", err, got, grpcmon.ErrorTypeTransport)
+	}
+	waitErrorType(t, h.ClientRecorder, "client", grpcmon.ErrorTypeTransport)
+}
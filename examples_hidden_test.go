@@ -2,20 +2,100 @@ package grpcmon_test
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
 
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
 
 	bpb "github.com/Bo0mer/grpcmon/testdata/backend"
 	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
 )
 
-var addr, backendAddr string
+const (
+	addr        = "frontend"
+	backendAddr = "backend"
+)
+
+var (
+	listenersMu sync.Mutex
+	listeners   = make(map[string]*bufconn.Listener)
+)
+
+func init() {
+	srv := grpc.NewServer()
+	bpb.RegisterBackendServer(srv, &Backend{})
+	go srv.Serve(listen(backendAddr))
+}
+
+// listen returns an in-memory listener registered under addr.
+func listen(addr string) net.Listener {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	lis := bufconn.Listen(1 << 20)
+	listeners[addr] = lis
+	return lis
+}
+
+// dial connects to the in-memory listener registered under addr.
+func dial(ctx context.Context, addr string) (net.Conn, error) {
+	listenersMu.Lock()
+	lis, ok := listeners[addr]
+	listenersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no listener for %q", addr)
+	}
+	return lis.DialContext(ctx)
+}
 
 type Server struct {
 	backend bpb.BackendClient
 }
 
-func (*Server) Query(context.Context, *pb.QueryRequest) (*pb.QueryResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "Query not implemented")
+func (s *Server) Query(ctx context.Context, _ *pb.QueryRequest) (*pb.QueryResponse, error) {
+	if _, err := s.backend.Query(ctx, &bpb.QueryRequest{}); err != nil {
+		return nil, err
+	}
+	return &pb.QueryResponse{}, nil
+}
+
+type Backend struct{}
+
+func (*Backend) Query(context.Context, *bpb.QueryRequest) (*bpb.QueryResponse, error) {
+	return &bpb.QueryResponse{}, nil
+}
+
+// printMetrics prints the samples of the named counter families in g.
+func printMetrics(g prometheus.Gatherer, names ...string) {
+	mfs, err := g.Gather()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if !contains(names, mf.GetName()) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var labels []string
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", lp.GetName(), lp.GetValue()))
+			}
+			sort.Strings(labels)
+			fmt.Printf("%s{%s} %v\n", mf.GetName(), strings.Join(labels, ","), m.GetCounter().GetValue())
+		}
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
@@ -1,39 +1,65 @@
 package grpcmon_test
 
 import (
+	"context"
 	"log"
-	"net"
 
 	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcprom"
 	bpb "github.com/Bo0mer/grpcmon/testdata/backend"
 	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 func Example() {
-	// Create gRPC metrics with selected options and register with monitoring
-	// sytem.
-	clientMetrics := &grpcmon.Metrics{
-	// ...
+	// Create gRPC metrics and register them with an isolated registry.
+	reg := prometheus.NewRegistry()
+	clientMetrics, err := grpcprom.NewClientMetrics(reg)
+	if err != nil {
+		log.Fatal(err)
 	}
 	// Instrument gRPC client(s).
-	backendConn, err := grpc.Dial(backendAddr, grpcmon.DialOption(clientMetrics))
+	backendConn, err := grpc.Dial(backendAddr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dial),
+		grpcmon.DialOption(clientMetrics.Metrics),
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer backendConn.Close()
 
-	serverMetrics := &grpcmon.Metrics{
-	// ...
+	serverMetrics, err := grpcprom.NewServerMetrics(reg)
+	if err != nil {
+		log.Fatal(err)
 	}
 	// Instrument gRPC server and, optionally, initialize server metrics.
-	srv := grpc.NewServer(grpcmon.ServerOption(serverMetrics))
+	srv := grpc.NewServer(grpcmon.ServerOption(serverMetrics.Metrics))
 	pb.RegisterFrontendServer(srv, &Server{
 		backend: bpb.NewBackendClient(backendConn),
 	})
 	// Listen and serve.
-	lis, err := net.Listen("tcp", addr)
+	lis := listen(addr)
+	go srv.Serve(lis)
+
+	// Issue a request and wait for it to be fully accounted for.
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dial),
+	)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Fatal(srv.Serve(lis))
+	if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		log.Fatal(err)
+	}
+	conn.Close()
+	srv.GracefulStop()
+
+	printMetrics(reg, "grpc_client_requests_total", "grpc_server_requests_total")
+	// Output:
+	// grpc_client_requests_total{code="OK",method="Query",service="backend.Backend"} 1
+	// grpc_server_requests_total{code="OK",method="Query",service="frontend.Frontend"} 1
 }
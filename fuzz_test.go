@@ -0,0 +1,96 @@
+package grpcmon
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func FuzzParseFullMethod(f *testing.F) {
+	f.Add("/pkg.Service/Method")
+	f.Add("pkg.Service/Method")
+	f.Add("/grpc.health.v1.Health/Check")
+	f.Add("/")
+	f.Add("")
+	f.Add("//Method")
+	f.Add("/pkg.Service/")
+	f.Add("/a/b/c")
+	f.Add("/\xff\xfe/\xc0")
+	f.Fuzz(func(t *testing.T, s string) {
+		service, method := ParseFullMethod(s)
+		for _, v := range []string{service, method} {
+			if !utf8.ValidString(v) {
+				t.Errorf("ParseFullMethod(%q) = %q, not valid UTF-8", s, v)
+			}
+			if len(v) > maxLabelValueLength {
+				t.Errorf("ParseFullMethod(%q) = %q, longer than %d bytes", s, v, maxLabelValueLength)
+			}
+			if v == "" {
+				t.Errorf("ParseFullMethod(%q) returned an empty part", s)
+			}
+		}
+	})
+}
+
+func FuzzParseFullMethodRoundTrip(f *testing.F) {
+	f.Add("pkg.Service", "Method")
+	f.Add("Service", "Method_v2")
+	f.Add("пакет.Сервис", "Метод")
+	f.Fuzz(func(t *testing.T, service, method string) {
+		if service == "" || method == "" || strings.Contains(service, "/") ||
+			!utf8.ValidString(service) || !utf8.ValidString(method) ||
+			len(service) > maxLabelValueLength || len(method) > maxLabelValueLength {
+			t.Skip("not well-formed")
+		}
+		gotService, gotMethod := ParseFullMethod("/" + service + "/" + method)
+		if gotService != service || gotMethod != method {
+			t.Errorf("ParseFullMethod(%q) = %q, %q, want %q, %q", "/"+service+"/"+method, gotService, gotMethod, service, method)
+		}
+	})
+}
+
+func FuzzSanitizeLabelValue(f *testing.F) {
+	f.Add("plain")
+	f.Add("\xff")
+	f.Add(strings.Repeat("é", maxLabelValueLength))
+	f.Add(strings.Repeat("a", maxLabelValueLength-1) + "é")
+	f.Fuzz(func(t *testing.T, s string) {
+		got := sanitizeLabelValue(s)
+		if !utf8.ValidString(got) {
+			t.Errorf("sanitizeLabelValue(%q) = %q, not valid UTF-8", s, got)
+		}
+		if len(got) > maxLabelValueLength {
+			t.Errorf("sanitizeLabelValue(%q) = %q, longer than %d bytes", s, got, maxLabelValueLength)
+		}
+		if utf8.ValidString(s) && len(s) <= maxLabelValueLength && got != s {
+			t.Errorf("sanitizeLabelValue(%q) = %q, want input unchanged", s, got)
+		}
+		if utf8.ValidString(s) && !strings.HasPrefix(s, got) {
+			t.Errorf("sanitizeLabelValue(%q) = %q, want a prefix of the input", s, got)
+		}
+	})
+}
+
+func FuzzCodeLabel(f *testing.F) {
+	f.Add(uint32(codes.OK), "")
+	f.Add(uint32(codes.Unavailable), "unavailable")
+	f.Add(uint32(1<<32-1), "\xff")
+	f.Fuzz(func(t *testing.T, code uint32, msg string) {
+		for _, err := range []error{
+			status.Error(codes.Code(code), msg),
+			errors.New(msg),
+		} {
+			got := codeLabel(err)
+			if !utf8.ValidString(got) {
+				t.Errorf("codeLabel(%v) = %q, not valid UTF-8", err, got)
+			}
+			if got == "" || len(got) > 32 {
+				t.Errorf("codeLabel(%v) = %q, want 1 to 32 bytes", err, got)
+			}
+		}
+	})
+}
@@ -0,0 +1,185 @@
+// Package grpcchannelz exports statistics of gRPC channels kept by channelz
+// as metrics. Unlike the stats handler view of grpcmon, channelz also sees
+// connection level failures that never produce RPC events.
+//
+// The following metrics are provided, summed over all channels with the same
+// target:
+//
+//  grpc_client_channel_calls_started{target} [gauge] Number of calls started on gRPC client channels.
+//  grpc_client_channel_calls_succeeded{target} [gauge] Number of calls succeeded on gRPC client channels.
+//  grpc_client_channel_calls_failed{target} [gauge] Number of calls failed on gRPC client channels.
+//  grpc_client_channel_last_call_started_timestamp_seconds{target} [gauge] Time the last call was started on gRPC client channels.
+//
+// The call counts are cumulative, but are exported as gauges since channelz
+// reports totals rather than increments.
+package grpcchannelz // import "github.com/Bo0mer/grpcmon/grpcchannelz"
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	metrics "github.com/go-kit/kit/metrics"
+	"google.golang.org/grpc"
+	channelzgrpc "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Metrics holds the metrics the Bridge exports. Nil fields are not exported.
+type Metrics struct {
+	_ struct{}
+
+	CallsStarted    metrics.Gauge
+	CallsSucceeded  metrics.Gauge
+	CallsFailed     metrics.Gauge
+	LastCallStarted metrics.Gauge
+}
+
+// Options configures a Bridge.
+type Options struct {
+	// Interval is the time between polls. Defaults to 15 seconds.
+	Interval time.Duration
+	// MaxChannels is the maximum number of channels exported, in the order
+	// of their channelz IDs. Defaults to 100.
+	MaxChannels int
+}
+
+// Bridge periodically polls channelz and exports channel statistics.
+type Bridge struct {
+	client channelzgrpc.ChannelzClient
+	m      *Metrics
+	opts   Options
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Start starts polling client until Close is called. Use InProcess to poll
+// the channelz data of the current process.
+func Start(client channelzgrpc.ChannelzClient, m *Metrics, opts Options) *Bridge {
+	if opts.Interval <= 0 {
+		opts.Interval = 15 * time.Second
+	}
+	if opts.MaxChannels <= 0 {
+		opts.MaxChannels = 100
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Bridge{
+		client: client,
+		m:      m,
+		opts:   opts,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go b.run(ctx)
+	return b
+}
+
+// Close stops polling and waits for an ongoing poll to finish.
+func (b *Bridge) Close() {
+	b.once.Do(b.cancel)
+	<-b.done
+}
+
+func (b *Bridge) run(ctx context.Context) {
+	defer close(b.done)
+	t := time.NewTicker(b.opts.Interval)
+	defer t.Stop()
+	for {
+		b.Poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Poll polls channelz once and updates the metrics.
+func (b *Bridge) Poll(ctx context.Context) error {
+	resp, err := b.client.GetTopChannels(ctx, &channelzgrpc.GetTopChannelsRequest{
+		// One more than the cap, to account for the in-process channel.
+		MaxResults: int64(b.opts.MaxChannels) + 1,
+	})
+	if err != nil {
+		return err
+	}
+	type totals struct {
+		started, succeeded, failed int64
+		last                       time.Time
+	}
+	byTarget := make(map[string]*totals)
+	channels := resp.GetChannel()
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].GetRef().GetChannelId() < channels[j].GetRef().GetChannelId()
+	})
+	n := 0
+	for _, ch := range channels {
+		d := ch.GetData()
+		if d.GetTarget() == inProcessTarget {
+			continue
+		}
+		if n == b.opts.MaxChannels {
+			break
+		}
+		n++
+		t, ok := byTarget[d.GetTarget()]
+		if !ok {
+			t = &totals{}
+			byTarget[d.GetTarget()] = t
+		}
+		t.started += d.GetCallsStarted()
+		t.succeeded += d.GetCallsSucceeded()
+		t.failed += d.GetCallsFailed()
+		if ts := d.GetLastCallStartedTimestamp(); ts != nil && ts.AsTime().After(t.last) {
+			t.last = ts.AsTime()
+		}
+	}
+	for target, t := range byTarget {
+		set(b.m.CallsStarted, target, float64(t.started))
+		set(b.m.CallsSucceeded, target, float64(t.succeeded))
+		set(b.m.CallsFailed, target, float64(t.failed))
+		if !t.last.IsZero() {
+			set(b.m.LastCallStarted, target, float64(t.last.UnixNano())/1e9)
+		}
+	}
+	return nil
+}
+
+func set(g metrics.Gauge, target string, v float64) {
+	if g != nil {
+		g.With("target", target).Set(v)
+	}
+}
+
+// inProcessTarget is the target of the channel created by InProcess, which
+// is not exported.
+const inProcessTarget = "passthrough:///grpcchannelz.in-process"
+
+// InProcess serves channelz on an in-memory listener and returns a client
+// connected to it, along with a function that releases both.
+func InProcess() (channelzgrpc.ChannelzClient, func(), error) {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	service.RegisterChannelzServiceToServer(srv)
+	go srv.Serve(lis)
+	conn, err := grpc.NewClient(inProcessTarget,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+	)
+	if err != nil {
+		srv.Stop()
+		return nil, nil, err
+	}
+	return channelzgrpc.NewChannelzClient(conn), func() {
+		conn.Close()
+		srv.Stop()
+	}, nil
+}
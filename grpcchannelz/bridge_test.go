@@ -0,0 +1,134 @@
+package grpcchannelz_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	metrics "github.com/go-kit/kit/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/Bo0mer/grpcmon/grpcchannelz"
+)
+
+// gauge records the last value set per target.
+type gauge struct {
+	mu     sync.Mutex
+	values map[string]float64
+	target string
+	root   *gauge
+}
+
+func newGauge() *gauge {
+	g := &gauge{values: make(map[string]float64)}
+	g.root = g
+	return g
+}
+
+func (g *gauge) With(labelValues ...string) metrics.Gauge {
+	return &gauge{target: labelValues[1], root: g.root}
+}
+
+func (g *gauge) Set(v float64) {
+	g.root.mu.Lock()
+	defer g.root.mu.Unlock()
+	g.root.values[g.target] = v
+}
+
+func (g *gauge) Add(float64) { panic("unexpected Add") }
+
+func (g *gauge) value(target string) (float64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v, ok := g.values[target]
+	return v, ok
+}
+
+func TestBridge(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+	const target = "passthrough:///grpcchannelz-test"
+	conn, err := grpc.NewClient(target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 2; i++ {
+		// Fails with Unimplemented.
+		conn.Invoke(context.Background(), "/test.Test/Missing", &emptypb.Empty{}, &emptypb.Empty{})
+	}
+
+	client, release, err := grpcchannelz.InProcess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	m := &grpcchannelz.Metrics{
+		CallsStarted:    newGauge(),
+		CallsSucceeded:  newGauge(),
+		CallsFailed:     newGauge(),
+		LastCallStarted: newGauge(),
+	}
+	b := grpcchannelz.Start(client, m, grpcchannelz.Options{Interval: time.Millisecond})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if v, _ := m.CallsFailed.(*gauge).value(target); v == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("failed calls not exported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Close()
+	b.Close()
+
+	if v, _ := m.CallsStarted.(*gauge).value(target); v != 2 {
+		t.Errorf("calls started = %v, want 2", v)
+	}
+	if v, ok := m.LastCallStarted.(*gauge).value(target); !ok || v <= 0 {
+		t.Errorf("last call started = %v, want positive", v)
+	}
+	for _, g := range []metrics.Gauge{m.CallsStarted, m.CallsSucceeded, m.CallsFailed} {
+		if _, ok := g.(*gauge).value("passthrough:///grpcchannelz.in-process"); ok {
+			t.Error("in-process channel exported")
+		}
+	}
+}
+
+func TestPollMaxChannels(t *testing.T) {
+	client, release, err := grpcchannelz.InProcess()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	for i := 0; i < 3; i++ {
+		conn, err := grpc.NewClient(fmt.Sprintf("passthrough:///capped-%d", i), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	m := &grpcchannelz.Metrics{CallsStarted: newGauge()}
+	b := grpcchannelz.Start(client, m, grpcchannelz.Options{Interval: time.Hour, MaxChannels: 1})
+	b.Close()
+	if err := b.Poll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(m.CallsStarted.(*gauge).values); got != 1 {
+		t.Errorf("exported %d targets, want 1", got)
+	}
+}
@@ -0,0 +1,121 @@
+// Package grpcdogstatsd provides grpcmon metrics sent to DogStatsD, with
+// labels as tags.
+//
+// Counters and gauges keep the names documented by grpcmon. Histograms map
+// to DogStatsD types as follows:
+//
+//  grpc_{side}_connection_duration_seconds -> grpc_{side}_connection_duration [timing, ms]
+//  grpc_{side}_latency_seconds             -> grpc_{side}_latency [timing, ms]
+//  grpc_{side}_stream_age_seconds          -> grpc_{side}_stream_age [timing, ms]
+//  grpc_{side}_first_response_seconds      -> grpc_{side}_first_response [timing, ms]
+//  grpc_{side}_inter_message_gap_seconds   -> grpc_{side}_inter_message_gap [timing, ms]
+//  grpc_server_deadline_budget_seconds     -> grpc_server_deadline_budget [timing, ms]
+//  grpc_server_processing_seconds          -> grpc_server_processing [timing, ms]
+//  grpc_client_dial_latency_seconds        -> grpc_client_dial_latency [timing, ms]
+//  grpc_client_pick_latency_seconds        -> grpc_client_pick_latency [timing, ms]
+//  grpc_{side}_recv_bytes                  -> grpc_{side}_recv_bytes [histogram]
+//  grpc_{side}_sent_bytes                  -> grpc_{side}_sent_bytes [histogram]
+//  grpc_{side}_msg_recv_bytes              -> grpc_{side}_msg_recv_bytes [histogram]
+//  grpc_{side}_msg_sent_bytes              -> grpc_{side}_msg_sent_bytes [histogram]
+//  grpc_server_connection_streams          -> grpc_server_connection_streams [histogram]
+//
+// Timings are in milliseconds, as DogStatsD expects, so their names drop the
+// unit suffix.
+package grpcdogstatsd // import "github.com/Bo0mer/grpcmon/grpcdogstatsd"
+
+import (
+	metrics "github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/dogstatsd"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// Option configures the metrics created by NewClientMetrics and
+// NewServerMetrics.
+type Option func(*options)
+
+type options struct {
+	bytesSampleRate float64
+}
+
+// WithBytesSampleRate sets the sample rate of the byte histograms, which
+// observe every frame and are the most voluminous. Defaults to 1.
+func WithBytesSampleRate(rate float64) Option {
+	return func(o *options) {
+		o.bytesSampleRate = rate
+	}
+}
+
+// NewClientMetrics returns metrics for gRPC clients sent through d.
+func NewClientMetrics(d *dogstatsd.Dogstatsd, opts ...Option) *grpcmon.Metrics {
+	m := newMetrics(d, "client", opts)
+	m.DialErrors = d.NewCounter("grpc_client_dial_errors_total", 1)
+	m.DialLatency = milliseconds{d.NewTiming("grpc_client_dial_latency", 1)}
+	m.PickLatency = milliseconds{d.NewTiming("grpc_client_pick_latency", 1)}
+	m.Retries = d.NewCounter("grpc_client_retries_total", 1)
+	return m
+}
+
+// NewServerMetrics is like NewClientMetrics for gRPC servers.
+func NewServerMetrics(d *dogstatsd.Dogstatsd, opts ...Option) *grpcmon.Metrics {
+	m := newMetrics(d, "server", opts)
+	m.DeadlineOvershoots = d.NewCounter("grpc_server_deadline_overshoot_total", 1)
+	m.DeadlineBudget = milliseconds{d.NewTiming("grpc_server_deadline_budget", 1)}
+	m.ReqsNoDeadline = d.NewCounter("grpc_server_requests_no_deadline_total", 1)
+	m.UnknownCalls = d.NewCounter("grpc_server_unknown_calls_total", 1)
+	m.ProcessingTime = milliseconds{d.NewTiming("grpc_server_processing", 1)}
+	m.ClientCancellations = d.NewCounter("grpc_server_client_cancellations_total", 1)
+	m.StreamsPerConnMax = d.NewGauge("grpc_server_streams_per_connection_max")
+	m.ConnStreams = d.NewHistogram("grpc_server_connection_streams", 1)
+	return m
+}
+
+func newMetrics(d *dogstatsd.Dogstatsd, side string, opts []Option) *grpcmon.Metrics {
+	o := options{bytesSampleRate: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	prefix := "grpc_" + side + "_"
+	return &grpcmon.Metrics{
+		ConnsOpen:       d.NewGauge(prefix + "connections_open"),
+		ConnsTotal:      d.NewCounter(prefix+"connections_total", 1),
+		ConnDuration:    milliseconds{d.NewTiming(prefix+"connection_duration", 1)},
+		ReqsPending:     d.NewGauge(prefix + "requests_pending"),
+		ReqsPendingMax:  d.NewGauge(prefix + "requests_pending_max"),
+		ReqsStarted:     d.NewCounter(prefix+"requests_started_total", 1),
+		ReqsTotal:       d.NewCounter(prefix+"requests_total", 1),
+		Latency:         milliseconds{d.NewTiming(prefix+"latency", 1)},
+		BytesRecv:       d.NewHistogram(prefix+"recv_bytes", o.bytesSampleRate),
+		BytesSent:       d.NewHistogram(prefix+"sent_bytes", o.bytesSampleRate),
+		StreamAge:       milliseconds{d.NewTiming(prefix+"stream_age", 1)},
+		MsgsSent:        d.NewCounter(prefix+"msgs_sent_total", 1),
+		MsgsRecv:        d.NewCounter(prefix+"msgs_received_total", 1),
+		MsgBytesSent:    d.NewHistogram(prefix+"msg_sent_bytes", o.bytesSampleRate),
+		MsgBytesRecv:    d.NewHistogram(prefix+"msg_recv_bytes", o.bytesSampleRate),
+		BytesSentTotal:  d.NewCounter(prefix+"sent_bytes_total", 1),
+		BytesRecvTotal:  d.NewCounter(prefix+"recv_bytes_total", 1),
+		TTFB:            milliseconds{d.NewTiming(prefix+"first_response", 1)},
+		InterMsgGap:     milliseconds{d.NewTiming(prefix+"inter_message_gap", 1)},
+		SubscriberDrops: d.NewCounter(prefix+"subscriber_dropped_total", 1),
+		SLOEvents:       d.NewCounter(prefix+"slo_events_total", 1),
+		SLOBurnRate:     d.NewGauge(prefix + "slo_burn_rate"),
+		ErrorDetails:    d.NewCounter(prefix+"error_details_total", 1),
+		ErrorTypes:      d.NewCounter(prefix+"errors_total", 1),
+		ErrorRate:       d.NewGauge(prefix + "error_ratio"),
+		ConnChurnSpikes: d.NewCounter(prefix+"connection_churn_spikes_total", 1),
+	}
+}
+
+// milliseconds converts the observations in seconds made by grpcmon to the
+// milliseconds of timings.
+type milliseconds struct {
+	h metrics.Histogram
+}
+
+func (m milliseconds) With(labelValues ...string) metrics.Histogram {
+	return milliseconds{m.h.With(labelValues...)}
+}
+
+func (m milliseconds) Observe(value float64) {
+	m.h.Observe(value * 1000)
+}
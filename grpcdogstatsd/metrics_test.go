@@ -0,0 +1,71 @@
+package grpcdogstatsd_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/dogstatsd"
+	"github.com/go-kit/log"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcdogstatsd"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+func TestNewMetrics(t *testing.T) {
+	lis, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	conn, err := net.Dial("udp", lis.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	d := dogstatsd.New("", log.NewNopLogger())
+	grpcmontest.Replay(grpcmon.ClientStatsHandler(grpcdogstatsd.NewClientMetrics(d)), grpcmontest.UnaryOK(true))
+	// Only a few of the sampled payload observations can be dropped.
+	server := grpcmon.ServerStatsHandler(grpcdogstatsd.NewServerMetrics(d, grpcdogstatsd.WithBytesSampleRate(0.5)))
+	for i := 0; i < 20; i++ {
+		grpcmontest.Replay(server, grpcmontest.UnaryOK(false))
+	}
+	if _, err := d.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every line is sent in its own packet.
+	var lines []string
+	buf := make([]byte, 1<<16)
+	for {
+		lis.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := lis.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")...)
+	}
+	for _, want := range []string{
+		"grpc_client_requests_total:1.000000|c|#service:grpcmontest.Test,method:Method,code:OK",
+		"grpc_server_requests_total:20.000000|c|#service:grpcmontest.Test,method:Method,code:OK",
+		"grpc_server_requests_pending:0.000000|g|#service:grpcmontest.Test,method:Method",
+		"grpc_server_latency:3.000000|ms|#service:grpcmontest.Test,method:Method,code:OK",
+		"grpc_server_sent_bytes:25.000000|h|@0.500000|#service:grpcmontest.Test,method:Method,frame:payload",
+	} {
+		if !contains(lines, want) {
+			t.Errorf("missing line %q in\n%s", want, strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func contains(lines []string, s string) bool {
+	for _, l := range lines {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
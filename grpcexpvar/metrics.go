@@ -0,0 +1,170 @@
+// Package grpcexpvar provides grpcmon metrics published with the expvar
+// package, for programs that expose /debug/vars rather than a metrics
+// system.
+//
+// Metrics without labels are expvar floats, backed by go-kit's expvar
+// package. Metrics with labels are expvar maps keyed by their label values in
+// order, joined by dots, so that the requests of a method are published as
+//
+//  "grpc_server_requests_total": {"pkg.Service.Method.OK": 1}
+//
+// Histogram entries are maps with the count and the sum of the observed
+// values.
+package grpcexpvar // import "github.com/Bo0mer/grpcmon/grpcexpvar"
+
+import (
+	"expvar"
+	"strings"
+	"sync"
+
+	metrics "github.com/go-kit/kit/metrics"
+	kitexpvar "github.com/go-kit/kit/metrics/expvar"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// NewClientMetrics returns metrics for gRPC clients published under the
+// names documented by grpcmon. Like expvar.Publish, it panics if any of them
+// is already published, so it is to be called once.
+func NewClientMetrics() *grpcmon.Metrics {
+	m := newMetrics("grpc_client_")
+	m.DialErrors = newCounter("grpc_client_dial_errors_total")
+	m.DialLatency = newHistogram("grpc_client_dial_latency_seconds")
+	m.PickLatency = newHistogram("grpc_client_pick_latency_seconds")
+	m.Retries = newCounter("grpc_client_retries_total")
+	return m
+}
+
+// NewServerMetrics is like NewClientMetrics for gRPC servers.
+func NewServerMetrics() *grpcmon.Metrics {
+	m := newMetrics("grpc_server_")
+	m.DeadlineOvershoots = newCounter("grpc_server_deadline_overshoot_total")
+	m.DeadlineBudget = newHistogram("grpc_server_deadline_budget_seconds")
+	m.ReqsNoDeadline = newCounter("grpc_server_requests_no_deadline_total")
+	m.UnknownCalls = newCounter("grpc_server_unknown_calls_total")
+	m.ProcessingTime = newHistogram("grpc_server_processing_seconds")
+	m.ClientCancellations = newCounter("grpc_server_client_cancellations_total")
+	m.StreamsPerConnMax = newGauge("grpc_server_streams_per_connection_max")
+	m.ConnStreams = newHistogram("grpc_server_connection_streams")
+	return m
+}
+
+func newMetrics(prefix string) *grpcmon.Metrics {
+	return &grpcmon.Metrics{
+		ConnsOpen:       kitexpvar.NewGauge(prefix + "connections_open"),
+		ConnsTotal:      kitexpvar.NewCounter(prefix + "connections_total"),
+		ConnDuration:    newHistogram(prefix + "connection_duration_seconds"),
+		ReqsPending:     newGauge(prefix + "requests_pending"),
+		ReqsPendingMax:  newGauge(prefix + "requests_pending_max"),
+		ReqsStarted:     newCounter(prefix + "requests_started_total"),
+		ReqsTotal:       newCounter(prefix + "requests_total"),
+		Latency:         newHistogram(prefix + "latency_seconds"),
+		BytesRecv:       newHistogram(prefix + "recv_bytes"),
+		BytesSent:       newHistogram(prefix + "sent_bytes"),
+		StreamAge:       newHistogram(prefix + "stream_age_seconds"),
+		MsgsSent:        newCounter(prefix + "msgs_sent_total"),
+		MsgsRecv:        newCounter(prefix + "msgs_received_total"),
+		MsgBytesSent:    newHistogram(prefix + "msg_sent_bytes"),
+		MsgBytesRecv:    newHistogram(prefix + "msg_recv_bytes"),
+		BytesSentTotal:  newCounter(prefix + "sent_bytes_total"),
+		BytesRecvTotal:  newCounter(prefix + "recv_bytes_total"),
+		TTFB:            newHistogram(prefix + "first_response_seconds"),
+		InterMsgGap:     newHistogram(prefix + "inter_message_gap_seconds"),
+		SubscriberDrops: kitexpvar.NewCounter(prefix + "subscriber_dropped_total"),
+		SLOEvents:       newCounter(prefix + "slo_events_total"),
+		SLOBurnRate:     newGauge(prefix + "slo_burn_rate"),
+		ErrorDetails:    newCounter(prefix + "error_details_total"),
+		ErrorTypes:      newCounter(prefix + "errors_total"),
+		ErrorRate:       newGauge(prefix + "error_ratio"),
+		ConnChurnSpikes: kitexpvar.NewCounter(prefix + "connection_churn_spikes_total"),
+	}
+}
+
+// key returns the entry of the given label names and values in a map.
+func key(labelValues []string) string {
+	values := make([]string, 0, len(labelValues)/2)
+	for i := 1; i < len(labelValues); i += 2 {
+		values = append(values, labelValues[i])
+	}
+	if len(labelValues)%2 == 1 {
+		values = append(values, "unknown")
+	}
+	return strings.Join(values, ".")
+}
+
+func with(labelValues, more []string) []string {
+	return append(labelValues[:len(labelValues):len(labelValues)], more...)
+}
+
+type counter struct {
+	m           *expvar.Map
+	labelValues []string
+}
+
+func newCounter(name string) *counter {
+	return &counter{m: expvar.NewMap(name)}
+}
+
+func (c *counter) With(labelValues ...string) metrics.Counter {
+	return &counter{m: c.m, labelValues: with(c.labelValues, labelValues)}
+}
+
+func (c *counter) Add(delta float64) {
+	c.m.AddFloat(key(c.labelValues), delta)
+}
+
+type gauge struct {
+	m           *expvar.Map
+	labelValues []string
+}
+
+func newGauge(name string) *gauge {
+	return &gauge{m: expvar.NewMap(name)}
+}
+
+func (g *gauge) With(labelValues ...string) metrics.Gauge {
+	return &gauge{m: g.m, labelValues: with(g.labelValues, labelValues)}
+}
+
+func (g *gauge) Set(value float64) {
+	k := key(g.labelValues)
+	// AddFloat creates the entry if needed.
+	g.m.AddFloat(k, 0)
+	g.m.Get(k).(*expvar.Float).Set(value)
+}
+
+func (g *gauge) Add(delta float64) {
+	g.m.AddFloat(key(g.labelValues), delta)
+}
+
+type histogram struct {
+	*histogramMap
+	labelValues []string
+}
+
+// histogramMap holds the entries of a histogram.
+type histogramMap struct {
+	mu sync.Mutex
+	m  *expvar.Map
+}
+
+func newHistogram(name string) *histogram {
+	return &histogram{histogramMap: &histogramMap{m: expvar.NewMap(name)}}
+}
+
+func (h *histogram) With(labelValues ...string) metrics.Histogram {
+	return &histogram{histogramMap: h.histogramMap, labelValues: with(h.labelValues, labelValues)}
+}
+
+func (h *histogram) Observe(value float64) {
+	k := key(h.labelValues)
+	h.mu.Lock()
+	e, ok := h.m.Get(k).(*expvar.Map)
+	if !ok {
+		e = new(expvar.Map)
+		h.m.Set(k, e)
+	}
+	h.mu.Unlock()
+	e.Add("count", 1)
+	e.AddFloat("sum", value)
+}
@@ -0,0 +1,54 @@
+package grpcexpvar_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcexpvar"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+// replayOnce publishes the metrics and records their RPCs once per test
+// binary, since expvar names can only be published once, so that the test
+// can run several times with -count.
+var replayOnce sync.Once
+
+func TestNewMetrics(t *testing.T) {
+	replayOnce.Do(func() {
+		grpcmontest.Replay(grpcmon.ClientStatsHandler(grpcexpvar.NewClientMetrics()), grpcmontest.UnaryOK(true))
+		grpcmontest.Replay(grpcmon.ServerStatsHandler(grpcexpvar.NewServerMetrics()), grpcmontest.UnaryOK(false))
+	})
+
+	rw := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(rw, httptest.NewRequest("GET", "/debug/vars", nil))
+	var vars struct {
+		ClientConns    float64                       `json:"grpc_client_connections_total"`
+		ClientRequests map[string]float64            `json:"grpc_client_requests_total"`
+		ServerRequests map[string]float64            `json:"grpc_server_requests_total"`
+		ServerPending  map[string]float64            `json:"grpc_server_requests_pending"`
+		ServerSent     map[string]map[string]float64 `json:"grpc_server_sent_bytes"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	}
+
+	const method = "grpcmontest.Test.Method"
+	if vars.ClientConns != 1 {
+		t.Errorf("client connections = %v, want 1", vars.ClientConns)
+	}
+	for side, requests := range map[string]map[string]float64{"client": vars.ClientRequests, "server": vars.ServerRequests} {
+		if got := requests[method+".OK"]; got != 1 {
+			t.Errorf("%s requests = %v, want 1", side, requests)
+		}
+	}
+	if got, ok := vars.ServerPending[method]; !ok || got != 0 {
+		t.Errorf("server requests pending = %v, want 0", vars.ServerPending)
+	}
+	if got := vars.ServerSent[method+".payload"]; got["count"] != 1 || got["sum"] != 25 {
+		t.Errorf("server payload bytes sent = %v, want one of 25", got)
+	}
+}
@@ -0,0 +1,120 @@
+// Package grpchealth exports the serving status of gRPC health services as
+// metrics, next to the RPC metrics of grpcmon.
+//
+// The following metric is provided:
+//
+//	grpc_server_health_status{service} [gauge] Serving status of gRPC services: 1 serving, 0 not serving, -1 unknown.
+//
+// The overall status of a server is exported with an empty service label.
+//
+// Use NewServer in place of health.NewServer to export the status whenever
+// it is set, or Watch to follow a health service constructed elsewhere.
+package grpchealth // import "github.com/Bo0mer/grpcmon/grpchealth"
+
+import (
+	"context"
+	"sync"
+
+	metrics "github.com/go-kit/kit/metrics"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// Value returns the gauge value of a serving status.
+func Value(status healthpb.HealthCheckResponse_ServingStatus) float64 {
+	switch status {
+	case healthpb.HealthCheckResponse_SERVING:
+		return 1
+	case healthpb.HealthCheckResponse_NOT_SERVING:
+		return 0
+	default:
+		return -1
+	}
+}
+
+// Server is a health.Server that sets the status gauge of every service
+// whenever their serving status changes.
+type Server struct {
+	*health.Server
+	status metrics.Gauge
+
+	mu sync.Mutex // serializes changes with their export
+}
+
+// NewServer returns a health server exporting serving statuses to status.
+// Register it with healthpb.RegisterHealthServer like a health.Server.
+func NewServer(status metrics.Gauge) *Server {
+	s := &Server{Server: health.NewServer(), status: status}
+	s.export()
+	return s
+}
+
+// SetServingStatus sets the serving status of a service and exports it.
+func (s *Server) SetServingStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Server.SetServingStatus(service, status)
+	s.export()
+}
+
+// Shutdown sets the status of all services to NOT_SERVING, as
+// health.Server.Shutdown does, and exports it.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Server.Shutdown()
+	s.export()
+}
+
+// Resume sets the status of all services to SERVING, as
+// health.Server.Resume does, and exports it.
+func (s *Server) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Server.Resume()
+	s.export()
+}
+
+// export sets the gauges from the statuses the server reports, which take
+// into account changes it ignored while shut down.
+func (s *Server) export() {
+	resp, err := s.Server.List(context.Background(), &healthpb.HealthListRequest{})
+	if err != nil {
+		return
+	}
+	for service, st := range resp.GetStatuses() {
+		s.status.With("service", service).Set(Value(st.GetStatus()))
+	}
+}
+
+// Watch follows the serving status of the given services on srv and exports
+// it to status until ctx is done. It is meant for health services that are
+// not constructed with NewServer, and calls their Watch method directly,
+// without going through a connection. Services unknown to srv are exported
+// as unknown.
+func Watch(ctx context.Context, srv healthpb.HealthServer, status metrics.Gauge, services ...string) {
+	for _, service := range services {
+		stream := &watchStream{ctx: ctx, service: service, status: status}
+		go srv.Watch(&healthpb.HealthCheckRequest{Service: service}, stream)
+	}
+}
+
+// watchStream receives the updates of a Watch call.
+type watchStream struct {
+	ctx     context.Context
+	service string
+	status  metrics.Gauge
+}
+
+func (w *watchStream) Send(resp *healthpb.HealthCheckResponse) error {
+	w.status.With("service", w.service).Set(Value(resp.GetStatus()))
+	return nil
+}
+
+func (w *watchStream) Context() context.Context     { return w.ctx }
+func (w *watchStream) SetHeader(metadata.MD) error  { return nil }
+func (w *watchStream) SendHeader(metadata.MD) error { return nil }
+func (w *watchStream) SetTrailer(metadata.MD)       {}
+func (w *watchStream) SendMsg(m interface{}) error  { return w.Send(m.(*healthpb.HealthCheckResponse)) }
+func (w *watchStream) RecvMsg(interface{}) error    { return nil }
@@ -0,0 +1,129 @@
+package grpchealth_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	metrics "github.com/go-kit/kit/metrics"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/Bo0mer/grpcmon/grpchealth"
+)
+
+// gauge records the last value set per service.
+type gauge struct {
+	mu      sync.Mutex
+	values  map[string]float64
+	service string
+	root    *gauge
+}
+
+func newGauge() *gauge {
+	g := &gauge{values: make(map[string]float64)}
+	g.root = g
+	return g
+}
+
+func (g *gauge) With(labelValues ...string) metrics.Gauge {
+	return &gauge{service: labelValues[1], root: g.root}
+}
+
+func (g *gauge) Set(v float64) {
+	g.root.mu.Lock()
+	defer g.root.mu.Unlock()
+	g.root.values[g.service] = v
+}
+
+func (g *gauge) Add(float64) { panic("unexpected Add") }
+
+func (g *gauge) value(service string) (float64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	v, ok := g.values[service]
+	return v, ok
+}
+
+func assertValue(t *testing.T, g *gauge, service string, want float64) {
+	t.Helper()
+	if got, ok := g.value(service); !ok || got != want {
+		t.Errorf("status of %q = %v (set %v), want %v", service, got, ok, want)
+	}
+}
+
+func TestServer(t *testing.T) {
+	g := newGauge()
+	s := grpchealth.NewServer(g)
+	assertValue(t, g, "", 1)
+
+	s.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+	assertValue(t, g, "svc", 0)
+	s.SetServingStatus("svc", healthpb.HealthCheckResponse_UNKNOWN)
+	assertValue(t, g, "svc", -1)
+
+	s.Shutdown()
+	assertValue(t, g, "", 0)
+	assertValue(t, g, "svc", 0)
+	// Ignored while shut down.
+	s.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+	assertValue(t, g, "svc", 0)
+
+	s.Resume()
+	assertValue(t, g, "", 1)
+	assertValue(t, g, "svc", 1)
+}
+
+func TestServerConcurrent(t *testing.T) {
+	g := newGauge()
+	s := grpchealth.NewServer(g)
+	statuses := []healthpb.HealthCheckResponse_ServingStatus{
+		healthpb.HealthCheckResponse_SERVING,
+		healthpb.HealthCheckResponse_NOT_SERVING,
+		healthpb.HealthCheckResponse_UNKNOWN,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.SetServingStatus("svc", statuses[(i+j)%len(statuses)])
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	resp, err := s.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, g, "svc", grpchealth.Value(resp.GetStatus()))
+}
+
+func TestWatch(t *testing.T) {
+	srv := health.NewServer()
+	srv.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+	g := newGauge()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	grpchealth.Watch(ctx, srv, g, "svc", "missing")
+
+	waitFor(t, g, "svc", 1)
+	waitFor(t, g, "missing", -1)
+	srv.SetServingStatus("svc", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitFor(t, g, "svc", 0)
+}
+
+func waitFor(t *testing.T, g *gauge, service string, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if got, ok := g.value(service); ok && got == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertValue(t, g, service, want)
+}
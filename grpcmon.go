@@ -3,30 +3,113 @@
 //
 // The following metrics are provided:
 //
-//  grpc_client_connections_open [gauge] Number of gRPC client connections open.
-//  grpc_client_connections_total [counter] Total number of gRPC client connections opened.
-//  grpc_client_requests_pending{service,method} [gauge] Number of gRPC client requests pending.
-//  grpc_client_requests_total{service,method,code} [counter] Total number of gRPC client requests completed.
-//  grpc_client_latency_seconds{service,method,code} [histogram] Latency of gRPC client requests.
-//  grpc_client_recv_bytes{service,method,frame} [histogram] Bytes received in gRPC client responses.
-//  grpc_client_sent_bytes{service,method,frame} [histogram] Bytes sent in gRPC client requests.
+//	grpc_client_connections_open [gauge] Number of gRPC client connections open.
+//	grpc_client_connections_total [counter] Total number of gRPC client connections opened.
+//	grpc_client_connection_duration_seconds [histogram] Duration of gRPC client connections.
+//	grpc_client_requests_pending{service,method} [gauge] Number of gRPC client requests pending.
+//	grpc_client_requests_pending_max{service,method} [gauge] Highest number of gRPC client requests pending since last reset.
+//	grpc_client_requests_started_total{service,method} [counter] Total number of gRPC client requests started.
+//	grpc_client_requests_total{service,method,code} [counter] Total number of gRPC client requests completed.
+//	grpc_client_latency_seconds{service,method,code} [histogram] Latency of gRPC client requests.
+//	grpc_client_recv_bytes{service,method,frame} [histogram] Bytes received in gRPC client responses.
+//	grpc_client_sent_bytes{service,method,frame} [histogram] Bytes sent in gRPC client requests.
+//	grpc_client_stream_age_seconds{service,method} [histogram] Age of long-lived gRPC client requests in flight.
+//	grpc_client_msgs_sent_total{service,method} [counter] Total number of messages sent in gRPC client requests.
+//	grpc_client_msgs_received_total{service,method} [counter] Total number of messages received in gRPC client responses.
+//	grpc_client_msg_sent_bytes{service,method} [histogram] Uncompressed sizes of messages sent in gRPC client requests.
+//	grpc_client_msg_recv_bytes{service,method} [histogram] Uncompressed sizes of messages received in gRPC client responses.
+//	grpc_client_sent_bytes_total{service,method} [counter] Total number of bytes sent in gRPC client requests.
+//	grpc_client_recv_bytes_total{service,method} [counter] Total number of bytes received in gRPC client responses.
+//	grpc_client_first_response_seconds{service,method} [histogram] Time until the first response message of gRPC client requests.
+//	grpc_client_inter_message_gap_seconds{service,method,direction} [histogram] Time between consecutive messages of gRPC client requests.
+//	grpc_client_subscriber_dropped_total [counter] Total number of RPC summaries dropped by slow subscribers.
+//	grpc_client_slo_events_total{service,method,result} [counter] Total number of gRPC client requests classified by their SLO.
+//	grpc_client_slo_burn_rate{service,method,window} [gauge] Error budget burn rate of gRPC client requests.
+//	grpc_client_error_details_total{service,method,type} [counter] Total number of error details returned to gRPC client requests.
+//	grpc_client_errors_total{service,method,error_type} [counter] Total number of gRPC client requests failed, by the type of their error.
+//	grpc_client_error_ratio{service,method} [gauge] Ratio of failed gRPC client requests over a rolling window.
+//	grpc_client_connection_churn_spikes_total [counter] Total number of spikes of gRPC client connections opened.
+//	grpc_client_dial_errors_total{target} [counter] Total number of gRPC client dials failed.
+//	grpc_client_dial_latency_seconds{target} [histogram] Latency of successful gRPC client dials.
+//	grpc_client_pick_latency_seconds{service,method} [histogram] Time gRPC client requests wait for a connection before sending their headers.
+//	grpc_client_retries_total{service,method} [counter] Total number of gRPC client request attempts after the first.
 //
-//  grpc_server_connections_open [gauge] Number of gRPC server connections open.
-//  grpc_server_connections_total [counter] Total number of gRPC server connections opened.
-//  grpc_server_requests_pending{service,method} [gauge] Number of gRPC server requests pending.
-//  grpc_server_requests_total{service,method,code} [counter] Total number of gRPC server requests completed.
-//  grpc_server_latency_seconds{service,method,code} [histogram] Latency of gRPC server requests.
-//  grpc_server_recv_bytes{service,method,frame} [histogram] Bytes received in gRPC server requests.
-//  grpc_server_sent_bytes{service,method,frame} [histogram] Bytes sent in gRPC server responses.
+//	grpc_server_connections_open [gauge] Number of gRPC server connections open.
+//	grpc_server_connections_total [counter] Total number of gRPC server connections opened.
+//	grpc_server_connection_duration_seconds [histogram] Duration of gRPC server connections.
+//	grpc_server_requests_pending{service,method} [gauge] Number of gRPC server requests pending.
+//	grpc_server_requests_pending_max{service,method} [gauge] Highest number of gRPC server requests pending since last reset.
+//	grpc_server_requests_started_total{service,method} [counter] Total number of gRPC server requests started.
+//	grpc_server_requests_total{service,method,code} [counter] Total number of gRPC server requests completed.
+//	grpc_server_latency_seconds{service,method,code} [histogram] Latency of gRPC server requests.
+//	grpc_server_recv_bytes{service,method,frame} [histogram] Bytes received in gRPC server requests.
+//	grpc_server_sent_bytes{service,method,frame} [histogram] Bytes sent in gRPC server responses.
+//	grpc_server_stream_age_seconds{service,method} [histogram] Age of long-lived gRPC server requests in flight.
+//	grpc_server_msgs_sent_total{service,method} [counter] Total number of messages sent in gRPC server responses.
+//	grpc_server_msgs_received_total{service,method} [counter] Total number of messages received in gRPC server requests.
+//	grpc_server_msg_sent_bytes{service,method} [histogram] Uncompressed sizes of messages sent in gRPC server responses.
+//	grpc_server_msg_recv_bytes{service,method} [histogram] Uncompressed sizes of messages received in gRPC server requests.
+//	grpc_server_sent_bytes_total{service,method} [counter] Total number of bytes sent in gRPC server responses.
+//	grpc_server_recv_bytes_total{service,method} [counter] Total number of bytes received in gRPC server requests.
+//	grpc_server_first_response_seconds{service,method} [histogram] Time until the first response message of gRPC server requests.
+//	grpc_server_inter_message_gap_seconds{service,method,direction} [histogram] Time between consecutive messages of gRPC server requests.
+//	grpc_server_subscriber_dropped_total [counter] Total number of RPC summaries dropped by slow subscribers.
+//	grpc_server_slo_events_total{service,method,result} [counter] Total number of gRPC server requests classified by their SLO.
+//	grpc_server_slo_burn_rate{service,method,window} [gauge] Error budget burn rate of gRPC server requests.
+//	grpc_server_error_details_total{service,method,type} [counter] Total number of error details returned to gRPC server requests.
+//	grpc_server_errors_total{service,method,error_type} [counter] Total number of gRPC server requests failed, by the type of their error.
+//	grpc_server_error_ratio{service,method} [gauge] Ratio of failed gRPC server requests over a rolling window.
+//	grpc_server_connection_churn_spikes_total [counter] Total number of spikes of gRPC server connections opened.
+//	grpc_server_deadline_overshoot_total{service,method} [counter] Total number of gRPC server requests handled past the deadline of their client.
+//	grpc_server_deadline_budget_seconds{service,method} [histogram] Time left until the deadline of gRPC server requests as they begin.
+//	grpc_server_requests_no_deadline_total{service,method} [counter] Total number of gRPC server requests begun without a deadline.
+//	grpc_server_unknown_calls_total{service} [counter] Total number of gRPC server calls to unknown services and methods.
+//	grpc_server_processing_seconds{service,method,code} [histogram] Time gRPC server requests take from their first request message to their first response message.
+//	grpc_server_client_cancellations_total{service,method} [counter] Total number of gRPC server requests canceled by their client before they were handled.
+//	grpc_server_streams_per_connection_max [gauge] Highest number of streams open at once on a gRPC server connection since last reset.
+//	grpc_server_connection_streams [histogram] Highest number of streams open at once on gRPC server connections.
+//
+// The following metrics about the instrumentation itself are provided with
+// WithSelfMetrics:
+//
+//	grpcmon_dropped_observations_total{reason} [counter] Total number of observations dropped by grpcmon.
+//	grpcmon_sink_errors_total [counter] Total number of panics recovered from grpcmon hooks and callbacks.
+//	grpcmon_unattributed_events_total [counter] Total number of gRPC events grpcmon could not attribute to an RPC.
+//	grpcmon_label_overflow_total [counter] Total number of RPCs and connections beyond grpcmon tracking limits.
+//
+// With WithConnPeerLabel, WithConnTransportLabel and WithTarget,
+// connections_open, connections_total, connection_duration_seconds and
+// connection_streams have a peer, a transport and a target label
+// respectively.
+//
+// With WithRPCTypeLabel, requests_pending, requests_started_total,
+// requests_total, latency_seconds, msgs_sent_total and msgs_received_total
+// have an additional type label, one of unary, client_stream, server_stream
+// and bidi.
+//
+// With WithFailFastLabel, the requests_total and latency_seconds of clients
+// have an additional fail_fast label, true or false.
+//
+// With WithPeerIdentityLabel, the requests_total and latency_seconds of
+// servers have an additional peer label, the identity of the client.
+//
+// Applications not using go-kit can implement a Collector instead, and
+// instrument with DialOptionCollector and ServerOptionCollector.
 package grpcmon // import "github.com/Bo0mer/grpcmon"
 
 import (
 	"context"
+	"net"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	metrics "github.com/go-kit/kit/metrics"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
 )
@@ -40,144 +123,1110 @@ const (
 // DefaultLatencyBuckets provides convenient default latency histogram buckets.
 var DefaultLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
 
+// DefaultConnDurationBuckets provides convenient default connection duration
+// histogram buckets, from a second to a day.
+var DefaultConnDurationBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 10800, 21600, 86400}
+
+// DefaultConnStreamsBuckets provides convenient default histogram buckets of
+// the number of streams open on connections.
+var DefaultConnStreamsBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
 // DefaultBytesBuckets provides convenient default bytes histogram buckets.
 var DefaultBytesBuckets = []float64{0, 32, 64, 128, 256, 512, 1024, 2048, 8192, 32768, 131072, 524288}
 
 // ClientStatsHandler returns gRPC stats.Handler to be used with gRPC clients.
 // It is to be used when clients want to chain multiple stats.Handler
-// implementations.
-func ClientStatsHandler(metrics *Metrics) stats.Handler {
-	return &handler{client: metrics}
+// implementations, or to embed the Handler in one of their own.
+func ClientStatsHandler(metrics *Metrics, opts ...Option) *Handler {
+	return newHandler(metrics, true, opts)
 }
 
 // ServerStatsHandler returns gRPC stats.Handler to be used with gRPC servers.
 // It is to be used when servers want to chain multiple stats.Handler
-// implementations.
-func ServerStatsHandler(metrics *Metrics) stats.Handler {
-	return &handler{server: metrics}
+// implementations, or to embed the Handler in one of their own.
+func ServerStatsHandler(metrics *Metrics, opts ...Option) *Handler {
+	return newHandler(metrics, false, opts)
 }
 
 // DialOption returns a gRPC DialOption that instruments metrics
 // for the client connection.
-func DialOption(metrics *Metrics) grpc.DialOption {
-	return grpc.WithStatsHandler(&handler{client: metrics})
+func DialOption(metrics *Metrics, opts ...Option) grpc.DialOption {
+	return grpc.WithStatsHandler(ClientStatsHandler(metrics, opts...))
 }
 
 // ServerOption returns a gRPC ServerOption that instruments metrics
 // for the server.
-func ServerOption(metrics *Metrics) grpc.ServerOption {
-	return grpc.StatsHandler(&handler{server: metrics})
+func ServerOption(metrics *Metrics, opts ...Option) grpc.ServerOption {
+	return grpc.StatsHandler(ServerStatsHandler(metrics, opts...))
 }
 
-// Metrics tracks gRPC metrics.
+// Metrics tracks gRPC metrics. Every field is optional; nil fields are not
+// recorded.
 type Metrics struct {
 	_ struct{}
 
-	ConnsOpen   metrics.Gauge
-	ConnsTotal  metrics.Counter
-	ReqsPending metrics.Gauge
+	ConnsOpen  metrics.Gauge
+	ConnsTotal metrics.Counter
+	// ConnDuration observes the duration of connections as they close.
+	ConnDuration metrics.Histogram
+	ReqsPending  metrics.Gauge
+	// ReqsPendingMax is the highest ReqsPending of each method since
+	// Handler.PendingMax last reset it, so that the spikes scrapes of
+	// ReqsPending miss are seen.
+	ReqsPendingMax metrics.Gauge
+	// ReqsStarted counts the requests as they begin, and ReqsTotal as they
+	// complete, so that requests that never complete can be told apart.
+	ReqsStarted metrics.Counter
 	ReqsTotal   metrics.Counter
 	Latency     metrics.Histogram
 	BytesSent   metrics.Histogram
 	BytesRecv   metrics.Histogram
+	// StreamAge is observed periodically with the age of RPCs that are
+	// in flight for longer than a threshold. See WithStreamAge.
+	StreamAge metrics.Histogram
+	// MsgsSent and MsgsRecv count the messages sent and received.
+	MsgsSent metrics.Counter
+	MsgsRecv metrics.Counter
+	// MsgBytesSent and MsgBytesRecv observe the uncompressed sizes of the
+	// messages sent and received, whereas BytesSent and BytesRecv observe
+	// the sizes of the frames on the wire.
+	MsgBytesSent metrics.Histogram
+	MsgBytesRecv metrics.Histogram
+	// BytesSentTotal and BytesRecvTotal count the bytes of the frames sent
+	// and received on the wire, which BytesSent and BytesRecv observe.
+	BytesSentTotal metrics.Counter
+	BytesRecvTotal metrics.Counter
+	// TTFB observes the time from the beginning of RPCs until their first
+	// response message is received by clients or sent by servers, once per
+	// RPC. Unlike Latency, it is meaningful for long-lived streams.
+	TTFB metrics.Histogram
+	// InterMsgGap observes the time between consecutive messages received or
+	// sent by RPCs, by direction, which shows stalled producers of
+	// long-lived streams. The first message of each direction of an RPC
+	// has no gap.
+	InterMsgGap metrics.Histogram
+	// SubscriberDrops counts the summaries dropped because a subscriber of
+	// Handler.Subscribe fell behind.
+	SubscriberDrops metrics.Counter
+	// SLOEvents and SLOBurnRate track service level objectives. See
+	// WithSLOs.
+	SLOEvents   metrics.Counter
+	SLOBurnRate metrics.Gauge
+	// ErrorDetails counts the details attached to the statuses RPCs end
+	// with, by type. See WithErrorDetailTypes.
+	ErrorDetails metrics.Counter
+	// ErrorTypes counts the RPCs that end with an error, by the class of the
+	// error returned by ErrorType, telling the failures of connections
+	// apart from the errors returned by handlers.
+	ErrorTypes metrics.Counter
+	// ErrorRate is the ratio of failed RPCs per method over a rolling
+	// window. See WithErrorRate.
+	ErrorRate metrics.Gauge
+	// DeadlineOvershoots counts the server RPCs handled past the deadline
+	// of their client. See WithDeadlineOvershootHook.
+	DeadlineOvershoots metrics.Counter
+	// DeadlineBudget observes the time left until the deadline of server
+	// RPCs as they begin, and ReqsNoDeadline counts the server RPCs that
+	// begin without a deadline.
+	DeadlineBudget metrics.Histogram
+	ReqsNoDeadline metrics.Counter
+	// UnknownCalls counts the calls to services and methods servers do not
+	// implement. See UnknownServiceHandler.
+	UnknownCalls metrics.Counter
+	// ProcessingTime observes the time server RPCs take from the receipt of
+	// their first request message to the sending of their first response
+	// message, which for unary RPCs is the time spent in the handler,
+	// without the setup of the stream and the transfer of the messages that
+	// Latency includes. RPCs that end without both messages are not
+	// observed.
+	ProcessingTime metrics.Histogram
+	// ClientCancellations counts the server RPCs whose client went away
+	// before they were handled: the ones canceled by the client, or by the
+	// loss of its connection, before the server sent their status, whatever
+	// code the handler returned. RPCs that hit their deadline are not
+	// counted.
+	ClientCancellations metrics.Counter
+	// StreamsPerConnMax is the highest number of streams open at once on a
+	// server connection since Handler.StreamsPerConnMax last reset it, and
+	// ConnStreams observes the highest number of streams open at once on
+	// each server connection as it closes. Client streams are not counted.
+	StreamsPerConnMax metrics.Gauge
+	ConnStreams       metrics.Histogram
+	// ConnChurnSpikes counts the spikes of connections opened. See
+	// WithConnChurn.
+	ConnChurnSpikes metrics.Counter
+	// DialErrors counts the dials of clients that fail, and DialLatency
+	// observes the latency of the ones that succeed. See WithContextDialer.
+	DialErrors  metrics.Counter
+	DialLatency metrics.Histogram
+	// PickLatency observes the time from the beginning of client RPCs until
+	// their headers are sent, once per RPC. It approximates the time spent
+	// waiting for the resolver and balancer to pick a ready connection, and
+	// for it to connect, which grpc-go does not report otherwise.
+	PickLatency metrics.Histogram
+	// Retries counts the attempts of client calls after the first, which
+	// grpc-go makes transparently, or by the retry policy of the service
+	// config, and records like separate RPCs. See WithFinalAttemptOnly.
+	Retries metrics.Counter
 }
 
 var rpcInfoKey = "rpc-tag"
 
+// rpcInfo holds the state of an RPC. It is shared by the events of the RPC,
+// which streams handle concurrently, so fields set after TagRPC are atomic.
+// It is reused once the RPC ends, see rpcContext.
 type rpcInfo struct {
+	// refs counts the references to the rpcInfo: one for the RPC until it
+	// ends and one for each event being handled.
+	refs atomic.Int64
+	// gen is incremented every time the rpcInfo is reused.
+	gen atomic.Uint64
+
+	server string
+	method string
+	// peer is the peer label of server RPCs, if WithPeerIdentityLabel is
+	// set.
+	peer string
+	// begun is set by the Begin event of the RPC.
+	begun atomic.Pointer[rpcBegin]
+
+	// bytesSent and bytesRecv accumulate the wire sizes of the frames of the
+	// RPC.
+	bytesSent atomic.Int64
+	bytesRecv atomic.Int64
+	// msgsSent and msgsRecv count the messages of the RPC.
+	msgsSent atomic.Int64
+	msgsRecv atomic.Int64
+	// ended is set by the first End event of the RPC, after which other
+	// events are not recorded.
+	ended atomic.Bool
+	// responded is set by the first response message of the RPC.
+	responded atomic.Bool
+	// picked is set by the first outgoing header of client RPCs.
+	picked atomic.Bool
+	// trailed is set by the trailer of server RPCs, which grpc-go does not
+	// send once the stream is closed.
+	trailed atomic.Bool
+	// lastRecv and lastSent are the times of the last messages received and
+	// sent, in nanoseconds since the Unix epoch, or zero before the first.
+	lastRecv atomic.Int64
+	lastSent atomic.Int64
+	// firstRecv and firstSent are the times of the first messages received
+	// and sent by server RPCs, in nanoseconds since the Unix epoch, or zero
+	// before the first. They are only set for ProcessingTime.
+	firstRecv atomic.Int64
+	firstSent atomic.Int64
+	// methods holds the metrics last recorded by the RPC.
+	methods atomic.Pointer[methodMetrics]
+
+	override atomic.Pointer[rpcName]
+	// trace holds the events of the RPC while it is captured.
+	trace atomic.Pointer[rpcTrace]
+}
+
+// duration returns the duration of the RPC ended by s, and false if the
+// Begin event of the RPC was not seen.
+func (v *rpcInfo) duration(s *stats.End) (time.Duration, bool) {
+	begin := v.begin().time
+	if begin.IsZero() {
+		return 0, false
+	}
+	if s.EndTime.IsZero() {
+		return time.Since(begin), true
+	}
+	return s.EndTime.Sub(begin), true
+}
+
+// withType returns labels with the type label typ appended if WithRPCTypeLabel
+// is set.
+func (o *options) withType(typ string, labels ...string) []string {
+	if o.typeLabel {
+		labels = append(labels, "type", typ)
+	}
+	return labels
+}
+
+// rpcType returns the type label of an RPC with the given streaming
+// directions.
+func rpcType(clientStream, serverStream bool) string {
+	switch {
+	case clientStream && serverStream:
+		return "bidi"
+	case clientStream:
+		return "client_stream"
+	case serverStream:
+		return "server_stream"
+	default:
+		return "unary"
+	}
+}
+
+// rpcBegin describes an RPC as of its Begin event.
+type rpcBegin struct {
+	time time.Time
+	// deadline is the deadline of server RPCs, if any.
+	deadline time.Time
+	// typ is the type label of the RPC.
+	typ string
+	// failFast is the fail_fast label of client RPCs, if WithFailFastLabel
+	// is set.
+	failFast string
+	// pending is ReqsPending with the labels the RPC started with.
+	pending metrics.Gauge
+	// call is the call of client RPCs, if their attempts are tracked.
+	call *clientCall
+	// cancel watches the context of server RPCs for ClientCancellations.
+	cancel *cancelWatch
+	// conn is the connection of server RPCs, whose streams are counted.
+	conn *connInfo
+}
+
+// begin returns the Begin state of the RPC, which is zero if the Begin event
+// was not seen.
+func (v *rpcInfo) begin() rpcBegin {
+	if b := v.begun.Load(); b != nil {
+		return *b
+	}
+	return rpcBegin{}
+}
+
+type rpcName struct {
 	server string
 	method string
-	begin  time.Time
 }
 
-// handler implements the stats.Handler interface.
-type handler struct {
-	client *Metrics
-	server *Metrics
+// names returns the service and method names to record metrics under.
+func (v *rpcInfo) names() (server, method string) {
+	if n := v.override.Load(); n != nil {
+		return n.server, n.method
+	}
+	return v.server, v.method
+}
+
+// OverrideMethod overrides the service and method names recorded for the RPC
+// associated with ctx. It is meant to be used by interceptors that dispatch
+// generic methods to concrete handlers, so that metrics reflect the logical
+// method.
+//
+// The override applies to all metrics recorded after the call, with the
+// exception of those that keep the names the RPC started with so that the
+// RPCs counted in flight are the ones that end: ReqsPending and
+// ReqsPendingMax, the counts of Handler.InFlight and Handler.PendingMax and
+// the calls of WithPendingWatchdog, as well as ReqsStarted, Retries and
+// DeadlineBudget, which are recorded as the RPC begins. A Collector sees the
+// beginning of the RPC under the names it started with too. The last call
+// wins. Calls with a context that is not associated with an instrumented RPC,
+// such as client interceptors that run before the RPC is started, have no
+// effect.
+func OverrideMethod(ctx context.Context, service, method string) {
+	// Every handler that tagged the RPC records the override.
+	for {
+		c, ok := ctx.Value(&rpcInfoKey).(*rpcContext)
+		if !ok {
+			return
+		}
+		if v := c.acquire(); v != nil {
+			v.override.Store(&rpcName{server: service, method: method})
+			v.release()
+		}
+		ctx = c.Context
+	}
+}
+
+// Handler is a gRPC stats.Handler that records metrics. Besides being passed
+// to gRPC, it gives access to what it observes about RPCs.
+//
+// A Handler may be embedded in a stats.Handler of another type that
+// overrides some of its methods, for example TagRPC to start a trace span,
+// as long as the overrides call the methods of the Handler. The context
+// returned by Handler.TagRPC may be wrapped in further contexts, and the one
+// passed to it may already carry the values of other handlers, including
+// other Handlers: each Handler only sees the RPCs it tagged itself.
+type Handler struct {
+	// isClient tells the side the handler records. client and server are
+	// never nil; the metrics of the other side are empty.
+	isClient bool
+	client   *Metrics
+	server   *Metrics
+	opts     options
+
+	clientMethods *methodCache
+	serverMethods *methodCache
+
+	inflight *inflight
+	slow     *slowRPCHook
+	subs     subscribers
+	rolling  *rolling
+	pending  *pendingCounts
+	slo      *sloTracker
+	anomaly  *anomalyDetector
+
+	errorRates *errorRates
+	red        *redLogger
+	watchdog   *pendingWatchdog
+	churn      *churnDetector
+	calls      *clientCalls
+	streams    *connStreams
+
+	// capturing is the capture in progress, and captured the last one.
+	capturing atomic.Pointer[capture]
+	captured  atomic.Pointer[capture]
+
+	detailTypes map[string]bool
+
+	// payloads counts the payload events seen with WithPayloadSampling.
+	payloads atomic.Uint64
+
+	// clientSkip and serverSkip are the kinds of events nothing is recorded
+	// for.
+	clientSkip eventKinds
+	serverSkip eventKinds
+}
+
+// newHandler returns a handler recording m for the given side. A nil m records
+// nothing, as do the metrics of the other side, so that neither is nil.
+func newHandler(m *Metrics, client bool, opts []Option) *Handler {
+	if m == nil {
+		m = new(Metrics)
+	}
+	h := &Handler{isClient: client, client: new(Metrics), server: new(Metrics), pending: &pendingCounts{}}
+	for _, opt := range opts {
+		opt(&h.opts)
+	}
+	// The Metrics of a MetricsCollector are recorded along with m, rather
+	// than through the methods of the Collector.
+	if c, ok := h.opts.collector.(metricsCollector); ok {
+		m = teeMetrics(m, c.m)
+		h.opts.collector = nil
+	}
+	if client {
+		h.client = m
+	} else {
+		h.server = m
+	}
+	if labels := h.opts.constLabels; len(labels) > 0 {
+		h.client = withLabels(h.client, labels)
+		h.server = withLabels(h.server, labels)
+		h.opts.self = withLabels(h.opts.self, labels)
+	}
+	h.clientMethods = &methodCache{m: h.client, opts: &h.opts}
+	h.serverMethods = &methodCache{m: h.server, opts: &h.opts}
+	if h.opts.streamAgeInterval > 0 || h.opts.inflightRegistry {
+		h.inflight = newInflight(h.opts.streamAgeThreshold, h.opts.streamAgeInterval, h.opts.inUnit)
+	}
+	if h.opts.rollingSlots > 0 && h.opts.rollingWidth > 0 {
+		h.rolling = newRolling(h.opts.rollingSlots, h.opts.rollingWidth)
+		h.rolling.self = h.opts.self
+	}
+	if h.opts.watchdogFn != nil {
+		cooldown := h.opts.watchdogCooldown
+		if cooldown <= 0 {
+			cooldown = defaultWatchdogCooldown
+		}
+		h.watchdog = &pendingWatchdog{
+			limit:    int64(h.opts.watchdogLimit),
+			methods:  h.opts.watchdogMethods,
+			cooldown: cooldown,
+			fn:       h.opts.watchdogFn,
+			now:      time.Now,
+			self:     h.opts.self,
+		}
+	}
+	if client && (h.client.Retries != nil || h.opts.finalAttemptOnly) {
+		h.calls = &clientCalls{calls: make(map[<-chan struct{}]*clientCall)}
+	}
+	if !client {
+		h.streams = newConnStreams()
+	}
+	if h.opts.failure == nil {
+		h.opts.failure = func(code codes.Code) bool { return code != codes.OK }
+	}
+	types := h.opts.detailTypes
+	if types == nil {
+		types = DefaultErrorDetailTypes
+	}
+	h.detailTypes = make(map[string]bool, len(types))
+	for _, t := range types {
+		h.detailTypes[t] = true
+	}
+	if cfg := h.opts.anomalies; cfg != nil && cfg.Short > 0 && cfg.Callback != nil {
+		h.anomaly = newAnomalyDetector(*cfg)
+		h.anomaly.self = h.opts.self
+		h.anomaly.rolling.self = h.opts.self
+	}
+	if h.opts.errorRateWindow > 0 {
+		h.errorRates = newErrorRates(h.opts.errorRateWindow)
+		h.errorRates.self = h.opts.self
+	}
+	if cfg := h.opts.churn; cfg != nil && cfg.Interval > 0 {
+		h.churn = newChurnDetector(*cfg)
+		h.churn.self = h.opts.self
+	}
+	if h.opts.redLogger != nil && h.opts.redInterval > 0 {
+		h.red = newREDLogger(h.opts.redLogger, h.opts.redInterval, client)
+		h.red.self = h.opts.self
+	}
+	if len(h.opts.objectives) > 0 {
+		h.slo = newSLOTracker(h.opts.objectives)
+		h.slo.self = h.opts.self
+	}
+	if h.opts.slowRPCHook != nil {
+		h.slow = &slowRPCHook{
+			threshold: h.opts.slowRPCThreshold,
+			methods:   h.opts.slowRPCMethods,
+			fn:        h.opts.slowRPCHook,
+			self:      h.opts.self,
+		}
+	}
+	h.clientSkip = h.skippable(h.client, true)
+	h.serverSkip = h.skippable(h.server, false)
+	return h
 }
 
 // TagRPC implements the stats.Handler interface.
-func (*handler) TagRPC(ctx context.Context, v *stats.RPCTagInfo) context.Context {
-	server, method := splitFullMethodName(v.FullMethodName)
-	return context.WithValue(ctx, &rpcInfoKey, &rpcInfo{
-		server: server,
-		method: method,
-	})
+func (h *Handler) TagRPC(ctx context.Context, v *stats.RPCTagInfo) context.Context {
+	return h.TagRPCFunc(ctx, v, nil, nil)
 }
 
-func splitFullMethodName(s string) (server, method string) {
+// TagRPCFunc is like TagRPC, but first calls start, if not nil, with ctx and
+// the service and method names of the RPC, and tags the RPC with the context
+// start returns instead. At the end of the RPC, end is called, if not nil,
+// with the tag start returned, the names the RPC is recorded under and its
+// End event. It is meant for handlers embedding a Handler that start
+// something along with every RPC, such as a trace span, without parsing the
+// method name again or holding it in a context value of their own. Unlike
+// the WithOnRPCEnd hooks, end does not make the Handler handle the events it
+// records nothing for. Neither is called for the RPCs excluded by
+// WithFilter.
+func (h *Handler) TagRPCFunc(ctx context.Context, v *stats.RPCTagInfo, start func(ctx context.Context, service, method string) (context.Context, interface{}), end func(tag interface{}, service, method string, s *stats.End)) context.Context {
+	server, method := ParseFullMethod(v.FullMethodName)
+	if h.opts.filter != nil && !h.opts.filter(server, method) {
+		return &rpcContext{Context: ctx, handler: h}
+	}
+	var tag interface{}
+	if start != nil {
+		ctx, tag = start(ctx, server, method)
+	}
+	var identity string
+	if h.opts.peerIdentity != nil && !h.isClient {
+		identity = h.opts.peerIdentityLabel(ctx)
+	}
+	c := h.newRPCContext(ctx, server, method, identity)
+	c.tag, c.end = tag, end
+	return c
+}
+
+// ParseFullMethod splits a full method name in the format
+// /package.service/method into its service and method parts, as recorded in
+// the service and method labels. Malformed names are reported as "unknown".
+// Since method names come from the network, both parts are sanitized to be
+// valid UTF-8 of bounded length.
+func ParseFullMethod(s string) (service, method string) {
 	s = strings.TrimPrefix(s, "/")
 	i := strings.Index(s, "/")
-	if i < 0 {
+	if i <= 0 || i == len(s)-1 {
 		return "unknown", "unknown"
 	}
-	return s[:i], s[i+1:]
+	return sanitizeLabelValue(s[:i]), sanitizeLabelValue(s[i+1:])
 }
 
 // HandleRPC implements the stats.Handler interface.
-func (h *handler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
-	v, ok := ctx.Value(&rpcInfoKey).(*rpcInfo)
+func (h *Handler) HandleRPC(ctx context.Context, stat stats.RPCStats) {
+	if h.skips(stat) {
+		return
+	}
+	c, ok := h.rpcContext(ctx)
 	if !ok {
+		h.opts.self.unattributed()
+		h.untagged(stat)
 		return
 	}
-	m := h.server
+	if c.filtered() {
+		return
+	}
+	v := c.acquire()
+	if v == nil {
+		// The RPC ended already.
+		h.opts.self.unattributed()
+		return
+	}
+	defer v.release()
+	if _, ok := stat.(*stats.End); ok {
+		if !v.ended.CompareAndSwap(false, true) {
+			// Only the first End event is recorded.
+			h.opts.self.unattributed()
+			return
+		}
+		// Drop the reference of the RPC once the End event is handled.
+		defer v.release()
+	}
+	m, mc := h.server, h.serverMethods
 	if stat.IsClient() {
-		m = h.client
+		m, mc = h.client, h.clientMethods
+	}
+	server, method := v.names()
+	if c := h.capturing.Load(); c != nil {
+		c.record(v, rpcName{server: server, method: method}, stat)
 	}
 	switch s := stat.(type) {
 	case *stats.Begin:
-		v.begin = s.BeginTime
-		m.ReqsPending.With("service", v.server, "method", v.method).Add(1)
+		b := &rpcBegin{time: s.BeginTime, typ: rpcType(s.IsClientStream, s.IsServerStream)}
+		if !s.Client {
+			b.deadline, _ = ctx.Deadline()
+			if m.ClientCancellations != nil {
+				b.cancel = watchCancel(ctx, b.deadline)
+			}
+			if h.streams != nil {
+				b.conn = h.openStream(ctx, m)
+			}
+		} else if h.opts.failFastLabel {
+			b.failFast = strconv.FormatBool(s.FailFast)
+		}
+		if s.Client && h.calls != nil {
+			var retry bool
+			b.call, retry = h.calls.begin(ctx)
+			if retry && m.Retries != nil {
+				m.Retries.With("service", v.server, "method", v.method).Add(1)
+			}
+		}
+		mm := mc.forRPC(v, v.server, v.method, *b)
+		b.pending = mm.reqsPending
+		v.begun.Store(b)
+		if !s.Client {
+			h.deadlineBudget(mm, b.deadline, s.BeginTime)
+		}
+		if b.pending != nil {
+			b.pending.Add(1)
+		}
+		if mm.reqsStarted != nil {
+			mm.reqsStarted.Add(1)
+		}
+		if c := h.opts.collector; c != nil {
+			c.RPCBegin(RPCLabels{Service: v.server, Method: v.method, Type: b.typ})
+		}
+		name := rpcName{server: v.server, method: v.method}
+		n, raised := h.pending.add(name, 1)
+		if raised && mm.reqsPendingMax != nil {
+			mm.reqsPendingMax.Set(float64(n))
+		}
+		if h.watchdog != nil {
+			h.watchdog.check(name, n)
+		}
+		if h.inflight != nil {
+			e := inflightRPC{client: s.Client}
+			if h.opts.streamAgeInterval > 0 && m.StreamAge != nil {
+				e.m = m
+			}
+			if h.opts.inflightRegistry {
+				if p, ok := peer.FromContext(ctx); ok {
+					e.peer = p.Addr
+				}
+				e.deadline, _ = ctx.Deadline()
+			}
+			if e.m != nil || h.opts.inflightRegistry {
+				h.inflight.add(v, e)
+			}
+		}
 	case *stats.End:
-		code := status.Code(s.Error).String()
-		if m.Latency != nil {
-			m.Latency.With("service", v.server, "method", v.method, "code", code).Observe(time.Since(v.begin).Seconds())
+		if h.inflight != nil {
+			h.inflight.remove(v)
+		}
+		// The code is looked up once, and its name only by the hooks.
+		code := status.Code(s.Error)
+		b := v.begin()
+		d, timed := v.duration(s)
+		cm := mc.withCode(mc.forRPC(v, server, method, b), code)
+		if h.opts.finalAttemptOnly && b.call != nil && (cm.reqsTotal != nil || cm.latency != nil) {
+			h.calls.end(b.call, func() { h.recordEnd(cm, d, timed) })
+		} else {
+			h.recordEnd(cm, d, timed)
+		}
+		if c := h.opts.collector; c != nil {
+			var latency time.Duration
+			if timed {
+				latency = d
+			}
+			c.RPCEnd(RPCLabels{Service: server, Method: method, Type: b.typ}, h.opts.codeLabel(code), latency)
+		}
+		if m.ErrorDetails != nil && s.Error != nil {
+			for _, t := range errorDetailTypes(s.Error, h.detailTypes) {
+				m.ErrorDetails.With("service", server, "method", method, "type", t).Add(1)
+			}
+		}
+		if m.ErrorTypes != nil && s.Error != nil {
+			m.ErrorTypes.With("service", server, "method", method, "error_type", ErrorType(s.Error)).Add(1)
+		}
+		if !s.Client && m.ProcessingTime != nil {
+			h.processingTime(m, v, server, method, code)
+		}
+		if b.cancel != nil && !v.trailed.Load() && b.cancel.canceled(ctx, b.deadline) {
+			m.ClientCancellations.With("service", server, "method", method).Add(1)
+		}
+		closeStream(b.conn)
+		// RPCs whose Begin was not seen were never counted as pending.
+		if v.begun.Load() != nil {
+			if b.pending != nil {
+				b.pending.Add(-1)
+			}
+			h.pending.add(rpcName{server: v.server, method: v.method}, -1)
+		}
+		failed := h.opts.failure(code)
+		if h.rolling != nil && timed {
+			h.rolling.observe(rpcName{server: server, method: method}, d, failed)
+		}
+		if h.slo != nil && timed {
+			h.slo.observe(m, rpcName{server: server, method: method}, d, failed)
+		}
+		if h.errorRates != nil {
+			rate, ok := h.errorRates.observe(rpcName{server: server, method: method}, failed)
+			if ok && m.ErrorRate != nil {
+				m.ErrorRate.With("service", server, "method", method).Set(rate)
+			}
+		}
+		if h.anomaly != nil && timed {
+			h.anomaly.observe(rpcName{server: server, method: method}, d)
+		}
+		if h.red != nil && timed {
+			h.red.observe(server, d, failed, v.bytesSent.Load(), v.bytesRecv.Load())
+		}
+		if !b.deadline.IsZero() {
+			if end := b.time.Add(d); end.After(b.deadline) {
+				if m.DeadlineOvershoots != nil {
+					m.DeadlineOvershoots.With("service", server, "method", method).Add(1)
+				}
+				if h.opts.deadlineOvershootHook != nil {
+					h.opts.deadlineOvershootHook(ctx, DeadlineOvershoot{
+						Service:   server,
+						Method:    method,
+						Code:      code.String(),
+						Budget:    b.deadline.Sub(b.time),
+						Duration:  d,
+						Overshoot: end.Sub(b.deadline),
+					})
+				}
+			}
+		}
+		if h.slow != nil && timed && d > h.slow.thresholdFor(server, method) {
+			info := SlowRPC{
+				Client:    s.Client,
+				Service:   server,
+				Method:    method,
+				Code:      code.String(),
+				Duration:  d,
+				BytesSent: v.bytesSent.Load(),
+				BytesRecv: v.bytesRecv.Load(),
+			}
+			if p, ok := peer.FromContext(ctx); ok {
+				info.Peer = p.Addr
+			}
+			h.slow.enqueue(info)
+		}
+		if len(h.opts.onRPCEnd) > 0 || h.subs.active() {
+			sum := RPCSummary{
+				Client:    s.Client,
+				Service:   server,
+				Method:    method,
+				Code:      code.String(),
+				Err:       s.Error,
+				BeginTime: s.BeginTime,
+				EndTime:   s.EndTime,
+				MsgsSent:  v.msgsSent.Load(),
+				MsgsRecv:  v.msgsRecv.Load(),
+				BytesSent: v.bytesSent.Load(),
+				BytesRecv: v.bytesRecv.Load(),
+			}
+			for _, fn := range h.opts.onRPCEnd {
+				fn(ctx, sum)
+			}
+			h.subs.publish(sum, m, h.opts.self)
+		}
+		if c.end != nil {
+			c.end(c.tag, server, method, s)
 		}
-		m.ReqsTotal.With("service", v.server, "method", v.method, "code", code).Add(1)
-		m.ReqsPending.With("service", v.server, "method", v.method).Add(-1)
 	case *stats.InHeader:
-		if m.BytesRecv != nil {
-			m.BytesRecv.With("service", v.server, "method", v.method, "frame", header).Observe(float64(s.WireLength))
+		mm := mc.forRPC(v, server, method, v.begin())
+		n := headerLength(s.WireLength, s.Header)
+		v.bytesRecv.Add(int64(n))
+		h.collect(v, server, method, Inbound, header, n)
+		if mm.bytesRecv.header != nil && n > 0 {
+			mm.bytesRecv.header.Observe(float64(n))
+		}
+		if mm.bytesRecvTotal != nil {
+			mm.bytesRecvTotal.Add(float64(n))
 		}
 	case *stats.InPayload:
-		if m.BytesRecv != nil {
-			m.BytesRecv.With("service", v.server, "method", v.method, "frame", payload).Observe(float64(s.WireLength))
+		mm := mc.forRPC(v, server, method, v.begin())
+		v.msgsRecv.Add(1)
+		if mm.msgsRecv != nil {
+			mm.msgsRecv.Add(1)
+		}
+		if s.Client {
+			h.firstResponse(v, mm, s.RecvTime)
+		} else if m.ProcessingTime != nil {
+			firstMessage(&v.firstRecv, s.RecvTime)
+		}
+		h.interMsgGap(mm.gapRecv, &v.lastRecv, s.RecvTime)
+		v.bytesRecv.Add(int64(s.WireLength))
+		h.collect(v, server, method, Inbound, payload, s.WireLength)
+		if mm.bytesRecvTotal != nil {
+			mm.bytesRecvTotal.Add(float64(s.WireLength))
+		}
+		if h.samplePayload() {
+			if mm.bytesRecv.payload != nil {
+				mm.bytesRecv.payload.Observe(float64(s.WireLength))
+			}
+			if mm.msgBytesRecv != nil {
+				mm.msgBytesRecv.Observe(float64(s.Length))
+			}
 		}
 	case *stats.InTrailer:
-		if m.BytesRecv != nil {
-			m.BytesRecv.With("service", v.server, "method", v.method, "frame", trailer).Observe(float64(s.WireLength))
+		mm := mc.forRPC(v, server, method, v.begin())
+		n := headerLength(s.WireLength, s.Trailer)
+		v.bytesRecv.Add(int64(n))
+		h.collect(v, server, method, Inbound, trailer, n)
+		if mm.bytesRecv.trailer != nil && n > 0 {
+			mm.bytesRecv.trailer.Observe(float64(n))
+		}
+		if mm.bytesRecvTotal != nil {
+			mm.bytesRecvTotal.Add(float64(n))
 		}
 	case *stats.OutHeader:
-		if m.BytesSent != nil {
-			m.BytesSent.With("service", v.server, "method", v.method, "frame", header).Observe(0) // TODO ???
+		mm := mc.forRPC(v, server, method, v.begin())
+		if s.Client {
+			h.pickLatency(v, mm)
+		}
+		// Outgoing headers have no wire length.
+		n := headerLength(0, s.Header)
+		v.bytesSent.Add(int64(n))
+		h.collect(v, server, method, Outbound, header, n)
+		if mm.bytesSent.header != nil && n > 0 {
+			mm.bytesSent.header.Observe(float64(n))
+		}
+		if mm.bytesSentTotal != nil {
+			mm.bytesSentTotal.Add(float64(n))
 		}
 	case *stats.OutPayload:
-		if m.BytesSent != nil {
-			m.BytesSent.With("service", v.server, "method", v.method, "frame", payload).Observe(float64(s.WireLength))
+		mm := mc.forRPC(v, server, method, v.begin())
+		v.msgsSent.Add(1)
+		if mm.msgsSent != nil {
+			mm.msgsSent.Add(1)
+		}
+		if !s.Client {
+			h.firstResponse(v, mm, s.SentTime)
+			if m.ProcessingTime != nil {
+				firstMessage(&v.firstSent, s.SentTime)
+			}
+		}
+		h.interMsgGap(mm.gapSent, &v.lastSent, s.SentTime)
+		v.bytesSent.Add(int64(s.WireLength))
+		h.collect(v, server, method, Outbound, payload, s.WireLength)
+		if mm.bytesSentTotal != nil {
+			mm.bytesSentTotal.Add(float64(s.WireLength))
+		}
+		if h.samplePayload() {
+			if mm.bytesSent.payload != nil {
+				mm.bytesSent.payload.Observe(float64(s.WireLength))
+			}
+			if mm.msgBytesSent != nil {
+				mm.msgBytesSent.Observe(float64(s.Length))
+			}
 		}
 	case *stats.OutTrailer:
-		if m.BytesSent != nil {
-			m.BytesSent.With("service", v.server, "method", v.method, "frame", trailer).Observe(float64(s.WireLength))
+		mm := mc.forRPC(v, server, method, v.begin())
+		v.trailed.Store(true)
+		// Releases of grpc-go no longer populate the wire length of outgoing
+		// trailers, which is deprecated.
+		n := headerLength(s.WireLength, s.Trailer)
+		v.bytesSent.Add(int64(n))
+		h.collect(v, server, method, Outbound, trailer, n)
+		if mm.bytesSent.trailer != nil && n > 0 {
+			mm.bytesSent.trailer.Observe(float64(n))
+		}
+		if mm.bytesSentTotal != nil {
+			mm.bytesSentTotal.Add(float64(n))
+		}
+	}
+}
+
+// untagged records the Begin and End events of an RPC whose context was not
+// tagged by h, as happens when an interceptor or transport replaces it, under
+// the unknown service and method, so that the request totals stay correct.
+// The type, fail_fast and peer labels are unknown too, since the End event
+// does not tell them.
+func (h *Handler) untagged(stat stats.RPCStats) {
+	if h.opts.filter != nil && !h.opts.filter("unknown", "unknown") {
+		return
+	}
+	mc := h.serverMethods
+	k := methodKey{server: "unknown", method: "unknown"}
+	if h.opts.typeLabel {
+		k.typ = "unknown"
+	}
+	if stat.IsClient() {
+		mc = h.clientMethods
+		if h.opts.failFastLabel {
+			k.failFast = "unknown"
+		}
+	} else if h.opts.peerIdentity != nil {
+		k.peer = "unknown"
+	}
+	l := RPCLabels{Service: k.server, Method: k.method}
+	switch s := stat.(type) {
+	case *stats.Begin:
+		mm := mc.get(k)
+		if mm.reqsPending != nil {
+			mm.reqsPending.Add(1)
+		}
+		if mm.reqsStarted != nil {
+			mm.reqsStarted.Add(1)
+		}
+		if c := h.opts.collector; c != nil {
+			c.RPCBegin(l)
+		}
+	case *stats.End:
+		mm := mc.get(k)
+		if mm.reqsPending != nil {
+			mm.reqsPending.Add(-1)
+		}
+		cm := mc.withCode(mm, status.Code(s.Error))
+		if cm.reqsTotal != nil {
+			cm.reqsTotal.Add(1)
+		}
+		var d time.Duration
+		if !s.BeginTime.IsZero() && !s.EndTime.IsZero() {
+			d = s.EndTime.Sub(s.BeginTime)
+			if cm.latency != nil {
+				cm.latency.Observe(h.opts.inUnit(d))
+			}
+		}
+		if c := h.opts.collector; c != nil {
+			c.RPCEnd(l, h.opts.codeLabel(status.Code(s.Error)), d)
 		}
 	}
 }
 
+// deadlineBudget records the budget of a server RPC with the given deadline
+// that began at t.
+func (h *Handler) deadlineBudget(mm *methodMetrics, deadline, t time.Time) {
+	if deadline.IsZero() {
+		if mm.reqsNoDeadline != nil {
+			mm.reqsNoDeadline.Add(1)
+		}
+		return
+	}
+	if mm.deadlineBudget != nil {
+		if t.IsZero() {
+			t = time.Now()
+		}
+		mm.deadlineBudget.Observe(h.opts.inUnit(deadline.Sub(t)))
+	}
+}
+
+// firstResponse observes TTFB if the response message received or sent at t
+// is the first of the RPC v.
+func (h *Handler) firstResponse(v *rpcInfo, mm *methodMetrics, t time.Time) {
+	if mm.ttfb == nil || !v.responded.CompareAndSwap(false, true) {
+		return
+	}
+	begin := v.begin().time
+	if begin.IsZero() {
+		return
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	mm.ttfb.Observe(h.opts.inUnit(t.Sub(begin)))
+}
+
+// interMsgGap observes the gap between the message received or sent at t and
+// the previous one in the same direction, whose time is stored in last, with
+// gap. Messages without a time, and the ones handled out of order, are not
+// observed.
+func (h *Handler) interMsgGap(gap metrics.Histogram, last *atomic.Int64, t time.Time) {
+	if gap == nil || t.IsZero() {
+		return
+	}
+	now := t.UnixNano()
+	if prev := last.Swap(now); prev != 0 && now >= prev {
+		gap.Observe(h.opts.inUnit(time.Duration(now - prev)))
+	}
+}
+
+// firstMessage sets first to t, the time of a message, unless it is set
+// already.
+func firstMessage(first *atomic.Int64, t time.Time) {
+	if t.IsZero() || first.Load() != 0 {
+		return
+	}
+	first.CompareAndSwap(0, t.UnixNano())
+}
+
+// processingTime records the ProcessingTime of the server RPC v, which ended
+// with code.
+func (h *Handler) processingTime(m *Metrics, v *rpcInfo, server, method string, code codes.Code) {
+	recv, sent := v.firstRecv.Load(), v.firstSent.Load()
+	if recv == 0 || sent == 0 || sent < recv {
+		return
+	}
+	d := time.Duration(sent - recv)
+	m.ProcessingTime.With("service", server, "method", method, "code", h.opts.codeLabel(code)).Observe(h.opts.inUnit(d))
+}
+
+// pickLatency observes PickLatency if the outgoing header being handled is
+// the first of the client RPC v. Header events have no timestamp, so the
+// time they are handled is used.
+func (h *Handler) pickLatency(v *rpcInfo, mm *methodMetrics) {
+	if mm.pickLatency == nil || !v.picked.CompareAndSwap(false, true) {
+		return
+	}
+	if begin := v.begin().time; !begin.IsZero() {
+		mm.pickLatency.Observe(h.opts.inUnit(time.Since(begin)))
+	}
+}
+
+// samplePayload reports whether the byte histograms observe the payload
+// event being handled. See WithPayloadSampling.
+func (h *Handler) samplePayload() bool {
+	n := h.opts.payloadSampling
+	return n <= 1 || h.payloads.Add(1)%uint64(n) == 0
+}
+
+// headerLength returns wireLength if it is known, or an approximation of the
+// size of md otherwise. Some transports and grpc-go releases report a zero
+// wire length for headers and trailers that did cross the wire, and frames
+// of zero length are not observed since nothing is known about them. The
+// approximation is the sum of the lengths of all keys and values and ignores
+// any encoding overhead.
+func headerLength(wireLength int, md metadata.MD) int {
+	if wireLength > 0 {
+		return wireLength
+	}
+	n := 0
+	for k, vs := range md {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+// connInfo holds the information about a connection needed when handling its
+// stats.
+type connInfo struct {
+	// host is the remote host, which is only set when the churn detector
+	// counts hosts.
+	host string
+	// labels are the label names and values of the connection metrics.
+	labels []string
+	// begun is the time of the ConnBegin event of the connection.
+	begun atomic.Pointer[time.Time]
+	// streams is the number of streams open on server connections, and
+	// streamsMax the highest one.
+	streams    atomic.Int64
+	streamsMax atomic.Int64
+}
+
+// connInfoKey is the context key of the connInfo of the connections tagged by
+// a handler. Keys differ by handler, so that stacked handlers each find their
+// own connInfo.
+type connInfoKey struct {
+	h *Handler
+}
+
 // TagConn implements the stats.Handler interface.
-func (h *handler) TagConn(ctx context.Context, v *stats.ConnTagInfo) context.Context {
-	return ctx
+func (h *Handler) TagConn(ctx context.Context, v *stats.ConnTagInfo) context.Context {
+	info := new(connInfo)
+	if h.churn != nil && h.churn.peers != nil {
+		info.host = remoteHost(v.RemoteAddr)
+	}
+	if h.opts.connPeerLabel != nil {
+		info.labels = append(info.labels, "peer", sanitizeLabelValue(h.opts.connPeerLabel(v.RemoteAddr)))
+	}
+	if h.opts.connTransportLabel {
+		info.labels = append(info.labels, "transport", transport(v.LocalAddr))
+	}
+	if h.opts.connTarget != "" {
+		info.labels = append(info.labels, "target", h.opts.connTarget)
+	}
+	return context.WithValue(ctx, connInfoKey{h}, info)
+}
+
+// transport returns the network of addr, such as tcp or unix.
+func transport(addr net.Addr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	return sanitizeLabelValue(addr.Network())
 }
 
 // HandleConn implements the stats.Handler interface.
-func (h *handler) HandleConn(ctx context.Context, stat stats.ConnStats) {
+func (h *Handler) HandleConn(ctx context.Context, stat stats.ConnStats) {
 	m := h.server
 	if stat.IsClient() {
 		m = h.client
 	}
+	info := h.connInfo(ctx)
+	if info == nil {
+		info = new(connInfo)
+	}
+	connsOpen, connsTotal := m.ConnsOpen, m.ConnsTotal
+	if len(info.labels) > 0 {
+		if connsOpen != nil {
+			connsOpen = connsOpen.With(info.labels...)
+		}
+		if connsTotal != nil {
+			connsTotal = connsTotal.With(info.labels...)
+		}
+	}
 	switch stat.(type) {
 	case *stats.ConnBegin:
-		m.ConnsOpen.Add(1)
-		m.ConnsTotal.Add(1)
+		now := time.Now()
+		info.begun.Store(&now)
+		if connsOpen != nil {
+			connsOpen.Add(1)
+		}
+		if connsTotal != nil {
+			connsTotal.Add(1)
+		}
+		if !stat.IsClient() && h.streams != nil {
+			h.streams.add(info)
+		}
+		if c := h.opts.collector; c != nil {
+			c.ConnOpen()
+		}
+		if h.churn != nil {
+			if info, ok := h.churn.observe(info.host); ok {
+				info.Client = stat.IsClient()
+				if m.ConnChurnSpikes != nil {
+					m.ConnChurnSpikes.Add(1)
+				}
+				if h.churn.cfg.Callback != nil {
+					h.churn.notify(info)
+				}
+			}
+		}
 	case *stats.ConnEnd:
-		m.ConnsOpen.Add(-1)
+		// Connections that began before the handler was attached were not
+		// counted as open, so they are not counted as closed either.
+		begun := info.begun.Swap(nil)
+		if begun == nil {
+			h.opts.self.unattributed()
+			return
+		}
+		if connsOpen != nil {
+			connsOpen.Add(-1)
+		}
+		if c := h.opts.collector; c != nil {
+			c.ConnClose()
+		}
+		if m.ConnDuration != nil {
+			m.ConnDuration.With(info.labels...).Observe(h.opts.inUnit(time.Since(*begun)))
+		}
+		if !stat.IsClient() && h.streams != nil {
+			h.streams.remove(info)
+			if m.ConnStreams != nil {
+				m.ConnStreams.With(info.labels...).Observe(float64(info.streamsMax.Load()))
+			}
+		}
 	}
 }
@@ -0,0 +1,1815 @@
+package grpcmon_test
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/internal/statsshape"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+type frontend struct{}
+
+func (*frontend) Query(context.Context, *pb.QueryRequest) (*pb.QueryResponse, error) {
+	return &pb.QueryResponse{}, nil
+}
+
+func TestOverrideMethod(t *testing.T) {
+	h := grpcmontest.NewHarness(t, grpcmontest.ServerOptions(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			grpcmon.OverrideMethod(ctx, "frontend.Logical", "Rewritten")
+			return handler(ctx, req)
+		}),
+	))
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+
+	if _, err := pb.NewFrontendClient(h.Conn()).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	rec := h.ServerRecorder
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, "service", "frontend.Logical", "method", "Rewritten", "code", "OK"); got != 1 {
+		t.Errorf("requests total for overridden method = %v, want 1", got)
+	}
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, "service", "frontend.Frontend", "method", "Query", "code", "OK"); got != 0 {
+		t.Errorf("requests total for original method = %v, want 0", got)
+	}
+	if got := rec.HistogramCount(grpcmontest.Latency, "service", "frontend.Logical", "method", "Rewritten", "code", "OK"); got != 1 {
+		t.Errorf("latency observations for overridden method = %d, want 1", got)
+	}
+	if got := rec.GaugeValue(grpcmontest.ReqsPending, "service", "frontend.Frontend", "method", "Query"); got != 0 {
+		t.Errorf("requests pending for original method = %v, want 0", got)
+	}
+}
+
+func TestOverrideMethodWithoutRPC(t *testing.T) {
+	// Must not panic.
+	grpcmon.OverrideMethod(context.Background(), "svc", "method")
+}
+
+func TestTagRPCFunc(t *testing.T) {
+	type key struct{}
+	var ended []string
+	start := func(ctx context.Context, service, method string) (context.Context, interface{}) {
+		return context.WithValue(ctx, key{}, service+"/"+method), "tag"
+	}
+	end := func(tag interface{}, service, method string, s *stats.End) {
+		ended = append(ended, fmt.Sprintf("%v %s/%s %v", tag, service, method, status.Code(s.Error)))
+	}
+	m, _ := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithFilter(func(service, _ string) bool {
+		return service != "grpcmontest.Filtered"
+	}))
+	for _, fullMethod := range []string{grpcmontest.Method, "/grpcmontest.Filtered/Method"} {
+		ctx := h.TagRPCFunc(context.Background(), &stats.RPCTagInfo{FullMethodName: fullMethod}, start, end)
+		if fullMethod == grpcmontest.Method && ctx.Value(key{}) != "grpcmontest.Test/Method" {
+			t.Errorf("tagged context value = %v, want the names of the RPC", ctx.Value(key{}))
+		}
+		grpcmon.OverrideMethod(ctx, "grpcmontest.Logical", "Rewritten")
+		for _, ev := range grpcmontest.UnaryError(false, codes.NotFound).RPCs[0].Events {
+			h.HandleRPC(ctx, ev)
+		}
+	}
+	want := []string{"tag grpcmontest.Logical/Rewritten NotFound"}
+	if !reflect.DeepEqual(ended, want) {
+		t.Errorf("ended %q, want %q", ended, want)
+	}
+}
+
+func TestInHeaderLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		client bool
+		header *stats.InHeader
+		want   []float64
+	}{
+		{
+			name:   "server wire length",
+			header: &stats.InHeader{WireLength: 42, Header: metadata.Pairs("key", "value")},
+			want:   []float64{42},
+		},
+		{
+			name:   "server zero wire length",
+			header: &stats.InHeader{Header: metadata.Pairs("key", "value", "k", "v")},
+			want:   []float64{10},
+		},
+		{
+			name:   "server nothing known",
+			header: &stats.InHeader{},
+			want:   nil,
+		},
+		{
+			name:   "client wire length",
+			client: true,
+			header: &stats.InHeader{Client: true, WireLength: 42},
+			want:   []float64{42},
+		},
+		{
+			name:   "client zero wire length",
+			client: true,
+			header: &stats.InHeader{Client: true, Header: metadata.Pairs("key", "value")},
+			want:   []float64{8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, rec := grpcmontest.NewRecorder()
+			h := grpcmon.ServerStatsHandler(m)
+			if tt.client {
+				h = grpcmon.ClientStatsHandler(m)
+			}
+			ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/svc/Method"})
+			h.HandleRPC(ctx, tt.header)
+
+			got := rec.Observations(grpcmontest.BytesRecv, "service", "svc", "method", "Method", "frame", "header")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("header observations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type blockingFrontend struct {
+	release chan struct{}
+}
+
+func (f *blockingFrontend) Query(ctx context.Context, _ *pb.QueryRequest) (*pb.QueryResponse, error) {
+	<-f.release
+	return &pb.QueryResponse{}, nil
+}
+
+func TestStreamAge(t *testing.T) {
+	h := grpcmontest.NewHarness(t, grpcmontest.MonitorOptions(grpcmon.WithStreamAge(20*time.Millisecond, 5*time.Millisecond)))
+	fe := &blockingFrontend{release: make(chan struct{})}
+	pb.RegisterFrontendServer(h.Server, fe)
+	conn := h.Conn()
+	rec := h.ServerRecorder
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{})
+		done <- err
+	}()
+
+	ages := func() []float64 {
+		return rec.Observations(grpcmontest.StreamAge, "service", "frontend.Frontend", "method", "Query")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ages()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for stream age observations")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(fe.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	observed := ages()
+	for i, age := range observed {
+		if age < 0.02 {
+			t.Errorf("age %d = %v, want >= threshold", i, age)
+		}
+		if i > 0 && age < observed[i-1] {
+			t.Errorf("age %d = %v, want >= previous %v", i, age, observed[i-1])
+		}
+	}
+	if got := rec.HistogramCount(grpcmontest.Latency, "service", "frontend.Frontend", "method", "Query", "code", "OK"); got != 1 {
+		t.Errorf("latency observations = %d, want 1", got)
+	}
+
+	// No more observations are made once the RPC has ended.
+	n := len(ages())
+	time.Sleep(20 * time.Millisecond)
+	if got := len(ages()); got != n {
+		t.Errorf("stream age observations after end = %d, want %d", got, n)
+	}
+}
+
+func TestUnary(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	registerTestService(h.Server, &testService{})
+
+	var out wrapperspb.BytesValue
+	if err := h.Conn().Invoke(context.Background(), "/test.Test/Unary", wrapperspb.Bytes([]byte("hello")), &out); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	for _, rec := range []*grpcmontest.Recorder{h.ClientRecorder, h.ServerRecorder} {
+		labels := map[string]string{"service": "test.Test", "method": "Unary"}
+		rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"method": "Unary", "code": "OK"}, 1)
+		rec.AssertHistogramCount(t, grpcmontest.Latency, map[string]string{"method": "Unary", "code": "OK"}, 1)
+		rec.AssertHistogramCount(t, grpcmontest.BytesSent, map[string]string{"method": "Unary", "frame": "payload"}, 1)
+		rec.AssertHistogramCount(t, grpcmontest.BytesRecv, map[string]string{"method": "Unary", "frame": "payload"}, 1)
+		if got := rec.GaugeValue(grpcmontest.ReqsPending, "service", "test.Test", "method", "Unary"); got != 0 {
+			t.Errorf("requests pending %v = %v, want 0", labels, got)
+		}
+		if got := rec.CounterValue(grpcmontest.ConnsTotal); got != 1 {
+			t.Errorf("connections total = %v, want 1", got)
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	const n = 5
+	h := grpcmontest.NewHarness(t)
+	registerTestService(h.Server, &testService{})
+
+	stream, err := newStream(context.Background(), h.Conn(), "Bidi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := stream.SendMsg(wrapperspb.Bytes([]byte("ping"))); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.RecvMsg(new(wrapperspb.BytesValue)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.RecvMsg(new(wrapperspb.BytesValue)); err != io.EOF {
+		t.Fatalf("got %v, want EOF", err)
+	}
+	h.Stop()
+
+	for _, rec := range []*grpcmontest.Recorder{h.ClientRecorder, h.ServerRecorder} {
+		rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"method": "Bidi", "code": "OK"}, 1)
+		rec.AssertHistogramCount(t, grpcmontest.Latency, map[string]string{"method": "Bidi", "code": "OK"}, 1)
+		rec.AssertHistogramCount(t, grpcmontest.BytesSent, map[string]string{"method": "Bidi", "frame": "payload"}, n)
+		rec.AssertHistogramCount(t, grpcmontest.BytesRecv, map[string]string{"method": "Bidi", "frame": "payload"}, n)
+	}
+}
+
+func TestError(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	registerTestService(h.Server, &testService{err: status.Error(codes.NotFound, "not found")})
+
+	err := h.Conn().Invoke(context.Background(), "/test.Test/Unary", wrapperspb.Bytes(nil), new(wrapperspb.BytesValue))
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound", err)
+	}
+	h.Stop()
+
+	for _, rec := range []*grpcmontest.Recorder{h.ClientRecorder, h.ServerRecorder} {
+		rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"method": "Unary", "code": "NotFound"}, 1)
+		rec.AssertHistogramCount(t, grpcmontest.Latency, map[string]string{"method": "Unary", "code": "NotFound"}, 1)
+		rec.AssertNoObservations(t, grpcmontest.Latency, map[string]string{"code": "OK"})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	srv := &testService{block: make(chan struct{}), started: make(chan struct{}, 1)}
+	registerTestService(h.Server, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := newStream(ctx, h.Conn(), "ServerStream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(wrapperspb.Bytes([]byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	<-srv.started
+	cancel()
+	if err := stream.RecvMsg(new(wrapperspb.BytesValue)); status.Code(err) != codes.Canceled {
+		t.Fatalf("got %v, want Canceled", err)
+	}
+	h.Stop()
+
+	for _, rec := range []*grpcmontest.Recorder{h.ClientRecorder, h.ServerRecorder} {
+		rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"method": "ServerStream", "code": "Canceled"}, 1)
+		if got := rec.GaugeValue(grpcmontest.ReqsPending, "service", "test.Test", "method", "ServerStream"); got != 0 {
+			t.Errorf("requests pending = %v, want 0", got)
+		}
+	}
+}
+
+// forEachShape calls fn with seq converted to each supported shape of stats
+// events.
+func forEachShape(seq grpcmontest.Sequence, fn func(grpcmontest.Sequence)) {
+	for _, shape := range statsshape.All {
+		fn(shape.Sequence(seq))
+	}
+}
+
+func TestReplaySequences(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		for _, seq := range []grpcmontest.Sequence{
+			grpcmontest.UnaryOK(client),
+			grpcmontest.UnaryError(client, codes.Unavailable),
+			grpcmontest.ServerStream(client, 3),
+			grpcmontest.ClientStream(client, 3),
+			grpcmontest.BidiStream(client, 3),
+			grpcmontest.ClientCancel(client),
+		} {
+			forEachShape(seq, func(seq grpcmontest.Sequence) {
+				t.Run(fmt.Sprintf("%s client=%v", seq.Name, client), func(t *testing.T) {
+					m, rec := grpcmontest.NewRecorder()
+					h := grpcmon.ServerStatsHandler(m)
+					if client {
+						h = grpcmon.ClientStatsHandler(m)
+					}
+					grpcmontest.Replay(h, seq)
+
+					rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"service": "grpcmontest.Test", "method": "Method"}, 1)
+					rec.AssertHistogramCount(t, grpcmontest.Latency, map[string]string{"service": "grpcmontest.Test", "method": "Method"}, 1)
+					if got := rec.GaugeValue(grpcmontest.ReqsPending, "service", "grpcmontest.Test", "method", "Method"); got != 0 {
+						t.Errorf("requests pending = %v, want 0", got)
+					}
+					if got := rec.GaugeValue(grpcmontest.ConnsOpen); got != 0 {
+						t.Errorf("connections open = %v, want 0", got)
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestReplayMalformedSequences(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		for _, seq := range []grpcmontest.Sequence{
+			grpcmontest.MissingBegin(client),
+			grpcmontest.DuplicateEnd(client),
+		} {
+			forEachShape(seq, func(seq grpcmontest.Sequence) {
+				m, rec := grpcmontest.NewRecorder()
+				h := grpcmon.ServerStatsHandler(m)
+				if client {
+					h = grpcmon.ClientStatsHandler(m)
+				}
+				// Must not panic.
+				grpcmontest.Replay(h, seq)
+				// Nor leave the RPC pending, or count it ended more than it
+				// started.
+				if got := rec.GaugeValue(grpcmontest.ReqsPending, "service", "grpcmontest.Test", "method", "Method"); got != 0 {
+					t.Errorf("%s client=%v: requests pending = %v, want 0", seq.Name, client, got)
+				}
+				if got := h.InFlight("grpcmontest.Test", "Method"); got != 0 {
+					t.Errorf("%s client=%v: InFlight = %v, want 0", seq.Name, client, got)
+				}
+				if got := h.InFlightTotal(); got != 0 {
+					t.Errorf("%s client=%v: InFlightTotal = %v, want 0", seq.Name, client, got)
+				}
+			})
+		}
+	}
+}
+
+func TestShapesAgree(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		for _, seq := range grpcmontest.Sequences(client) {
+			t.Run(fmt.Sprintf("%s client=%v", seq.Name, client), func(t *testing.T) {
+				series := make(map[string]string)
+				for _, shape := range statsshape.All {
+					m, rec := grpcmontest.NewRecorder()
+					h := grpcmon.ServerStatsHandler(m)
+					if client {
+						h = grpcmon.ClientStatsHandler(m)
+					}
+					grpcmontest.Replay(h, shape.Sequence(seq))
+					series[shape.Name] = rec.String()
+				}
+				want := series[statsshape.Current.Name]
+				for name, got := range series {
+					if got != want {
+						t.Errorf("series of shape %s differ from the current ones:\n%s\nwant:\n%s", name, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestShapesTrailerBytes(t *testing.T) {
+	// The trailer size the current releases no longer report is estimated
+	// from the trailer metadata, as the legacy releases computed it.
+	labels := []string{"service", "grpcmontest.Test", "method", "Method", "frame", "trailer"}
+	var want []float64
+	for _, shape := range statsshape.All {
+		m, rec := grpcmontest.NewRecorder()
+		grpcmontest.Replay(grpcmon.ServerStatsHandler(m), shape.Sequence(grpcmontest.UnaryOK(false)))
+		got := rec.Observations(grpcmontest.BytesSent, labels...)
+		if len(got) != 1 || got[0] == 0 {
+			t.Errorf("%s: trailer bytes sent = %v, want one non-zero observation", shape.Name, got)
+		}
+		if want == nil {
+			want = got
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: trailer bytes sent = %v, want %v", shape.Name, got, want)
+		}
+	}
+}
+
+func TestShapesTypeLabel(t *testing.T) {
+	// Legacy releases do not report the stream type in Begin, so their RPCs
+	// are all taken to be unary.
+	for _, tt := range []struct {
+		shape statsshape.Shape
+		want  string
+	}{
+		{statsshape.Current, "server_stream"},
+		{statsshape.Legacy, "unary"},
+	} {
+		m, rec := grpcmontest.NewRecorder()
+		grpcmontest.Replay(grpcmon.ServerStatsHandler(m, grpcmon.WithRPCTypeLabel()), tt.shape.Sequence(grpcmontest.ServerStream(false, 3)))
+		labels := []string{"service", "grpcmontest.Test", "method", "Method", "type", tt.want}
+		if got := rec.CounterValue(grpcmontest.MsgsSent, labels...); got != 3 {
+			t.Errorf("%s: messages sent of type %s = %v, want 3", tt.shape.Name, tt.want, got)
+		}
+		if got := rec.CounterValue(grpcmontest.ReqsTotal, append(labels, "code", "OK")...); got != 1 {
+			t.Errorf("%s: requests of type %s = %v, want 1", tt.shape.Name, tt.want, got)
+		}
+	}
+}
+
+var seed = flag.Int64("grpcmon.seed", 0, "seed of TestRandomInterleavings, random if zero")
+
+func TestRandomInterleavings(t *testing.T) {
+	s := *seed
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	t.Logf("seed %d, reproduce with -grpcmon.seed=%d", s, s)
+	rnd := rand.New(rand.NewSource(s))
+
+	const iterations, conns, rpcs = 20, 4, 50
+	for i := 0; i < iterations; i++ {
+		for _, client := range []bool{false, true} {
+			m, rec := grpcmontest.NewRecorder()
+			h := grpcmon.ServerStatsHandler(m, grpcmon.WithStreamAge(0, time.Millisecond))
+			if client {
+				h = grpcmon.ClientStatsHandler(m, grpcmon.WithStreamAge(0, time.Millisecond))
+			}
+			grpcmontest.ReplayConcurrent(h, grpcmontest.RandomSequences(rnd, client, conns, rpcs))
+
+			rec.AssertGauges(t, grpcmontest.ReqsPending, nil, 0)
+			rec.AssertGauges(t, grpcmontest.ConnsOpen, nil, 0)
+			rec.AssertCounterDelta(t, grpcmontest.ConnsTotal, nil, conns)
+			rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, nil, rpcs)
+			rec.AssertHistogramCount(t, grpcmontest.Latency, nil, rpcs)
+			for _, name := range []string{grpcmontest.Latency, grpcmontest.BytesSent, grpcmontest.BytesRecv, grpcmontest.StreamAge} {
+				rec.AssertNoNegativeObservations(t, name, nil)
+			}
+			if t.Failed() {
+				t.Fatalf("iteration %d client=%v failed", i, client)
+			}
+		}
+	}
+}
+
+func TestSlowRPCHook(t *testing.T) {
+	slow := make(chan grpcmon.SlowRPC, 10)
+	m, _ := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m,
+		grpcmon.WithSlowRPCHook(time.Millisecond, func(info grpcmon.SlowRPC) {
+			slow <- info
+			panic("must be recovered")
+		}),
+		grpcmon.WithSlowRPCThreshold("grpcmontest.Test", "Fast", time.Hour),
+	)
+
+	fast := grpcmontest.UnaryOK(false)
+	fast.RPCs[0].FullMethodName = "/grpcmontest.Test/Fast"
+	grpcmontest.Replay(h, fast)
+	grpcmontest.Replay(h, grpcmontest.UnaryError(false, codes.Unavailable))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+
+	for _, want := range []grpcmon.SlowRPC{
+		{Service: "grpcmontest.Test", Method: "Method", Code: "Unavailable", Duration: 2 * time.Millisecond, BytesRecv: 40 + 15, BytesSent: 12},
+		{Service: "grpcmontest.Test", Method: "Method", Code: "OK", Duration: 3 * time.Millisecond, BytesRecv: 40 + 15, BytesSent: 28 + 25 + 12},
+	} {
+		select {
+		case got := <-slow:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("hook not called")
+		}
+	}
+	select {
+	case got := <-slow:
+		t.Errorf("unexpected slow RPC %+v", got)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestOnRPCEnd(t *testing.T) {
+	var got []grpcmon.RPCSummary
+	m, _ := grpcmontest.NewRecorder()
+	h := grpcmon.ClientStatsHandler(m, grpcmon.WithOnRPCEnd(func(_ context.Context, s grpcmon.RPCSummary) {
+		got = append(got, s)
+	}))
+	grpcmontest.Replay(h, grpcmontest.ServerStream(true, 3))
+	grpcmontest.Replay(h, grpcmontest.DuplicateEnd(true))
+
+	if len(got) != 2 {
+		t.Fatalf("got %d summaries, want 2", len(got))
+	}
+	want := grpcmon.RPCSummary{
+		Client:    true,
+		Service:   "grpcmontest.Test",
+		Method:    "Method",
+		Code:      "OK",
+		BeginTime: grpcmontest.Epoch,
+		EndTime:   grpcmontest.Epoch.Add(5 * time.Millisecond),
+		MsgsSent:  1,
+		MsgsRecv:  3,
+		BytesSent: 21 + 15,
+		BytesRecv: 20 + 3*25 + 15,
+	}
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("got %+v, want %+v", got[0], want)
+	}
+	if d := got[0].Duration(); d != 5*time.Millisecond {
+		t.Errorf("duration = %v, want 5ms", d)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	for _, tc := range []struct {
+		policy grpcmon.DropPolicy
+		want   []string
+	}{
+		{grpcmon.DropNewest, []string{"Unavailable", "NotFound"}},
+		{grpcmon.DropOldest, []string{"NotFound", "Internal"}},
+	} {
+		m, rec := grpcmontest.NewRecorder()
+		h := grpcmon.ServerStatsHandler(m, grpcmon.WithDropPolicy(tc.policy))
+		ch, cancel := h.Subscribe(2)
+		other, cancelOther := h.Subscribe(3)
+		for _, code := range []codes.Code{codes.Unavailable, codes.NotFound, codes.Internal} {
+			grpcmontest.Replay(h, grpcmontest.UnaryError(false, code))
+		}
+		cancel()
+		cancel()
+
+		var got []string
+		for s := range ch {
+			got = append(got, s.Code)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("policy %v: got %q, want %q", tc.policy, got, tc.want)
+		}
+		if got := len(other); got != 3 {
+			t.Errorf("policy %v: other subscriber got %d summaries, want 3", tc.policy, got)
+		}
+		if got := rec.CounterValue(grpcmontest.SubscriberDrops); got != 1 {
+			t.Errorf("policy %v: drops = %v, want 1", tc.policy, got)
+		}
+
+		cancelOther()
+		grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+		if got := rec.CounterValue(grpcmontest.SubscriberDrops); got != 1 {
+			t.Errorf("policy %v: drops after cancel = %v, want 1", tc.policy, got)
+		}
+	}
+}
+
+func TestSLOs(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m,
+		grpcmon.WithSLOs(
+			grpcmon.Objective{Service: "grpcmontest.Test", Target: 0.9},
+			grpcmon.Objective{Service: "grpcmontest.Test", Method: "Slow", Target: 0.5, Latency: time.Millisecond},
+		),
+		grpcmon.WithFailure(func(code codes.Code) bool { return code != codes.OK && code != codes.NotFound }),
+	)
+	for i := 0; i < 7; i++ {
+		grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	}
+	grpcmontest.Replay(h, grpcmontest.UnaryError(false, codes.NotFound))
+	grpcmontest.Replay(h, grpcmontest.UnaryError(false, codes.Unavailable))
+	grpcmontest.Replay(h, grpcmontest.UnaryError(false, codes.Internal))
+	// The canned unary RPC takes 3ms, which exceeds the latency objective.
+	slow := grpcmontest.UnaryOK(false)
+	slow.RPCs[0].FullMethodName = "/grpcmontest.Test/Slow"
+	grpcmontest.Replay(h, slow)
+	other := grpcmontest.UnaryError(false, codes.Internal)
+	other.RPCs[0].FullMethodName = "/other.Other/Method"
+	grpcmontest.Replay(h, other)
+
+	for _, tc := range []struct {
+		method    string
+		good, bad float64
+		burn      float64
+	}{
+		{"Method", 8, 2, 2},
+		{"Slow", 0, 1, 2},
+	} {
+		if got := rec.CounterValue(grpcmontest.SLOEvents, "service", "grpcmontest.Test", "method", tc.method, "result", "good"); got != tc.good {
+			t.Errorf("%s: good = %v, want %v", tc.method, got, tc.good)
+		}
+		if got := rec.CounterValue(grpcmontest.SLOEvents, "service", "grpcmontest.Test", "method", tc.method, "result", "bad"); got != tc.bad {
+			t.Errorf("%s: bad = %v, want %v", tc.method, got, tc.bad)
+		}
+		for _, window := range []string{"5m", "1h", "6h"} {
+			if got := rec.GaugeValue(grpcmontest.SLOBurnRate, "service", "grpcmontest.Test", "method", tc.method, "window", window); math.Abs(got-tc.burn) > 1e-9 {
+				t.Errorf("%s: burn rate over %s = %v, want %v", tc.method, window, got, tc.burn)
+			}
+		}
+	}
+	if got := rec.CounterValue(grpcmontest.SLOEvents, "service", "other.Other", "method", "Method", "result", "bad"); got != 0 {
+		t.Errorf("method without objective counted %v bad events", got)
+	}
+}
+
+func TestErrorDetails(t *testing.T) {
+	st, err := status.New(codes.ResourceExhausted, "slow down").WithDetails(
+		&errdetails.RetryInfo{},
+		&errdetails.QuotaFailure{},
+		wrapperspb.String("custom"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := grpcmontest.UnaryOK(false)
+	end := seq.RPCs[0].Events[len(seq.RPCs[0].Events)-1].(*stats.End)
+	end.Error = st.Err()
+
+	for _, tc := range []struct {
+		opts []grpcmon.Option
+		want map[string]float64
+	}{
+		{nil, map[string]float64{"google.rpc.RetryInfo": 1, "google.rpc.QuotaFailure": 1, "other": 1}},
+		{[]grpcmon.Option{grpcmon.WithErrorDetailTypes("google.protobuf.StringValue")}, map[string]float64{"google.protobuf.StringValue": 1, "other": 2}},
+	} {
+		m, rec := grpcmontest.NewRecorder()
+		h := grpcmon.ServerStatsHandler(m, tc.opts...)
+		grpcmontest.Replay(h, seq)
+		grpcmontest.Replay(h, grpcmontest.UnaryError(false, codes.Internal))
+		for typ, want := range tc.want {
+			if got := rec.CounterValue(grpcmontest.ErrorDetails, "service", "grpcmontest.Test", "method", "Method", "type", typ); got != want {
+				t.Errorf("%s = %v, want %v", typ, got, want)
+			}
+		}
+		rec.AssertCounterDelta(t, grpcmontest.ErrorDetails, nil, 3)
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithErrorRate(time.Minute))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	grpcmontest.Replay(h, grpcmontest.UnaryError(false, codes.Unavailable))
+	rec.AssertGauges(t, grpcmontest.ErrorRate, map[string]string{"service": "grpcmontest.Test", "method": "Method"}, 0.5)
+	if got := h.ErrorRate("grpcmontest.Test", "Method"); got != 0.5 {
+		t.Errorf("ErrorRate = %v, want 0.5", got)
+	}
+}
+
+// deadlineContext is a context with a deadline that is never done.
+type deadlineContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c deadlineContext) Deadline() (time.Time, bool) { return c.deadline, true }
+
+// withDeadline tags the RPCs handled by h with the given deadline.
+type withDeadline struct {
+	stats.Handler
+	deadline time.Time
+}
+
+func (h withDeadline) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return h.Handler.TagRPC(deadlineContext{ctx, h.deadline}, info)
+}
+
+func TestDeadlineOvershoot(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	var got []grpcmon.DeadlineOvershoot
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithDeadlineOvershootHook(func(_ context.Context, info grpcmon.DeadlineOvershoot) {
+		got = append(got, info)
+	}))
+	grpcmontest.Replay(withDeadline{h, grpcmontest.Epoch.Add(time.Millisecond)}, grpcmontest.UnaryOK(false))
+	grpcmontest.Replay(withDeadline{h, grpcmontest.Epoch.Add(time.Hour)}, grpcmontest.UnaryOK(false))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+
+	rec.AssertCounterDelta(t, grpcmontest.DeadlineOvershoots, map[string]string{"service": "grpcmontest.Test", "method": "Method"}, 1)
+	if len(got) != 1 {
+		t.Fatalf("hook called %d times, want 1", len(got))
+	}
+	if info := got[0]; info.Code != "OK" || info.Budget != time.Millisecond || info.Duration != 3*time.Millisecond || info.Overshoot != 2*time.Millisecond {
+		t.Errorf("info = %+v", info)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	m, _ := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m)
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: time.Now()})
+	if got := h.InFlight("grpcmontest.Test", "Method"); got != 2 {
+		t.Errorf("InFlight = %d, want 2", got)
+	}
+	if got := h.InFlight("grpcmontest.Test", "Other"); got != 0 {
+		t.Errorf("InFlight of another method = %d, want 0", got)
+	}
+	h.HandleRPC(ctx, &stats.End{EndTime: time.Now()})
+	if got := h.InFlightTotal(); got != 1 {
+		t.Errorf("InFlightTotal = %d, want 1", got)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	m, _ := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m)
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	if got := h.Captured(); got != nil {
+		t.Fatalf("captured %d RPCs without Capture", len(got))
+	}
+
+	h.Capture("grpcmontest.Test", "Method", 2)
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	grpcmontest.Replay(h, grpcmontest.UnaryError(false, codes.Internal))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	h.Capture("", "", 0)
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+
+	got := h.Captured()
+	if len(got) != 2 {
+		t.Fatalf("captured %d RPCs, want 2", len(got))
+	}
+	if got[0].Code != "Internal" || got[1].Code != "OK" {
+		t.Errorf("codes = %s, %s, want Internal, OK", got[0].Code, got[1].Code)
+	}
+	var types []string
+	for _, ev := range got[1].Events {
+		types = append(types, fmt.Sprintf("%s:%d", ev.Type, ev.WireLength))
+	}
+	want := "Begin:0 InHeader:40 InPayload:15 OutHeader:0 OutPayload:25 OutTrailer:0 End:0"
+	if s := strings.Join(types, " "); s != want {
+		t.Errorf("events = %s, want %s", s, want)
+	}
+
+	w := httptest.NewRecorder()
+	grpcmon.CaptureHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/?format=json", nil))
+	var decoded []grpcmon.CapturedRPC
+	if err := json.NewDecoder(w.Body).Decode(&decoded); err != nil || len(decoded) != 2 {
+		t.Errorf("decoded %d RPCs, err = %v", len(decoded), err)
+	}
+	w = httptest.NewRecorder()
+	grpcmon.CaptureHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "<td>OutPayload</td><td>25</td>") {
+		t.Errorf("missing event in:\n%s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	grpcmon.CaptureHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/?service=grpcmontest.Test&method=Method&n=1", nil))
+	if !strings.Contains(w.Body.String(), "Nothing captured") {
+		t.Errorf("new capture not started:\n%s", w.Body.String())
+	}
+}
+
+func TestInFlightRPCs(t *testing.T) {
+	m, _ := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithInFlightRegistry())
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+	ctx = deadlineContext{ctx, time.Now().Add(time.Hour)}
+	old := h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/pkg.Svc/Old"})
+	h.HandleRPC(old, &stats.Begin{BeginTime: time.Now().Add(-time.Minute)})
+	recent := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Svc/Recent"})
+	h.HandleRPC(recent, &stats.Begin{BeginTime: time.Now()})
+	done := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: "/pkg.Svc/Done"})
+	h.HandleRPC(done, &stats.Begin{BeginTime: time.Now()})
+	h.HandleRPC(done, &stats.End{EndTime: time.Now()})
+
+	rpcs := h.InFlightRPCs()
+	if len(rpcs) != 2 || rpcs[0].Method != "Old" || rpcs[1].Method != "Recent" {
+		t.Fatalf("in flight = %+v, want Old and Recent", rpcs)
+	}
+	if rpcs[0].Age < time.Minute || rpcs[0].Peer != "10.0.0.1:1234" || rpcs[0].DeadlineRemaining <= 0 {
+		t.Errorf("Old = %+v", rpcs[0])
+	}
+	if rpcs[1].Peer != "" || rpcs[1].DeadlineRemaining != 0 {
+		t.Errorf("Recent = %+v", rpcs[1])
+	}
+
+	w := httptest.NewRecorder()
+	grpcmon.InFlightHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[1], "10.0.0.1:1234") || strings.Join(strings.Fields(lines[2])[4:], " ") != "- -" {
+		t.Errorf("unexpected table:\n%s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	grpcmon.InFlightHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/?format=json", nil))
+	var decoded []grpcmon.InFlightRPC
+	if err := json.NewDecoder(w.Body).Decode(&decoded); err != nil || len(decoded) != 2 {
+		t.Errorf("decoded %d RPCs, err = %v", len(decoded), err)
+	}
+
+	if got := grpcmon.ServerStatsHandler(m).InFlightRPCs(); got != nil {
+		t.Errorf("InFlightRPCs without registry = %+v", got)
+	}
+}
+
+func TestConnChurn(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	reports := make(chan grpcmon.ConnChurn, 1)
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithConnChurn(grpcmon.ChurnConfig{
+		Interval:  time.Hour,
+		Threshold: 2,
+		TopPeers:  1,
+		Callback:  func(info grpcmon.ConnChurn) { reports <- info },
+	}))
+	for i := 0; i < 3; i++ {
+		grpcmontest.Replay(h, grpcmontest.Sequence{})
+	}
+	rec.AssertCounterDelta(t, grpcmontest.ConnChurnSpikes, nil, 1)
+	info := <-reports
+	if info.Opened != 3 || len(info.TopPeers) != 1 || info.TopPeers[0] != (grpcmon.PeerConns{Host: "10.0.0.1", Conns: 3}) {
+		t.Errorf("report = %+v", info)
+	}
+}
+
+func TestSelfMetrics(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	done := make(chan struct{})
+	h := grpcmon.ServerStatsHandler(m,
+		grpcmon.WithSelfMetrics(rec.SelfMetrics()),
+		grpcmon.WithSlowRPCHook(0, func(grpcmon.SlowRPC) {
+			defer close(done)
+			panic("boom")
+		}),
+	)
+	_, cancel := h.Subscribe(0)
+	defer cancel()
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	h.HandleRPC(context.Background(), &stats.End{})
+	<-done
+
+	rec.AssertCounterDelta(t, grpcmontest.DroppedObservations, map[string]string{"reason": grpcmon.DropSubscriber}, 1)
+	rec.AssertCounterDelta(t, grpcmontest.UnattributedEvents, nil, 1)
+	for deadline := time.Now().Add(5 * time.Second); rec.CounterValue(grpcmontest.SinkErrors) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	rec.AssertCounterDelta(t, grpcmontest.SinkErrors, nil, 1)
+}
+
+func TestOutHeaderBytes(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		m, rec := grpcmontest.NewRecorder()
+		h := grpcmon.ServerStatsHandler(m)
+		if client {
+			h = grpcmon.ClientStatsHandler(m)
+		}
+		grpcmontest.Replay(h, grpcmontest.UnaryOK(client))
+		obs := rec.Observations(grpcmontest.BytesSent, "service", "grpcmontest.Test", "method", "Method", "frame", "header")
+		if len(obs) != 1 || obs[0] <= 0 {
+			t.Errorf("client=%v: header bytes sent = %v, want one positive observation", client, obs)
+		}
+	}
+}
+
+func TestOptionalMetrics(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		seqs := grpcmontest.Sequences(client)
+		newHandler := grpcmon.ServerStatsHandler
+		if client {
+			newHandler = grpcmon.ClientStatsHandler
+		}
+		for _, seq := range seqs {
+			grpcmontest.Replay(newHandler(&grpcmon.Metrics{}), seq)
+		}
+
+		all, _ := grpcmontest.NewRecorder()
+		fields := reflect.ValueOf(all).Elem()
+		for i := 0; i < fields.NumField(); i++ {
+			f := fields.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			full, rec := grpcmontest.NewRecorder()
+			m := &grpcmon.Metrics{}
+			reflect.ValueOf(m).Elem().Field(i).Set(reflect.ValueOf(full).Elem().Field(i))
+			h := newHandler(m)
+			for _, seq := range seqs {
+				grpcmontest.Replay(h, seq)
+			}
+			switch f.Name {
+			case "ConnsOpen", "ConnsTotal", "ReqsPending", "ReqsTotal", "Latency", "BytesSent", "BytesRecv":
+				if rec.String() == "" {
+					t.Errorf("client=%v: %s only: nothing recorded", client, f.Name)
+				}
+			}
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		h := grpcmon.ServerStatsHandler(nil)
+		if client {
+			h = grpcmon.ClientStatsHandler(nil)
+		}
+		// The subscriber falls behind, so that drops are counted.
+		_, cancel := h.Subscribe(1)
+		for _, seq := range grpcmontest.Sequences(client) {
+			grpcmontest.Replay(h, seq)
+		}
+		cancel()
+		h.PendingMax()
+		h.StreamsPerConnMax()
+	}
+
+	invoker := func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+	if err := grpcmon.UnaryClientInterceptor(nil)(context.Background(), "/s/m", nil, nil, nil, invoker); status.Code(err) != codes.Unavailable {
+		t.Errorf("unary client interceptor error = %v, want Unavailable", err)
+	}
+	handler := func(context.Context, interface{}) (interface{}, error) { return nil, nil }
+	if _, err := grpcmon.UnaryServerInterceptor(nil)(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/s/m"}, handler); err != nil {
+		t.Errorf("unary server interceptor error = %v", err)
+	}
+}
+
+func TestInitializeMetrics(t *testing.T) {
+	srv := grpc.NewServer()
+	pb.RegisterFrontendServer(srv, &frontend{})
+	m, rec := grpcmontest.NewRecorder()
+	grpcmon.InitializeMetrics(srv, m)
+	grpcmon.InitializeMetrics(srv, m)
+
+	method := map[string]string{"service": "frontend.Frontend", "method": "Query"}
+	rec.AssertGauges(t, grpcmontest.ReqsPending, method, 0)
+	rec.AssertCounterDelta(t, grpcmontest.ReqsStarted, method, 0)
+	for _, code := range []string{"OK", "Unavailable", "Unauthenticated"} {
+		rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"service": "frontend.Frontend", "method": "Query", "code": code}, 0)
+	}
+	if got := strings.Count(rec.String(), "\n"); got != 19 {
+		t.Errorf("initialized %d series, want 19:\n%s", got, rec.String())
+	}
+}
+
+func TestMessageCounts(t *testing.T) {
+	const n = 5
+	for _, client := range []bool{false, true} {
+		m, rec := grpcmontest.NewRecorder()
+		h := grpcmon.ServerStatsHandler(m)
+		if client {
+			h = grpcmon.ClientStatsHandler(m)
+		}
+		grpcmontest.Replay(h, grpcmontest.BidiStream(client, n))
+
+		for _, name := range []string{grpcmontest.MsgsSent, grpcmontest.MsgsRecv} {
+			if got := rec.CounterValue(name, "service", "grpcmontest.Test", "method", "Method"); got != n {
+				t.Errorf("client=%v: %s = %v, want %d", client, name, got, n)
+			}
+		}
+	}
+}
+
+func TestRPCTypeLabel(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		for _, tc := range []struct {
+			seq  grpcmontest.Sequence
+			want string
+		}{
+			{grpcmontest.UnaryOK(client), "unary"},
+			{grpcmontest.ClientStream(client, 3), "client_stream"},
+			{grpcmontest.ServerStream(client, 3), "server_stream"},
+			{grpcmontest.BidiStream(client, 3), "bidi"},
+		} {
+			m, rec := grpcmontest.NewRecorder()
+			h := grpcmon.ServerStatsHandler(m, grpcmon.WithRPCTypeLabel())
+			if client {
+				h = grpcmon.ClientStatsHandler(m, grpcmon.WithRPCTypeLabel())
+			}
+			grpcmontest.Replay(h, tc.seq)
+
+			labels := map[string]string{"service": "grpcmontest.Test", "method": "Method", "code": "OK", "type": tc.want}
+			rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, labels, 1)
+			rec.AssertHistogramCount(t, grpcmontest.Latency, labels, 1)
+		}
+	}
+
+	m, rec := grpcmontest.NewRecorder()
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m), grpcmontest.BidiStream(false, 1))
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, "service", "grpcmontest.Test", "method", "Method", "code", "OK"); got != 1 {
+		t.Errorf("requests without type label = %v, want 1", got)
+	}
+}
+
+func TestInitializeMetricsRPCTypeLabel(t *testing.T) {
+	srv := grpc.NewServer()
+	pb.RegisterFrontendServer(srv, &frontend{})
+	m, rec := grpcmontest.NewRecorder()
+	grpcmon.InitializeMetrics(srv, m, grpcmon.WithRPCTypeLabel())
+
+	rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"service": "frontend.Frontend", "method": "Query", "code": "OK", "type": "unary"}, 0)
+}
+
+func TestFilter(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		m, rec := grpcmontest.NewRecorder()
+		self := rec.SelfMetrics()
+		opts := []grpcmon.Option{grpcmon.ExcludeServices("grpc.health.v1.Health", "grpcmontest.Test"), grpcmon.WithSelfMetrics(self)}
+		h := grpcmon.ServerStatsHandler(m, opts...)
+		if client {
+			h = grpcmon.ClientStatsHandler(m, opts...)
+		}
+		grpcmontest.Replay(h, grpcmontest.BidiStream(client, 2))
+		grpcmontest.Replay(h, grpcmontest.UnaryError(client, codes.Internal))
+		if got := rec.String(); strings.Contains(got, "service=") {
+			t.Errorf("client=%v: excluded RPCs recorded:\n%s", client, got)
+		}
+		if got := rec.CounterValue(grpcmontest.UnattributedEvents); got != 0 {
+			t.Errorf("client=%v: %v unattributed events, want 0", client, got)
+		}
+
+		seq := grpcmontest.UnaryOK(client)
+		seq.RPCs[0].FullMethodName = "/grpcmontest.Other/Method"
+		grpcmontest.Replay(h, seq)
+		rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"service": "grpcmontest.Other", "method": "Method", "code": "OK"}, 1)
+		if got := h.InFlight("grpcmontest.Test", "Method"); got != 0 {
+			t.Errorf("client=%v: %d excluded RPCs in flight", client, got)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	begin := time.Now()
+	for _, tc := range []struct {
+		name   string
+		events []stats.RPCStats
+		want   []float64
+	}{
+		{"end time", []stats.RPCStats{&stats.Begin{BeginTime: begin}, &stats.End{BeginTime: begin, EndTime: begin.Add(1500 * time.Millisecond)}}, []float64{1.5}},
+		{"missing begin", []stats.RPCStats{&stats.End{BeginTime: begin, EndTime: begin.Add(time.Second)}}, nil},
+	} {
+		m, rec := grpcmontest.NewRecorder()
+		h := grpcmon.ServerStatsHandler(m)
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+		for _, ev := range tc.events {
+			h.HandleRPC(ctx, ev)
+		}
+		if got := rec.Observations(grpcmontest.Latency, "service", "grpcmontest.Test", "method", "Method", "code", "OK"); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: latency observations = %v, want %v", tc.name, got, tc.want)
+		}
+		rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"service": "grpcmontest.Test", "method": "Method", "code": "OK"}, 1)
+	}
+
+	// Without an end time, the latency is measured when End is handled.
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m)
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: begin.Add(-time.Hour)})
+	h.HandleRPC(ctx, &stats.End{})
+	got := rec.Observations(grpcmontest.Latency, "service", "grpcmontest.Test", "method", "Method", "code", "OK")
+	if len(got) != 1 || got[0] < time.Hour.Seconds() || got[0] > 2*time.Hour.Seconds() {
+		t.Errorf("latency observations without end time = %v, want one of about an hour", got)
+	}
+}
+
+// floodDesc describes a bidirectional streaming service sending floodMsgs
+// messages while it receives the messages of the client.
+var floodDesc = grpc.ServiceDesc{
+	ServiceName: "grpcmontest.Flood",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Flood",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(_ interface{}, ss grpc.ServerStream) error {
+			sent := make(chan error, 1)
+			go func() { sent <- flood(ss.SendMsg) }()
+			for {
+				if err := ss.RecvMsg(new(wrapperspb.StringValue)); err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+			}
+			return <-sent
+		},
+	}},
+}
+
+const floodMsgs = 100
+
+func flood(send func(interface{}) error) error {
+	for i := 0; i < floodMsgs; i++ {
+		if err := send(wrapperspb.String("flood")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestConcurrentStreamEvents(t *testing.T) {
+	h := grpcmontest.NewHarness(t, grpcmontest.MonitorOptions(
+		grpcmon.WithStreamAge(0, time.Millisecond),
+		grpcmon.WithInFlightRegistry(),
+	))
+	h.Server.RegisterService(&floodDesc, nil)
+	s, err := h.Conn().NewStream(context.Background(), &floodDesc.Streams[0], "/grpcmontest.Flood/Flood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 1)
+	go func() {
+		err := flood(s.SendMsg)
+		if err == nil {
+			err = s.CloseSend()
+		}
+		sent <- err
+	}()
+	for {
+		if err := s.RecvMsg(new(wrapperspb.StringValue)); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	method := map[string]string{"service": "grpcmontest.Flood", "method": "Flood"}
+	for _, rec := range []*grpcmontest.Recorder{h.ClientRecorder, h.ServerRecorder} {
+		rec.AssertCounterDelta(t, grpcmontest.MsgsSent, method, floodMsgs)
+		rec.AssertCounterDelta(t, grpcmontest.MsgsRecv, method, floodMsgs)
+		rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, method, 1)
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithConstLabels(map[string]string{"region": "eu", "env": "prod"}))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+
+	labels := map[string]string{"service": "grpcmontest.Test", "method": "Method", "env": "prod", "region": "eu"}
+	rec.AssertCounterDelta(t, grpcmontest.ConnsTotal, map[string]string{"env": "prod", "region": "eu"}, 1)
+	rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, labels, 1)
+	rec.AssertHistogramCount(t, grpcmontest.Latency, labels, 1)
+	rec.AssertHistogramCount(t, grpcmontest.BytesRecv, labels, 2)
+	rec.AssertHistogramCount(t, grpcmontest.BytesSent, labels, 3)
+	if s := rec.String(); strings.Count(s, `env="prod"`) != strings.Count(s, "\n") {
+		t.Errorf("series without constant labels:\n%s", s)
+	}
+}
+
+func TestConnPeerLabel(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithConnPeerLabel(grpcmon.PeerHost))
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.2"} {
+		seq := grpcmontest.UnaryOK(false)
+		seq.RemoteAddr = &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}
+		grpcmontest.Replay(h, seq)
+	}
+
+	rec.AssertCounterDelta(t, grpcmontest.ConnsTotal, map[string]string{"peer": "10.0.0.1"}, 1)
+	rec.AssertCounterDelta(t, grpcmontest.ConnsTotal, map[string]string{"peer": "10.0.0.2"}, 2)
+	rec.AssertGauges(t, grpcmontest.ConnsOpen, map[string]string{"peer": "10.0.0.2"}, 0)
+
+	m, rec = grpcmontest.NewRecorder()
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m), grpcmontest.UnaryOK(false))
+	if got := rec.CounterValue(grpcmontest.ConnsTotal); got != 1 {
+		t.Errorf("connections total without peer label = %v, want 1", got)
+	}
+}
+
+func TestConnTransportLabel(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	srv := grpc.NewServer(grpcmon.ServerOption(m, grpcmon.WithConnTransportLabel()))
+	pb.RegisterFrontendServer(srv, &frontend{})
+	sock := filepath.Join(t.TempDir(), "grpc.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lis)
+	go srv.Serve(listen("transport"))
+
+	for target, dialer := range map[string]grpc.DialOption{
+		"transport":      grpc.WithContextDialer(dial),
+		"unix://" + sock: grpc.EmptyDialOption{},
+	} {
+		conn, err := grpc.Dial(target, dialer, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	srv.GracefulStop()
+
+	rec.AssertCounterDelta(t, grpcmontest.ConnsTotal, map[string]string{"transport": "unix"}, 1)
+	rec.AssertCounterDelta(t, grpcmontest.ConnsTotal, map[string]string{"transport": "bufconn"}, 1)
+}
+
+func TestCodeMapper(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithCodeMapper(grpcmon.CodeClass))
+	for _, seq := range []grpcmontest.Sequence{
+		grpcmontest.UnaryOK(false),
+		grpcmontest.UnaryError(false, codes.InvalidArgument),
+		grpcmontest.UnaryError(false, codes.NotFound),
+		grpcmontest.UnaryError(false, codes.Unavailable),
+		grpcmontest.ClientCancel(false),
+	} {
+		grpcmontest.Replay(h, seq)
+	}
+
+	for code, want := range map[string]int{"ok": 1, "client_error": 2, "server_error": 1, "canceled": 1} {
+		labels := []string{"service", "grpcmontest.Test", "method", "Method", "code", code}
+		if got := rec.CounterValue(grpcmontest.ReqsTotal, labels...); got != float64(want) {
+			t.Errorf("requests total with code %s = %v, want %d", code, got, want)
+		}
+		if got := rec.HistogramCount(grpcmontest.Latency, labels...); got != want {
+			t.Errorf("latency observations with code %s = %d, want %d", code, got, want)
+		}
+	}
+	if strings.Contains(rec.String(), `code="OK"`) {
+		t.Errorf("unmapped code label recorded:\n%s", rec.String())
+	}
+}
+
+// sizeDesc describes a service echoing bytes values in unary RPCs.
+var sizeDesc = grpc.ServiceDesc{
+	ServiceName: "grpcmontest.Size",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Echo",
+		Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			v := new(wrapperspb.BytesValue)
+			if err := dec(v); err != nil {
+				return nil, err
+			}
+			return v, nil
+		},
+	}},
+}
+
+func TestMessageBytes(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	h.Server.RegisterService(&sizeDesc, nil)
+	req := wrapperspb.Bytes(make([]byte, 10000))
+	if err := h.Conn().Invoke(context.Background(), "/grpcmontest.Size/Echo", req, new(wrapperspb.BytesValue), grpc.UseCompressor(gzip.Name)); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	size := float64(proto.Size(req))
+	for side, rec := range map[string]*grpcmontest.Recorder{"client": h.ClientRecorder, "server": h.ServerRecorder} {
+		for _, name := range []string{grpcmontest.MsgBytesSent, grpcmontest.MsgBytesRecv} {
+			got := rec.Observations(name, "service", "grpcmontest.Size", "method", "Echo")
+			if len(got) != 1 || got[0] != size {
+				t.Errorf("%s: %s observations = %v, want [%v]", side, name, got, size)
+			}
+		}
+		for _, name := range []string{grpcmontest.BytesSent, grpcmontest.BytesRecv} {
+			got := rec.Observations(name, "service", "grpcmontest.Size", "method", "Echo", "frame", "payload")
+			if len(got) != 1 || got[0] >= size {
+				t.Errorf("%s: %s payload observations = %v, want one below %v", side, name, got, size)
+			}
+		}
+	}
+}
+
+func TestByteTotals(t *testing.T) {
+	const n = 5
+	m, rec := grpcmontest.NewRecorder()
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m), grpcmontest.ServerStream(false, n))
+
+	method := []string{"service", "grpcmontest.Test", "method", "Method"}
+	for name, want := range map[string]float64{
+		// Headers, and a 10 byte request framed in 15.
+		grpcmontest.BytesRecvTotal: 40 + 15,
+		// Headers, n 20 byte responses framed in 25, and the trailer.
+		grpcmontest.BytesSentTotal: 28 + n*25 + 12,
+	} {
+		if got := rec.CounterValue(name, method...); got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+	for total, hist := range map[string]string{
+		grpcmontest.BytesRecvTotal: grpcmontest.BytesRecv,
+		grpcmontest.BytesSentTotal: grpcmontest.BytesSent,
+	} {
+		var sum float64
+		for _, frame := range []string{"header", "payload", "trailer"} {
+			for _, obs := range rec.Observations(hist, append(method, "frame", frame)...) {
+				sum += obs
+			}
+		}
+		if got := rec.CounterValue(total, method...); got != sum {
+			t.Errorf("%s = %v, want the sum of %s observations %v", total, got, hist, sum)
+		}
+	}
+}
+
+func TestPayloadSampling(t *testing.T) {
+	const n = 100
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithPayloadSampling(10))
+	for i := 0; i < 2; i++ {
+		grpcmontest.Replay(h, grpcmontest.BidiStream(false, n))
+	}
+
+	method := []string{"service", "grpcmontest.Test", "method", "Method"}
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, append(method, "code", "OK")...); got != 2 {
+		t.Errorf("requests total = %v, want 2", got)
+	}
+	if got := rec.HistogramCount(grpcmontest.Latency, append(method, "code", "OK")...); got != 2 {
+		t.Errorf("latency observations = %d, want 2", got)
+	}
+	for _, name := range []string{grpcmontest.MsgsSent, grpcmontest.MsgsRecv} {
+		if got := rec.CounterValue(name, method...); got != 2*n {
+			t.Errorf("%s = %v, want %d", name, got, 2*n)
+		}
+	}
+	if got := rec.CounterValue(grpcmontest.BytesRecvTotal, method...); got != 2*(40+n*15) {
+		t.Errorf("bytes received = %v, want %d", got, 2*(40+n*15))
+	}
+	// Payloads are sampled across both directions.
+	payloads := rec.HistogramCount(grpcmontest.BytesSent, append(method, "frame", "payload")...) +
+		rec.HistogramCount(grpcmontest.BytesRecv, append(method, "frame", "payload")...)
+	if payloads != 2*2*n/10 {
+		t.Errorf("payload observations = %d, want %d", payloads, 2*2*n/10)
+	}
+	if got := rec.HistogramCount(grpcmontest.BytesRecv, append(method, "frame", "header")...); got != 2 {
+		t.Errorf("header observations = %d, want 2", got)
+	}
+}
+
+// delayedStreamDesc describes a server streaming service that sends two
+// messages, each after sleeping for the duration in the request.
+var delayedStreamDesc = grpc.ServiceDesc{
+	ServiceName: "grpcmontest.Delayed",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Stream",
+		ServerStreams: true,
+		Handler: func(_ interface{}, ss grpc.ServerStream) error {
+			d := new(wrapperspb.Int64Value)
+			if err := ss.RecvMsg(d); err != nil {
+				return err
+			}
+			for i := 0; i < 2; i++ {
+				time.Sleep(time.Duration(d.Value))
+				if err := ss.SendMsg(d); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}},
+}
+
+func TestTTFB(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	h := grpcmontest.NewHarness(t)
+	h.Server.RegisterService(&delayedStreamDesc, nil)
+	s, err := h.Conn().NewStream(context.Background(), &delayedStreamDesc.Streams[0], "/grpcmontest.Delayed/Stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMsg(wrapperspb.Int64(int64(delay))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	for s.RecvMsg(new(wrapperspb.Int64Value)) == nil {
+	}
+	h.Stop()
+
+	method := []string{"service", "grpcmontest.Delayed", "method", "Stream"}
+	for side, rec := range map[string]*grpcmontest.Recorder{"client": h.ClientRecorder, "server": h.ServerRecorder} {
+		ttfb := rec.Observations(grpcmontest.TTFB, method...)
+		latency := rec.Observations(grpcmontest.Latency, append(method, "code", "OK")...)
+		if len(ttfb) != 1 || len(latency) != 1 {
+			t.Fatalf("%s: got %d first response and %d latency observations, want 1 each", side, len(ttfb), len(latency))
+		}
+		if ttfb[0] < delay.Seconds() || ttfb[0] >= 2*delay.Seconds() {
+			t.Errorf("%s: first response after %vs, want between %v and %v", side, ttfb[0], delay, 2*delay)
+		}
+		if latency[0] < 2*delay.Seconds() {
+			t.Errorf("%s: latency %vs, want at least %v", side, latency[0], 2*delay)
+		}
+	}
+}
+
+func TestConnDuration(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+	if _, err := pb.NewFrontendClient(h.Conn()).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+	for side, rec := range map[string]*grpcmontest.Recorder{"client": h.ClientRecorder, "server": h.ServerRecorder} {
+		if got := rec.Observations(grpcmontest.ConnDuration); len(got) != 1 || got[0] <= 0 {
+			t.Errorf("%s: connection durations = %v, want one positive", side, got)
+		}
+	}
+
+	// A connection whose begin was not seen has no duration.
+	m, rec := grpcmontest.NewRecorder()
+	sh := grpcmon.ServerStatsHandler(m)
+	ctx := sh.TagConn(context.Background(), &stats.ConnTagInfo{})
+	sh.HandleConn(ctx, &stats.ConnEnd{})
+	if got := rec.Observations(grpcmontest.ConnDuration); len(got) != 0 {
+		t.Errorf("connection durations without begin = %v, want none", got)
+	}
+}
+
+func TestConnEndWithoutBegin(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	sh := grpcmon.ServerStatsHandler(m, grpcmon.WithSelfMetrics(rec.SelfMetrics()))
+	check := func(when string, want float64) {
+		t.Helper()
+		if got := rec.GaugeValue(grpcmontest.ConnsOpen); got != want {
+			t.Errorf("connections open %s = %v, want %v", when, got, want)
+		}
+	}
+
+	// Connections that began before the handler was attached, with and
+	// without a tagged context.
+	sh.HandleConn(sh.TagConn(context.Background(), &stats.ConnTagInfo{}), &stats.ConnEnd{})
+	sh.HandleConn(context.Background(), &stats.ConnEnd{})
+	check("after unmatched ends", 0)
+
+	ctx := sh.TagConn(context.Background(), &stats.ConnTagInfo{})
+	sh.HandleConn(ctx, &stats.ConnBegin{})
+	check("after begin", 1)
+	sh.HandleConn(ctx, &stats.ConnEnd{})
+	sh.HandleConn(ctx, &stats.ConnEnd{})
+	check("after repeated ends", 0)
+	rec.AssertCounterDelta(t, grpcmontest.UnattributedEvents, nil, 3)
+}
+
+func TestDeadlineBudget(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	h := grpcmontest.NewHarness(t)
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+	client := pb.NewFrontendClient(h.Conn())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := client.Query(ctx, &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	method := []string{"service", "frontend.Frontend", "method", "Query"}
+	rec := h.ServerRecorder
+	if got := rec.Observations(grpcmontest.DeadlineBudget, method...); len(got) != 1 || got[0] <= 0 || got[0] > timeout.Seconds() {
+		t.Errorf("deadline budgets = %v, want one in (0, %v]", got, timeout.Seconds())
+	}
+	if got := rec.CounterValue(grpcmontest.ReqsNoDeadline, method...); got != 1 {
+		t.Errorf("requests without deadline = %v, want 1", got)
+	}
+	if got := h.ClientRecorder.String(); strings.Contains(got, grpcmontest.DeadlineBudget) || strings.Contains(got, grpcmontest.ReqsNoDeadline) {
+		t.Errorf("client recorded deadline budgets:\n%s", got)
+	}
+}
+
+func TestFailFastLabel(t *testing.T) {
+	h := grpcmontest.NewHarness(t, grpcmontest.MonitorOptions(grpcmon.WithFailFastLabel()))
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+	client := pb.NewFrontendClient(h.Conn())
+	if _, err := client.Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Query(context.Background(), &pb.QueryRequest{}, grpc.WaitForReady(true)); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	for _, failFast := range []string{"true", "false"} {
+		labels := []string{"service", "frontend.Frontend", "method", "Query", "code", "OK", "fail_fast", failFast}
+		if got := h.ClientRecorder.CounterValue(grpcmontest.ReqsTotal, labels...); got != 1 {
+			t.Errorf("client requests total with fail_fast %s = %v, want 1", failFast, got)
+		}
+		if got := h.ClientRecorder.HistogramCount(grpcmontest.Latency, labels...); got != 1 {
+			t.Errorf("client latency observations with fail_fast %s = %d, want 1", failFast, got)
+		}
+	}
+	if got := h.ServerRecorder.CounterValue(grpcmontest.ReqsTotal, "service", "frontend.Frontend", "method", "Query", "code", "OK"); got != 2 {
+		t.Errorf("server requests total = %v, want 2", got)
+	}
+	if got := h.ServerRecorder.String(); strings.Contains(got, "fail_fast") {
+		t.Errorf("server recorded the fail_fast label:\n%s", got)
+	}
+}
+
+// hangingStreamDesc describes a server streaming service that does not
+// respond until the client cancels.
+var hangingStreamDesc = grpc.ServiceDesc{
+	ServiceName: "grpcmontest.Hanging",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Stream",
+		ServerStreams: true,
+		Handler: func(_ interface{}, ss grpc.ServerStream) error {
+			<-ss.Context().Done()
+			return ss.Context().Err()
+		},
+	}},
+}
+
+func TestReqsStarted(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	h.Server.RegisterService(&hangingStreamDesc, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := h.Conn().NewStream(ctx, &hangingStreamDesc.Streams[0], "/grpcmontest.Hanging/Stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMsg(wrapperspb.Int64(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	method := []string{"service", "grpcmontest.Hanging", "method", "Stream"}
+	for deadline := time.Now().Add(5 * time.Second); h.ServerRecorder.CounterValue(grpcmontest.ReqsStarted, method...) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	for side, rec := range map[string]*grpcmontest.Recorder{"client": h.ClientRecorder, "server": h.ServerRecorder} {
+		if got := rec.CounterValue(grpcmontest.ReqsStarted, method...); got != 1 {
+			t.Errorf("%s: requests started = %v, want 1", side, got)
+		}
+		if got := rec.String(); strings.Contains(got, grpcmontest.ReqsTotal) {
+			t.Errorf("%s: requests completed while hanging:\n%s", side, got)
+		}
+	}
+	cancel()
+	h.Stop()
+}
+
+func TestTarget(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	for _, target := range []string{"target-a", "target-b"} {
+		srv := grpc.NewServer()
+		pb.RegisterFrontendServer(srv, &frontend{})
+		go srv.Serve(listen(target))
+		defer srv.Stop()
+		conn, err := grpc.Dial(target, grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpcmon.DialOption(m, grpcmon.WithTarget(target)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, target := range []string{"target-a", "target-b"} {
+		if got := rec.CounterValue(grpcmontest.ConnsTotal, "target", target); got != 1 {
+			t.Errorf("connections total to %s = %v, want 1", target, got)
+		}
+		if got := rec.GaugeValue(grpcmontest.ConnsOpen, "target", target); got != 1 {
+			t.Errorf("connections open to %s = %v, want 1", target, got)
+		}
+	}
+	if got := rec.CounterValue(grpcmontest.ConnsTotal); got != 0 {
+		t.Errorf("connections total without target = %v, want 0", got)
+	}
+}
+
+// trailerDesc describes a unary service that sets a response header and
+// trailer.
+var trailerDesc = grpc.ServiceDesc{
+	ServiceName: "grpcmontest.Trailer",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Echo",
+		Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			v := new(wrapperspb.StringValue)
+			if err := dec(v); err != nil {
+				return nil, err
+			}
+			grpc.SetHeader(ctx, metadata.Pairs("x-header", "header"))
+			grpc.SetTrailer(ctx, metadata.Pairs("x-trailer", "trailer"))
+			return v, nil
+		},
+	}},
+}
+
+func TestTrailerBytes(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	h.Server.RegisterService(&trailerDesc, nil)
+	if err := h.Conn().Invoke(context.Background(), "/grpcmontest.Trailer/Echo", wrapperspb.String("echo"), new(wrapperspb.StringValue)); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	method := []string{"service", "grpcmontest.Trailer", "method", "Echo"}
+	for _, tc := range []struct {
+		side string
+		rec  *grpcmontest.Recorder
+		name string
+	}{
+		{"client", h.ClientRecorder, grpcmontest.BytesSent},
+		{"client", h.ClientRecorder, grpcmontest.BytesRecv},
+		{"server", h.ServerRecorder, grpcmontest.BytesSent},
+		{"server", h.ServerRecorder, grpcmontest.BytesRecv},
+	} {
+		frames := []string{"header"}
+		if (tc.side == "client") == (tc.name == grpcmontest.BytesRecv) {
+			frames = append(frames, "trailer")
+		}
+		for _, frame := range frames {
+			if got := tc.rec.Observations(tc.name, append(method, "frame", frame)...); len(got) != 1 || got[0] <= 0 {
+				t.Errorf("%s: %s of the %s = %v, want one positive observation", tc.side, tc.name, frame, got)
+			}
+		}
+	}
+}
+
+// TestTrailerBytesShapes checks that trailers are observed with their size
+// whether or not their wire length is populated.
+func TestTrailerBytesShapes(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		forEachShape(grpcmontest.UnaryOK(client), func(seq grpcmontest.Sequence) {
+			m, rec := grpcmontest.NewRecorder()
+			h := grpcmon.ServerStatsHandler(m)
+			name := grpcmontest.BytesSent
+			if client {
+				h, name = grpcmon.ClientStatsHandler(m), grpcmontest.BytesRecv
+			}
+			grpcmontest.Replay(h, seq)
+			if got := rec.Observations(name, "service", "grpcmontest.Test", "method", "Method", "frame", "trailer"); len(got) != 1 || got[0] <= 0 {
+				t.Errorf("%s client=%v: trailer bytes = %v, want one positive observation", seq.Name, client, got)
+			}
+		})
+	}
+}
+
+func TestPickLatency(t *testing.T) {
+	const wait = 50 * time.Millisecond
+	srv := grpc.NewServer()
+	pb.RegisterFrontendServer(srv, &frontend{})
+	go srv.Serve(listen("pick"))
+	defer srv.Stop()
+
+	// The server becomes reachable only after the RPC begins waiting.
+	ready := make(chan struct{})
+	slowDial := func(ctx context.Context, addr string) (net.Conn, error) {
+		<-ready
+		return dial(ctx, addr)
+	}
+	m, rec := grpcmontest.NewRecorder()
+	conn, err := grpc.Dial("pick", grpc.WithContextDialer(slowDial), grpc.WithTransportCredentials(insecure.NewCredentials()), grpcmon.DialOption(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.AfterFunc(wait, func() { close(ready) })
+	if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}, grpc.WaitForReady(true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := rec.Observations(grpcmontest.PickLatency, "service", "frontend.Frontend", "method", "Query")
+	if len(got) != 2 {
+		t.Fatalf("pick latencies = %v, want 2", got)
+	}
+	if got[0] < wait.Seconds() {
+		t.Errorf("pick latency while connecting = %vs, want at least %v", got[0], wait)
+	}
+	if got[1] >= wait.Seconds() {
+		t.Errorf("pick latency once connected = %vs, want less than %v", got[1], wait)
+	}
+}
+
+func TestLatencyUnit(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithLatencyUnit(time.Millisecond))
+	// The canned sequences take 1ms between events.
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+
+	method := []string{"service", "grpcmontest.Test", "method", "Method"}
+	if got := rec.Observations(grpcmontest.Latency, append(method, "code", "OK")...); !reflect.DeepEqual(got, []float64{3}) {
+		t.Errorf("latency = %v, want [3]", got)
+	}
+	if got := rec.Observations(grpcmontest.TTFB, method...); !reflect.DeepEqual(got, []float64{2}) {
+		t.Errorf("first response = %v, want [2]", got)
+	}
+
+	m, rec = grpcmontest.NewRecorder()
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m), grpcmontest.UnaryOK(false))
+	if got := rec.Observations(grpcmontest.Latency, append(method, "code", "OK")...); !reflect.DeepEqual(got, []float64{0.003}) {
+		t.Errorf("default latency = %v, want [0.003]", got)
+	}
+}
+
+// TestLatencyUnitScaled replays fixed times that are not whole units and
+// checks the exact observations of every time histogram they make.
+func TestLatencyUnitScaled(t *testing.T) {
+	at := func(us int) time.Time { return grpcmontest.Epoch.Add(time.Duration(us) * time.Microsecond) }
+	seq := grpcmontest.Sequence{RPCs: []grpcmontest.RPC{{
+		FullMethodName: grpcmontest.Method,
+		Events: []stats.RPCStats{
+			&stats.Begin{BeginTime: at(0), IsClientStream: true},
+			&stats.InPayload{Length: 10, WireLength: 15, RecvTime: at(500)},
+			&stats.InPayload{Length: 10, WireLength: 15, RecvTime: at(1250)},
+			&stats.OutPayload{Length: 10, WireLength: 15, SentTime: at(2000)},
+			&stats.End{BeginTime: at(0), EndTime: at(2500)},
+		},
+	}}}
+	m, rec := grpcmontest.NewRecorder()
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m, grpcmon.WithLatencyUnit(time.Millisecond)), seq)
+
+	method := []string{"service", "grpcmontest.Test", "method", "Method"}
+	withCode := append(method[:len(method):len(method)], "code", "OK")
+	for _, tc := range []struct {
+		name   string
+		labels []string
+		want   []float64
+	}{
+		{grpcmontest.Latency, withCode, []float64{2.5}},
+		{grpcmontest.TTFB, method, []float64{2}},
+		{grpcmontest.ProcessingTime, withCode, []float64{1.5}},
+		{grpcmontest.InterMsgGap, append(method[:len(method):len(method)], "direction", "inbound"), []float64{0.75}},
+	} {
+		if got := rec.Observations(tc.name, tc.labels...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s%v = %v, want milliseconds %v", tc.name, tc.labels, got, tc.want)
+		}
+	}
+}
+
+func TestInterMsgGap(t *testing.T) {
+	at := func(ms int) time.Time { return grpcmontest.Epoch.Add(time.Duration(ms) * time.Millisecond) }
+	seq := grpcmontest.Sequence{RPCs: []grpcmontest.RPC{{
+		FullMethodName: grpcmontest.Method,
+		Events: []stats.RPCStats{
+			&stats.Begin{BeginTime: at(0), IsClientStream: true, IsServerStream: true},
+			&stats.InPayload{Length: 10, WireLength: 15, RecvTime: at(1)},
+			&stats.InPayload{Length: 10, WireLength: 15, RecvTime: at(11)},
+			&stats.OutPayload{Length: 10, WireLength: 15, SentTime: at(12)},
+			&stats.InPayload{Length: 10, WireLength: 15, RecvTime: at(41)},
+			&stats.OutPayload{Length: 10, WireLength: 15, SentTime: at(62)},
+			&stats.End{BeginTime: at(0), EndTime: at(70)},
+		},
+	}}}
+	m, rec := grpcmontest.NewRecorder()
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m), seq)
+
+	for dir, want := range map[string][]float64{"inbound": {0.01, 0.03}, "outbound": {0.05}} {
+		got := rec.Observations(grpcmontest.InterMsgGap, "service", "grpcmontest.Test", "method", "Method", "direction", dir)
+		if len(got) != len(want) {
+			t.Errorf("%s gaps = %v, want %v", dir, got, want)
+			continue
+		}
+		for i := range want {
+			if math.Abs(got[i]-want[i]) > 1e-9 {
+				t.Errorf("%s gaps = %v, want %v", dir, got, want)
+				break
+			}
+		}
+	}
+
+	// Unary RPCs send and receive a single message, which has no gap.
+	m, rec = grpcmontest.NewRecorder()
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m), grpcmontest.UnaryOK(false))
+	if got := rec.String(); strings.Contains(got, grpcmontest.InterMsgGap) {
+		t.Errorf("unary RPC recorded gaps:\n%s", got)
+	}
+}
@@ -0,0 +1,143 @@
+package grpcmontest
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// AssertCounterDelta asserts that the counters with the given name and
+// labels were increased by delta since the last call to Mark. Any recorded
+// series that has all of the given labels matches, and the deltas of all
+// matching series are summed up.
+func (r *Recorder) AssertCounterDelta(t testing.TB, name string, labels map[string]string, delta float64) {
+	t.Helper()
+	var got float64
+	matched := r.match(name, labels, func(s *series) { got += s.value - s.markValue })
+	if !matched {
+		t.Errorf("%s%s: no matching series%s", trimName(name), formatLabels(labels), r.nearest(name, labels))
+		return
+	}
+	if got != delta {
+		t.Errorf("%s%s: counter delta = %v, want %v", trimName(name), formatLabels(labels), got, delta)
+	}
+}
+
+// AssertHistogramCount asserts that the histograms with the given name and
+// labels observed n values since the last call to Mark. Series are matched
+// like in AssertCounterDelta.
+func (r *Recorder) AssertHistogramCount(t testing.TB, name string, labels map[string]string, n int) {
+	t.Helper()
+	var got int
+	matched := r.match(name, labels, func(s *series) { got += len(s.obs) - s.markObs })
+	if !matched {
+		t.Errorf("%s%s: no matching series%s", trimName(name), formatLabels(labels), r.nearest(name, labels))
+		return
+	}
+	if got != n {
+		t.Errorf("%s%s: histogram count = %d, want %d", trimName(name), formatLabels(labels), got, n)
+	}
+}
+
+// AssertNoObservations asserts that no histogram with the given name and
+// labels observed a value since the last call to Mark. Series are matched
+// like in AssertCounterDelta; nil labels match every series.
+func (r *Recorder) AssertNoObservations(t testing.TB, name string, labels map[string]string) {
+	t.Helper()
+	var got int
+	r.match(name, labels, func(s *series) { got += len(s.obs) - s.markObs })
+	if got != 0 {
+		t.Errorf("%s%s: histogram count = %d, want 0", trimName(name), formatLabels(labels), got)
+	}
+}
+
+// match calls fn for every series with the given name that has all of the
+// given labels and reports whether there was any.
+func (r *Recorder) match(name string, labels map[string]string, fn func(*series)) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name = trimName(name)
+	matched := false
+	for _, s := range r.series {
+		if s.name == name && common(s.labels, labels) == len(labels) {
+			matched = true
+			fn(s)
+		}
+	}
+	return matched
+}
+
+// nearest describes the recorded label sets of the named metric that are
+// closest to labels, for use in failure messages.
+func (r *Recorder) nearest(name string, labels map[string]string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name = trimName(name)
+	var candidates []*series
+	for _, s := range r.series {
+		if s.name == name {
+			candidates = append(candidates, s)
+		}
+	}
+	if len(candidates) == 0 {
+		return "; nothing recorded for " + name
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ci, cj := common(candidates[i].labels, labels), common(candidates[j].labels, labels)
+		if ci != cj {
+			return ci > cj
+		}
+		return formatLabels(candidates[i].labels) < formatLabels(candidates[j].labels)
+	})
+	const max = 3
+	if len(candidates) > max {
+		candidates = candidates[:max]
+	}
+	var b strings.Builder
+	b.WriteString("; nearest recorded:")
+	for _, s := range candidates {
+		b.WriteString("\n\t")
+		b.WriteString(name)
+		b.WriteString(formatLabels(s.labels))
+	}
+	return b.String()
+}
+
+// common returns the number of labels in want that have an equal value in
+// have.
+func common(have, want map[string]string) int {
+	n := 0
+	for k, v := range want {
+		if hv, ok := have[k]; ok && hv == v {
+			n++
+		}
+	}
+	return n
+}
+
+// AssertGauges asserts that every gauge with the given name and labels has
+// the given value. Series are matched like in AssertCounterDelta, but values
+// are absolute rather than relative to Mark.
+func (r *Recorder) AssertGauges(t testing.TB, name string, labels map[string]string, value float64) {
+	t.Helper()
+	r.match(name, labels, func(s *series) {
+		if s.value != value {
+			t.Errorf("%s%s: gauge = %v, want %v", s.name, formatLabels(s.labels), s.value, value)
+		}
+	})
+}
+
+// AssertNoNegativeObservations asserts that no histogram with the given name
+// and labels ever observed a negative value. Series are matched like in
+// AssertCounterDelta.
+func (r *Recorder) AssertNoNegativeObservations(t testing.TB, name string, labels map[string]string) {
+	t.Helper()
+	r.match(name, labels, func(s *series) {
+		for _, v := range s.obs {
+			if v < 0 {
+				t.Errorf("%s%s: observed %v", s.name, formatLabels(s.labels), v)
+				return
+			}
+		}
+	})
+}
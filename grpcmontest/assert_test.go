@@ -0,0 +1,101 @@
+package grpcmontest_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+// fakeT records failures instead of failing the test.
+type fakeT struct {
+	testing.TB
+	errors []string
+}
+
+func (*fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertCounterDelta(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	m.ReqsTotal.With("service", "svc", "method", "M", "code", "OK").Add(1)
+	rec.Mark()
+	m.ReqsTotal.With("service", "svc", "method", "M", "code", "OK").Add(2)
+	m.ReqsTotal.With("service", "svc", "method", "N", "code", "OK").Add(1)
+
+	rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"code": "OK"}, 3)
+	rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, map[string]string{"method": "M", "code": "OK"}, 2)
+
+	ft := &fakeT{TB: t}
+	rec.AssertCounterDelta(ft, grpcmontest.ReqsTotal, map[string]string{"method": "M", "code": "OK"}, 1)
+	rec.AssertCounterDelta(ft, grpcmontest.ReqsTotal, map[string]string{"methd": "M", "code": "OK"}, 1)
+	rec.AssertCounterDelta(ft, grpcmontest.ConnsTotal, nil, 1)
+	if len(ft.errors) != 3 {
+		t.Fatalf("got %d errors, want 3: %q", len(ft.errors), ft.errors)
+	}
+	if want := "counter delta = 2, want 1"; !strings.Contains(ft.errors[0], want) {
+		t.Errorf("error %q does not contain %q", ft.errors[0], want)
+	}
+	if want := `nearest recorded:` + "\n\t" + `requests_total{code="OK",method="M",service="svc"}`; !strings.Contains(ft.errors[1], want) {
+		t.Errorf("error %q does not contain %q", ft.errors[1], want)
+	}
+	if want := "nothing recorded for connections_total"; !strings.Contains(ft.errors[2], want) {
+		t.Errorf("error %q does not contain %q", ft.errors[2], want)
+	}
+}
+
+func TestAssertHistogram(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	m.Latency.With("code", "OK").Observe(1)
+	rec.Mark()
+	m.Latency.With("code", "OK").Observe(1)
+
+	rec.AssertHistogramCount(t, grpcmontest.Latency, map[string]string{"code": "OK"}, 1)
+	rec.AssertNoObservations(t, grpcmontest.Latency, map[string]string{"code": "Unknown"})
+	rec.AssertNoObservations(t, grpcmontest.BytesSent, nil)
+
+	ft := &fakeT{TB: t}
+	rec.AssertNoObservations(ft, grpcmontest.Latency, nil)
+	rec.AssertHistogramCount(ft, grpcmontest.Latency, map[string]string{"code": "OK"}, 2)
+	if len(ft.errors) != 2 {
+		t.Fatalf("got %d errors, want 2: %q", len(ft.errors), ft.errors)
+	}
+}
+
+type frontend struct{}
+
+func (*frontend) Query(_ context.Context, req *pb.QueryRequest) (*pb.QueryResponse, error) {
+	return nil, status.Error(codes.NotFound, "not found")
+}
+
+// TestClientServer shows how to assert the metrics of both sides of a
+// connection after a few RPCs.
+func TestClientServer(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+
+	client := pb.NewFrontendClient(h.Conn())
+	for i := 0; i < 3; i++ {
+		if _, err := client.Query(context.Background(), &pb.QueryRequest{}); status.Code(err) != codes.NotFound {
+			t.Fatalf("got error %v, want NotFound", err)
+		}
+	}
+	h.Stop()
+
+	labels := map[string]string{"service": "frontend.Frontend", "method": "Query", "code": "NotFound"}
+	for _, rec := range []*grpcmontest.Recorder{h.ClientRecorder, h.ServerRecorder} {
+		rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, labels, 3)
+		rec.AssertHistogramCount(t, grpcmontest.Latency, labels, 3)
+		rec.AssertCounterDelta(t, grpcmontest.ConnsTotal, nil, 1)
+		rec.AssertNoObservations(t, grpcmontest.Latency, map[string]string{"code": "OK"})
+	}
+}
@@ -0,0 +1,108 @@
+package grpcmontest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// Harness runs an instrumented gRPC server and client connected over an
+// in-memory connection, recording the metrics of both sides.
+//
+// Services are to be registered on Server before the first call to Conn.
+type Harness struct {
+	// Server is the instrumented server.
+	Server *grpc.Server
+	// ServerRecorder records the metrics of Server.
+	ServerRecorder *Recorder
+	// ClientRecorder records the metrics of the connection returned by
+	// Conn.
+	ClientRecorder *Recorder
+
+	t             testing.TB
+	lis           *bufconn.Listener
+	clientMetrics *grpcmon.Metrics
+	config        harnessConfig
+
+	once sync.Once
+	conn *grpc.ClientConn
+}
+
+// HarnessOption configures a Harness.
+type HarnessOption func(*harnessConfig)
+
+type harnessConfig struct {
+	serverOpts  []grpc.ServerOption
+	dialOpts    []grpc.DialOption
+	monitorOpts []grpcmon.Option
+}
+
+// ServerOptions adds options to the server of the harness.
+func ServerOptions(opts ...grpc.ServerOption) HarnessOption {
+	return func(c *harnessConfig) { c.serverOpts = append(c.serverOpts, opts...) }
+}
+
+// DialOptions adds options to the client connection of the harness.
+func DialOptions(opts ...grpc.DialOption) HarnessOption {
+	return func(c *harnessConfig) { c.dialOpts = append(c.dialOpts, opts...) }
+}
+
+// MonitorOptions adds grpcmon options to both the server and the client
+// instrumentation.
+func MonitorOptions(opts ...grpcmon.Option) HarnessOption {
+	return func(c *harnessConfig) { c.monitorOpts = append(c.monitorOpts, opts...) }
+}
+
+// NewHarness returns a new harness. The server and client are stopped when
+// the test finishes.
+func NewHarness(t testing.TB, opts ...HarnessOption) *Harness {
+	h := &Harness{t: t, lis: bufconn.Listen(1 << 20)}
+	for _, opt := range opts {
+		opt(&h.config)
+	}
+	var serverMetrics *grpcmon.Metrics
+	serverMetrics, h.ServerRecorder = NewRecorder()
+	h.clientMetrics, h.ClientRecorder = NewRecorder()
+	serverOpts := append([]grpc.ServerOption{grpcmon.ServerOption(serverMetrics, h.config.monitorOpts...)}, h.config.serverOpts...)
+	h.Server = grpc.NewServer(serverOpts...)
+	t.Cleanup(h.Stop)
+	return h
+}
+
+// Conn starts the server and returns a client connection to it. Subsequent
+// calls return the same connection.
+func (h *Harness) Conn() *grpc.ClientConn {
+	h.once.Do(func() {
+		go h.Server.Serve(h.lis)
+		dialOpts := append([]grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return h.lis.DialContext(ctx)
+			}),
+			grpcmon.DialOption(h.clientMetrics, h.config.monitorOpts...),
+		}, h.config.dialOpts...)
+		conn, err := grpc.Dial("bufconn", dialOpts...)
+		if err != nil {
+			h.t.Fatalf("grpcmontest: dial: %v", err)
+		}
+		h.conn = conn
+	})
+	return h.conn
+}
+
+// Stop closes the client connection and gracefully stops the server. Once
+// it returns, all metrics of both sides are recorded, including the ones for
+// the connection. It is safe to call Stop multiple times.
+func (h *Harness) Stop() {
+	if h.conn != nil {
+		h.conn.Close()
+	}
+	h.Server.GracefulStop()
+}
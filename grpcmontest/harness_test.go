@@ -0,0 +1,41 @@
+package grpcmontest_test
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+func TestHarness(t *testing.T) {
+	var intercepted bool
+	h := grpcmontest.NewHarness(t,
+		grpcmontest.ServerOptions(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			intercepted = true
+			return handler(ctx, req)
+		})),
+	)
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+
+	if h.Conn() != h.Conn() {
+		t.Error("Conn returned different connections")
+	}
+	pb.NewFrontendClient(h.Conn()).Query(context.Background(), &pb.QueryRequest{})
+	h.Stop()
+	h.Stop()
+
+	if !intercepted {
+		t.Error("server options were not applied")
+	}
+	for _, rec := range []*grpcmontest.Recorder{h.ClientRecorder, h.ServerRecorder} {
+		if got := rec.CounterValue(grpcmontest.ConnsTotal); got != 1 {
+			t.Errorf("connections total = %v, want 1", got)
+		}
+		if got := rec.GaugeValue(grpcmontest.ConnsOpen); got != 0 {
+			t.Errorf("connections open = %v, want 0", got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package grpcmontest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+)
+
+// RandomSequences returns conns sequences with rpcs RPCs spread randomly
+// across them. Each RPC is a randomly chosen canned RPC on one of a few
+// methods of the grpcmontest.Test service, so the result is valid but
+// otherwise arbitrary. The same rnd state yields the same sequences.
+func RandomSequences(rnd *rand.Rand, client bool, conns, rpcs int) []Sequence {
+	seqs := make([]Sequence, conns)
+	for i := range seqs {
+		seqs[i] = Sequence{Name: fmt.Sprintf("random %d", i), Client: client}
+	}
+	codes := []codes.Code{codes.Unavailable, codes.NotFound, codes.Internal, codes.DeadlineExceeded}
+	for i := 0; i < rpcs; i++ {
+		var rpc Sequence
+		switch rnd.Intn(4) {
+		case 0:
+			rpc = UnaryOK(client)
+		case 1:
+			rpc = UnaryError(client, codes[rnd.Intn(len(codes))])
+		case 2:
+			rpc = ServerStream(client, rnd.Intn(5))
+		case 3:
+			rpc = ClientCancel(client)
+		}
+		rpc.RPCs[0].FullMethodName = fmt.Sprintf("/grpcmontest.Test/Method%d", rnd.Intn(3))
+		c := &seqs[rnd.Intn(conns)]
+		c.RPCs = append(c.RPCs, rpc.RPCs[0])
+	}
+	return seqs
+}
+
+// ReplayConcurrent feeds seqs through h like Replay does, but with all
+// connections and all RPCs on them handled concurrently. A connection ends
+// as soon as all of its RPCs began, so that its end races with the rest of
+// their events, as it does in gRPC when a transport closes.
+func ReplayConcurrent(h stats.Handler, seqs []Sequence) {
+	var wg sync.WaitGroup
+	for _, seq := range seqs {
+		wg.Add(1)
+		go func(seq Sequence) {
+			defer wg.Done()
+			replayConcurrent(h, seq)
+		}(seq)
+	}
+	wg.Wait()
+}
+
+func replayConcurrent(h stats.Handler, seq Sequence) {
+	connCtx := h.TagConn(context.Background(), seq.connTagInfo())
+	h.HandleConn(connCtx, &stats.ConnBegin{Client: seq.Client})
+
+	var began, done sync.WaitGroup
+	for _, rpc := range seq.RPCs {
+		began.Add(1)
+		done.Add(1)
+		go func(rpc RPC) {
+			defer done.Done()
+			ctx := connCtx
+			if seq.Client {
+				ctx = context.Background()
+			}
+			ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: rpc.FullMethodName, FailFast: seq.Client})
+			for i, ev := range rpc.Events {
+				h.HandleRPC(ctx, ev)
+				if i == 0 {
+					began.Done()
+				}
+				runtime.Gosched()
+			}
+			if len(rpc.Events) == 0 {
+				began.Done()
+			}
+		}(rpc)
+	}
+	began.Wait()
+	h.HandleConn(connCtx, &stats.ConnEnd{Client: seq.Client})
+	done.Wait()
+}
@@ -0,0 +1,346 @@
+// Package grpcmontest provides utilities for testing code instrumented with
+// grpcmon.
+package grpcmontest // import "github.com/Bo0mer/grpcmon/grpcmontest"
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/metrics"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// Metric names used by the metrics returned by NewRecorder. They match the
+// documented metric names without the grpc_client_ or grpc_server_ prefix.
+const (
+	ConnsOpen      = "connections_open"
+	ConnsTotal     = "connections_total"
+	ConnDuration   = "connection_duration_seconds"
+	ReqsPending    = "requests_pending"
+	ReqsPendingMax = "requests_pending_max"
+	ReqsStarted    = "requests_started_total"
+	ReqsTotal      = "requests_total"
+	Latency        = "latency_seconds"
+	BytesSent      = "sent_bytes"
+	BytesRecv      = "recv_bytes"
+	StreamAge      = "stream_age_seconds"
+	MsgsSent       = "msgs_sent_total"
+	MsgsRecv       = "msgs_received_total"
+	MsgBytesSent   = "msg_sent_bytes"
+	MsgBytesRecv   = "msg_recv_bytes"
+	BytesSentTotal = "sent_bytes_total"
+	BytesRecvTotal = "recv_bytes_total"
+	TTFB           = "first_response_seconds"
+	InterMsgGap    = "inter_message_gap_seconds"
+
+	SubscriberDrops = "subscriber_dropped_total"
+	SLOEvents       = "slo_events_total"
+	SLOBurnRate     = "slo_burn_rate"
+	ErrorDetails    = "error_details_total"
+	ErrorTypes      = "errors_total"
+	ErrorRate       = "error_ratio"
+	ConnChurnSpikes = "connection_churn_spikes_total"
+	// DeadlineOvershoots is only recorded by servers.
+	DeadlineOvershoots = "deadline_overshoot_total"
+	// DeadlineBudget, ReqsNoDeadline, UnknownCalls, ProcessingTime,
+	// ClientCancellations, StreamsPerConnMax and ConnStreams are only
+	// recorded by servers.
+	DeadlineBudget      = "deadline_budget_seconds"
+	ReqsNoDeadline      = "requests_no_deadline_total"
+	UnknownCalls        = "unknown_calls_total"
+	ProcessingTime      = "processing_seconds"
+	ClientCancellations = "client_cancellations_total"
+	StreamsPerConnMax   = "streams_per_connection_max"
+	ConnStreams         = "connection_streams"
+	// DialErrors, DialLatency, PickLatency and Retries are only recorded by
+	// clients.
+	DialErrors  = "dial_errors_total"
+	DialLatency = "dial_latency_seconds"
+	PickLatency = "pick_latency_seconds"
+	Retries     = "retries_total"
+)
+
+// Metric names used by the metrics returned by Recorder.SelfMetrics.
+const (
+	DroppedObservations = "grpcmon_dropped_observations_total"
+	SinkErrors          = "grpcmon_sink_errors_total"
+	UnattributedEvents  = "grpcmon_unattributed_events_total"
+	LabelOverflow       = "grpcmon_label_overflow_total"
+)
+
+// Recorder records every counter add, gauge update and histogram observation
+// made through the metrics returned by NewRecorder, together with their
+// label pairs. It is safe for concurrent use.
+//
+// Query methods accept metric names with or without the grpc_client_ or
+// grpc_server_ prefix, so use separate recorders for clients and servers.
+// Labels are given as alternating key and value pairs, in any order, and
+// must match the recorded label set exactly.
+type Recorder struct {
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	name   string
+	labels map[string]string
+	value  float64
+	obs    []float64
+
+	// markValue and markObs hold the value and number of observations at
+	// the time of the last call to Mark.
+	markValue float64
+	markObs   int
+}
+
+// NewRecorder returns metrics with every field set, all of which record into
+// the returned Recorder.
+func NewRecorder() (*grpcmon.Metrics, *Recorder) {
+	r := &Recorder{series: make(map[string]*series)}
+	return &grpcmon.Metrics{
+		ConnsOpen:      &gauge{r: r, name: ConnsOpen},
+		ConnsTotal:     &counter{r: r, name: ConnsTotal},
+		ConnDuration:   &histogram{r: r, name: ConnDuration},
+		ReqsPending:    &gauge{r: r, name: ReqsPending},
+		ReqsPendingMax: &gauge{r: r, name: ReqsPendingMax},
+		ReqsStarted:    &counter{r: r, name: ReqsStarted},
+		ReqsTotal:      &counter{r: r, name: ReqsTotal},
+		Latency:        &histogram{r: r, name: Latency},
+		BytesSent:      &histogram{r: r, name: BytesSent},
+		BytesRecv:      &histogram{r: r, name: BytesRecv},
+		StreamAge:      &histogram{r: r, name: StreamAge},
+		MsgsSent:       &counter{r: r, name: MsgsSent},
+		MsgsRecv:       &counter{r: r, name: MsgsRecv},
+		MsgBytesSent:   &histogram{r: r, name: MsgBytesSent},
+		MsgBytesRecv:   &histogram{r: r, name: MsgBytesRecv},
+		BytesSentTotal: &counter{r: r, name: BytesSentTotal},
+		BytesRecvTotal: &counter{r: r, name: BytesRecvTotal},
+		TTFB:           &histogram{r: r, name: TTFB},
+		InterMsgGap:    &histogram{r: r, name: InterMsgGap},
+
+		SubscriberDrops:     &counter{r: r, name: SubscriberDrops},
+		SLOEvents:           &counter{r: r, name: SLOEvents},
+		SLOBurnRate:         &gauge{r: r, name: SLOBurnRate},
+		ErrorDetails:        &counter{r: r, name: ErrorDetails},
+		ErrorTypes:          &counter{r: r, name: ErrorTypes},
+		ErrorRate:           &gauge{r: r, name: ErrorRate},
+		DeadlineOvershoots:  &counter{r: r, name: DeadlineOvershoots},
+		DeadlineBudget:      &histogram{r: r, name: DeadlineBudget},
+		ReqsNoDeadline:      &counter{r: r, name: ReqsNoDeadline},
+		UnknownCalls:        &counter{r: r, name: UnknownCalls},
+		ProcessingTime:      &histogram{r: r, name: ProcessingTime},
+		ClientCancellations: &counter{r: r, name: ClientCancellations},
+		StreamsPerConnMax:   &gauge{r: r, name: StreamsPerConnMax},
+		ConnStreams:         &histogram{r: r, name: ConnStreams},
+		ConnChurnSpikes:     &counter{r: r, name: ConnChurnSpikes},
+		DialErrors:          &counter{r: r, name: DialErrors},
+		DialLatency:         &histogram{r: r, name: DialLatency},
+		PickLatency:         &histogram{r: r, name: PickLatency},
+		Retries:             &counter{r: r, name: Retries},
+	}, r
+}
+
+// SelfMetrics returns self metrics with every field set, all of which record
+// into r.
+func (r *Recorder) SelfMetrics() *grpcmon.SelfMetrics {
+	return &grpcmon.SelfMetrics{
+		DroppedObservations: &counter{r: r, name: DroppedObservations},
+		SinkErrors:          &counter{r: r, name: SinkErrors},
+		UnattributedEvents:  &counter{r: r, name: UnattributedEvents},
+		LabelOverflow:       &counter{r: r, name: LabelOverflow},
+	}
+}
+
+// CounterValue returns the value of the counter with the given name and
+// labels, or zero if it was never added to.
+func (r *Recorder) CounterValue(name string, labels ...string) float64 {
+	return r.value(name, labels)
+}
+
+// GaugeValue returns the value of the gauge with the given name and labels,
+// or zero if it was never updated.
+func (r *Recorder) GaugeValue(name string, labels ...string) float64 {
+	return r.value(name, labels)
+}
+
+// Observations returns the values observed by the histogram with the given
+// name and labels, in the order they were observed.
+func (r *Recorder) Observations(name string, labels ...string) []float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.series[key(name, labels)]
+	if !ok {
+		return nil
+	}
+	return append([]float64(nil), s.obs...)
+}
+
+// HistogramCount returns the number of values observed by the histogram with
+// the given name and labels.
+func (r *Recorder) HistogramCount(name string, labels ...string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.series[key(name, labels)]
+	if !ok {
+		return 0
+	}
+	return len(s.obs)
+}
+
+// String returns every recorded series with its value and observations, one
+// per line in the order of names and labels, so that recorders can be
+// compared. The observations of histograms measuring time, the ones with a
+// _seconds suffix, are replaced with their number since they vary between
+// runs.
+func (r *Recorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := make([]string, 0, len(r.series))
+	for k := range r.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		s := r.series[k]
+		fmt.Fprintf(&b, "%s %v", k, s.value)
+		if strings.HasSuffix(s.name, "_seconds") {
+			fmt.Fprintf(&b, " %d observations", len(s.obs))
+		} else if len(s.obs) > 0 {
+			fmt.Fprintf(&b, " %v", s.obs)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Reset discards everything recorded so far.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series = make(map[string]*series)
+}
+
+// Mark records the current state of all metrics. Assertions made afterwards
+// are relative to it.
+func (r *Recorder) Mark() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.series {
+		s.markValue = s.value
+		s.markObs = len(s.obs)
+	}
+}
+
+func (r *Recorder) value(name string, labels []string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.series[key(name, labels)]
+	if !ok {
+		return 0
+	}
+	return s.value
+}
+
+// update calls fn with the series with the given name and labels, creating
+// it if needed.
+func (r *Recorder) update(name string, labels []string, fn func(*series)) {
+	k := key(name, labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.series[k]
+	if !ok {
+		s = &series{name: trimName(name), labels: labelMap(labels)}
+		r.series[k] = s
+	}
+	fn(s)
+}
+
+// key returns a canonical representation of a metric name and its labels.
+func key(name string, labels []string) string {
+	return trimName(name) + formatLabels(labelMap(labels))
+}
+
+// trimName removes the client or server prefix from name.
+func trimName(name string) string {
+	name = strings.TrimPrefix(name, "grpc_client_")
+	return strings.TrimPrefix(name, "grpc_server_")
+}
+
+// labelMap converts alternating key and value pairs to a map. A missing
+// final value is reported as "unknown", like go-kit does.
+func labelMap(labels []string) map[string]string {
+	m := make(map[string]string, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		v := "unknown"
+		if i+1 < len(labels) {
+			v = labels[i+1]
+		}
+		m[labels[i]] = v
+	}
+	return m
+}
+
+// formatLabels returns labels in a canonical, Prometheus-like format.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func with(labels []string, more []string) []string {
+	return append(append([]string(nil), labels...), more...)
+}
+
+type counter struct {
+	r      *Recorder
+	name   string
+	labels []string
+}
+
+func (c *counter) With(labelValues ...string) metrics.Counter {
+	return &counter{r: c.r, name: c.name, labels: with(c.labels, labelValues)}
+}
+
+func (c *counter) Add(delta float64) {
+	c.r.update(c.name, c.labels, func(s *series) { s.value += delta })
+}
+
+type gauge struct {
+	r      *Recorder
+	name   string
+	labels []string
+}
+
+func (g *gauge) With(labelValues ...string) metrics.Gauge {
+	return &gauge{r: g.r, name: g.name, labels: with(g.labels, labelValues)}
+}
+
+func (g *gauge) Set(value float64) {
+	g.r.update(g.name, g.labels, func(s *series) { s.value = value })
+}
+
+func (g *gauge) Add(delta float64) {
+	g.r.update(g.name, g.labels, func(s *series) { s.value += delta })
+}
+
+type histogram struct {
+	r      *Recorder
+	name   string
+	labels []string
+}
+
+func (h *histogram) With(labelValues ...string) metrics.Histogram {
+	return &histogram{r: h.r, name: h.name, labels: with(h.labels, labelValues)}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.r.update(h.name, h.labels, func(s *series) { s.obs = append(s.obs, value) })
+}
@@ -0,0 +1,67 @@
+package grpcmontest_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+func TestRecorder(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+
+	m.ReqsTotal.With("service", "svc", "method", "M", "code", "OK").Add(1)
+	m.ReqsTotal.With("service", "svc", "method", "M").With("code", "OK").Add(2)
+	m.ReqsPending.With("service", "svc", "method", "M").Set(5)
+	m.ReqsPending.With("service", "svc", "method", "M").Add(-1)
+	m.Latency.With("service", "svc", "method", "M", "code", "OK").Observe(0.5)
+	m.Latency.With("service", "svc", "method", "M", "code", "OK").Observe(1.5)
+	m.ConnsTotal.Add(1)
+
+	if got := rec.CounterValue("grpc_server_requests_total", "code", "OK", "service", "svc", "method", "M"); got != 3 {
+		t.Errorf("requests total = %v, want 3", got)
+	}
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, "service", "svc", "method", "M"); got != 0 {
+		t.Errorf("requests total for partial labels = %v, want 0", got)
+	}
+	if got := rec.GaugeValue(grpcmontest.ReqsPending, "service", "svc", "method", "M"); got != 4 {
+		t.Errorf("requests pending = %v, want 4", got)
+	}
+	if got, want := rec.Observations(grpcmontest.Latency, "service", "svc", "method", "M", "code", "OK"), []float64{0.5, 1.5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("latency observations = %v, want %v", got, want)
+	}
+	if got := rec.HistogramCount(grpcmontest.Latency, "service", "svc", "method", "M", "code", "OK"); got != 2 {
+		t.Errorf("latency count = %d, want 2", got)
+	}
+	if got := rec.CounterValue("grpc_client_connections_total"); got != 1 {
+		t.Errorf("connections total = %v, want 1", got)
+	}
+
+	rec.Reset()
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, "service", "svc", "method", "M", "code", "OK"); got != 0 {
+		t.Errorf("requests total after reset = %v, want 0", got)
+	}
+}
+
+func TestRecorderConcurrent(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.ReqsTotal.With("code", "OK").Add(1)
+				m.Latency.With("code", "OK").Observe(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, "code", "OK"); got != 1000 {
+		t.Errorf("requests total = %v, want 1000", got)
+	}
+	if got := len(rec.Observations(grpcmontest.Latency, "code", "OK")); got != 1000 {
+		t.Errorf("latency observations = %d, want 1000", got)
+	}
+}
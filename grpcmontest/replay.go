@@ -0,0 +1,247 @@
+package grpcmontest
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+// Sequence is a scripted sequence of stats events on a single connection.
+type Sequence struct {
+	// Name describes the sequence.
+	Name string
+	// Client reports whether the sequence is seen by a client.
+	Client bool
+	// RemoteAddr and LocalAddr are the addresses of the connection. Nil
+	// values are replaced with placeholder TCP addresses.
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// RPCs are the RPCs made on the connection, in order.
+	RPCs []RPC
+}
+
+// RPC is a scripted RPC.
+type RPC struct {
+	// FullMethodName is the method in the format /package.service/method.
+	FullMethodName string
+	// Events are the stats of the RPC, in order.
+	Events []stats.RPCStats
+}
+
+// Replay feeds seq through h exactly as gRPC would: the connection is tagged
+// and begun, each RPC is tagged and has its events handled in order, and
+// finally the connection ends. As in gRPC, server RPC contexts derive from
+// the connection context while client ones do not.
+func Replay(h stats.Handler, seq Sequence) {
+	connCtx := h.TagConn(context.Background(), seq.connTagInfo())
+	h.HandleConn(connCtx, &stats.ConnBegin{Client: seq.Client})
+	for _, rpc := range seq.RPCs {
+		ctx := connCtx
+		if seq.Client {
+			ctx = context.Background()
+		}
+		ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: rpc.FullMethodName, FailFast: seq.Client})
+		for _, ev := range rpc.Events {
+			h.HandleRPC(ctx, ev)
+		}
+	}
+	h.HandleConn(connCtx, &stats.ConnEnd{Client: seq.Client})
+}
+
+// connTagInfo returns the tag info of the connection of seq.
+func (seq Sequence) connTagInfo() *stats.ConnTagInfo {
+	info := &stats.ConnTagInfo{RemoteAddr: seq.RemoteAddr, LocalAddr: seq.LocalAddr}
+	if info.RemoteAddr == nil {
+		info.RemoteAddr = defaultRemote
+	}
+	if info.LocalAddr == nil {
+		info.LocalAddr = defaultLocal
+	}
+	return info
+}
+
+// Placeholder connection addresses.
+var (
+	defaultRemote net.Addr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	defaultLocal  net.Addr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+)
+
+// Epoch is the time at which all canned sequences begin.
+var Epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Method is the method used by the canned sequences.
+const Method = "/grpcmontest.Test/Method"
+
+// rpcEvents builds the events of a canned RPC.
+type rpcEvents struct {
+	client bool
+	now    time.Time
+	events []stats.RPCStats
+}
+
+func (b *rpcEvents) after(d time.Duration) time.Time {
+	b.now = b.now.Add(d)
+	return b.now
+}
+
+func (b *rpcEvents) begin(clientStream, serverStream bool) *rpcEvents {
+	b.events = append(b.events, &stats.Begin{
+		Client:         b.client,
+		BeginTime:      b.now,
+		FailFast:       b.client,
+		IsClientStream: clientStream,
+		IsServerStream: serverStream,
+	})
+	return b
+}
+
+// request adds the events of the client sending a message.
+func (b *rpcEvents) request(n int) *rpcEvents {
+	if b.client {
+		b.events = append(b.events, &stats.OutPayload{Client: true, Length: n, CompressedLength: n, WireLength: n + 5, SentTime: b.after(time.Millisecond)})
+	} else {
+		b.events = append(b.events, &stats.InPayload{Length: n, CompressedLength: n, WireLength: n + 5, RecvTime: b.after(time.Millisecond)})
+	}
+	return b
+}
+
+// response adds the events of the server sending a message.
+func (b *rpcEvents) response(n int) *rpcEvents {
+	if b.client {
+		b.events = append(b.events, &stats.InPayload{Client: true, Length: n, CompressedLength: n, WireLength: n + 5, RecvTime: b.after(time.Millisecond)})
+	} else {
+		b.events = append(b.events, &stats.OutPayload{Length: n, CompressedLength: n, WireLength: n + 5, SentTime: b.after(time.Millisecond)})
+	}
+	return b
+}
+
+// headers adds the events of the request headers.
+func (b *rpcEvents) headers() *rpcEvents {
+	md := metadata.Pairs("user-agent", "grpcmontest")
+	if b.client {
+		b.events = append(b.events, &stats.OutHeader{Client: true, FullMethod: Method, Header: md})
+	} else {
+		b.events = append(b.events, &stats.InHeader{FullMethod: Method, Header: md, WireLength: 40})
+	}
+	return b
+}
+
+// responseHeaders adds the events of the response headers.
+func (b *rpcEvents) responseHeaders() *rpcEvents {
+	md := metadata.Pairs("content-type", "application/grpc")
+	if b.client {
+		b.events = append(b.events, &stats.InHeader{Client: true, Header: md, WireLength: 20})
+	} else {
+		b.events = append(b.events, &stats.OutHeader{Header: md})
+	}
+	return b
+}
+
+// trailer adds the events of the response trailer.
+func (b *rpcEvents) trailer() *rpcEvents {
+	md := metadata.Pairs("grpc-status", "0")
+	if b.client {
+		b.events = append(b.events, &stats.InTrailer{Client: true, Trailer: md, WireLength: 15})
+	} else {
+		b.events = append(b.events, &stats.OutTrailer{Trailer: md})
+	}
+	return b
+}
+
+func (b *rpcEvents) end(err error) *rpcEvents {
+	b.events = append(b.events, &stats.End{Client: b.client, BeginTime: Epoch, EndTime: b.after(time.Millisecond), Error: err})
+	return b
+}
+
+func newRPC(client bool) *rpcEvents {
+	return &rpcEvents{client: client, now: Epoch}
+}
+
+func sequence(name string, client bool, events *rpcEvents) Sequence {
+	return Sequence{
+		Name:   name,
+		Client: client,
+		RPCs:   []RPC{{FullMethodName: Method, Events: events.events}},
+	}
+}
+
+// UnaryOK returns the sequence of a successful unary RPC with a 10 byte
+// request and a 20 byte response.
+func UnaryOK(client bool) Sequence {
+	return sequence("unary OK", client, newRPC(client).begin(false, false).
+		headers().request(10).responseHeaders().response(20).trailer().end(nil))
+}
+
+// UnaryError returns the sequence of a unary RPC failing with code after
+// receiving a 10 byte request.
+func UnaryError(client bool, code codes.Code) Sequence {
+	return sequence("unary "+code.String(), client, newRPC(client).begin(false, false).
+		headers().request(10).trailer().end(status.Error(code, "grpcmontest")))
+}
+
+// ServerStream returns the sequence of a successful server streaming RPC
+// sending n 20 byte responses.
+func ServerStream(client bool, n int) Sequence {
+	b := newRPC(client).begin(false, true).headers().request(10).responseHeaders()
+	for i := 0; i < n; i++ {
+		b.response(20)
+	}
+	return sequence("server stream", client, b.trailer().end(nil))
+}
+
+// ClientStream returns the sequence of a successful client streaming RPC
+// sending n 10 byte requests.
+func ClientStream(client bool, n int) Sequence {
+	b := newRPC(client).begin(true, false).headers()
+	for i := 0; i < n; i++ {
+		b.request(10)
+	}
+	return sequence("client stream", client, b.responseHeaders().response(20).trailer().end(nil))
+}
+
+// BidiStream returns the sequence of a successful bidirectional streaming
+// RPC exchanging n 10 byte requests and n 20 byte responses.
+func BidiStream(client bool, n int) Sequence {
+	b := newRPC(client).begin(true, true).headers().responseHeaders()
+	for i := 0; i < n; i++ {
+		b.request(10).response(20)
+	}
+	return sequence("bidi stream", client, b.trailer().end(nil))
+}
+
+// ClientCancel returns the sequence of a server streaming RPC that is
+// canceled by the client after the first response.
+func ClientCancel(client bool) Sequence {
+	return sequence("client cancel", client, newRPC(client).begin(false, true).
+		headers().request(10).responseHeaders().response(20).end(status.Error(codes.Canceled, context.Canceled.Error())))
+}
+
+// MissingBegin returns the sequence of a unary RPC whose Begin event was not
+// seen, as happens when a handler is attached mid-flight.
+func MissingBegin(client bool) Sequence {
+	return sequence("missing begin", client, newRPC(client).
+		headers().request(10).responseHeaders().response(20).trailer().end(nil))
+}
+
+// DuplicateEnd returns the sequence of a unary RPC with two End events.
+func DuplicateEnd(client bool) Sequence {
+	return sequence("duplicate end", client, newRPC(client).begin(false, false).
+		headers().request(10).responseHeaders().response(20).trailer().end(nil).end(nil))
+}
+
+// Sequences returns all canned sequences for the given side.
+func Sequences(client bool) []Sequence {
+	return []Sequence{
+		UnaryOK(client),
+		UnaryError(client, codes.Unavailable),
+		ServerStream(client, 3),
+		ClientCancel(client),
+		MissingBegin(client),
+		DuplicateEnd(client),
+	}
+}
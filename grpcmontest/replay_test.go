@@ -0,0 +1,121 @@
+package grpcmontest_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+type ctxKey struct{}
+
+// orderHandler records the order of the calls made to it.
+type orderHandler struct {
+	calls []string
+}
+
+func (h *orderHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	h.calls = append(h.calls, fmt.Sprintf("TagRPC(conn=%v)", ctx.Value(ctxKey{}) != nil))
+	return ctx
+}
+
+func (h *orderHandler) HandleRPC(_ context.Context, s stats.RPCStats) {
+	h.calls = append(h.calls, fmt.Sprintf("HandleRPC(%T)", s))
+}
+
+func (h *orderHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	h.calls = append(h.calls, "TagConn")
+	return context.WithValue(ctx, ctxKey{}, true)
+}
+
+func (h *orderHandler) HandleConn(_ context.Context, s stats.ConnStats) {
+	h.calls = append(h.calls, fmt.Sprintf("HandleConn(%T)", s))
+}
+
+func TestReplay(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		h := &orderHandler{}
+		grpcmontest.Replay(h, grpcmontest.UnaryError(client, codes.Unavailable))
+
+		want := []string{
+			"TagConn",
+			"HandleConn(*stats.ConnBegin)",
+			fmt.Sprintf("TagRPC(conn=%v)", !client),
+			"HandleRPC(*stats.Begin)",
+			"HandleRPC(*stats.InHeader)",
+			"HandleRPC(*stats.InPayload)",
+			"HandleRPC(*stats.OutTrailer)",
+			"HandleRPC(*stats.End)",
+			"HandleConn(*stats.ConnEnd)",
+		}
+		if client {
+			want[4] = "HandleRPC(*stats.OutHeader)"
+			want[5] = "HandleRPC(*stats.OutPayload)"
+			want[6] = "HandleRPC(*stats.InTrailer)"
+		}
+		if !reflect.DeepEqual(h.calls, want) {
+			t.Errorf("client=%v: calls = %q, want %q", client, h.calls, want)
+		}
+	}
+}
+
+func TestSequencesSides(t *testing.T) {
+	for _, client := range []bool{false, true} {
+		for _, seq := range grpcmontest.Sequences(client) {
+			for _, rpc := range seq.RPCs {
+				for _, ev := range rpc.Events {
+					if ev.IsClient() != client {
+						t.Errorf("%s: %T.IsClient() = %v, want %v", seq.Name, ev, ev.IsClient(), client)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRandomSequences(t *testing.T) {
+	a := grpcmontest.RandomSequences(rand.New(rand.NewSource(1)), false, 3, 20)
+	b := grpcmontest.RandomSequences(rand.New(rand.NewSource(1)), false, 3, 20)
+	if len(a) != 3 {
+		t.Fatalf("got %d sequences, want 3", len(a))
+	}
+	n := 0
+	for i := range a {
+		n += len(a[i].RPCs)
+		if len(a[i].RPCs) != len(b[i].RPCs) {
+			t.Fatalf("sequence %d differs for the same seed", i)
+		}
+		for j := range a[i].RPCs {
+			if a[i].RPCs[j].FullMethodName != b[i].RPCs[j].FullMethodName || len(a[i].RPCs[j].Events) != len(b[i].RPCs[j].Events) {
+				t.Errorf("sequence %d RPC %d differs for the same seed", i, j)
+			}
+		}
+	}
+	if n != 20 {
+		t.Errorf("got %d RPCs, want 20", n)
+	}
+}
+
+func TestReplayConcurrent(t *testing.T) {
+	seqs := grpcmontest.RandomSequences(rand.New(rand.NewSource(1)), false, 2, 10)
+	spy, h := grpcmontest.SpyHandler(nil)
+	grpcmontest.ReplayConcurrent(h, seqs)
+	begins, ends := 0, 0
+	for _, ev := range spy.Events() {
+		switch ev {
+		case "HandleConn(*stats.ConnBegin)":
+			begins++
+		case "HandleConn(*stats.ConnEnd)":
+			ends++
+		}
+	}
+	if begins != 2 || ends != 2 {
+		t.Errorf("got %d conn begins and %d ends, want 2 each", begins, ends)
+	}
+}
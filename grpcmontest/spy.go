@@ -0,0 +1,120 @@
+package grpcmontest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/stats"
+)
+
+// Call is a call made to a stats.Handler.
+type Call struct {
+	// Method is the name of the called method: TagRPC, HandleRPC, TagConn
+	// or HandleConn.
+	Method string
+	// Ctx is the context the method was called with.
+	Ctx context.Context
+	// Result is the context returned by TagRPC and TagConn.
+	Result context.Context
+
+	// The remaining fields hold the argument of the call, depending on
+	// Method.
+	RPCTagInfo  *stats.RPCTagInfo
+	ConnTagInfo *stats.ConnTagInfo
+	RPCStats    stats.RPCStats
+	ConnStats   stats.ConnStats
+}
+
+// String describes the call, e.g. "HandleRPC(*stats.End)".
+func (c Call) String() string {
+	switch c.Method {
+	case "HandleRPC":
+		return fmt.Sprintf("HandleRPC(%T)", c.RPCStats)
+	case "HandleConn":
+		return fmt.Sprintf("HandleConn(%T)", c.ConnStats)
+	case "TagRPC":
+		return fmt.Sprintf("TagRPC(%s)", c.RPCTagInfo.FullMethodName)
+	}
+	return c.Method
+}
+
+// Spy records the calls made to the stats.Handler returned by SpyHandler.
+// It is safe for concurrent use.
+type Spy struct {
+	inner stats.Handler
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// SpyHandler returns a stats.Handler that records every call made to it in
+// the returned Spy and then forwards it to inner, if not nil.
+func SpyHandler(inner stats.Handler) (*Spy, stats.Handler) {
+	s := &Spy{inner: inner}
+	return s, (*spyHandler)(s)
+}
+
+// Calls returns the recorded calls in the order they were made.
+func (s *Spy) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// Events returns the descriptions of the recorded calls, see Call.String.
+func (s *Spy) Events() []string {
+	calls := s.Calls()
+	events := make([]string, len(calls))
+	for i, c := range calls {
+		events[i] = c.String()
+	}
+	return events
+}
+
+// Reset discards the recorded calls.
+func (s *Spy) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+}
+
+func (s *Spy) record(c Call) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, c)
+}
+
+type spyHandler Spy
+
+func (h *spyHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	res := ctx
+	if h.inner != nil {
+		res = h.inner.TagRPC(ctx, info)
+	}
+	(*Spy)(h).record(Call{Method: "TagRPC", Ctx: ctx, Result: res, RPCTagInfo: info})
+	return res
+}
+
+func (h *spyHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	(*Spy)(h).record(Call{Method: "HandleRPC", Ctx: ctx, RPCStats: s})
+	if h.inner != nil {
+		h.inner.HandleRPC(ctx, s)
+	}
+}
+
+func (h *spyHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	res := ctx
+	if h.inner != nil {
+		res = h.inner.TagConn(ctx, info)
+	}
+	(*Spy)(h).record(Call{Method: "TagConn", Ctx: ctx, Result: res, ConnTagInfo: info})
+	return res
+}
+
+func (h *spyHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	(*Spy)(h).record(Call{Method: "HandleConn", Ctx: ctx, ConnStats: s})
+	if h.inner != nil {
+		h.inner.HandleConn(ctx, s)
+	}
+}
@@ -0,0 +1,70 @@
+package grpcmontest_test
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+func index(events []string, event string) int {
+	for i, e := range events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestSpyHandler(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	spy, h := grpcmontest.SpyHandler(grpcmon.ServerStatsHandler(m))
+
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+
+	events := spy.Events()
+	tags := 0
+	for _, e := range events {
+		if e == "TagRPC("+grpcmontest.Method+")" {
+			tags++
+		}
+	}
+	if tags != 2 {
+		t.Errorf("TagRPC called %d times, want 2", tags)
+	}
+	if end, trailer := index(events, "HandleRPC(*stats.End)"), index(events, "HandleRPC(*stats.OutTrailer)"); end < trailer {
+		t.Errorf("End at %d came before OutTrailer at %d: %q", end, trailer, events)
+	}
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, "service", "grpcmontest.Test", "method", "Method", "code", "OK"); got != 2 {
+		t.Errorf("inner handler recorded %v requests, want 2", got)
+	}
+
+	// The context returned by the inner TagRPC is the one recorded.
+	calls := spy.Calls()
+	for _, c := range calls {
+		if c.Method == "TagRPC" && c.Result == c.Ctx {
+			t.Error("TagRPC result is the unmodified context")
+		}
+	}
+
+	spy.Reset()
+	if got := len(spy.Calls()); got != 0 {
+		t.Errorf("got %d calls after Reset, want 0", got)
+	}
+}
+
+func TestSpyHandlerNilInner(t *testing.T) {
+	spy, h := grpcmontest.SpyHandler(nil)
+	ctx := context.Background()
+	if got := h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: "/a/b"}); got != ctx {
+		t.Error("TagRPC modified the context")
+	}
+	h.HandleRPC(ctx, &stats.Begin{})
+	if got, want := spy.Events(), []string{"TagRPC(/a/b)", "HandleRPC(*stats.Begin)"}; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
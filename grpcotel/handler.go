@@ -0,0 +1,149 @@
+package grpcotel
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// instrumentationName is the name of the tracer of Handler.
+const instrumentationName = "github.com/Bo0mer/grpcmon/grpcotel"
+
+// Options configures a Handler.
+type Options struct {
+	// TracerProvider creates the tracer of the spans. Defaults to the
+	// global tracer provider.
+	TracerProvider trace.TracerProvider
+	// Propagator propagates span contexts in request metadata. Defaults
+	// to the global propagator.
+	Propagator propagation.TextMapPropagator
+}
+
+// Handler is a stats.Handler that records the metrics of grpcmon and traces
+// every RPC with an OpenTelemetry span, in one pass over the stats events.
+// The recorded metrics are the same as those of the grpcmon handler alone.
+//
+// Spans are named after the full method name without its leading slash and
+// have the rpc.system attribute. They start when the RPC is tagged and end
+// with the RPC, after the grpcmon.WithOnRPCEnd hooks given to the Handler,
+// with the rpc.service, rpc.method and rpc.grpc.status_code attributes of
+// the names and code the metrics are recorded under, overrides by
+// grpcmon.OverrideMethod included. Failed RPCs have an error status. The
+// RPCs excluded by grpcmon.WithFilter are not traced.
+type Handler struct {
+	*grpcmon.Handler
+	client     bool
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// ClientHandler returns a Handler for gRPC clients, which records metrics
+// on m and injects the span context of every RPC into its metadata.
+func ClientHandler(m *grpcmon.Metrics, opts Options, monOpts ...grpcmon.Option) *Handler {
+	h := newHandler(true, opts)
+	h.Handler = grpcmon.ClientStatsHandler(m, monOpts...)
+	return h
+}
+
+// ServerHandler returns a Handler for gRPC servers, which records metrics
+// on m and continues the trace of every RPC from its metadata.
+func ServerHandler(m *grpcmon.Metrics, opts Options, monOpts ...grpcmon.Option) *Handler {
+	h := newHandler(false, opts)
+	h.Handler = grpcmon.ServerStatsHandler(m, monOpts...)
+	return h
+}
+
+func newHandler(client bool, opts Options) *Handler {
+	if opts.TracerProvider == nil {
+		opts.TracerProvider = otel.GetTracerProvider()
+	}
+	if opts.Propagator == nil {
+		opts.Propagator = otel.GetTextMapPropagator()
+	}
+	return &Handler{
+		client:     client,
+		tracer:     opts.TracerProvider.Tracer(instrumentationName),
+		propagator: opts.Propagator,
+	}
+}
+
+// TagRPC implements the stats.Handler interface.
+func (h *Handler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return h.Handler.TagRPCFunc(ctx, info, func(ctx context.Context, _, _ string) (context.Context, interface{}) {
+		return h.startSpan(ctx, info.FullMethodName)
+	}, endSpan)
+}
+
+// startSpan starts the span of the RPC of fullMethod with context ctx.
+func (h *Handler) startSpan(ctx context.Context, fullMethod string) (context.Context, trace.Span) {
+	kind := trace.SpanKindServer
+	if h.client {
+		kind = trace.SpanKindClient
+	} else {
+		md, _ := metadata.FromIncomingContext(ctx)
+		ctx = h.propagator.Extract(ctx, metadataCarrier(md))
+	}
+	ctx, span := h.tracer.Start(ctx, strings.TrimPrefix(fullMethod, "/"),
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc")),
+	)
+	if h.client {
+		md := metadata.MD{}
+		h.propagator.Inject(ctx, metadataCarrier(md))
+		for k, vs := range md {
+			for _, v := range vs {
+				ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+			}
+		}
+	}
+	return ctx, span
+}
+
+// endSpan ends the span started by startSpan, the tag of the RPC of s, with
+// the names the RPC is recorded under.
+func endSpan(tag interface{}, service, method string, s *stats.End) {
+	span := tag.(trace.Span)
+	code := status.Code(s.Error)
+	span.SetAttributes(
+		attribute.String("rpc.service", service),
+		attribute.String("rpc.method", method),
+		attribute.Int("rpc.grpc.status_code", int(code)),
+	)
+	if code != codes.OK {
+		span.SetStatus(otelcodes.Error, status.Convert(s.Error).Message())
+	}
+	span.End(trace.WithTimestamp(s.EndTime))
+}
+
+// metadataCarrier adapts metadata to propagation.TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if vs := metadata.MD(c).Get(key); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
@@ -0,0 +1,144 @@
+package grpcotel_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/grpcotel"
+)
+
+// TestHandlerMetrics replays the canned sequences through the combined and
+// the standalone handler and compares the metrics they record.
+func TestHandlerMetrics(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	for _, client := range []bool{false, true} {
+		for _, seq := range grpcmontest.Sequences(client) {
+			want, wantRec := grpcmontest.NewRecorder()
+			got, gotRec := grpcmontest.NewRecorder()
+			opts := grpcotel.Options{TracerProvider: tp}
+			standalone, combined := grpcmon.ServerStatsHandler(want), grpcotel.ServerHandler(got, opts)
+			if client {
+				standalone, combined = grpcmon.ClientStatsHandler(want), grpcotel.ClientHandler(got, opts)
+			}
+			grpcmontest.Replay(standalone, seq)
+			grpcmontest.Replay(combined, seq)
+			if g, w := gotRec.String(), wantRec.String(); g != w {
+				t.Errorf("%s client=%v: got metrics\n%s\nwant\n%s", seq.Name, client, g, w)
+			}
+		}
+	}
+}
+
+func TestHandlerSpans(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	opts := grpcotel.Options{TracerProvider: tp, Propagator: propagation.TraceContext{}}
+	m, _ := grpcmontest.NewRecorder()
+	grpcmontest.Replay(grpcotel.ServerHandler(m, opts), grpcmontest.UnaryError(false, codes.NotFound))
+	grpcmontest.Replay(grpcotel.ServerHandler(m, opts), grpcmontest.UnaryOK(false))
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	failed := spans[0]
+	if failed.Name() != "grpcmontest.Test/Method" || failed.SpanKind() != trace.SpanKindServer {
+		t.Errorf("span = %s %v", failed.Name(), failed.SpanKind())
+	}
+	if failed.Status().Code != otelcodes.Error || failed.Status().Description != "grpcmontest" {
+		t.Errorf("status = %+v", failed.Status())
+	}
+	attrs := make(map[string]string)
+	for _, kv := range failed.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	for k, v := range map[string]string{
+		"rpc.system":           "grpc",
+		"rpc.service":          "grpcmontest.Test",
+		"rpc.method":           "Method",
+		"rpc.grpc.status_code": "5",
+	} {
+		if attrs[k] != v {
+			t.Errorf("%s = %q, want %q", k, attrs[k], v)
+		}
+	}
+	if !failed.EndTime().Equal(grpcmontest.Epoch.Add(2 * time.Millisecond)) {
+		t.Errorf("end time = %v", failed.EndTime())
+	}
+	if spans[1].Status().Code != otelcodes.Unset {
+		t.Errorf("status of OK RPC = %+v", spans[1].Status())
+	}
+}
+
+func TestHandlerPropagation(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	opts := grpcotel.Options{TracerProvider: tp, Propagator: propagation.TraceContext{}}
+	m, _ := grpcmontest.NewRecorder()
+	client := grpcotel.ClientHandler(m, opts)
+	ctx := client.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if len(md.Get("traceparent")) != 1 {
+		t.Fatalf("outgoing metadata = %v, want a traceparent", md)
+	}
+
+	server := grpcotel.ServerHandler(m, opts)
+	sctx := server.TagRPC(metadata.NewIncomingContext(context.Background(), md), &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+	if got, want := trace.SpanContextFromContext(sctx).TraceID(), trace.SpanContextFromContext(ctx).TraceID(); got != want {
+		t.Errorf("server trace = %v, want %v", got, want)
+	}
+}
+
+func TestHandlerOverrideMethod(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	m, mrec := grpcmontest.NewRecorder()
+	h := grpcotel.ServerHandler(m, grpcotel.Options{TracerProvider: tp})
+	ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: grpcmontest.Epoch})
+	grpcmon.OverrideMethod(ctx, "logical.Service", "Call")
+	h.HandleRPC(ctx, &stats.End{BeginTime: grpcmontest.Epoch, EndTime: grpcmontest.Epoch.Add(time.Millisecond)})
+
+	spans := rec.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	attrs := make(map[string]string)
+	for _, kv := range spans[0].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	for k, v := range map[string]string{
+		"rpc.service":          "logical.Service",
+		"rpc.method":           "Call",
+		"rpc.grpc.status_code": "0",
+	} {
+		if attrs[k] != v {
+			t.Errorf("%s = %q, want %q", k, attrs[k], v)
+		}
+	}
+	if got := mrec.CounterValue(grpcmontest.ReqsTotal, "service", "logical.Service", "method", "Call", "code", "OK"); got != 1 {
+		t.Errorf("requests total under the override = %v, want 1", got)
+	}
+}
+
+func TestHandlerFiltered(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	m, _ := grpcmontest.NewRecorder()
+	h := grpcotel.ServerHandler(m, grpcotel.Options{TracerProvider: tp}, grpcmon.ExcludeServices("grpcmontest.Test"))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	if n := len(rec.Started()); n != 0 {
+		t.Errorf("started %d spans for a filtered RPC, want none", n)
+	}
+}
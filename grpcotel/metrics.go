@@ -0,0 +1,191 @@
+package grpcotel
+
+import (
+	"context"
+	"errors"
+
+	kitmetrics "github.com/go-kit/kit/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// NewClientMetrics returns metrics for gRPC clients with the names of the
+// metrics documented by grpcmon, backed by instruments created with meter.
+// Labels are recorded as attributes. Histograms use the default buckets of
+// grpcmon, counters are Int64Counters, gauges updated by adding are
+// Int64UpDownCounters and gauges updated by setting are Float64Gauges. The
+// metrics are returned along with any error creating instruments.
+func NewClientMetrics(meter metric.Meter) (*grpcmon.Metrics, error) {
+	return newMetrics(meter, "client")
+}
+
+// NewServerMetrics is like NewClientMetrics for gRPC servers.
+func NewServerMetrics(meter metric.Meter) (*grpcmon.Metrics, error) {
+	return newMetrics(meter, "server")
+}
+
+func newMetrics(meter metric.Meter, side string) (*grpcmon.Metrics, error) {
+	sent, recv := "requests", "responses"
+	if side == "server" {
+		sent, recv = recv, sent
+	}
+	b := &builder{meter: meter, prefix: "grpc_" + side + "_"}
+	latency, bytes := grpcmon.DefaultLatencyBuckets, grpcmon.DefaultBytesBuckets
+	m := &grpcmon.Metrics{
+		ConnsOpen:       b.upDownCounter("connections_open", "Number of gRPC "+side+" connections open."),
+		ConnsTotal:      b.counter("connections_total", "Total number of gRPC "+side+" connections opened."),
+		ConnDuration:    b.histogram("connection_duration_seconds", "Duration of gRPC "+side+" connections.", "s", grpcmon.DefaultConnDurationBuckets),
+		ReqsPending:     b.upDownCounter("requests_pending", "Number of gRPC "+side+" requests pending."),
+		ReqsPendingMax:  b.gauge("requests_pending_max", "Highest number of gRPC "+side+" requests pending since last reset."),
+		ReqsStarted:     b.counter("requests_started_total", "Total number of gRPC "+side+" requests started."),
+		ReqsTotal:       b.counter("requests_total", "Total number of gRPC "+side+" requests completed."),
+		Latency:         b.histogram("latency_seconds", "Latency of gRPC "+side+" requests.", "s", latency),
+		BytesRecv:       b.histogram("recv_bytes", "Bytes received in gRPC "+side+" "+recv+".", "By", bytes),
+		BytesSent:       b.histogram("sent_bytes", "Bytes sent in gRPC "+side+" "+sent+".", "By", bytes),
+		StreamAge:       b.histogram("stream_age_seconds", "Age of long-lived gRPC "+side+" requests in flight.", "s", latency),
+		MsgsSent:        b.counter("msgs_sent_total", "Total number of messages sent in gRPC "+side+" "+sent+"."),
+		MsgsRecv:        b.counter("msgs_received_total", "Total number of messages received in gRPC "+side+" "+recv+"."),
+		MsgBytesSent:    b.histogram("msg_sent_bytes", "Uncompressed sizes of messages sent in gRPC "+side+" "+sent+".", "By", bytes),
+		MsgBytesRecv:    b.histogram("msg_recv_bytes", "Uncompressed sizes of messages received in gRPC "+side+" "+recv+".", "By", bytes),
+		BytesSentTotal:  b.counter("sent_bytes_total", "Total number of bytes sent in gRPC "+side+" "+sent+"."),
+		BytesRecvTotal:  b.counter("recv_bytes_total", "Total number of bytes received in gRPC "+side+" "+recv+"."),
+		TTFB:            b.histogram("first_response_seconds", "Time until the first response message of gRPC "+side+" requests.", "s", latency),
+		InterMsgGap:     b.histogram("inter_message_gap_seconds", "Time between consecutive messages of gRPC "+side+" requests.", "s", latency),
+		SubscriberDrops: b.counter("subscriber_dropped_total", "Total number of RPC summaries dropped by slow subscribers."),
+		SLOEvents:       b.counter("slo_events_total", "Total number of gRPC "+side+" requests classified by their SLO."),
+		SLOBurnRate:     b.gauge("slo_burn_rate", "Error budget burn rate of gRPC "+side+" requests."),
+		ErrorDetails:    b.counter("error_details_total", "Total number of error details returned to gRPC "+side+" requests."),
+		ErrorTypes:      b.counter("errors_total", "Total number of gRPC "+side+" requests failed, by the type of their error."),
+		ErrorRate:       b.gauge("error_ratio", "Ratio of failed gRPC "+side+" requests over a rolling window."),
+		ConnChurnSpikes: b.counter("connection_churn_spikes_total", "Total number of spikes of gRPC "+side+" connections opened."),
+	}
+	if side == "server" {
+		m.DeadlineOvershoots = b.counter("deadline_overshoot_total", "Total number of gRPC server requests handled past the deadline of their client.")
+		m.DeadlineBudget = b.histogram("deadline_budget_seconds", "Time left until the deadline of gRPC server requests as they begin.", "s", latency)
+		m.ReqsNoDeadline = b.counter("requests_no_deadline_total", "Total number of gRPC server requests begun without a deadline.")
+		m.UnknownCalls = b.counter("unknown_calls_total", "Total number of gRPC server calls to unknown services and methods.")
+		m.ClientCancellations = b.counter("client_cancellations_total", "Total number of gRPC server requests canceled by their client before they were handled.")
+		m.ProcessingTime = b.histogram("processing_seconds", "Time gRPC server requests take from their first request message to their first response message.", "s", latency)
+		m.StreamsPerConnMax = b.gauge("streams_per_connection_max", "Highest number of streams open at once on a gRPC server connection since last reset.")
+		m.ConnStreams = b.histogram("connection_streams", "Highest number of streams open at once on gRPC server connections.", "{stream}", grpcmon.DefaultConnStreamsBuckets)
+	} else {
+		m.DialErrors = b.counter("dial_errors_total", "Total number of gRPC client dials failed.")
+		m.DialLatency = b.histogram("dial_latency_seconds", "Latency of successful gRPC client dials.", "s", latency)
+		m.PickLatency = b.histogram("pick_latency_seconds", "Time gRPC client requests wait for a connection before sending their headers.", "s", latency)
+		m.Retries = b.counter("retries_total", "Total number of gRPC client request attempts after the first.")
+	}
+	return m, b.err
+}
+
+// builder creates metrics with instruments of a meter, collecting the errors
+// of doing so.
+type builder struct {
+	meter  metric.Meter
+	prefix string
+	err    error
+}
+
+func (b *builder) counter(name, desc string) kitmetrics.Counter {
+	c, err := b.meter.Int64Counter(b.prefix+name, metric.WithDescription(desc))
+	b.err = errors.Join(b.err, err)
+	return &counter{c: c}
+}
+
+func (b *builder) upDownCounter(name, desc string) kitmetrics.Gauge {
+	c, err := b.meter.Int64UpDownCounter(b.prefix+name, metric.WithDescription(desc))
+	b.err = errors.Join(b.err, err)
+	return &upDownCounter{c: c}
+}
+
+func (b *builder) gauge(name, desc string) kitmetrics.Gauge {
+	g, err := b.meter.Float64Gauge(b.prefix+name, metric.WithDescription(desc))
+	b.err = errors.Join(b.err, err)
+	return &gauge{g: g}
+}
+
+func (b *builder) histogram(name, desc, unit string, buckets []float64) kitmetrics.Histogram {
+	h, err := b.meter.Float64Histogram(b.prefix+name, metric.WithDescription(desc), metric.WithUnit(unit), metric.WithExplicitBucketBoundaries(buckets...))
+	b.err = errors.Join(b.err, err)
+	return &histogram{h: h}
+}
+
+// labels are alternating label names and values.
+type labels []string
+
+func (l labels) with(more []string) labels {
+	return append(l[:len(l):len(l)], more...)
+}
+
+// attributes returns l as attributes. A missing final value is reported as
+// "unknown", like go-kit does.
+func (l labels) attributes() metric.MeasurementOption {
+	attrs := make([]attribute.KeyValue, 0, (len(l)+1)/2)
+	for i := 0; i < len(l); i += 2 {
+		v := "unknown"
+		if i+1 < len(l) {
+			v = l[i+1]
+		}
+		attrs = append(attrs, attribute.String(l[i], v))
+	}
+	return metric.WithAttributes(attrs...)
+}
+
+type counter struct {
+	c      metric.Int64Counter
+	labels labels
+}
+
+func (c *counter) With(labelValues ...string) kitmetrics.Counter {
+	return &counter{c: c.c, labels: c.labels.with(labelValues)}
+}
+
+func (c *counter) Add(delta float64) {
+	c.c.Add(context.Background(), int64(delta), c.labels.attributes())
+}
+
+// upDownCounter is a gauge that is only added to; Set has no effect.
+type upDownCounter struct {
+	c      metric.Int64UpDownCounter
+	labels labels
+}
+
+func (g *upDownCounter) With(labelValues ...string) kitmetrics.Gauge {
+	return &upDownCounter{c: g.c, labels: g.labels.with(labelValues)}
+}
+
+func (g *upDownCounter) Set(float64) {}
+
+func (g *upDownCounter) Add(delta float64) {
+	g.c.Add(context.Background(), int64(delta), g.labels.attributes())
+}
+
+// gauge is a gauge that is only set; Add has no effect.
+type gauge struct {
+	g      metric.Float64Gauge
+	labels labels
+}
+
+func (g *gauge) With(labelValues ...string) kitmetrics.Gauge {
+	return &gauge{g: g.g, labels: g.labels.with(labelValues)}
+}
+
+func (g *gauge) Set(value float64) {
+	g.g.Record(context.Background(), value, g.labels.attributes())
+}
+
+func (g *gauge) Add(float64) {}
+
+type histogram struct {
+	h      metric.Float64Histogram
+	labels labels
+}
+
+func (h *histogram) With(labelValues ...string) kitmetrics.Histogram {
+	return &histogram{h: h.h, labels: h.labels.with(labelValues)}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.h.Record(context.Background(), value, h.labels.attributes())
+}
@@ -0,0 +1,105 @@
+package grpcotel_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthgrpc "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcotel"
+)
+
+func TestNewMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("grpcotel")
+	client, err := grpcotel.NewClientMetrics(meter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := grpcotel.NewServerMetrics(meter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpcmon.ServerOption(server))
+	healthgrpc.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpcmon.DialOption(client),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := healthgrpc.NewHealthClient(conn).Check(context.Background(), &healthgrpc.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	srv.GracefulStop()
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]metricdata.Aggregation)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			got[m.Name] = m.Data
+		}
+	}
+	withCode := attribute.NewSet(
+		attribute.String("service", "grpc.health.v1.Health"),
+		attribute.String("method", "Check"),
+		attribute.String("code", "OK"),
+	)
+	method := attribute.NewSet(
+		attribute.String("service", "grpc.health.v1.Health"),
+		attribute.String("method", "Check"),
+	)
+	for _, side := range []string{"client", "server"} {
+		if v := sumValue(t, got["grpc_"+side+"_requests_total"], withCode); v != 1 {
+			t.Errorf("%s requests total = %d, want 1", side, v)
+		}
+		if v := sumValue(t, got["grpc_"+side+"_requests_pending"], method); v != 0 {
+			t.Errorf("%s requests pending = %d, want 0", side, v)
+		}
+		if v := sumValue(t, got["grpc_"+side+"_connections_total"], *attribute.EmptySet()); v != 1 {
+			t.Errorf("%s connections total = %d, want 1", side, v)
+		}
+		h, ok := got["grpc_"+side+"_latency_seconds"].(metricdata.Histogram[float64])
+		if !ok {
+			t.Fatalf("%s latency = %T, want a histogram", side, got["grpc_"+side+"_latency_seconds"])
+		}
+		if len(h.DataPoints) != 1 || !h.DataPoints[0].Attributes.Equals(&withCode) || h.DataPoints[0].Count != 1 {
+			t.Errorf("%s latency data points = %+v", side, h.DataPoints)
+		}
+	}
+}
+
+// sumValue returns the value of the data point of sum with the given
+// attributes.
+func sumValue(t *testing.T, sum metricdata.Aggregation, attrs attribute.Set) int64 {
+	t.Helper()
+	s, ok := sum.(metricdata.Sum[int64])
+	if !ok {
+		t.Fatalf("got %T, want an int64 sum", sum)
+	}
+	for _, dp := range s.DataPoints {
+		if dp.Attributes.Equals(&attrs) {
+			return dp.Value
+		}
+	}
+	t.Fatalf("no data point with attributes %v", attrs.Encoded(attribute.DefaultEncoder()))
+	return 0
+}
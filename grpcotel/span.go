@@ -0,0 +1,51 @@
+// Package grpcotel integrates grpcmon with OpenTelemetry, either by
+// annotating the spans of another stats handler with WithSpanAttributes or
+// by tracing RPCs along with recording metrics with ClientHandler and
+// ServerHandler. NewClientMetrics and NewServerMetrics record the metrics
+// themselves with OpenTelemetry instruments.
+package grpcotel // import "github.com/Bo0mer/grpcmon/grpcotel"
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/status"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// Attribute keys set by WithSpanAttributes besides the semantic convention
+// ones.
+const (
+	MsgsSentKey  = attribute.Key("grpcmon.messages_sent")
+	MsgsRecvKey  = attribute.Key("grpcmon.messages_received")
+	BytesSentKey = attribute.Key("grpcmon.bytes_sent")
+	BytesRecvKey = attribute.Key("grpcmon.bytes_received")
+)
+
+// WithSpanAttributes annotates the span active in the context of every
+// completed RPC with the service, method and code grpcmon records the RPC
+// under, as rpc.service, rpc.method and rpc.grpc.status_code, along with its
+// message and byte totals. This keeps span attributes and metric labels in
+// agreement when spans are created by another stats handler. Nothing is done
+// if the span is not recording.
+func WithSpanAttributes() grpcmon.Option {
+	return grpcmon.WithOnRPCEnd(annotate)
+}
+
+func annotate(ctx context.Context, s grpcmon.RPCSummary) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(
+		attribute.String("rpc.service", s.Service),
+		attribute.String("rpc.method", s.Method),
+		attribute.Int("rpc.grpc.status_code", int(status.Code(s.Err))),
+		MsgsSentKey.Int64(s.MsgsSent),
+		MsgsRecvKey.Int64(s.MsgsRecv),
+		BytesSentKey.Int64(s.BytesSent),
+		BytesRecvKey.Int64(s.BytesRecv),
+	)
+}
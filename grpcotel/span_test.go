@@ -0,0 +1,79 @@
+package grpcotel_test
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/grpcotel"
+)
+
+// tracingHandler starts a span in TagRPC and ends it after End, like
+// tracing stats handlers do.
+type tracingHandler struct {
+	stats.Handler
+	tp *sdktrace.TracerProvider
+}
+
+func (h *tracingHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	ctx, _ = h.tp.Tracer("test").Start(ctx, info.FullMethodName)
+	return h.Handler.TagRPC(ctx, info)
+}
+
+func TestWithSpanAttributes(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	m, _ := grpcmontest.NewRecorder()
+	h := &tracingHandler{Handler: grpcmon.ServerStatsHandler(m, grpcotel.WithSpanAttributes()), tp: tp}
+
+	seq := grpcmontest.UnaryError(false, codes.NotFound)
+	var spans []context.Context
+	spy, sh := grpcmontest.SpyHandler(h)
+	grpcmontest.Replay(sh, seq)
+	for _, c := range spy.Calls() {
+		if c.Method == "TagRPC" {
+			spans = append(spans, c.Result)
+		}
+	}
+	if len(spans) != 1 {
+		t.Fatalf("got %d RPCs, want 1", len(spans))
+	}
+	span := oteltrace.SpanFromContext(spans[0])
+	span.End()
+
+	ended := rec.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("got %d spans, want 1", len(ended))
+	}
+	got := make(map[attribute.Key]attribute.Value)
+	for _, kv := range ended[0].Attributes() {
+		got[kv.Key] = kv.Value
+	}
+	for k, want := range map[attribute.Key]attribute.Value{
+		"rpc.service":          attribute.StringValue("grpcmontest.Test"),
+		"rpc.method":           attribute.StringValue("Method"),
+		"rpc.grpc.status_code": attribute.IntValue(int(codes.NotFound)),
+		grpcotel.MsgsRecvKey:   attribute.Int64Value(1),
+		grpcotel.BytesRecvKey:  attribute.Int64Value(40 + 15),
+		grpcotel.MsgsSentKey:   attribute.Int64Value(0),
+		grpcotel.BytesSentKey:  attribute.Int64Value(12),
+	} {
+		if got[k] != want {
+			t.Errorf("%s = %v, want %v", k, got[k].Emit(), want.Emit())
+		}
+	}
+}
+
+func TestWithSpanAttributesNoSpan(t *testing.T) {
+	m, _ := grpcmontest.NewRecorder()
+	// Must not panic without a span in the context.
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m, grpcotel.WithSpanAttributes()), grpcmontest.UnaryOK(false))
+}
@@ -0,0 +1,55 @@
+package grpcpprof_test
+
+import (
+	"context"
+	"runtime/pprof"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"github.com/Bo0mer/grpcmon/grpcpprof"
+)
+
+func checkLabels(t *testing.T, ctx context.Context) {
+	t.Helper()
+	for k, want := range map[string]string{"grpc_service": "test.Test", "grpc_method": "Query"} {
+		if got, _ := pprof.Label(ctx, k); got != want {
+			t.Errorf("label %s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	called := false
+	_, err := grpcpprof.UnaryServerInterceptor()(context.Background(), nil,
+		&grpc.UnaryServerInfo{FullMethod: "/test.Test/Query"},
+		func(ctx context.Context, _ interface{}) (interface{}, error) {
+			called = true
+			checkLabels(t, ctx)
+			return nil, nil
+		})
+	if err != nil || !called {
+		t.Fatalf("handler called = %v, err = %v", called, err)
+	}
+}
+
+type stream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *stream) Context() context.Context { return s.ctx }
+
+func TestStreamServerInterceptor(t *testing.T) {
+	called := false
+	err := grpcpprof.StreamServerInterceptor()(nil, &stream{ctx: context.Background()},
+		&grpc.StreamServerInfo{FullMethod: "/test.Test/Query"},
+		func(_ interface{}, ss grpc.ServerStream) error {
+			called = true
+			checkLabels(t, ss.Context())
+			return nil
+		})
+	if err != nil || !called {
+		t.Fatalf("handler called = %v, err = %v", called, err)
+	}
+}
@@ -0,0 +1,64 @@
+package grpcprom
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// Metrics are grpcmon metrics backed by Prometheus collectors, as returned
+// by NewClientMetrics and NewServerMetrics, which are given to grpcmon as
+// their embedded *grpcmon.Metrics.
+type Metrics struct {
+	*grpcmon.Metrics
+	collectors []prometheus.Collector
+}
+
+// metrics returns the Metrics of m, backed by the collectors of b.
+func (b *builder) metrics(m *grpcmon.Metrics) *Metrics {
+	return &Metrics{Metrics: m, collectors: b.collectors}
+}
+
+// Collectors returns the collectors backing m, for registering them with
+// registries other than the one m was created with.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return append([]prometheus.Collector(nil), m.collectors...)
+}
+
+// Register registers the collectors backing ms with reg. It returns an
+// error, and registers nothing, if any of them is already registered.
+// Metrics created with a nil registry are registered with none until then.
+func Register(reg prometheus.Registerer, ms ...*Metrics) error {
+	b := new(builder)
+	for _, m := range ms {
+		if m == nil {
+			return errors.New("grpcprom: nil metrics")
+		}
+		b.collectors = append(b.collectors, m.collectors...)
+	}
+	return b.register(reg)
+}
+
+// MustRegister is like Register, but panics if registering fails.
+func MustRegister(reg prometheus.Registerer, ms ...*Metrics) {
+	if err := Register(reg, ms...); err != nil {
+		panic(err)
+	}
+}
+
+// Handler returns an HTTP handler serving ms, and nothing else, in the
+// Prometheus exposition format, for services that do not export other
+// Prometheus metrics. It registers them with a registry of its own, which
+// fails if ms includes metrics with the same names, such as two sets of
+// client metrics.
+func Handler(ms ...*Metrics) (http.Handler, error) {
+	reg := prometheus.NewRegistry()
+	if err := Register(reg, ms...); err != nil {
+		return nil, err
+	}
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{}), nil
+}
@@ -0,0 +1,104 @@
+package grpcprom_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcprom"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+type frontend struct{}
+
+func (*frontend) Query(context.Context, *pb.QueryRequest) (*pb.QueryResponse, error) {
+	return &pb.QueryResponse{}, nil
+}
+
+func TestHandler(t *testing.T) {
+	client, err := grpcprom.NewClientMetrics(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := grpcprom.NewServerMetrics(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := grpcprom.Handler(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(grpcmon.ServerOption(server.Metrics))
+	pb.RegisterFrontendServer(srv, &frontend{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpcmon.DialOption(client.Metrics),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`grpc_client_requests_total{code="OK",method="Query",service="frontend.Frontend"} 1`,
+		`grpc_server_requests_total{code="OK",method="Query",service="frontend.Frontend"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape does not contain %s:\n%s", want, body)
+		}
+	}
+}
+
+func TestHandlerDuplicate(t *testing.T) {
+	a, _ := grpcprom.NewClientMetrics(nil)
+	b, _ := grpcprom.NewClientMetrics(nil)
+	if _, err := grpcprom.Handler(a, b); err == nil {
+		t.Error("Handler with two sets of client metrics succeeded")
+	}
+	if _, err := grpcprom.Handler((*grpcprom.Metrics)(nil)); err == nil {
+		t.Error("Handler with nil metrics succeeded")
+	}
+}
+
+func TestCollectors(t *testing.T) {
+	m, _ := grpcprom.NewServerMetrics(nil)
+	reg := prometheus.NewRegistry()
+	for _, c := range m.Collectors() {
+		reg.MustRegister(c)
+	}
+	if err := grpcprom.Register(reg, m); err == nil {
+		t.Error("Register after registering the collectors succeeded")
+	}
+}
+
+func TestMustRegister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, _ := grpcprom.NewServerMetrics(nil)
+	grpcprom.MustRegister(reg, m)
+	defer func() {
+		if recover() == nil {
+			t.Error("registering the same metrics twice did not panic")
+		}
+	}()
+	grpcprom.MustRegister(reg, m)
+}
@@ -0,0 +1,126 @@
+package grpcprom
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	metrics "github.com/go-kit/kit/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IntCounter is a go-kit counter backed by an integer per series, and the
+// Prometheus collector exporting them as a counter family. Counters summing
+// float64 values stop growing by small increments past 2^53, about 9 PB for
+// byte counts, whereas IntCounter counts exactly up to 2^64, whatever the
+// implementation of client_golang counters, and only converts to float64 as
+// it is scraped. NewClientMetrics and NewServerMetrics back BytesSentTotal
+// and BytesRecvTotal with it.
+//
+// Deltas are truncated to integers, and negative ones panic, as they do
+// for Prometheus counters.
+type IntCounter struct {
+	vec *intCounterVec
+	lvs []string
+	// s is the series of lvs once they give a value to every label, so
+	// that adding to it does not look it up.
+	s *intSeries
+}
+
+type intCounterVec struct {
+	desc       *prometheus.Desc
+	labelNames []string
+	series     sync.Map // joined label values -> *intSeries
+}
+
+type intSeries struct {
+	values []string
+	n      atomic.Uint64
+}
+
+// NewIntCounter returns an IntCounter with the given options and label
+// names, which is to be registered like any other collector.
+func NewIntCounter(opts prometheus.CounterOpts, labelNames []string) *IntCounter {
+	name := prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name)
+	desc := prometheus.NewDesc(name, opts.Help, labelNames, opts.ConstLabels)
+	return newIntCounter(&intCounterVec{desc: desc, labelNames: labelNames}, nil)
+}
+
+func newIntCounter(vec *intCounterVec, lvs []string) *IntCounter {
+	c := &IntCounter{vec: vec, lvs: lvs}
+	if values, complete := c.values(); complete {
+		c.s = vec.get(values)
+	}
+	return c
+}
+
+// With implements metrics.Counter.
+func (c *IntCounter) With(labelValues ...string) metrics.Counter {
+	return newIntCounter(c.vec, append(c.lvs[:len(c.lvs):len(c.lvs)], labelValues...))
+}
+
+// Add implements metrics.Counter.
+func (c *IntCounter) Add(delta float64) {
+	if delta < 0 {
+		panic("grpcprom: counter cannot decrease in value")
+	}
+	c.series().n.Add(uint64(delta))
+}
+
+// Value returns the exact value of the series of c.
+func (c *IntCounter) Value() uint64 {
+	return c.series().n.Load()
+}
+
+// series returns the series of c, creating it if needed.
+func (c *IntCounter) series() *intSeries {
+	if c.s != nil {
+		return c.s
+	}
+	values, _ := c.values()
+	return c.vec.get(values)
+}
+
+// values returns the label values of c in the order of the label names, and
+// whether every label has one. Labels without a value are empty.
+func (c *IntCounter) values() (values []string, complete bool) {
+	values = make([]string, len(c.vec.labelNames))
+	set := make([]bool, len(values))
+	for i := 0; i+1 < len(c.lvs); i += 2 {
+		for j, name := range c.vec.labelNames {
+			if name == c.lvs[i] {
+				values[j], set[j] = c.lvs[i+1], true
+			}
+		}
+	}
+	for _, ok := range set {
+		if !ok {
+			return values, false
+		}
+	}
+	return values, true
+}
+
+// get returns the series of the given label values, creating it if needed.
+func (v *intCounterVec) get(values []string) *intSeries {
+	key := strings.Join(values, "\xff")
+	if s, ok := v.series.Load(key); ok {
+		return s.(*intSeries)
+	}
+	s, _ := v.series.LoadOrStore(key, &intSeries{values: values})
+	return s.(*intSeries)
+}
+
+// Describe implements prometheus.Collector.
+func (c *IntCounter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.vec.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *IntCounter) Collect(ch chan<- prometheus.Metric) {
+	c.vec.series.Range(func(_, v interface{}) bool {
+		s := v.(*intSeries)
+		ch <- prometheus.MustNewConstMetric(c.vec.desc, prometheus.CounterValue, float64(s.n.Load()), s.values...)
+		return true
+	})
+}
@@ -0,0 +1,117 @@
+package grpcprom_test
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/grpcprom"
+	"github.com/Bo0mer/grpcmon/grpcprom/promtest"
+)
+
+func TestIntCounterBeyondFloat53(t *testing.T) {
+	const (
+		start = 1 << 53
+		n     = 1000
+	)
+	reg := prometheus.NewRegistry()
+	c := grpcprom.NewIntCounter(prometheus.CounterOpts{Name: "grpc_test_bytes_total"}, []string{"service", "method"})
+	f := generic.NewCounter("float_bytes_total")
+	reg.MustRegister(c)
+
+	series := c.With("service", "s").With("method", "m")
+	series.Add(start)
+	f.Add(start)
+	for i := 0; i < n; i++ {
+		series.Add(1)
+		f.Add(1)
+	}
+	if got, want := series.(*grpcprom.IntCounter).Value(), uint64(start+n); got != want {
+		t.Errorf("Value = %d, want %d", got, want)
+	}
+	if got, want := mustValue(t, reg, "grpc_test_bytes_total", map[string]string{"service": "s", "method": "m"}), float64(start+n); got != want {
+		t.Errorf("scraped value = %v, want %v", got, want)
+	}
+	// A counter summing float64 values does not see small increments past
+	// 2^53.
+	if got := f.Value(); got != start {
+		t.Errorf("float64 counter value = %v, want it stuck at %v", got, float64(start))
+	}
+}
+
+func TestIntCounterNegative(t *testing.T) {
+	c := grpcprom.NewIntCounter(prometheus.CounterOpts{Name: "grpc_test_total"}, nil)
+	defer func() {
+		if recover() == nil {
+			t.Error("negative delta did not panic")
+		}
+	}()
+	c.Add(-1)
+}
+
+func TestNewMetricsIntByteTotals(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := grpcprom.NewServerMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]interface{}{"BytesSentTotal": m.BytesSentTotal, "BytesRecvTotal": m.BytesRecvTotal} {
+		if _, ok := c.(*grpcprom.IntCounter); !ok {
+			t.Errorf("%s is a %T, want an IntCounter", name, c)
+		}
+	}
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m.Metrics), grpcmontest.UnaryOK(false))
+	labels := map[string]string{"service": "grpcmontest.Test", "method": "Method"}
+	if got := mustValue(t, reg, "grpc_server_sent_bytes_total", labels); got == 0 {
+		t.Error("sent bytes total = 0, want the bytes sent")
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "grpc_server_recv_bytes_total" && mf.GetType() != dto.MetricType_COUNTER {
+			t.Errorf("grpc_server_recv_bytes_total is a %v, want a counter", mf.GetType())
+		}
+	}
+}
+
+func mustValue(t *testing.T, g prometheus.Gatherer, name string, labels map[string]string) float64 {
+	t.Helper()
+	v, err := promtest.SeriesValue(g, name, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestIntCounterAddAllocs(t *testing.T) {
+	c := grpcprom.NewIntCounter(prometheus.CounterOpts{Name: "grpc_test_bytes_total"}, []string{"service", "method"})
+	series := c.With("service", "s").With("method", "m")
+	if n := testing.AllocsPerRun(100, func() { series.Add(10) }); n != 0 {
+		t.Errorf("Add allocates %v times, want 0", n)
+	}
+}
+
+func TestIntCounterPartialLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := grpcprom.NewIntCounter(prometheus.CounterOpts{Name: "grpc_test_bytes_total"}, []string{"service", "method"})
+	reg.MustRegister(c)
+	partial := c.With("service", "s")
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 0 {
+		t.Errorf("gathered %v after With with part of the labels, want nothing", mfs)
+	}
+	partial.With("method", "m").Add(1)
+	partial.With("method", "m").Add(2)
+	if got := mustValue(t, reg, "grpc_test_bytes_total", map[string]string{"service": "s", "method": "m"}); got != 3 {
+		t.Errorf("value = %v, want 3", got)
+	}
+}
@@ -0,0 +1,168 @@
+package grpcprom
+
+import (
+	metrics "github.com/go-kit/kit/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// WithLegacyNames makes NewClientMetrics and NewServerMetrics create the
+// metrics of go-grpc-prometheus instead, with its names and labels, for a
+// drop-in replacement:
+//
+//  grpc_{side}_started_total{grpc_type,grpc_service,grpc_method} [counter]
+//  grpc_{side}_handled_total{grpc_type,grpc_service,grpc_method,grpc_code} [counter]
+//  grpc_{side}_msg_received_total{grpc_type,grpc_service,grpc_method} [counter]
+//  grpc_{side}_msg_sent_total{grpc_type,grpc_service,grpc_method} [counter]
+//  grpc_{side}_handling_seconds{grpc_type,grpc_service,grpc_method} [histogram]
+//
+// The handler must record the type label with grpcmon.WithRPCTypeLabel, or
+// grpc_type is "unknown". The latency buckets default to
+// prometheus.DefBuckets, like in go-grpc-prometheus.
+func WithLegacyNames() Option {
+	return func(o *options) {
+		o.legacy = true
+	}
+}
+
+// legacyLabels maps the labels recorded by grpcmon to the ones of
+// go-grpc-prometheus.
+var legacyLabels = map[string]string{
+	"type":    "grpc_type",
+	"service": "grpc_service",
+	"method":  "grpc_method",
+	"code":    "grpc_code",
+}
+
+var (
+	legacyMethodLabels = []string{"grpc_type", "grpc_service", "grpc_method"}
+	legacyCodeLabels   = []string{"grpc_type", "grpc_service", "grpc_method", "grpc_code"}
+)
+
+func newLegacyMetrics(reg prometheus.Registerer, side string, o options) (*Metrics, error) {
+	on, by := "on the server", "by the server"
+	handlingHelp := "Histogram of response latency (seconds) of gRPC that had been application-level handled by the server."
+	if side == "client" {
+		on, by = "on the client", "by the client"
+		handlingHelp = "Histogram of response latency (seconds) of the gRPC until it is finished by the application."
+	}
+	buckets := o.latencyBuckets
+	if buckets == nil {
+		buckets = prometheus.DefBuckets
+	}
+	counter := func(name, help string, labels []string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "grpc", Subsystem: side, Name: name, Help: help}, labels)
+	}
+	started := counter("started_total", "Total number of RPCs started "+on+".", legacyMethodLabels)
+	handledTotal := counter("handled_total", "Total number of RPCs completed "+on+", regardless of success or failure.", legacyCodeLabels)
+	received := counter("msg_received_total", "Total number of RPC stream messages received "+by+".", legacyMethodLabels)
+	sent := counter("msg_sent_total", "Total number of gRPC stream messages sent "+by+".", legacyMethodLabels)
+	handling := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "grpc",
+		Subsystem: side,
+		Name:      "handling_seconds",
+		Help:      handlingHelp,
+		Buckets:   buckets,
+	}, legacyMethodLabels)
+	b := &builder{collectors: []prometheus.Collector{started, handledTotal, received, sent, handling}}
+	if err := b.register(reg); err != nil {
+		return nil, err
+	}
+	return b.metrics(&grpcmon.Metrics{
+		ReqsStarted: &legacyCounter{v: started, names: legacyMethodLabels},
+		ReqsTotal:   &legacyCounter{v: handledTotal, names: legacyCodeLabels},
+		Latency:     &legacyHistogram{v: handling},
+		MsgsRecv:    &legacyCounter{v: received, names: legacyMethodLabels},
+		MsgsSent:    &legacyCounter{v: sent, names: legacyMethodLabels},
+	}), nil
+}
+
+// legacyLabelValues are label names and values recorded by grpcmon.
+type legacyLabelValues []string
+
+func (l legacyLabelValues) with(more []string) legacyLabelValues {
+	return append(l[:len(l):len(l)], more...)
+}
+
+// values returns the values of the go-grpc-prometheus labels with the given
+// names, and whether all of them but grpc_type, which is only recorded with
+// grpcmon.WithRPCTypeLabel, are recorded. Labels that are not recorded are
+// "unknown" and labels that are not named are dropped.
+func (l legacyLabelValues) values(names []string) ([]string, bool) {
+	values := make([]string, len(names))
+	var set uint
+	for i := 0; i+1 < len(l); i += 2 {
+		name := legacyLabels[l[i]]
+		for j, n := range names {
+			if n != name {
+				continue
+			}
+			v := l[i+1]
+			if name == "grpc_type" && v == "bidi" {
+				v = "bidi_stream"
+			}
+			values[j] = v
+			set |= 1 << j
+		}
+	}
+	complete := true
+	for j, name := range names {
+		if set&(1<<j) == 0 {
+			values[j] = "unknown"
+			complete = complete && name == "grpc_type"
+		}
+	}
+	return values, complete
+}
+
+// legacyCounter resolves its series in With once all of its labels are
+// recorded, and in Add otherwise.
+type legacyCounter struct {
+	v           *prometheus.CounterVec
+	names       []string
+	labelValues legacyLabelValues
+	c           prometheus.Counter
+}
+
+func (c *legacyCounter) With(labelValues ...string) metrics.Counter {
+	n := &legacyCounter{v: c.v, names: c.names, labelValues: c.labelValues.with(labelValues)}
+	if values, ok := n.labelValues.values(n.names); ok {
+		n.c = c.v.WithLabelValues(values...)
+	}
+	return n
+}
+
+func (c *legacyCounter) Add(delta float64) {
+	if c.c != nil {
+		c.c.Add(delta)
+		return
+	}
+	values, _ := c.labelValues.values(c.names)
+	c.v.WithLabelValues(values...).Add(delta)
+}
+
+// legacyHistogram drops the code label, and resolves its series like
+// legacyCounter.
+type legacyHistogram struct {
+	v           *prometheus.HistogramVec
+	labelValues legacyLabelValues
+	o           prometheus.Observer
+}
+
+func (h *legacyHistogram) With(labelValues ...string) metrics.Histogram {
+	n := &legacyHistogram{v: h.v, labelValues: h.labelValues.with(labelValues)}
+	if values, ok := n.labelValues.values(legacyMethodLabels); ok {
+		n.o = h.v.WithLabelValues(values...)
+	}
+	return n
+}
+
+func (h *legacyHistogram) Observe(value float64) {
+	if h.o != nil {
+		h.o.Observe(value)
+		return
+	}
+	values, _ := h.labelValues.values(legacyMethodLabels)
+	h.v.WithLabelValues(values...).Observe(value)
+}
@@ -0,0 +1,352 @@
+// Package grpcprom provides Prometheus integration for grpcmon.
+package grpcprom // import "github.com/Bo0mer/grpcmon/grpcprom"
+
+import (
+	"fmt"
+	"time"
+
+	metrics "github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// Option configures the metrics created by NewClientMetrics and
+// NewServerMetrics.
+type Option func(*options)
+
+type options struct {
+	latencyBuckets []float64
+	latencySummary map[float64]float64
+	bytesBuckets   []float64
+	native         bool
+	nativeFactor   float64
+	typeLabel      bool
+	legacy         bool
+	connPeerLabel  bool
+	transportLabel bool
+	failFastLabel  bool
+	targetLabel    bool
+	peerIdentity   bool
+}
+
+// WithLatencyBuckets sets the buckets of the latency and stream age
+// histograms, in seconds. Defaults to grpcmon.DefaultLatencyBuckets.
+func WithLatencyBuckets(buckets ...float64) Option {
+	return func(o *options) {
+		o.latencyBuckets = buckets
+	}
+}
+
+// WithLatencySummary backs the Latency metric with a summary of the given
+// objectives instead of a histogram, under the same name and labels. The
+// objectives map quantiles to their absolute error, like the Objectives of
+// prometheus.SummaryOpts, for example {0.5: 0.05, 0.99: 0.001}; with none,
+// only the sum and count of the latencies are exported. Quantiles must be
+// within [0, 1] and errors within [0, min(q, 1-q)], or the metrics are not
+// created. Other histograms, and the metrics created with WithLegacyNames,
+// are not affected.
+//
+// A summary exports a series per objective rather than per bucket, which is
+// cheaper where series are charged for, but its quantiles are computed by
+// each process over the last 10 minutes: they are queried as is, for example
+// grpc_server_latency_seconds{quantile="0.99"}, cannot be computed by
+// histogram_quantile and cannot be aggregated across processes or label
+// values. The mean latency is still rate(grpc_server_latency_seconds_sum[5m])
+// / rate(grpc_server_latency_seconds_count[5m]). The rules and dashboards of
+// the rules and dashboard packages query latency buckets and do not apply.
+func WithLatencySummary(objectives map[float64]float64) Option {
+	return func(o *options) {
+		if objectives == nil {
+			objectives = map[float64]float64{}
+		}
+		o.latencySummary = objectives
+	}
+}
+
+// checkObjectives returns an error if the objectives of WithLatencySummary
+// are not valid.
+func checkObjectives(objectives map[float64]float64) error {
+	for q, e := range objectives {
+		if q < 0 || q > 1 {
+			return fmt.Errorf("grpcprom: latency summary quantile %v out of range [0, 1]", q)
+		}
+		if e < 0 || e > q || e > 1-q {
+			return fmt.Errorf("grpcprom: latency summary error %v of quantile %v out of range [0, %v]", e, q, min(q, 1-q))
+		}
+	}
+	return nil
+}
+
+// WithNativeHistograms makes the histograms export the native
+// representation of Prometheus histograms besides their buckets, with the
+// given bucket factor: the maximum ratio between the bounds of consecutive
+// buckets, such as 1.1. Native histograms need no choice of buckets, and
+// are only scraped by Prometheus servers with the native histograms feature
+// enabled, which otherwise keep scraping the buckets. Each histogram keeps at
+// most 160 native buckets, widening them as needed, and resets at most once
+// an hour to narrow them again. The factor must be above 1, or the metrics
+// are not created. Metrics created with WithLegacyNames are not affected.
+// Native histograms need client_golang 1.15 or later.
+func WithNativeHistograms(bucketFactor float64) Option {
+	return func(o *options) {
+		o.native, o.nativeFactor = true, bucketFactor
+	}
+}
+
+// WithBytesBuckets sets the buckets of the byte histograms. Defaults to
+// grpcmon.DefaultBytesBuckets.
+func WithBytesBuckets(buckets ...float64) Option {
+	return func(o *options) {
+		o.bytesBuckets = buckets
+	}
+}
+
+// WithRPCTypeLabel adds the type label to the metrics grpcmon.WithRPCTypeLabel
+// records it on.
+func WithRPCTypeLabel() Option {
+	return func(o *options) {
+		o.typeLabel = true
+	}
+}
+
+// WithConnPeerLabel adds the peer label to the connection metrics, as
+// recorded with grpcmon.WithConnPeerLabel.
+func WithConnPeerLabel() Option {
+	return func(o *options) {
+		o.connPeerLabel = true
+	}
+}
+
+// WithConnTransportLabel adds the transport label to the connection metrics,
+// as recorded with grpcmon.WithConnTransportLabel.
+func WithConnTransportLabel() Option {
+	return func(o *options) {
+		o.transportLabel = true
+	}
+}
+
+// WithConnTargetLabel adds the target label to the connection metrics, as
+// recorded with grpcmon.WithTarget.
+func WithConnTargetLabel() Option {
+	return func(o *options) {
+		o.targetLabel = true
+	}
+}
+
+// WithFailFastLabel adds the fail_fast label to the client metrics
+// grpcmon.WithFailFastLabel records it on. Server metrics are not affected.
+func WithFailFastLabel() Option {
+	return func(o *options) {
+		o.failFastLabel = true
+	}
+}
+
+// WithPeerIdentityLabel adds the peer label to the server metrics
+// grpcmon.WithPeerIdentityLabel records it on. Client metrics are not
+// affected.
+func WithPeerIdentityLabel() Option {
+	return func(o *options) {
+		o.peerIdentity = true
+	}
+}
+
+// NewClientMetrics returns metrics for gRPC clients with the names and
+// labels documented by grpcmon, and registers them with reg. It returns an
+// error, and registers nothing, if any of them is already registered. With a
+// nil reg, nothing is registered until Register or Handler does.
+func NewClientMetrics(reg prometheus.Registerer, opts ...Option) (*Metrics, error) {
+	return newMetrics(reg, "client", opts)
+}
+
+// NewServerMetrics is like NewClientMetrics for gRPC servers.
+func NewServerMetrics(reg prometheus.Registerer, opts ...Option) (*Metrics, error) {
+	return newMetrics(reg, "server", opts)
+}
+
+// nativeMaxBuckets is the maximum number of buckets of the native
+// histograms of WithNativeHistograms.
+const nativeMaxBuckets = 160
+
+// builder creates metrics and collects them for registration.
+type builder struct {
+	namespace  string
+	subsystem  string
+	collectors []prometheus.Collector
+	// nativeFactor is the native histogram bucket factor of the histograms,
+	// or zero.
+	nativeFactor float64
+}
+
+func (b *builder) counter(name, help string, labels ...string) metrics.Counter {
+	v := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: b.namespace, Subsystem: b.subsystem, Name: name, Help: help}, labels)
+	b.collectors = append(b.collectors, v)
+	return kitprometheus.NewCounter(v)
+}
+
+// intCounter is like counter, backed by an IntCounter for counts that may
+// exceed the integers float64 represents exactly.
+func (b *builder) intCounter(name, help string, labels ...string) metrics.Counter {
+	c := NewIntCounter(prometheus.CounterOpts{Namespace: b.namespace, Subsystem: b.subsystem, Name: name, Help: help}, labels)
+	b.collectors = append(b.collectors, c)
+	return c
+}
+
+func (b *builder) gauge(name, help string, labels ...string) metrics.Gauge {
+	v := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: b.namespace, Subsystem: b.subsystem, Name: name, Help: help}, labels)
+	b.collectors = append(b.collectors, v)
+	return kitprometheus.NewGauge(v)
+}
+
+func (b *builder) histogram(name, help string, buckets []float64, labels ...string) metrics.Histogram {
+	opts := prometheus.HistogramOpts{Namespace: b.namespace, Subsystem: b.subsystem, Name: name, Help: help, Buckets: buckets}
+	if b.nativeFactor > 0 {
+		opts.NativeHistogramBucketFactor = b.nativeFactor
+		opts.NativeHistogramMaxBucketNumber = nativeMaxBuckets
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	v := prometheus.NewHistogramVec(opts, labels)
+	b.collectors = append(b.collectors, v)
+	return kitprometheus.NewHistogram(v)
+}
+
+func (b *builder) summary(name, help string, objectives map[float64]float64, labels ...string) metrics.Histogram {
+	v := prometheus.NewSummaryVec(prometheus.SummaryOpts{Namespace: b.namespace, Subsystem: b.subsystem, Name: name, Help: help, Objectives: objectives}, labels)
+	b.collectors = append(b.collectors, v)
+	return kitprometheus.NewSummary(v)
+}
+
+// register registers all collectors with reg, or none of them if any fails
+// to register. A nil reg registers nothing.
+func (b *builder) register(reg prometheus.Registerer) error {
+	if reg == nil {
+		return nil
+	}
+	for i, c := range b.collectors {
+		if err := reg.Register(c); err != nil {
+			for _, c := range b.collectors[:i] {
+				reg.Unregister(c)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func newMetrics(reg prometheus.Registerer, side string, opts []Option) (*Metrics, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.legacy {
+		return newLegacyMetrics(reg, side, o)
+	}
+	if o.latencyBuckets == nil {
+		o.latencyBuckets = grpcmon.DefaultLatencyBuckets
+	}
+	if o.bytesBuckets == nil {
+		o.bytesBuckets = grpcmon.DefaultBytesBuckets
+	}
+	if err := checkObjectives(o.latencySummary); err != nil {
+		return nil, err
+	}
+	if o.native && !(o.nativeFactor > 1) {
+		return nil, fmt.Errorf("grpcprom: native histogram bucket factor %v not above 1", o.nativeFactor)
+	}
+	sent, recv := "requests", "responses"
+	if side == "server" {
+		sent, recv = recv, sent
+	}
+	methodLabels, codeLabels := []string{"service", "method"}, []string{"service", "method", "code"}
+	if o.typeLabel {
+		methodLabels, codeLabels = append(methodLabels, "type"), append(codeLabels, "type")
+	}
+	if o.failFastLabel && side == "client" {
+		codeLabels = append(codeLabels, "fail_fast")
+	}
+	if o.peerIdentity && side == "server" {
+		codeLabels = append(codeLabels, "peer")
+	}
+	var connLabels []string
+	if o.connPeerLabel {
+		connLabels = append(connLabels, "peer")
+	}
+	if o.transportLabel {
+		connLabels = append(connLabels, "transport")
+	}
+	if o.targetLabel {
+		connLabels = append(connLabels, "target")
+	}
+	b := &builder{namespace: "grpc", subsystem: side, nativeFactor: o.nativeFactor}
+	var latency metrics.Histogram
+	if o.latencySummary != nil {
+		latency = b.summary("latency_seconds", "Latency of gRPC "+side+" requests.", o.latencySummary, codeLabels...)
+	} else {
+		latency = b.histogram("latency_seconds", "Latency of gRPC "+side+" requests.", o.latencyBuckets, codeLabels...)
+	}
+	m := &grpcmon.Metrics{
+		ConnsOpen:       b.gauge("connections_open", "Number of gRPC "+side+" connections open.", connLabels...),
+		ConnsTotal:      b.counter("connections_total", "Total number of gRPC "+side+" connections opened.", connLabels...),
+		ConnDuration:    b.histogram("connection_duration_seconds", "Duration of gRPC "+side+" connections.", grpcmon.DefaultConnDurationBuckets, connLabels...),
+		ReqsPending:     b.gauge("requests_pending", "Number of gRPC "+side+" requests pending.", methodLabels...),
+		ReqsPendingMax:  b.gauge("requests_pending_max", "Highest number of gRPC "+side+" requests pending since last reset.", "service", "method"),
+		ReqsStarted:     b.counter("requests_started_total", "Total number of gRPC "+side+" requests started.", methodLabels...),
+		ReqsTotal:       b.counter("requests_total", "Total number of gRPC "+side+" requests completed.", codeLabels...),
+		Latency:         latency,
+		BytesRecv:       b.histogram("recv_bytes", "Bytes received in gRPC "+side+" "+recv+".", o.bytesBuckets, "service", "method", "frame"),
+		BytesSent:       b.histogram("sent_bytes", "Bytes sent in gRPC "+side+" "+sent+".", o.bytesBuckets, "service", "method", "frame"),
+		StreamAge:       b.histogram("stream_age_seconds", "Age of long-lived gRPC "+side+" requests in flight.", o.latencyBuckets, "service", "method"),
+		MsgsSent:        b.counter("msgs_sent_total", "Total number of messages sent in gRPC "+side+" "+sent+".", methodLabels...),
+		MsgsRecv:        b.counter("msgs_received_total", "Total number of messages received in gRPC "+side+" "+recv+".", methodLabels...),
+		MsgBytesSent:    b.histogram("msg_sent_bytes", "Uncompressed sizes of messages sent in gRPC "+side+" "+sent+".", o.bytesBuckets, "service", "method"),
+		MsgBytesRecv:    b.histogram("msg_recv_bytes", "Uncompressed sizes of messages received in gRPC "+side+" "+recv+".", o.bytesBuckets, "service", "method"),
+		BytesSentTotal:  b.intCounter("sent_bytes_total", "Total number of bytes sent in gRPC "+side+" "+sent+".", "service", "method"),
+		BytesRecvTotal:  b.intCounter("recv_bytes_total", "Total number of bytes received in gRPC "+side+" "+recv+".", "service", "method"),
+		TTFB:            b.histogram("first_response_seconds", "Time until the first response message of gRPC "+side+" requests.", o.latencyBuckets, "service", "method"),
+		InterMsgGap:     b.histogram("inter_message_gap_seconds", "Time between consecutive messages of gRPC "+side+" requests.", o.latencyBuckets, "service", "method", "direction"),
+		SubscriberDrops: b.counter("subscriber_dropped_total", "Total number of RPC summaries dropped by slow subscribers."),
+		SLOEvents:       b.counter("slo_events_total", "Total number of gRPC "+side+" requests classified by their SLO.", "service", "method", "result"),
+		SLOBurnRate:     b.gauge("slo_burn_rate", "Error budget burn rate of gRPC "+side+" requests.", "service", "method", "window"),
+		ErrorDetails:    b.counter("error_details_total", "Total number of error details returned to gRPC "+side+" requests.", "service", "method", "type"),
+		ErrorTypes:      b.counter("errors_total", "Total number of gRPC "+side+" requests failed, by the type of their error.", "service", "method", "error_type"),
+		ErrorRate:       b.gauge("error_ratio", "Ratio of failed gRPC "+side+" requests over a rolling window.", "service", "method"),
+		ConnChurnSpikes: b.counter("connection_churn_spikes_total", "Total number of spikes of gRPC "+side+" connections opened."),
+	}
+	if side == "server" {
+		m.DeadlineOvershoots = b.counter("deadline_overshoot_total", "Total number of gRPC server requests handled past the deadline of their client.", "service", "method")
+		m.DeadlineBudget = b.histogram("deadline_budget_seconds", "Time left until the deadline of gRPC server requests as they begin.", o.latencyBuckets, "service", "method")
+		m.ReqsNoDeadline = b.counter("requests_no_deadline_total", "Total number of gRPC server requests begun without a deadline.", "service", "method")
+		m.UnknownCalls = b.counter("unknown_calls_total", "Total number of gRPC server calls to unknown services and methods.", "service")
+		m.ClientCancellations = b.counter("client_cancellations_total", "Total number of gRPC server requests canceled by their client before they were handled.", "service", "method")
+		m.ProcessingTime = b.histogram("processing_seconds", "Time gRPC server requests take from their first request message to their first response message.", o.latencyBuckets, "service", "method", "code")
+		m.StreamsPerConnMax = b.gauge("streams_per_connection_max", "Highest number of streams open at once on a gRPC server connection since last reset.")
+		m.ConnStreams = b.histogram("connection_streams", "Highest number of streams open at once on gRPC server connections.", grpcmon.DefaultConnStreamsBuckets, connLabels...)
+	} else {
+		m.DialErrors = b.counter("dial_errors_total", "Total number of gRPC client dials failed.", "target")
+		m.DialLatency = b.histogram("dial_latency_seconds", "Latency of successful gRPC client dials.", o.latencyBuckets, "target")
+		m.PickLatency = b.histogram("pick_latency_seconds", "Time gRPC client requests wait for a connection before sending their headers.", o.latencyBuckets, "service", "method")
+		m.Retries = b.counter("retries_total", "Total number of gRPC client request attempts after the first.", "service", "method")
+	}
+	if err := b.register(reg); err != nil {
+		return nil, err
+	}
+	return b.metrics(m), nil
+}
+
+// NewSelfMetrics returns the metrics about grpcmon itself documented by
+// grpcmon, and registers them with reg, like NewClientMetrics. Only one set
+// of them can be registered with a registry; share it among handlers.
+func NewSelfMetrics(reg prometheus.Registerer) (*grpcmon.SelfMetrics, error) {
+	b := &builder{namespace: "grpcmon"}
+	m := &grpcmon.SelfMetrics{
+		DroppedObservations: b.counter("dropped_observations_total", "Total number of observations dropped by grpcmon.", "reason"),
+		SinkErrors:          b.counter("sink_errors_total", "Total number of panics recovered from grpcmon hooks and callbacks."),
+		UnattributedEvents:  b.counter("unattributed_events_total", "Total number of gRPC events grpcmon could not attribute to an RPC."),
+		LabelOverflow:       b.counter("label_overflow_total", "Total number of RPCs and connections beyond grpcmon tracking limits."),
+	}
+	if err := b.register(reg); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
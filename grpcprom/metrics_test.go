@@ -0,0 +1,316 @@
+package grpcprom_test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/grpcprom"
+	"github.com/Bo0mer/grpcmon/grpcprom/promtest"
+)
+
+func TestNewMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	client, err := grpcprom.NewClientMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := grpcprom.NewServerMetrics(reg, grpcprom.WithLatencyBuckets(0.1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcmontest.Replay(grpcmon.ClientStatsHandler(client.Metrics), grpcmontest.UnaryOK(true))
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(server.Metrics), grpcmontest.UnaryOK(false))
+
+	method := map[string]string{"service": "grpcmontest.Test", "method": "Method"}
+	withCode := map[string]string{"service": "grpcmontest.Test", "method": "Method", "code": "OK"}
+	withFrame := map[string]string{"service": "grpcmontest.Test", "method": "Method", "frame": "payload"}
+	for _, side := range []string{"client", "server"} {
+		for name, labels := range map[string]map[string]string{
+			"connections_open":  nil,
+			"connections_total": nil,
+			"requests_pending":  method,
+			"requests_total":    withCode,
+			"latency_seconds":   withCode,
+			"sent_bytes":        withFrame,
+			"recv_bytes":        withFrame,
+			"msg_sent_bytes":    method,
+			"msg_recv_bytes":    method,
+		} {
+			promtest.AssertSeriesExists(t, reg, "grpc_"+side+"_"+name, labels)
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == "grpc_server_latency_seconds" {
+			if got := len(f.GetMetric()[0].GetHistogram().GetBucket()); got != 2 {
+				t.Errorf("server latency has %d buckets, want 2", got)
+			}
+		}
+	}
+}
+
+func TestNewMetricsDuplicate(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	if _, err := grpcprom.NewServerMetrics(reg); err != nil {
+		t.Fatal(err)
+	}
+	_, err := grpcprom.NewServerMetrics(reg)
+	var are prometheus.AlreadyRegisteredError
+	if !errors.As(err, &are) {
+		t.Errorf("err = %v, want AlreadyRegisteredError", err)
+	}
+
+	// A failed registration leaves nothing behind.
+	reg = prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "grpc_server_error_details_total", Help: "Taken."}))
+	if _, err := grpcprom.NewServerMetrics(reg); err == nil {
+		t.Fatal("registered despite a conflict")
+	}
+	if _, err := grpcprom.NewClientMetrics(reg); err != nil {
+		t.Errorf("client metrics: %v", err)
+	}
+	if err := reg.Register(prometheus.NewCounter(prometheus.CounterOpts{Name: "grpc_server_connections_total", Help: "Total number of gRPC server connections opened."})); err != nil {
+		t.Errorf("server metrics partially registered: %v", err)
+	}
+}
+
+func TestNewSelfMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	self, err := grpcprom.NewSelfMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := grpcprom.NewServerMetrics(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := grpcmon.ServerStatsHandler(m.Metrics, grpcmon.WithSelfMetrics(self))
+	h.HandleRPC(t.Context(), &stats.End{})
+	if v, err := promtest.SeriesValue(reg, "grpcmon_unattributed_events_total", nil); err != nil || v != 1 {
+		t.Errorf("unattributed events = %v, %v, want 1", v, err)
+	}
+}
+
+func TestNewMetricsRPCTypeLabel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := grpcprom.NewServerMetrics(reg, grpcprom.WithRPCTypeLabel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m.Metrics, grpcmon.WithRPCTypeLabel()), grpcmontest.BidiStream(false, 2))
+
+	labels := map[string]string{"service": "grpcmontest.Test", "method": "Method", "code": "OK", "type": "bidi"}
+	promtest.AssertSeriesExists(t, reg, "grpc_server_requests_total", labels)
+	promtest.AssertSeriesExists(t, reg, "grpc_server_latency_seconds", labels)
+}
+
+func TestNewMetricsLegacyNames(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	client, err := grpcprom.NewClientMetrics(reg, grpcprom.WithLegacyNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := grpcprom.NewServerMetrics(reg, grpcprom.WithLegacyNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []bool{false, true} {
+		m := server
+		if c {
+			m = client
+		}
+		h := grpcmon.ServerStatsHandler(m.Metrics, grpcmon.WithRPCTypeLabel())
+		if c {
+			h = grpcmon.ClientStatsHandler(m.Metrics, grpcmon.WithRPCTypeLabel())
+		}
+		grpcmontest.Replay(h, grpcmontest.UnaryOK(c))
+		grpcmontest.Replay(h, grpcmontest.UnaryError(c, codes.NotFound))
+		grpcmontest.Replay(h, grpcmontest.ServerStream(c, 2))
+		grpcmontest.Replay(h, grpcmontest.BidiStream(c, 3))
+	}
+	promtest.AssertGolden(t, reg, filepath.Join("testdata", "legacy.golden"), promtest.GoldenOptions{})
+}
+
+func TestLegacyNamesAddAllocs(t *testing.T) {
+	m, err := grpcprom.NewServerMetrics(nil, grpcprom.WithLegacyNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := m.ReqsTotal.With("service", "s", "method", "m").With("code", "OK")
+	latency := m.Latency.With("service", "s", "method", "m", "code", "OK")
+	if n := testing.AllocsPerRun(100, func() { reqs.Add(1) }); n != 0 {
+		t.Errorf("Add allocates %v times, want 0", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { latency.Observe(1) }); n != 0 {
+		t.Errorf("Observe allocates %v times, want 0", n)
+	}
+}
+
+func TestNewMetricsConnPeerLabel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := grpcprom.NewServerMetrics(reg, grpcprom.WithConnPeerLabel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m.Metrics, grpcmon.WithConnPeerLabel(grpcmon.PeerHost)), grpcmontest.UnaryOK(false))
+	promtest.AssertSeriesExists(t, reg, "grpc_server_connections_total", map[string]string{"peer": "10.0.0.1"})
+}
+
+func TestNewMetricsConnTargetLabel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := grpcprom.NewClientMetrics(reg, grpcprom.WithConnTargetLabel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcmontest.Replay(grpcmon.ClientStatsHandler(m.Metrics, grpcmon.WithTarget("backend")), grpcmontest.UnaryOK(true))
+	promtest.AssertSeriesExists(t, reg, "grpc_client_connections_total", map[string]string{"target": "backend"})
+}
+
+func TestNewMetricsFailFastLabel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := grpcprom.NewClientMetrics(reg, grpcprom.WithFailFastLabel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcmontest.Replay(grpcmon.ClientStatsHandler(m.Metrics, grpcmon.WithFailFastLabel()), grpcmontest.UnaryOK(true))
+
+	labels := map[string]string{"service": "grpcmontest.Test", "method": "Method", "code": "OK", "fail_fast": "true"}
+	promtest.AssertSeriesExists(t, reg, "grpc_client_requests_total", labels)
+	promtest.AssertSeriesExists(t, reg, "grpc_client_latency_seconds", labels)
+	if _, err := grpcprom.NewServerMetrics(reg, grpcprom.WithFailFastLabel()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewMetricsPeerIdentityLabel(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := grpcprom.NewServerMetrics(reg, grpcprom.WithPeerIdentityLabel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m.Metrics, grpcmon.WithPeerIdentityLabel(grpcmon.TLSPeerIdentity)), grpcmontest.UnaryOK(false))
+
+	labels := map[string]string{"service": "grpcmontest.Test", "method": "Method", "code": "OK", "peer": "unknown"}
+	promtest.AssertSeriesExists(t, reg, "grpc_server_requests_total", labels)
+	promtest.AssertSeriesExists(t, reg, "grpc_server_latency_seconds", labels)
+	if _, err := grpcprom.NewClientMetrics(reg, grpcprom.WithPeerIdentityLabel()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewMetricsLatencySummary(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := grpcprom.NewServerMetrics(reg, grpcprom.WithLatencySummary(map[float64]float64{0.5: 0.05, 0.99: 0.001}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m.Metrics), grpcmontest.UnaryOK(false))
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "grpc_server_latency_seconds" {
+			continue
+		}
+		if got := f.GetType(); got != dto.MetricType_SUMMARY {
+			t.Fatalf("latency is a %v, want a summary", got)
+		}
+		s := f.GetMetric()[0].GetSummary()
+		var quantiles []float64
+		for _, q := range s.GetQuantile() {
+			quantiles = append(quantiles, q.GetQuantile())
+			if got := q.GetValue(); got != 0.003 {
+				t.Errorf("quantile %v = %v, want 0.003", q.GetQuantile(), got)
+			}
+		}
+		if !reflect.DeepEqual(quantiles, []float64{0.5, 0.99}) {
+			t.Errorf("latency quantiles = %v, want [0.5 0.99]", quantiles)
+		}
+		if got := s.GetSampleCount(); got != 1 {
+			t.Errorf("latency sample count = %d, want 1", got)
+		}
+	}
+	promtest.AssertSeriesExists(t, reg, "grpc_server_latency_seconds", map[string]string{"service": "grpcmontest.Test", "method": "Method", "code": "OK"})
+	// Other histograms keep their buckets.
+	if _, err := promtest.HistogramSampleCount(reg, "grpc_server_first_response_seconds", map[string]string{"service": "grpcmontest.Test", "method": "Method"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewMetricsLatencySummaryInvalid(t *testing.T) {
+	for _, objectives := range []map[float64]float64{
+		{1.5: 0.01},
+		{-0.5: 0.01},
+		{0.99: 0.05},
+		{0.5: -0.1},
+	} {
+		reg := prometheus.NewRegistry()
+		if _, err := grpcprom.NewServerMetrics(reg, grpcprom.WithLatencySummary(objectives)); err == nil {
+			t.Errorf("objectives %v accepted, want an error", objectives)
+		}
+		if families, _ := reg.Gather(); len(families) != 0 {
+			t.Errorf("objectives %v: %d metrics registered, want none", objectives, len(families))
+		}
+	}
+	reg := prometheus.NewRegistry()
+	if _, err := grpcprom.NewServerMetrics(reg, grpcprom.WithLatencySummary(nil)); err != nil {
+		t.Errorf("no objectives: %v", err)
+	}
+}
+
+func TestNewMetricsNativeHistograms(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := grpcprom.NewServerMetrics(reg, grpcprom.WithNativeHistograms(1.1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m.Metrics), grpcmontest.UnaryOK(false))
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, f := range families {
+		if f.GetName() != "grpc_server_latency_seconds" {
+			continue
+		}
+		found = true
+		h := f.GetMetric()[0].GetHistogram()
+		// A bucket factor of 1.1 is met by schema 3, whose buckets grow by
+		// 2^(1/8).
+		if got := h.GetSchema(); got != 3 {
+			t.Errorf("latency schema = %d, want 3", got)
+		}
+		if len(h.GetPositiveSpan()) == 0 || len(h.GetPositiveDelta()) == 0 {
+			t.Errorf("latency has no native buckets: %v", h)
+		}
+		if got, want := len(h.GetBucket()), len(grpcmon.DefaultLatencyBuckets); got != want {
+			t.Errorf("latency has %d classic buckets, want %d", got, want)
+		}
+	}
+	if !found {
+		t.Error("no latency histogram gathered")
+	}
+
+	for _, factor := range []float64{1, 0.5, -2} {
+		if _, err := grpcprom.NewServerMetrics(prometheus.NewRegistry(), grpcprom.WithNativeHistograms(factor)); err == nil {
+			t.Errorf("bucket factor %v accepted, want an error", factor)
+		}
+	}
+}
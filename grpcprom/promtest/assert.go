@@ -0,0 +1,104 @@
+package promtest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// AssertSeriesExists asserts that g gathers at least one series of the named
+// family that has all of the given labels.
+func AssertSeriesExists(t testing.TB, g prometheus.Gatherer, name string, labels map[string]string) {
+	t.Helper()
+	ms, err := series(g, name, labels)
+	if err != nil {
+		t.Fatalf("promtest: %v", err)
+	}
+	if len(ms) == 0 {
+		t.Errorf("promtest: no series %s%v", name, labels)
+	}
+}
+
+// SeriesValue returns the value of the single counter, gauge or untyped
+// series of the named family that has all of the given labels.
+func SeriesValue(g prometheus.Gatherer, name string, labels map[string]string) (float64, error) {
+	m, err := single(g, name, labels)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue(), nil
+	case m.Gauge != nil:
+		return m.Gauge.GetValue(), nil
+	case m.Untyped != nil:
+		return m.Untyped.GetValue(), nil
+	}
+	return 0, fmt.Errorf("series %s%v has no single value", name, labels)
+}
+
+// HistogramSampleCount returns the sample count of the single histogram or
+// summary series of the named family that has all of the given labels.
+func HistogramSampleCount(g prometheus.Gatherer, name string, labels map[string]string) (uint64, error) {
+	m, err := single(g, name, labels)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Histogram != nil:
+		return m.Histogram.GetSampleCount(), nil
+	case m.Summary != nil:
+		return m.Summary.GetSampleCount(), nil
+	}
+	return 0, fmt.Errorf("series %s%v is not a histogram", name, labels)
+}
+
+func single(g prometheus.Gatherer, name string, labels map[string]string) (*dto.Metric, error) {
+	ms, err := series(g, name, labels)
+	if err != nil {
+		return nil, err
+	}
+	switch len(ms) {
+	case 0:
+		return nil, fmt.Errorf("no series %s%v", name, labels)
+	case 1:
+		return ms[0], nil
+	}
+	return nil, fmt.Errorf("%d series match %s%v, want 1", len(ms), name, labels)
+}
+
+// series returns the series of the named family that have all of the given
+// labels.
+func series(g prometheus.Gatherer, name string, labels map[string]string) ([]*dto.Metric, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, fmt.Errorf("gather: %v", err)
+	}
+	var ms []*dto.Metric
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.Metric {
+			if hasLabels(m, labels) {
+				ms = append(ms, m)
+			}
+		}
+	}
+	return ms, nil
+}
+
+func hasLabels(m *dto.Metric, labels map[string]string) bool {
+	n := 0
+	for _, lp := range m.Label {
+		if v, ok := labels[lp.GetName()]; ok {
+			if v != lp.GetValue() {
+				return false
+			}
+			n++
+		}
+	}
+	return n == len(labels)
+}
@@ -0,0 +1,53 @@
+package promtest_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/grpcprom/promtest"
+)
+
+func TestAssertions(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := grpcmon.ServerStatsHandler(newServerMetrics(reg))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	grpcmontest.Replay(h, grpcmontest.UnaryError(false, codes.Internal))
+
+	promtest.AssertSeriesExists(t, reg, "grpc_server_requests_total", map[string]string{"code": "Internal"})
+	promtest.AssertSeriesExists(t, reg, "grpc_server_connections_open", nil)
+
+	ok := map[string]string{"service": "grpcmontest.Test", "method": "Method", "code": "OK"}
+	if v, err := promtest.SeriesValue(reg, "grpc_server_requests_total", ok); err != nil || v != 2 {
+		t.Errorf("SeriesValue = %v, %v, want 2, nil", v, err)
+	}
+	if v, err := promtest.SeriesValue(reg, "grpc_server_connections_total", nil); err != nil || v != 3 {
+		t.Errorf("SeriesValue = %v, %v, want 3, nil", v, err)
+	}
+	if n, err := promtest.HistogramSampleCount(reg, "grpc_server_latency_seconds", ok); err != nil || n != 2 {
+		t.Errorf("HistogramSampleCount = %v, %v, want 2, nil", n, err)
+	}
+
+	if _, err := promtest.SeriesValue(reg, "grpc_server_requests_total", nil); err == nil {
+		t.Error("SeriesValue matching several series returned nil error")
+	}
+	if _, err := promtest.SeriesValue(reg, "grpc_server_requests_total", map[string]string{"code": "NotFound"}); err == nil {
+		t.Error("SeriesValue matching no series returned nil error")
+	}
+	if _, err := promtest.SeriesValue(reg, "grpc_server_latency_seconds", ok); err == nil {
+		t.Error("SeriesValue of histogram returned nil error")
+	}
+	if _, err := promtest.HistogramSampleCount(reg, "grpc_server_requests_total", ok); err == nil {
+		t.Error("HistogramSampleCount of counter returned nil error")
+	}
+
+	ft := &fakeT{TB: t}
+	promtest.AssertSeriesExists(ft, reg, "grpc_server_requests_total", map[string]string{"code": "NotFound"})
+	if len(ft.errors) != 1 {
+		t.Errorf("got %d errors, want 1", len(ft.errors))
+	}
+}
@@ -0,0 +1,139 @@
+// Package promtest provides test helpers asserting the Prometheus metrics
+// recorded by grpcmon. It is meant to be imported by tests only.
+package promtest // import "github.com/Bo0mer/grpcmon/grpcprom/promtest"
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("promtest.update", false, "update golden files compared by promtest.AssertGolden")
+
+// GoldenOptions configures AssertGolden.
+type GoldenOptions struct {
+	// IgnoreLabels lists labels whose values are nondeterministic. Their
+	// values are replaced with a placeholder.
+	IgnoreLabels []string
+}
+
+// AssertGolden gathers the grpc_* metric families from g and compares their
+// text exposition with the contents of the golden file at path. Running the
+// test with the -promtest.update flag rewrites the golden file instead.
+//
+// To keep the output deterministic, timestamps and histogram sums are
+// dropped, the buckets of histograms measuring time (the ones with a
+// _seconds suffix) are dropped, and the values of opts.IgnoreLabels are
+// replaced with a placeholder.
+func AssertGolden(t testing.TB, g prometheus.Gatherer, path string, opts GoldenOptions) {
+	t.Helper()
+	got, err := exposition(g, opts)
+	if err != nil {
+		t.Fatalf("promtest: gather: %v", err)
+	}
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("promtest: update golden file: %v", err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("promtest: read golden file: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("promtest: metrics differ from %s (run with -promtest.update to update):\n%s", path, diff(string(want), string(got)))
+	}
+}
+
+// exposition returns the normalized text exposition of the grpc_* families
+// gathered from g.
+func exposition(g prometheus.Gatherer, opts GoldenOptions) ([]byte, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	ignore := make(map[string]bool, len(opts.IgnoreLabels))
+	for _, l := range opts.IgnoreLabels {
+		ignore[l] = true
+	}
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), "grpc_") {
+			continue
+		}
+		normalize(mf, ignore)
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func normalize(mf *dto.MetricFamily, ignore map[string]bool) {
+	timing := strings.HasSuffix(mf.GetName(), "_seconds")
+	for _, m := range mf.Metric {
+		m.TimestampMs = nil
+		for _, lp := range m.Label {
+			if ignore[lp.GetName()] {
+				lp.Value = stringPtr("<ignored>")
+			}
+		}
+		if h := m.Histogram; h != nil {
+			h.SampleSum = nil
+			if timing {
+				h.Bucket = nil
+			}
+		}
+	}
+	// Ignoring labels may change the order of metrics.
+	sort.SliceStable(mf.Metric, func(i, j int) bool {
+		return labelString(mf.Metric[i]) < labelString(mf.Metric[j])
+	})
+}
+
+func labelString(m *dto.Metric) string {
+	var b strings.Builder
+	for _, lp := range m.Label {
+		b.WriteString(lp.GetName())
+		b.WriteByte('=')
+		b.WriteString(lp.GetValue())
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+func stringPtr(s string) *string { return &s }
+
+// diff returns a line based description of the differences between want and
+// got.
+func diff(want, got string) string {
+	wl, gl := strings.Split(want, "\n"), strings.Split(got, "\n")
+	wantSet := make(map[string]bool, len(wl))
+	for _, l := range wl {
+		wantSet[l] = true
+	}
+	gotSet := make(map[string]bool, len(gl))
+	for _, l := range gl {
+		gotSet[l] = true
+	}
+	var b strings.Builder
+	for _, l := range wl {
+		if !gotSet[l] {
+			b.WriteString("- " + l + "\n")
+		}
+	}
+	for _, l := range gl {
+		if !wantSet[l] {
+			b.WriteString("+ " + l + "\n")
+		}
+	}
+	return b.String()
+}
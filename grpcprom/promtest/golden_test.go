@@ -0,0 +1,110 @@
+package promtest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcprom/promtest"
+)
+
+func newServerMetrics(reg prometheus.Registerer) *grpcmon.Metrics {
+	connsOpen := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "grpc_server_connections_open", Help: "Number of gRPC server connections open."}, nil)
+	connsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "grpc_server_connections_total", Help: "Total number of gRPC server connections opened."}, nil)
+	reqsPending := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "grpc_server_requests_pending", Help: "Number of gRPC server requests pending."}, []string{"service", "method"})
+	reqsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "grpc_server_requests_total", Help: "Total number of gRPC server requests completed."}, []string{"service", "method", "code"})
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "grpc_server_latency_seconds", Help: "Latency of gRPC server requests.", Buckets: grpcmon.DefaultLatencyBuckets}, []string{"service", "method", "code"})
+	bytesRecv := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "grpc_server_recv_bytes", Help: "Bytes received in gRPC server requests.", Buckets: grpcmon.DefaultBytesBuckets}, []string{"service", "method", "frame"})
+	bytesSent := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "grpc_server_sent_bytes", Help: "Bytes sent in gRPC server responses.", Buckets: grpcmon.DefaultBytesBuckets}, []string{"service", "method", "frame"})
+	reg.MustRegister(connsOpen, connsTotal, reqsPending, reqsTotal, latency, bytesRecv, bytesSent)
+	return &grpcmon.Metrics{
+		ConnsOpen:   kitprometheus.NewGauge(connsOpen),
+		ConnsTotal:  kitprometheus.NewCounter(connsTotal),
+		ReqsPending: kitprometheus.NewGauge(reqsPending),
+		ReqsTotal:   kitprometheus.NewCounter(reqsTotal),
+		Latency:     kitprometheus.NewHistogram(latency),
+		BytesRecv:   kitprometheus.NewHistogram(bytesRecv),
+		BytesSent:   kitprometheus.NewHistogram(bytesSent),
+	}
+}
+
+// unary feeds the stats of a unary RPC ending with err through h.
+func unary(ctx context.Context, h stats.Handler, method string, err error) {
+	ctx = h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: method})
+	begin := time.Now()
+	h.HandleRPC(ctx, &stats.Begin{BeginTime: begin})
+	h.HandleRPC(ctx, &stats.InHeader{WireLength: 40})
+	h.HandleRPC(ctx, &stats.InPayload{WireLength: 100})
+	h.HandleRPC(ctx, &stats.OutPayload{WireLength: 300})
+	h.HandleRPC(ctx, &stats.OutTrailer{WireLength: 20})
+	h.HandleRPC(ctx, &stats.End{BeginTime: begin, EndTime: time.Now(), Error: err})
+}
+
+func scriptedTraffic(h stats.Handler) {
+	ctx := h.TagConn(context.Background(), &stats.ConnTagInfo{RemoteAddr: &net.TCPAddr{}})
+	h.HandleConn(ctx, &stats.ConnBegin{})
+	unary(ctx, h, "/pkg.Service/Get", nil)
+	unary(ctx, h, "/pkg.Service/Get", nil)
+	unary(ctx, h, "/pkg.Service/Put", status.Error(codes.PermissionDenied, "denied"))
+	h.HandleConn(ctx, &stats.ConnEnd{})
+}
+
+func TestAssertGolden(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	scriptedTraffic(grpcmon.ServerStatsHandler(newServerMetrics(reg)))
+
+	promtest.AssertSeriesExists(t, reg, "grpc_server_requests_total", map[string]string{"method": "Put", "code": "PermissionDenied"})
+	promtest.AssertGolden(t, reg, filepath.Join("testdata", "server.golden"), promtest.GoldenOptions{})
+}
+
+func TestAssertGoldenIgnoreLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	scriptedTraffic(grpcmon.ServerStatsHandler(newServerMetrics(reg)))
+
+	promtest.AssertGolden(t, reg, filepath.Join("testdata", "server_ignore_method.golden"), promtest.GoldenOptions{
+		IgnoreLabels: []string{"method"},
+	})
+}
+
+// fakeT records failures instead of failing the test.
+type fakeT struct {
+	testing.TB
+	errors []string
+}
+
+func (*fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeT) Fatalf(format string, args ...interface{}) {
+	t.Errorf(format, args...)
+}
+
+func TestAssertGoldenMismatch(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := grpcmon.ServerStatsHandler(newServerMetrics(reg))
+	scriptedTraffic(h)
+	unary(context.Background(), h, "/pkg.Service/Get", errors.New("boom"))
+
+	if v, err := promtest.SeriesValue(reg, "grpc_server_requests_total", map[string]string{"method": "Get", "code": "Unknown"}); err != nil || v != 1 {
+		t.Fatalf("SeriesValue = %v, %v, want 1, nil", v, err)
+	}
+	ft := &fakeT{TB: t}
+	promtest.AssertGolden(ft, reg, filepath.Join("testdata", "server.golden"), promtest.GoldenOptions{})
+	if len(ft.errors) != 1 {
+		t.Fatalf("got %d errors, want 1: %q", len(ft.errors), ft.errors)
+	}
+}
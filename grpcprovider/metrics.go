@@ -0,0 +1,80 @@
+// Package grpcprovider creates grpcmon metrics with a go-kit metrics
+// provider, for programs that choose their metrics backend at run time.
+//
+// Providers create metrics by name only, so the metrics of a provider that
+// requires the label names of its metrics up front, such as the Prometheus
+// one, cannot be labeled. NewMetricsFrom refuses the Prometheus provider; use
+// the grpcprom package for Prometheus instead.
+package grpcprovider // import "github.com/Bo0mer/grpcmon/grpcprovider"
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/go-kit/kit/metrics/provider"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// ErrUnlabeled is returned by NewMetricsFrom for providers whose metrics
+// cannot be labeled.
+var ErrUnlabeled = errors.New("grpcprovider: the provider cannot label metrics, use grpcprom for Prometheus")
+
+// prometheusProvider is the type of the providers of
+// provider.NewPrometheusProvider, whose metrics panic when given labels they
+// were not created with.
+var prometheusProvider = reflect.TypeOf(provider.NewPrometheusProvider("", ""))
+
+// NewMetricsFrom returns the metrics recorded by both gRPC clients and
+// servers, created by p under the names documented by grpcmon, each
+// prefixed with prefix: grpc_client_ or grpc_server_ for the documented
+// names. The metrics only recorded by clients or by servers are left nil, to
+// be created by the caller if needed.
+//
+// Since providers take the number of buckets of the histograms rather than
+// their bounds, the latency and byte histograms get as many buckets as
+// latencyBuckets and bytesBuckets have, which default to
+// grpcmon.DefaultLatencyBuckets and grpcmon.DefaultBytesBuckets.
+//
+// NewMetricsFrom returns ErrUnlabeled for the Prometheus provider, without
+// creating any metric.
+func NewMetricsFrom(p provider.Provider, prefix string, latencyBuckets, bytesBuckets []float64) (*grpcmon.Metrics, error) {
+	if reflect.TypeOf(p) == prometheusProvider {
+		return nil, ErrUnlabeled
+	}
+	if latencyBuckets == nil {
+		latencyBuckets = grpcmon.DefaultLatencyBuckets
+	}
+	if bytesBuckets == nil {
+		bytesBuckets = grpcmon.DefaultBytesBuckets
+	}
+	latency, bytes := len(latencyBuckets), len(bytesBuckets)
+	return &grpcmon.Metrics{
+		ConnsOpen:       p.NewGauge(prefix + "connections_open"),
+		ConnsTotal:      p.NewCounter(prefix + "connections_total"),
+		ConnDuration:    p.NewHistogram(prefix+"connection_duration_seconds", len(grpcmon.DefaultConnDurationBuckets)),
+		ReqsPending:     p.NewGauge(prefix + "requests_pending"),
+		ReqsPendingMax:  p.NewGauge(prefix + "requests_pending_max"),
+		ReqsStarted:     p.NewCounter(prefix + "requests_started_total"),
+		ReqsTotal:       p.NewCounter(prefix + "requests_total"),
+		Latency:         p.NewHistogram(prefix+"latency_seconds", latency),
+		BytesRecv:       p.NewHistogram(prefix+"recv_bytes", bytes),
+		BytesSent:       p.NewHistogram(prefix+"sent_bytes", bytes),
+		StreamAge:       p.NewHistogram(prefix+"stream_age_seconds", latency),
+		MsgsSent:        p.NewCounter(prefix + "msgs_sent_total"),
+		MsgsRecv:        p.NewCounter(prefix + "msgs_received_total"),
+		MsgBytesSent:    p.NewHistogram(prefix+"msg_sent_bytes", bytes),
+		MsgBytesRecv:    p.NewHistogram(prefix+"msg_recv_bytes", bytes),
+		BytesSentTotal:  p.NewCounter(prefix + "sent_bytes_total"),
+		BytesRecvTotal:  p.NewCounter(prefix + "recv_bytes_total"),
+		TTFB:            p.NewHistogram(prefix+"first_response_seconds", latency),
+		InterMsgGap:     p.NewHistogram(prefix+"inter_message_gap_seconds", latency),
+		SubscriberDrops: p.NewCounter(prefix + "subscriber_dropped_total"),
+		SLOEvents:       p.NewCounter(prefix + "slo_events_total"),
+		SLOBurnRate:     p.NewGauge(prefix + "slo_burn_rate"),
+		ErrorDetails:    p.NewCounter(prefix + "error_details_total"),
+		ErrorTypes:      p.NewCounter(prefix + "errors_total"),
+		ErrorRate:       p.NewGauge(prefix + "error_ratio"),
+		ConnChurnSpikes: p.NewCounter(prefix + "connection_churn_spikes_total"),
+	}, nil
+}
@@ -0,0 +1,107 @@
+package grpcprovider_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	metrics "github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/go-kit/kit/metrics/provider"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/grpcprovider"
+)
+
+// genericProvider creates generic metrics, remembering the histograms and
+// their numbers of buckets by name.
+type genericProvider struct {
+	mu         sync.Mutex
+	names      []string
+	histograms map[string]*generic.Histogram
+	buckets    map[string]int
+}
+
+func (p *genericProvider) add(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.names = append(p.names, name)
+}
+
+func (p *genericProvider) NewCounter(name string) metrics.Counter {
+	p.add(name)
+	return generic.NewCounter(name)
+}
+
+func (p *genericProvider) NewGauge(name string) metrics.Gauge {
+	p.add(name)
+	return generic.NewGauge(name)
+}
+
+func (p *genericProvider) NewHistogram(name string, buckets int) metrics.Histogram {
+	p.add(name)
+	h := generic.NewHistogram(name, buckets)
+	p.histograms[name], p.buckets[name] = h, buckets
+	return h
+}
+
+func (p *genericProvider) Stop() {}
+
+func TestNewMetricsFrom(t *testing.T) {
+	p := &genericProvider{histograms: make(map[string]*generic.Histogram), buckets: make(map[string]int)}
+	m, err := grpcprovider.NewMetricsFrom(p, "grpc_server_", []float64{0.1, 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range p.names {
+		if !strings.HasPrefix(name, "grpc_server_") {
+			t.Errorf("metric %q created without the prefix", name)
+		}
+	}
+	if got, want := len(p.names), 26; got != want {
+		t.Errorf("created %d metrics, want %d: %v", got, want, p.names)
+	}
+	if got := p.buckets["grpc_server_latency_seconds"]; got != 2 {
+		t.Errorf("latency buckets = %d, want 2", got)
+	}
+	if got, want := p.buckets["grpc_server_sent_bytes"], len(grpcmon.DefaultBytesBuckets); got != want {
+		t.Errorf("sent bytes buckets = %d, want %d", got, want)
+	}
+	if m.DeadlineOvershoots != nil || m.DialErrors != nil {
+		t.Error("side specific metrics created")
+	}
+
+	grpcmontest.Replay(grpcmon.ServerStatsHandler(m), grpcmontest.UnaryOK(false))
+	if got := p.histograms["grpc_server_latency_seconds"].Quantile(0.5); got != 0.003 {
+		t.Errorf("median latency = %v, want 0.003", got)
+	}
+	if got := p.histograms["grpc_server_recv_bytes"].Quantile(0.99); got != 40 {
+		t.Errorf("largest frame received = %v, want 40", got)
+	}
+}
+
+func TestNewMetricsFromDiscard(t *testing.T) {
+	p := provider.NewDiscardProvider()
+	defer p.Stop()
+	for _, client := range []bool{false, true} {
+		prefix, h := "grpc_server_", grpcmon.ServerStatsHandler
+		if client {
+			prefix, h = "grpc_client_", grpcmon.ClientStatsHandler
+		}
+		m, err := grpcprovider.NewMetricsFrom(p, prefix, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		grpcmontest.Replay(h(m), grpcmontest.UnaryOK(client))
+	}
+}
+
+func TestNewMetricsFromPrometheus(t *testing.T) {
+	p := provider.NewPrometheusProvider("test", "grpcprovider")
+	defer p.Stop()
+	m, err := grpcprovider.NewMetricsFrom(p, "grpc_server_", nil, nil)
+	if err != grpcprovider.ErrUnlabeled || m != nil {
+		t.Errorf("NewMetricsFrom(Prometheus provider) = %v, %v, want nil, ErrUnlabeled", m, err)
+	}
+}
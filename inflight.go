@@ -0,0 +1,189 @@
+package grpcmon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// inflight tracks RPCs that are in flight and periodically observes the age
+// of the long-lived ones.
+type inflight struct {
+	threshold time.Duration
+	interval  time.Duration
+	// unit converts ages to the unit of StreamAge.
+	unit func(time.Duration) float64
+
+	mu      sync.Mutex
+	rpcs    map[*rpcInfo]inflightRPC
+	running bool
+}
+
+// inflightRPC holds what is known about an RPC in flight as of its Begin.
+type inflightRPC struct {
+	// m is the metrics to observe the age of the RPC on, or nil if its age
+	// is not observed.
+	m        *Metrics
+	client   bool
+	peer     net.Addr
+	deadline time.Time
+}
+
+func newInflight(threshold, interval time.Duration, unit func(time.Duration) float64) *inflight {
+	return &inflight{
+		threshold: threshold,
+		interval:  interval,
+		unit:      unit,
+		rpcs:      make(map[*rpcInfo]inflightRPC),
+	}
+}
+
+// add starts tracking v. Its age is observed on e.m.StreamAge, if set.
+func (f *inflight) add(v *rpcInfo, e inflightRPC) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rpcs[v] = e
+	if e.m != nil && !f.running {
+		f.running = true
+		go f.run()
+	}
+}
+
+// remove stops tracking v.
+func (f *inflight) remove(v *rpcInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.rpcs, v)
+}
+
+// run observes ages every interval until no RPCs whose age is observed are
+// in flight.
+func (f *inflight) run() {
+	t := time.NewTicker(f.interval)
+	defer t.Stop()
+	for now := range t.C {
+		if !f.observe(now) {
+			return
+		}
+	}
+}
+
+// observe records the age of the long-lived RPCs and reports whether any
+// RPCs whose age is observed are still in flight.
+func (f *inflight) observe(now time.Time) bool {
+	type entry struct {
+		m              *Metrics
+		server, method string
+		age            time.Duration
+	}
+	var old []entry
+	observed := false
+	// The rpcInfo of an RPC may be reused once it is removed, so it is only
+	// read with the lock held.
+	f.mu.Lock()
+	for v, e := range f.rpcs {
+		if e.m == nil {
+			continue
+		}
+		observed = true
+		if age := now.Sub(v.begin().time); age >= f.threshold {
+			server, method := v.names()
+			old = append(old, entry{m: e.m, server: server, method: method, age: age})
+		}
+	}
+	if !observed {
+		f.running = false
+		f.mu.Unlock()
+		return false
+	}
+	f.mu.Unlock()
+
+	for _, e := range old {
+		e.m.StreamAge.With("service", e.server, "method", e.method).Observe(f.unit(e.age))
+	}
+	return true
+}
+
+// InFlightRPC describes an RPC in flight.
+type InFlightRPC struct {
+	Client  bool          `json:"client"`
+	Service string        `json:"service"`
+	Method  string        `json:"method"`
+	Age     time.Duration `json:"age"`
+	// Peer is the address of the remote end, if known when the RPC began.
+	Peer string `json:"peer,omitempty"`
+	// DeadlineRemaining is the time left until the deadline of the RPC,
+	// negative once it passed, or zero if the RPC has no deadline.
+	DeadlineRemaining time.Duration `json:"deadline_remaining,omitempty"`
+}
+
+// snapshot returns the RPCs in flight, oldest first.
+func (f *inflight) snapshot(now time.Time) []InFlightRPC {
+	f.mu.Lock()
+	res := make([]InFlightRPC, 0, len(f.rpcs))
+	for v, e := range f.rpcs {
+		rpc := InFlightRPC{Client: e.client, Age: now.Sub(v.begin().time)}
+		rpc.Service, rpc.Method = v.names()
+		if e.peer != nil {
+			rpc.Peer = e.peer.String()
+		}
+		if !e.deadline.IsZero() {
+			rpc.DeadlineRemaining = e.deadline.Sub(now)
+		}
+		res = append(res, rpc)
+	}
+	f.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Age != res[j].Age {
+			return res[i].Age > res[j].Age
+		}
+		if res[i].Service != res[j].Service {
+			return res[i].Service < res[j].Service
+		}
+		return res[i].Method < res[j].Method
+	})
+	return res
+}
+
+// InFlightRPCs returns the RPCs in flight, oldest first. It returns nil
+// unless WithInFlightRegistry is used.
+func (h *Handler) InFlightRPCs() []InFlightRPC {
+	if !h.opts.inflightRegistry {
+		return nil
+	}
+	return h.inflight.snapshot(time.Now())
+}
+
+// InFlightHandler returns an http.Handler that renders the result of
+// h.InFlightRPCs as a text table, or as JSON if the format query parameter
+// is "json". Listing takes a short lock that RPCs also take as they end.
+func InFlightHandler(h *Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rpcs := h.InFlightRPCs()
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(rpcs)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "SERVICE\tMETHOD\tCLIENT\tAGE\tPEER\tDEADLINE")
+		for _, rpc := range rpcs {
+			deadline := "-"
+			if rpc.DeadlineRemaining != 0 {
+				deadline = rpc.DeadlineRemaining.String()
+			}
+			peer := rpc.Peer
+			if peer == "" {
+				peer = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%t\t%v\t%s\t%s\n", rpc.Service, rpc.Method, rpc.Client, rpc.Age, peer, deadline)
+		}
+		tw.Flush()
+	})
+}
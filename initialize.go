@@ -0,0 +1,52 @@
+package grpcmon
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// InitializeMetrics creates the series of every method registered with srv,
+// so that they are exported before the first RPC: ReqsTotal with every code,
+// ReqsPending and ReqsStarted are added zero. Histogram series cannot be
+// created without an observation and are left alone. Call it after
+// registering services, with the options of the server handler that affect
+// labels, such as WithCodeMapper; calling it again is harmless.
+func InitializeMetrics(srv *grpc.Server, m *Metrics, opts ...Option) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	m = withLabels(m, o.constLabels)
+	for service, info := range srv.GetServiceInfo() {
+		for _, mi := range info.Methods {
+			service, method := ParseFullMethod("/" + service + "/" + mi.Name)
+			typ := rpcType(mi.IsClientStream, mi.IsServerStream)
+			labels := []string{"service", service, "method", method}
+			if o.typeLabel {
+				labels = append(labels, "type", typ)
+			}
+			if m.ReqsPending != nil {
+				m.ReqsPending.With(labels...).Add(0)
+			}
+			if m.ReqsStarted != nil {
+				m.ReqsStarted.With(labels...).Add(0)
+			}
+			if m.ReqsTotal == nil {
+				continue
+			}
+			seen := make(map[string]bool)
+			for c := codes.OK; c <= codes.Unauthenticated; c++ {
+				code := o.codeLabel(c)
+				if seen[code] {
+					continue
+				}
+				seen[code] = true
+				labels := []string{"service", service, "method", method, "code", code}
+				if o.typeLabel {
+					labels = append(labels, "type", typ)
+				}
+				m.ReqsTotal.With(labels...).Add(0)
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package grpcmon
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryClientInterceptor returns an interceptor recording the ReqsPending,
+// ReqsStarted, ReqsTotal and Latency metrics of m under the same names and
+// labels as ClientStatsHandler with the same options. It is meant for clients
+// whose stats handler is taken by something else; interceptors do not see
+// wire sizes or connections, so the other metrics are not recorded.
+//
+// Of the options, WithRPCTypeLabel, WithFailFastLabel, WithConstLabels,
+// WithCodeMapper, WithLatencyUnit and WithFilter apply; the others configure
+// what interceptors do not record and have no effect.
+func UnaryClientInterceptor(m *Metrics, opts ...Option) grpc.UnaryClientInterceptor {
+	ic := newInterceptor(m, opts)
+	return func(ctx context.Context, fullMethod string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		r := ic.start(fullMethod, "unary", ic.failFast(callOpts), "")
+		err := invoker(ctx, fullMethod, req, reply, cc, callOpts...)
+		r.finish(err)
+		return err
+	}
+}
+
+// StreamClientInterceptor is like UnaryClientInterceptor for streaming RPCs.
+// An RPC is complete when receiving from its stream fails, io.EOF included,
+// when the server does not stream, once its response is received, when
+// sending, closing or reading the header of the stream fails, or when the
+// context of the RPC is done. Streams that are neither drained nor canceled
+// stay pending, as they stay open in gRPC.
+func StreamClientInterceptor(m *Metrics, opts ...Option) grpc.StreamClientInterceptor {
+	ic := newInterceptor(m, opts)
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, fullMethod string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		r := ic.start(fullMethod, rpcType(desc.ClientStreams, desc.ServerStreams), ic.failFast(callOpts), "")
+		s, err := streamer(ctx, desc, cc, fullMethod, callOpts...)
+		if err != nil {
+			r.finish(err)
+			return nil, err
+		}
+		// The context of the stream itself is also canceled once the RPC
+		// completes, so the one of the caller tells cancellations apart.
+		stop := context.AfterFunc(ctx, func() {
+			r.finish(status.FromContextError(ctx.Err()).Err())
+		})
+		return &clientStream{ClientStream: s, call: r, stop: stop, serverStreams: desc.ServerStreams}, nil
+	}
+}
+
+// UnaryServerInterceptor is like UnaryClientInterceptor for servers, with
+// the names and labels of ServerStatsHandler. WithPeerIdentityLabel applies
+// instead of WithFailFastLabel.
+func UnaryServerInterceptor(m *Metrics, opts ...Option) grpc.UnaryServerInterceptor {
+	ic := newInterceptor(m, opts)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		r := ic.start(info.FullMethod, "unary", "", ic.peer(ctx))
+		resp, err := handler(ctx, req)
+		r.finish(err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is like UnaryServerInterceptor for streaming RPCs.
+// A server stream is complete when its handler returns.
+func StreamServerInterceptor(m *Metrics, opts ...Option) grpc.StreamServerInterceptor {
+	ic := newInterceptor(m, opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		r := ic.start(info.FullMethod, rpcType(info.IsClientStream, info.IsServerStream), "", ic.peer(ss.Context()))
+		err := handler(srv, ss)
+		r.finish(err)
+		return err
+	}
+}
+
+// interceptor records the RPCs of an interceptor in a Metrics, through the
+// methodCache of the stats handlers so that the labels are the same.
+type interceptor struct {
+	opts    options
+	methods *methodCache
+}
+
+func newInterceptor(m *Metrics, opts []Option) *interceptor {
+	if m == nil {
+		m = new(Metrics)
+	}
+	ic := new(interceptor)
+	for _, opt := range opts {
+		opt(&ic.opts)
+	}
+	ic.methods = &methodCache{m: withLabels(m, ic.opts.constLabels), opts: &ic.opts}
+	return ic
+}
+
+// failFast returns the fail_fast label of a client RPC made with opts, if
+// WithFailFastLabel is set.
+func (ic *interceptor) failFast(opts []grpc.CallOption) string {
+	if !ic.opts.failFastLabel {
+		return ""
+	}
+	failFast := true
+	for _, opt := range opts {
+		if o, ok := opt.(grpc.FailFastCallOption); ok {
+			failFast = o.FailFast
+		}
+	}
+	return strconv.FormatBool(failFast)
+}
+
+// peer returns the peer label of the server RPC of ctx, if
+// WithPeerIdentityLabel is set.
+func (ic *interceptor) peer(ctx context.Context) string {
+	if ic.opts.peerIdentity == nil {
+		return ""
+	}
+	return ic.opts.peerIdentityLabel(ctx)
+}
+
+// start records the start of an RPC of fullMethod, and returns the call
+// recording its end.
+func (ic *interceptor) start(fullMethod, typ, failFast, peer string) *call {
+	service, method := ParseFullMethod(fullMethod)
+	c := &call{ic: ic, begin: time.Now()}
+	if ic.opts.filter != nil && !ic.opts.filter(service, method) {
+		return c
+	}
+	k := methodKey{server: service, method: method, failFast: failFast, peer: peer}
+	if ic.opts.typeLabel {
+		k.typ = typ
+	}
+	c.mm = ic.methods.get(k)
+	if c.mm.reqsPending != nil {
+		c.mm.reqsPending.Add(1)
+	}
+	if c.mm.reqsStarted != nil {
+		c.mm.reqsStarted.Add(1)
+	}
+	return c
+}
+
+// call records the metrics of an RPC observed by an interceptor.
+type call struct {
+	ic *interceptor
+	// mm holds the metrics of the method, nil if the RPC is filtered out.
+	mm    *methodMetrics
+	begin time.Time
+	once  sync.Once
+}
+
+// finish records the end of the RPC with err. Only the first call has an
+// effect, and none for the RPCs filtered out.
+func (c *call) finish(err error) {
+	c.once.Do(func() {
+		if c.mm == nil {
+			return
+		}
+		cm := c.ic.methods.withCode(c.mm, status.Code(err))
+		if cm.latency != nil {
+			cm.latency.Observe(c.ic.opts.inUnit(time.Since(c.begin)))
+		}
+		if cm.reqsTotal != nil {
+			cm.reqsTotal.Add(1)
+		}
+		if c.mm.reqsPending != nil {
+			c.mm.reqsPending.Add(-1)
+		}
+	})
+}
+
+// clientStream finishes its call when the RPC completes.
+type clientStream struct {
+	grpc.ClientStream
+	call *call
+	// stop stops finishing the call once the context of the RPC is done.
+	stop          func() bool
+	serverStreams bool
+}
+
+// finish finishes the call with err.
+func (s *clientStream) finish(err error) {
+	s.stop()
+	s.call.finish(err)
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.finish(nil)
+	case err != nil:
+		s.finish(err)
+	case !s.serverStreams:
+		s.finish(nil)
+	}
+	return err
+}
+
+// SendMsg finishes the call if sending fails, except with io.EOF, which
+// tells the RPC has ended with a status that RecvMsg returns.
+func (s *clientStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err != nil && err != io.EOF {
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *clientStream) CloseSend() error {
+	err := s.ClientStream.CloseSend()
+	if err != nil {
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *clientStream) Header() (metadata.MD, error) {
+	md, err := s.ClientStream.Header()
+	if err != nil {
+		s.finish(err)
+	}
+	return md, err
+}
@@ -0,0 +1,198 @@
+package grpcmon_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+// echoDesc describes a bidirectional streaming service echoing string
+// values until the client closes its side. It fails with InvalidArgument on
+// any value other than "ok".
+var echoDesc = grpc.ServiceDesc{
+	ServiceName: "grpcmontest.Echo",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Echo",
+		ServerStreams: true,
+		ClientStreams: true,
+		Handler: func(_ interface{}, ss grpc.ServerStream) error {
+			for {
+				v := new(wrapperspb.StringValue)
+				if err := ss.RecvMsg(v); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if v.Value != "ok" {
+					return status.Error(codes.InvalidArgument, v.Value)
+				}
+				if err := ss.SendMsg(v); err != nil {
+					return err
+				}
+			}
+		},
+	}},
+}
+
+// echo sends values to the echo service and receives until the stream
+// ends.
+func echo(t *testing.T, conn *grpc.ClientConn, values ...string) {
+	ctx := context.Background()
+	s, err := conn.NewStream(ctx, &echoDesc.Streams[0], "/grpcmontest.Echo/Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range values {
+		if err := s.SendMsg(wrapperspb.String(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if err := s.RecvMsg(new(wrapperspb.StringValue)); err != nil {
+			return
+		}
+	}
+}
+
+// interceptorWorkload issues unary, streaming and failing RPCs on conn.
+func interceptorWorkload(t *testing.T, conn *grpc.ClientConn) {
+	for i := 0; i < 2; i++ {
+		if _, err := pb.NewFrontendClient(conn).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	echo(t, conn, "ok", "ok", "ok")
+	echo(t, conn, "fail")
+}
+
+// requestSeries returns the lines of rec.String with the metrics recorded
+// by interceptors.
+func requestSeries(rec *grpcmontest.Recorder) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(rec.String(), "\n") {
+		for _, name := range []string{grpcmontest.ReqsPending, grpcmontest.ReqsStarted, grpcmontest.ReqsTotal, grpcmontest.Latency} {
+			if strings.HasPrefix(line, name+"{") {
+				b.WriteString(line)
+			}
+		}
+	}
+	return b.String()
+}
+
+func TestInterceptors(t *testing.T) {
+	for name, opts := range map[string][]grpcmon.Option{
+		"defaults": nil,
+		"options": {
+			grpcmon.WithRPCTypeLabel(),
+			grpcmon.WithConstLabels(map[string]string{"env": "test"}),
+			grpcmon.WithCodeMapper(grpcmon.CodeClass),
+			grpcmon.WithLatencyUnit(time.Millisecond),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testInterceptors(t, opts...)
+		})
+	}
+}
+
+// testInterceptors checks that the interceptors record what the stats
+// handlers do with the given options.
+func testInterceptors(t *testing.T, opts ...grpcmon.Option) {
+	h := grpcmontest.NewHarness(t, grpcmontest.MonitorOptions(opts...))
+	h.Server.RegisterService(&echoDesc, nil)
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+	interceptorWorkload(t, h.Conn())
+	h.Stop()
+
+	addr := "interceptors/" + t.Name()
+	serverMetrics, serverRec := grpcmontest.NewRecorder()
+	clientMetrics, clientRec := grpcmontest.NewRecorder()
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcmon.UnaryServerInterceptor(serverMetrics, opts...)),
+		grpc.StreamInterceptor(grpcmon.StreamServerInterceptor(serverMetrics, opts...)),
+	)
+	srv.RegisterService(&echoDesc, nil)
+	pb.RegisterFrontendServer(srv, &frontend{})
+	go srv.Serve(listen(addr))
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dial),
+		grpc.WithUnaryInterceptor(grpcmon.UnaryClientInterceptor(clientMetrics, opts...)),
+		grpc.WithStreamInterceptor(grpcmon.StreamClientInterceptor(clientMetrics, opts...)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interceptorWorkload(t, conn)
+	conn.Close()
+	srv.GracefulStop()
+
+	for side, recs := range map[string][2]*grpcmontest.Recorder{
+		"client": {h.ClientRecorder, clientRec},
+		"server": {h.ServerRecorder, serverRec},
+	} {
+		want := requestSeries(recs[0])
+		if got := requestSeries(recs[1]); got != want {
+			t.Errorf("%s: interceptors recorded\n%s\nstats handler recorded\n%s", side, got, want)
+		}
+		if want == "" {
+			t.Errorf("%s: nothing recorded", side)
+		}
+	}
+}
+
+func TestStreamClientInterceptorCanceled(t *testing.T) {
+	srv := grpc.NewServer()
+	srv.RegisterService(&echoDesc, nil)
+	addr := "interceptors/canceled"
+	go srv.Serve(listen(addr))
+	defer srv.Stop()
+	m, rec := grpcmontest.NewRecorder()
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(dial),
+		grpc.WithStreamInterceptor(grpcmon.StreamClientInterceptor(m)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The stream is canceled without being drained.
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := conn.NewStream(ctx, &echoDesc.Streams[0], "/grpcmontest.Echo/Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendMsg(wrapperspb.String("ok")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	labels := []string{"service", "grpcmontest.Echo", "method", "Echo"}
+	canceled := append(labels, "code", "Canceled")
+	for deadline := time.Now().Add(5 * time.Second); rec.CounterValue(grpcmontest.ReqsTotal, canceled...) == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, canceled...); got != 1 {
+		t.Errorf("canceled requests total = %v, want 1", got)
+	}
+	if got := rec.GaugeValue(grpcmontest.ReqsPending, labels...); got != 0 {
+		t.Errorf("requests pending = %v, want 0", got)
+	}
+}
@@ -0,0 +1,262 @@
+// Package bench measures the overhead of grpcmon instrumentation on an
+// in-process echo server.
+package bench
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics/discard"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Bo0mer/grpcmon"
+)
+
+// Metric configurations understood by Setup.
+const (
+	// None does not instrument the server and client at all.
+	None = "none"
+	// Nop instruments with metrics that discard everything.
+	Nop = "nop"
+	// RequestsOnly instruments with Prometheus backed request metrics
+	// only.
+	RequestsOnly = "requests-only"
+	// NoBytes instruments with all Prometheus backed metrics but the byte
+	// histograms.
+	NoBytes = "no-bytes"
+	// Full instruments with all Prometheus backed metrics.
+	Full = "full"
+)
+
+// Configs lists all metric configurations.
+var Configs = []string{None, Nop, RequestsOnly, NoBytes, Full}
+
+// Env is a running echo server and a client connected to it.
+type Env struct {
+	srv     *grpc.Server
+	conn    *grpc.ClientConn
+	payload *wrapperspb.BytesValue
+}
+
+// Setup starts an echo server and connects a client to it, both
+// instrumented with the given metric configuration. Calls made through the
+// returned Env send and receive payloadSize bytes.
+func Setup(config string, payloadSize int) (*Env, error) {
+	var srvOpts []grpc.ServerOption
+	var dialOpts []grpc.DialOption
+	if config != None {
+		reg := prometheus.NewRegistry()
+		serverMetrics, err := newMetrics(reg, "server", config)
+		if err != nil {
+			return nil, err
+		}
+		clientMetrics, err := newMetrics(reg, "client", config)
+		if err != nil {
+			return nil, err
+		}
+		srvOpts = append(srvOpts, grpcmon.ServerOption(serverMetrics))
+		dialOpts = append(dialOpts, grpcmon.DialOption(clientMetrics))
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer(srvOpts...)
+	srv.RegisterService(&echoDesc, nil)
+	go srv.Serve(lis)
+
+	dialOpts = append(dialOpts,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+	)
+	conn, err := grpc.Dial("bufconn", dialOpts...)
+	if err != nil {
+		srv.Stop()
+		return nil, err
+	}
+	return &Env{
+		srv:     srv,
+		conn:    conn,
+		payload: wrapperspb.Bytes(make([]byte, payloadSize)),
+	}, nil
+}
+
+// Call makes a single unary echo call.
+func (e *Env) Call(ctx context.Context) error {
+	return e.conn.Invoke(ctx, "/bench.Echo/Echo", e.payload, new(wrapperspb.BytesValue))
+}
+
+// Close stops the server and closes the client connection.
+func (e *Env) Close() {
+	e.conn.Close()
+	e.srv.Stop()
+}
+
+var echoDesc = grpc.ServiceDesc{
+	ServiceName: "bench.Echo",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Echo",
+		Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(wrapperspb.BytesValue)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			return in, nil
+		},
+	}},
+}
+
+// newMetrics returns metrics for side (client or server) according to
+// config, registering them with reg.
+func newMetrics(reg prometheus.Registerer, side, config string) (*grpcmon.Metrics, error) {
+	switch config {
+	case Nop:
+		return &grpcmon.Metrics{
+			ConnsOpen:   discard.NewGauge(),
+			ConnsTotal:  discard.NewCounter(),
+			ReqsPending: discard.NewGauge(),
+			ReqsTotal:   discard.NewCounter(),
+			Latency:     discard.NewHistogram(),
+			BytesSent:   discard.NewHistogram(),
+			BytesRecv:   discard.NewHistogram(),
+		}, nil
+	case RequestsOnly, NoBytes, Full:
+	default:
+		return nil, fmt.Errorf("bench: unknown metric configuration %q", config)
+	}
+
+	connsOpen := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "grpc", Subsystem: side, Name: "connections_open", Help: "Number of gRPC connections open."}, nil)
+	connsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "grpc", Subsystem: side, Name: "connections_total", Help: "Total number of gRPC connections opened."}, nil)
+	reqsPending := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "grpc", Subsystem: side, Name: "requests_pending", Help: "Number of gRPC requests pending."}, []string{"service", "method"})
+	reqsTotal := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "grpc", Subsystem: side, Name: "requests_total", Help: "Total number of gRPC requests completed."}, []string{"service", "method", "code"})
+	reg.MustRegister(connsOpen, connsTotal, reqsPending, reqsTotal)
+	m := &grpcmon.Metrics{
+		ConnsOpen:   kitprometheus.NewGauge(connsOpen),
+		ConnsTotal:  kitprometheus.NewCounter(connsTotal),
+		ReqsPending: kitprometheus.NewGauge(reqsPending),
+		ReqsTotal:   kitprometheus.NewCounter(reqsTotal),
+	}
+	if config == RequestsOnly {
+		return m, nil
+	}
+
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: "grpc", Subsystem: side, Name: "latency_seconds", Help: "Latency of gRPC requests.", Buckets: grpcmon.DefaultLatencyBuckets}, []string{"service", "method", "code"})
+	reg.MustRegister(latency)
+	m.Latency = kitprometheus.NewHistogram(latency)
+	if config == NoBytes {
+		return m, nil
+	}
+
+	bytesSent := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: "grpc", Subsystem: side, Name: "sent_bytes", Help: "Bytes sent in gRPC messages.", Buckets: grpcmon.DefaultBytesBuckets}, []string{"service", "method", "frame"})
+	bytesRecv := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: "grpc", Subsystem: side, Name: "recv_bytes", Help: "Bytes received in gRPC messages.", Buckets: grpcmon.DefaultBytesBuckets}, []string{"service", "method", "frame"})
+	reg.MustRegister(bytesSent, bytesRecv)
+	m.BytesSent = kitprometheus.NewHistogram(bytesSent)
+	m.BytesRecv = kitprometheus.NewHistogram(bytesRecv)
+	return m, nil
+}
+
+// Options configures a Run.
+type Options struct {
+	// Config is the metric configuration.
+	Config string
+	// Concurrency is the number of concurrent callers.
+	Concurrency int
+	// PayloadSize is the size in bytes of requests and responses.
+	PayloadSize int
+	// Duration is how long to make calls for.
+	Duration time.Duration
+}
+
+// Result holds the measurements of a Run.
+type Result struct {
+	Options Options
+	// Calls is the number of calls completed.
+	Calls int
+	// P50 and P99 are latency percentiles of the calls.
+	P50, P99 time.Duration
+	// Throughput is the number of calls per second.
+	Throughput float64
+	// AllocsPerCall is the number of heap allocations per call, for both
+	// the client and the server.
+	AllocsPerCall float64
+}
+
+// Run makes calls according to opts and reports the measurements.
+func Run(opts Options) (Result, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	env, err := Setup(opts.Config, opts.PayloadSize)
+	if err != nil {
+		return Result{}, err
+	}
+	defer env.Close()
+	// Warm up the connection.
+	if err := env.Call(context.Background()); err != nil {
+		return Result{}, err
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		firstErr  error
+		wg        sync.WaitGroup
+	)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	deadline := start.Add(opts.Duration)
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []time.Duration
+			for time.Now().Before(deadline) {
+				t := time.Now()
+				if err := env.Call(context.Background()); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				local = append(local, time.Since(t))
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	if firstErr != nil {
+		return Result{}, firstErr
+	}
+	if len(latencies) == 0 {
+		return Result{}, fmt.Errorf("bench: no calls completed in %v", opts.Duration)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	n := len(latencies)
+	return Result{
+		Options:       opts,
+		Calls:         n,
+		P50:           latencies[n*50/100],
+		P99:           latencies[n*99/100],
+		Throughput:    float64(n) / elapsed.Seconds(),
+		AllocsPerCall: float64(after.Mallocs-before.Mallocs) / float64(n),
+	}, nil
+}
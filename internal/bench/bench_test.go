@@ -0,0 +1,75 @@
+package bench_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Bo0mer/grpcmon/internal/bench"
+)
+
+func BenchmarkCall(b *testing.B) {
+	for _, config := range bench.Configs {
+		b.Run(config, func(b *testing.B) {
+			env, err := bench.Setup(config, 1024)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer env.Close()
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := env.Call(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	for _, config := range bench.Configs {
+		res, err := bench.Run(bench.Options{
+			Config:      config,
+			Concurrency: 2,
+			PayloadSize: 16,
+			Duration:    20 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", config, err)
+		}
+		if res.Calls == 0 || res.P50 <= 0 || res.P99 < res.P50 || res.Throughput <= 0 {
+			t.Errorf("%s: implausible result %+v", config, res)
+		}
+	}
+}
+
+func TestSetupUnknownConfig(t *testing.T) {
+	if _, err := bench.Setup("bogus", 0); err == nil {
+		t.Error("got nil error for unknown configuration")
+	}
+}
+
+func TestRunCardinality(t *testing.T) {
+	res, err := bench.RunCardinality(bench.CardinalityOptions{
+		Config:   bench.RequestsOnly,
+		Services: 2,
+		Methods:  3,
+		Tenants:  4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RPCs != 2*2*3*4 {
+		t.Errorf("got %d RPCs, want %d", res.RPCs, 2*2*3*4)
+	}
+	// 24 methods with a pending series each and two codes each, plus the
+	// two connection series.
+	if want := 24 + 24*2 + 2; res.Series != want {
+		t.Errorf("got %d series, want %d", res.Series, want)
+	}
+	if res.ScrapeBytes == 0 {
+		t.Error("got empty scrape")
+	}
+}
@@ -0,0 +1,118 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/grpc/codes"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+// CardinalityOptions configures a RunCardinality.
+type CardinalityOptions struct {
+	// Config is the metric configuration.
+	Config string
+	// Services, Methods and Tenants are the number of distinct services,
+	// methods per service and tenants per method to synthesize traffic for.
+	//
+	// grpcmon has no tenant label, so tenants are simulated by giving each
+	// tenant its own method name. This yields the number of series a tenant
+	// label would.
+	Services, Methods, Tenants int
+}
+
+// CardinalityResult holds the measurements of a RunCardinality.
+type CardinalityResult struct {
+	Options CardinalityOptions
+	// RPCs is the number of RPCs synthesized.
+	RPCs int
+	// Series is the number of series gathered.
+	Series int
+	// HeapBytes is the heap retained by the collectors after the traffic.
+	HeapBytes uint64
+	// ScrapeBytes is the size of the text exposition of all series.
+	ScrapeBytes int
+	// GatherTime is how long gathering all series took.
+	GatherTime time.Duration
+}
+
+// RunCardinality synthesizes server side traffic across every combination
+// of service, method and tenant, each seeing one successful and one failed
+// RPC, and reports the cost of the resulting series.
+func RunCardinality(opts CardinalityOptions) (CardinalityResult, error) {
+	if opts.Config == None {
+		return CardinalityResult{}, fmt.Errorf("bench: configuration %q records no series", None)
+	}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	reg := prometheus.NewRegistry()
+	m, err := newMetrics(reg, "server", opts.Config)
+	if err != nil {
+		return CardinalityResult{}, err
+	}
+	h := grpcmon.ServerStatsHandler(m)
+	rpcs := 0
+	for s := 0; s < opts.Services; s++ {
+		for i := 0; i < opts.Methods; i++ {
+			for t := 0; t < opts.Tenants; t++ {
+				method := fmt.Sprintf("/bench.Service%d/Method%d_tenant%d", s, i, t)
+				for _, seq := range []grpcmontest.Sequence{
+					grpcmontest.UnaryOK(false),
+					grpcmontest.UnaryError(false, codes.Unavailable),
+				} {
+					for j := range seq.RPCs {
+						seq.RPCs[j].FullMethodName = method
+					}
+					grpcmontest.Replay(h, seq)
+					rpcs++
+				}
+			}
+		}
+	}
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	start := time.Now()
+	mfs, err := reg.Gather()
+	if err != nil {
+		return CardinalityResult{}, err
+	}
+	gatherTime := time.Since(start)
+
+	res := CardinalityResult{
+		Options:    opts,
+		RPCs:       rpcs,
+		GatherTime: gatherTime,
+	}
+	if after.HeapAlloc > before.HeapAlloc {
+		res.HeapBytes = after.HeapAlloc - before.HeapAlloc
+	}
+	var w countingWriter
+	for _, mf := range mfs {
+		res.Series += len(mf.GetMetric())
+		if _, err := expfmt.MetricFamilyToText(&w, mf); err != nil {
+			return CardinalityResult{}, err
+		}
+	}
+	res.ScrapeBytes = int(w)
+	runtime.KeepAlive(reg)
+	return res, nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int
+
+var _ io.Writer = (*countingWriter)(nil)
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,96 @@
+// Package statsshape fabricates the stats events of different grpc-go
+// releases, so that the handler can be tested against all of them in a
+// single build.
+//
+// Fields of the stats structs come and go between releases. Rather than
+// testing against multiple checkouts of grpc-go, a Shape rewrites events into
+// the form a range of releases produces: fields a release lacks are left
+// zero and deprecated fields it still populates are filled in.
+package statsshape
+
+import (
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+// Shape is the form of the stats events produced by a range of grpc-go
+// releases.
+type Shape struct {
+	// Name describes the releases.
+	Name    string
+	convert func(stats.RPCStats) stats.RPCStats
+}
+
+var (
+	// Legacy is the form of releases that predate stream type reporting in
+	// Begin and still report the wire length of outgoing trailers.
+	Legacy = Shape{Name: "legacy", convert: legacy}
+	// Current is the form of the releases the module is built with, where
+	// the outgoing trailer wire length is no longer populated.
+	Current = Shape{Name: "current", convert: current}
+)
+
+// All lists all shapes.
+var All = []Shape{Legacy, Current}
+
+// Sequence returns a copy of seq with all events converted to s. The events
+// of seq are not modified.
+func (s Shape) Sequence(seq grpcmontest.Sequence) grpcmontest.Sequence {
+	rpcs := make([]grpcmontest.RPC, len(seq.RPCs))
+	for i, rpc := range seq.RPCs {
+		events := make([]stats.RPCStats, len(rpc.Events))
+		for j, ev := range rpc.Events {
+			events[j] = s.convert(ev)
+		}
+		rpcs[i] = grpcmontest.RPC{FullMethodName: rpc.FullMethodName, Events: events}
+	}
+	seq.Name += " (" + s.Name + ")"
+	seq.RPCs = rpcs
+	return seq
+}
+
+func legacy(ev stats.RPCStats) stats.RPCStats {
+	switch s := ev.(type) {
+	case *stats.Begin:
+		c := *s
+		c.IsClientStream = false
+		c.IsServerStream = false
+		c.IsTransparentRetryAttempt = false
+		return &c
+	case *stats.InPayload:
+		c := *s
+		c.CompressedLength = 0
+		return &c
+	case *stats.OutPayload:
+		c := *s
+		c.CompressedLength = 0
+		return &c
+	case *stats.OutTrailer:
+		c := *s
+		c.WireLength = mdLength(s.Trailer)
+		return &c
+	}
+	return ev
+}
+
+func current(ev stats.RPCStats) stats.RPCStats {
+	if s, ok := ev.(*stats.OutTrailer); ok {
+		c := *s
+		c.WireLength = 0
+		return &c
+	}
+	return ev
+}
+
+// mdLength approximates the encoded size of md.
+func mdLength(md metadata.MD) int {
+	n := 0
+	for k, vs := range md {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
@@ -0,0 +1,39 @@
+package statsshape_test
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/internal/statsshape"
+)
+
+func TestSequence(t *testing.T) {
+	orig := grpcmontest.ServerStream(false, 1)
+
+	legacy := statsshape.Legacy.Sequence(orig)
+	for _, ev := range legacy.RPCs[0].Events {
+		switch s := ev.(type) {
+		case *stats.Begin:
+			if s.IsServerStream {
+				t.Error("legacy Begin reports the stream type")
+			}
+		case *stats.OutTrailer:
+			if s.WireLength == 0 {
+				t.Error("legacy OutTrailer has no wire length")
+			}
+		}
+	}
+
+	current := statsshape.Current.Sequence(orig)
+	for _, ev := range current.RPCs[0].Events {
+		if s, ok := ev.(*stats.OutTrailer); ok && s.WireLength != 0 {
+			t.Errorf("current OutTrailer wire length = %d, want 0", s.WireLength)
+		}
+	}
+
+	if b := orig.RPCs[0].Events[0].(*stats.Begin); !b.IsServerStream {
+		t.Error("original sequence was modified")
+	}
+}
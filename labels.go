@@ -0,0 +1,68 @@
+package grpcmon
+
+import (
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxLabelValueLength is the maximum length in bytes of label values derived
+// from network-controlled strings.
+const maxLabelValueLength = 128
+
+// sanitizeLabelValue returns s as valid UTF-8, with invalid sequences
+// replaced, truncated to at most maxLabelValueLength bytes.
+func sanitizeLabelValue(s string) string {
+	if len(s) <= maxLabelValueLength && utf8.ValidString(s) {
+		return s
+	}
+	s = strings.ToValidUTF8(s, string(utf8.RuneError))
+	if len(s) <= maxLabelValueLength {
+		return s
+	}
+	s = s[:maxLabelValueLength]
+	// Drop a rune cut in half by the truncation.
+	for len(s) > 0 {
+		r, size := utf8.DecodeLastRuneInString(s)
+		if r != utf8.RuneError || size != 1 {
+			break
+		}
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// codeLabel returns the value of the code label for an RPC that ended with
+// err.
+func codeLabel(err error) string {
+	return status.Code(err).String()
+}
+
+// codeLabel returns the value of the code label of ReqsTotal and Latency for
+// code, as mapped with WithCodeMapper.
+func (o *options) codeLabel(code codes.Code) string {
+	if o.codeMapper == nil {
+		return code.String()
+	}
+	return sanitizeLabelValue(o.codeMapper(code))
+}
+
+// withLabels returns a copy of m, a Metrics or SelfMetrics, whose metrics
+// have the given labels, so that recording them costs nothing more.
+func withLabels[T any](m *T, labels []string) *T {
+	if m == nil || len(labels) == 0 {
+		return m
+	}
+	c := *m
+	v := reflect.ValueOf(&c).Elem()
+	args := []reflect.Value{reflect.ValueOf(labels)}
+	for i := 0; i < v.NumField(); i++ {
+		if f := v.Field(i); f.Kind() == reflect.Interface && !f.IsNil() {
+			f.Set(f.MethodByName("With").CallSlice(args)[0])
+		}
+	}
+	return &c
+}
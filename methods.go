@@ -0,0 +1,187 @@
+package grpcmon
+
+import (
+	"sync"
+	"sync/atomic"
+
+	metrics "github.com/go-kit/kit/metrics"
+	"google.golang.org/grpc/codes"
+)
+
+// methodKey identifies the labels shared by the metrics of a method.
+type methodKey struct {
+	server string
+	method string
+	typ    string
+	// failFast is the fail_fast label of the code metrics, if any.
+	failFast string
+	// peer is the peer label of the code metrics, if any.
+	peer string
+}
+
+// methodMetrics holds the metrics of a method with its labels applied, so
+// that recording them on every event does not apply the labels over again.
+// The metrics are nil if their fields of Metrics are.
+type methodMetrics struct {
+	key methodKey
+
+	reqsPending    metrics.Gauge
+	reqsPendingMax metrics.Gauge
+	reqsStarted    metrics.Counter
+	msgsSent       metrics.Counter
+	msgsRecv       metrics.Counter
+	bytesSent      frameHistograms
+	bytesRecv      frameHistograms
+	bytesSentTotal metrics.Counter
+	bytesRecvTotal metrics.Counter
+	msgBytesSent   metrics.Histogram
+	msgBytesRecv   metrics.Histogram
+	ttfb           metrics.Histogram
+	gapRecv        metrics.Histogram
+	gapSent        metrics.Histogram
+	pickLatency    metrics.Histogram
+	deadlineBudget metrics.Histogram
+	reqsNoDeadline metrics.Counter
+
+	// codes holds the metrics with the code label as well, by code, and is
+	// filled as codes are seen.
+	codes [numCodes]atomic.Pointer[codeMetrics]
+}
+
+// numCodes is the number of codes defined by gRPC.
+const numCodes = int(codes.Unauthenticated) + 1
+
+// frameHistograms holds a histogram with the frame label applied, by frame.
+type frameHistograms struct {
+	header  metrics.Histogram
+	payload metrics.Histogram
+	trailer metrics.Histogram
+}
+
+// codeMetrics holds the metrics of a method with the code label applied.
+type codeMetrics struct {
+	reqsTotal metrics.Counter
+	latency   metrics.Histogram
+}
+
+// methodCache holds the metrics of the methods recorded in a Metrics.
+type methodCache struct {
+	m       *Metrics
+	opts    *options
+	methods sync.Map // methodKey -> *methodMetrics
+}
+
+// get returns the metrics of the method with the given key.
+func (c *methodCache) get(k methodKey) *methodMetrics {
+	if mm, ok := c.methods.Load(k); ok {
+		return mm.(*methodMetrics)
+	}
+	mm, _ := c.methods.LoadOrStore(k, c.newMethodMetrics(k))
+	return mm.(*methodMetrics)
+}
+
+func (c *methodCache) newMethodMetrics(k methodKey) *methodMetrics {
+	m := c.m
+	mm := &methodMetrics{key: k}
+	labels := c.opts.withType(k.typ, "service", k.server, "method", k.method)
+	if m.ReqsPending != nil {
+		mm.reqsPending = m.ReqsPending.With(labels...)
+	}
+	if m.ReqsPendingMax != nil {
+		mm.reqsPendingMax = m.ReqsPendingMax.With("service", k.server, "method", k.method)
+	}
+	if m.ReqsStarted != nil {
+		mm.reqsStarted = m.ReqsStarted.With(labels...)
+	}
+	if m.MsgsSent != nil {
+		mm.msgsSent = m.MsgsSent.With(labels...)
+	}
+	if m.MsgsRecv != nil {
+		mm.msgsRecv = m.MsgsRecv.With(labels...)
+	}
+	mm.bytesSent = newFrameHistograms(m.BytesSent, k)
+	mm.bytesRecv = newFrameHistograms(m.BytesRecv, k)
+	if m.BytesSentTotal != nil {
+		mm.bytesSentTotal = m.BytesSentTotal.With("service", k.server, "method", k.method)
+	}
+	if m.BytesRecvTotal != nil {
+		mm.bytesRecvTotal = m.BytesRecvTotal.With("service", k.server, "method", k.method)
+	}
+	if m.MsgBytesSent != nil {
+		mm.msgBytesSent = m.MsgBytesSent.With("service", k.server, "method", k.method)
+	}
+	if m.MsgBytesRecv != nil {
+		mm.msgBytesRecv = m.MsgBytesRecv.With("service", k.server, "method", k.method)
+	}
+	if m.TTFB != nil {
+		mm.ttfb = m.TTFB.With("service", k.server, "method", k.method)
+	}
+	if m.InterMsgGap != nil {
+		mm.gapRecv = m.InterMsgGap.With("service", k.server, "method", k.method, "direction", Inbound.String())
+		mm.gapSent = m.InterMsgGap.With("service", k.server, "method", k.method, "direction", Outbound.String())
+	}
+	if m.PickLatency != nil {
+		mm.pickLatency = m.PickLatency.With("service", k.server, "method", k.method)
+	}
+	if m.DeadlineBudget != nil {
+		mm.deadlineBudget = m.DeadlineBudget.With("service", k.server, "method", k.method)
+	}
+	if m.ReqsNoDeadline != nil {
+		mm.reqsNoDeadline = m.ReqsNoDeadline.With("service", k.server, "method", k.method)
+	}
+	return mm
+}
+
+func newFrameHistograms(h metrics.Histogram, k methodKey) frameHistograms {
+	if h == nil {
+		return frameHistograms{}
+	}
+	return frameHistograms{
+		header:  h.With("service", k.server, "method", k.method, "frame", header),
+		payload: h.With("service", k.server, "method", k.method, "frame", payload),
+		trailer: h.With("service", k.server, "method", k.method, "frame", trailer),
+	}
+}
+
+// withCode returns the metrics of the method mm with the code label of code.
+func (c *methodCache) withCode(mm *methodMetrics, code codes.Code) *codeMetrics {
+	if int(code) < numCodes {
+		if cm := mm.codes[code].Load(); cm != nil {
+			return cm
+		}
+	}
+	m := c.m
+	cm := new(codeMetrics)
+	labels := c.opts.withType(mm.key.typ, "service", mm.key.server, "method", mm.key.method, "code", c.opts.codeLabel(code))
+	if mm.key.failFast != "" {
+		labels = append(labels, "fail_fast", mm.key.failFast)
+	}
+	if mm.key.peer != "" {
+		labels = append(labels, "peer", mm.key.peer)
+	}
+	if m.ReqsTotal != nil {
+		cm.reqsTotal = m.ReqsTotal.With(labels...)
+	}
+	if m.Latency != nil {
+		cm.latency = m.Latency.With(labels...)
+	}
+	if int(code) < numCodes {
+		mm.codes[code].Store(cm)
+	}
+	return cm
+}
+
+// forRPC returns the metrics of the RPC v, begun with b, under the given
+// names, which are remembered by v until the names change.
+func (c *methodCache) forRPC(v *rpcInfo, server, method string, b rpcBegin) *methodMetrics {
+	k := methodKey{server: server, method: method, failFast: b.failFast, peer: v.peer}
+	if c.opts.typeLabel {
+		k.typ = b.typ
+	}
+	if mm := v.methods.Load(); mm != nil && mm.key == k {
+		return mm
+	}
+	mm := c.get(k)
+	v.methods.Store(mm)
+	return mm
+}
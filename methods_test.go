@@ -0,0 +1,184 @@
+package grpcmon_test
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/metrics/generic"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+var update = flag.Bool("grpcmon.update", false, "update testdata/series.golden")
+
+// TestRecordedSeries replays the canned sequences and compares every series
+// recorded with testdata/series.golden, so that changes to how metrics are
+// recorded do not change what is recorded.
+func TestRecordedSeries(t *testing.T) {
+	var b strings.Builder
+	for _, client := range []bool{false, true} {
+		for _, opts := range [][]grpcmon.Option{
+			nil,
+			{grpcmon.WithRPCTypeLabel()},
+			{grpcmon.WithRPCTypeLabel(), grpcmon.WithCodeMapper(grpcmon.CodeClass)},
+		} {
+			m, rec := grpcmontest.NewRecorder()
+			h := grpcmon.ServerStatsHandler(m, opts...)
+			if client {
+				h = grpcmon.ClientStatsHandler(m, opts...)
+			}
+			seqs := append(grpcmontest.Sequences(client),
+				grpcmontest.ClientStream(client, 2),
+				grpcmontest.BidiStream(client, 2),
+				grpcmontest.UnaryError(client, codes.InvalidArgument),
+			)
+			for _, seq := range seqs {
+				grpcmontest.Replay(h, seq)
+			}
+			fmt.Fprintf(&b, "# client=%v options=%d\n%s\n", client, len(opts), rec.String())
+		}
+	}
+
+	path := filepath.Join("testdata", "series.golden")
+	if *update {
+		if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != string(want) {
+		t.Errorf("recorded series differ from %s (run with -grpcmon.update to update):\n%s", path, got)
+	}
+}
+
+// TestSkippedEvents checks that handlers with few metrics, which skip the
+// events they record nothing for, still record what depends on them.
+func TestSkippedEvents(t *testing.T) {
+	m, r := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(&grpcmon.Metrics{ReqsTotal: m.ReqsTotal, MsgsRecv: m.MsgsRecv})
+	grpcmontest.Replay(h, grpcmontest.ClientStream(false, 3))
+	method := []string{"service", "grpcmontest.Test", "method", "Method"}
+	if got := r.CounterValue(grpcmontest.ReqsTotal, append(method, "code", "OK")...); got != 1 {
+		t.Errorf("requests total = %v, want 1", got)
+	}
+	if got := r.CounterValue(grpcmontest.MsgsRecv, method...); got != 3 {
+		t.Errorf("messages received = %v, want 3", got)
+	}
+
+	// Subscriptions and captures see every event of handlers without
+	// metrics.
+	h = grpcmon.ServerStatsHandler(&grpcmon.Metrics{})
+	ch, cancel := h.Subscribe(1)
+	h.Capture("grpcmontest.Test", "Method", 1)
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+	cancel()
+	s := <-ch
+	if s.MsgsRecv != 1 || s.MsgsSent != 1 || s.BytesRecv == 0 || s.BytesSent == 0 {
+		t.Errorf("summary counts %d messages and %d bytes received, %d and %d sent, want all events counted",
+			s.MsgsRecv, s.BytesRecv, s.MsgsSent, s.BytesSent)
+	}
+	captured := h.Captured()
+	if len(captured) != 1 {
+		t.Fatalf("captured %d RPCs, want 1", len(captured))
+	}
+	var types []string
+	for _, e := range captured[0].Events {
+		types = append(types, e.Type)
+	}
+	if got, want := len(types), len(grpcmontest.UnaryOK(false).RPCs[0].Events); got != want {
+		t.Errorf("captured events %v, want all %d", types, want)
+	}
+}
+
+// BenchmarkHandleRPC measures handling the events of a unary RPC, with the
+// go-kit generic metrics, which allocate when labeled like most backends.
+func BenchmarkHandleRPC(b *testing.B) {
+	m := &grpcmon.Metrics{
+		ReqsPending:    generic.NewGauge("requests_pending"),
+		ReqsTotal:      generic.NewCounter("requests_total"),
+		Latency:        generic.NewHistogram("latency_seconds", 10),
+		BytesSent:      generic.NewHistogram("sent_bytes", 10),
+		BytesRecv:      generic.NewHistogram("recv_bytes", 10),
+		MsgsSent:       generic.NewCounter("msgs_sent_total"),
+		MsgsRecv:       generic.NewCounter("msgs_received_total"),
+		MsgBytesSent:   generic.NewHistogram("msg_sent_bytes", 10),
+		MsgBytesRecv:   generic.NewHistogram("msg_recv_bytes", 10),
+		BytesSentTotal: generic.NewCounter("sent_bytes_total"),
+		BytesRecvTotal: generic.NewCounter("recv_bytes_total"),
+	}
+	h := grpcmon.ServerStatsHandler(m)
+	seq := grpcmontest.UnaryOK(false)
+	events := seq.RPCs[0].Events
+	ctx := h.TagConn(context.Background(), &stats.ConnTagInfo{})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx := h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+		for _, ev := range events {
+			h.HandleRPC(ctx, ev)
+		}
+	}
+}
+
+// BenchmarkHandleRPCSparse measures handling the events of a unary RPC with
+// few or no metrics to record, which should cost little more than the
+// accounting of the RPC.
+func BenchmarkHandleRPCSparse(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		m    *grpcmon.Metrics
+	}{
+		{"ReqsTotal", &grpcmon.Metrics{ReqsTotal: generic.NewCounter("requests_total")}},
+		{"none", &grpcmon.Metrics{}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			h := grpcmon.ServerStatsHandler(bc.m)
+			events := grpcmontest.UnaryOK(false).RPCs[0].Events
+			ctx := h.TagConn(context.Background(), &stats.ConnTagInfo{})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ctx := h.TagRPC(ctx, &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+				for _, ev := range events {
+					h.HandleRPC(ctx, ev)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPayloadSampling measures handling the payload events of a stream
+// with and without sampling.
+func BenchmarkPayloadSampling(b *testing.B) {
+	for _, n := range []int{1, 100} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			m := &grpcmon.Metrics{
+				BytesSent: generic.NewHistogram("sent_bytes", 50),
+				BytesRecv: generic.NewHistogram("recv_bytes", 50),
+			}
+			h := grpcmon.ServerStatsHandler(m, grpcmon.WithPayloadSampling(n))
+			ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+			h.HandleRPC(ctx, &stats.Begin{IsClientStream: true, IsServerStream: true})
+			in := &stats.InPayload{Length: 10, WireLength: 15}
+			out := &stats.OutPayload{Length: 20, WireLength: 25}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.HandleRPC(ctx, in)
+				h.HandleRPC(ctx, out)
+			}
+		})
+	}
+}
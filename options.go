@@ -0,0 +1,536 @@
+package grpcmon
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Option configures the instrumentation. Options are applied in order, the
+// later ones overriding the earlier unless documented otherwise, and are
+// copied into the handler when it is created, which fixes its configuration
+// for its lifetime. The functions returning options panic when given
+// arguments that cannot be meant, such as nil functions or negative
+// durations.
+type Option func(*options)
+
+type options struct {
+	streamAgeThreshold time.Duration
+	streamAgeInterval  time.Duration
+
+	slowRPCThreshold time.Duration
+	slowRPCMethods   map[rpcName]time.Duration
+	slowRPCHook      func(SlowRPC)
+
+	onRPCEnd   []func(context.Context, RPCSummary)
+	dropPolicy DropPolicy
+
+	rollingSlots int
+	rollingWidth time.Duration
+
+	failure    func(codes.Code) bool
+	objectives []Objective
+
+	detailTypes []string
+
+	anomalies *AnomalyConfig
+
+	errorRateWindow time.Duration
+
+	redLogger   *slog.Logger
+	redInterval time.Duration
+
+	deadlineOvershootHook func(context.Context, DeadlineOvershoot)
+
+	watchdogLimit    int
+	watchdogMethods  map[rpcName]int
+	watchdogCooldown time.Duration
+	watchdogFn       func(service, method string, pending int)
+
+	inflightRegistry bool
+
+	churn *ChurnConfig
+
+	self *SelfMetrics
+
+	typeLabel     bool
+	failFastLabel bool
+	peerIdentity  func(*peer.Peer) string
+
+	finalAttemptOnly bool
+
+	collector Collector
+
+	filter func(service, method string) bool
+
+	constLabels []string
+
+	connPeerLabel      func(net.Addr) string
+	connTransportLabel bool
+	connTarget         string
+
+	codeMapper func(codes.Code) string
+
+	payloadSampling int
+
+	latencyUnit time.Duration
+}
+
+// checkOption panics with a message naming option and reason unless ok.
+// Options are checked as they are created, so that misuse is reported where
+// the option is written rather than when or whether the handler is built,
+// and the handler never checks them on the path of an RPC.
+func checkOption(ok bool, option, reason string) {
+	if !ok {
+		panic("grpcmon: " + option + ": " + reason)
+	}
+}
+
+// WithStreamAge enables periodic observations of the StreamAge histogram.
+// Every interval, the age of each RPC that has been in flight for longer than
+// threshold is observed, which makes long-lived streams visible before they
+// end. The final Latency observation is not affected. The background ticker
+// only runs while such RPCs are in flight.
+func WithStreamAge(threshold, interval time.Duration) Option {
+	checkOption(threshold >= 0 && interval > 0, "WithStreamAge", "threshold must not be negative and interval must be positive")
+	return func(o *options) {
+		o.streamAgeThreshold = threshold
+		o.streamAgeInterval = interval
+	}
+}
+
+// WithLatencyUnit sets the unit of the observations of the histograms
+// measuring time, Latency, StreamAge, TTFB, InterMsgGap, ProcessingTime,
+// ConnDuration, DeadlineBudget and PickLatency, which is a second by default
+// as their documented names say. It is meant for custom Metrics of pipelines
+// expecting other units, such as milliseconds. The interceptors observe
+// Latency in the unit too; WithContextDialer and MetricsCollector take no
+// options and always observe seconds.
+func WithLatencyUnit(unit time.Duration) Option {
+	checkOption(unit > 0, "WithLatencyUnit", "unit must be positive")
+	return func(o *options) {
+		o.latencyUnit = unit
+	}
+}
+
+// inUnit returns d in the unit set with WithLatencyUnit.
+func (o *options) inUnit(d time.Duration) float64 {
+	if o.latencyUnit <= 0 {
+		return d.Seconds()
+	}
+	return float64(d) / float64(o.latencyUnit)
+}
+
+// WithSlowRPCHook calls fn with every RPC that takes longer than threshold
+// to complete. Calls are made one at a time from a separate goroutine, and
+// panics in fn are recovered. If fn falls behind, further slow RPCs are
+// dropped rather than delaying RPC completion.
+func WithSlowRPCHook(threshold time.Duration, fn func(info SlowRPC)) Option {
+	checkOption(fn != nil, "WithSlowRPCHook", "nil function")
+	checkOption(threshold >= 0, "WithSlowRPCHook", "negative threshold")
+	return func(o *options) {
+		o.slowRPCThreshold = threshold
+		o.slowRPCHook = fn
+	}
+}
+
+// WithSlowRPCThreshold overrides the threshold of WithSlowRPCHook for the
+// given method, identified by its service and method label values.
+func WithSlowRPCThreshold(service, method string, threshold time.Duration) Option {
+	checkOption(threshold >= 0, "WithSlowRPCThreshold", "negative threshold")
+	return func(o *options) {
+		if o.slowRPCMethods == nil {
+			o.slowRPCMethods = make(map[rpcName]time.Duration)
+		}
+		o.slowRPCMethods[rpcName{server: service, method: method}] = threshold
+	}
+}
+
+// WithOnRPCEnd calls fn once for every completed RPC, after its metrics are
+// recorded. ctx is the context of the RPC. fn runs on the completion path of
+// the RPC and must be fast; move any slow work elsewhere. Multiple functions
+// may be registered and are called in order.
+func WithOnRPCEnd(fn func(ctx context.Context, s RPCSummary)) Option {
+	checkOption(fn != nil, "WithOnRPCEnd", "nil function")
+	return func(o *options) {
+		o.onRPCEnd = append(o.onRPCEnd, fn)
+	}
+}
+
+// WithDropPolicy sets which summary is dropped when a subscriber of
+// Handler.Subscribe falls behind. The default is DropNewest.
+func WithDropPolicy(p DropPolicy) Option {
+	checkOption(p == DropNewest || p == DropOldest, "WithDropPolicy", "unknown policy")
+	return func(o *options) {
+		o.dropPolicy = p
+	}
+}
+
+// WithErrorLog logs a structured record with the fields of RPCSummary for
+// every RPC that ends with an error, at warning level. At most limit records
+// per status code are logged per second, so that an outage does not flood
+// the logs.
+func WithErrorLog(logger *slog.Logger, limit int) Option {
+	checkOption(logger != nil, "WithErrorLog", "nil logger")
+	checkOption(limit > 0, "WithErrorLog", "limit must be positive")
+	return func(o *options) {
+		o.onRPCEnd = append(o.onRPCEnd, newErrorLogger(logger, limit).log)
+	}
+}
+
+// WithRollingWindow enables in-process aggregation of the RPCs of each
+// method over a rolling window of the given number of slots, each spanning
+// width, for example 10 slots of a minute. Memory is bounded by the number
+// of slots and methods, and data older than the window ages out. The
+// aggregates back Handler.TopSlowest and DebugHandler.
+func WithRollingWindow(slots int, width time.Duration) Option {
+	checkOption(slots > 0 && width > 0, "WithRollingWindow", "slots and width must be positive")
+	return func(o *options) {
+		o.rollingSlots = slots
+		o.rollingWidth = width
+	}
+}
+
+// WithFailure sets the function that decides which status codes count as
+// failures, for everything that distinguishes failed RPCs from successful
+// ones except the code label itself: the error counts of WithRollingWindow,
+// the SLO classification of WithSLOs, the ErrorRate gauge and
+// Handler.ErrorRate of WithErrorRate, and the error counts of WithREDLog.
+// WithErrorLog logs every RPC that ended with an error regardless. By
+// default, every code but OK is a failure.
+func WithFailure(fn func(code codes.Code) bool) Option {
+	checkOption(fn != nil, "WithFailure", "nil function")
+	return func(o *options) {
+		o.failure = fn
+	}
+}
+
+// WithSLOs tracks the given service level objectives. Every RPC of a method
+// with an objective is counted as good or bad by SLOEvents, and the rate at
+// which the error budget of the objective is burnt over the last 5 minutes,
+// hour and 6 hours is set on SLOBurnRate. A burn rate of 1 uses up the
+// budget exactly by the end of the objective's period. The gauges are
+// updated whenever an RPC of the method ends.
+func WithSLOs(objectives ...Objective) Option {
+	return func(o *options) {
+		o.objectives = append(o.objectives, objectives...)
+	}
+}
+
+// WithErrorDetailTypes sets the error detail types counted by ErrorDetails
+// under their own name, as fully qualified message names like
+// google.rpc.RetryInfo. Other types are counted as "other". The default is
+// DefaultErrorDetailTypes.
+func WithErrorDetailTypes(types ...string) Option {
+	return func(o *options) {
+		o.detailTypes = types
+	}
+}
+
+// WithLatencyAnomalies detects latency anomalies: methods whose mean
+// latency over a short window deviates from that over a longer baseline by
+// more than a number of standard deviations. The windows are kept like
+// those of WithRollingWindow, so memory is bounded by their size and the
+// number of methods. See AnomalyConfig for the knobs, none of which have
+// defaults.
+func WithLatencyAnomalies(cfg AnomalyConfig) Option {
+	return func(o *options) {
+		o.anomalies = &cfg
+	}
+}
+
+// WithErrorRate tracks the ratio of failed RPCs of each method over a
+// rolling window, for example 30 seconds. The ratio is set on ErrorRate as
+// RPCs end and is available from Handler.ErrorRate.
+func WithErrorRate(window time.Duration) Option {
+	checkOption(window > 0, "WithErrorRate", "window must be positive")
+	return func(o *options) {
+		o.errorRateWindow = window
+	}
+}
+
+// WithREDLog logs a summary of the RPCs of each service every interval, for
+// environments without a metrics backend. Each line holds the number of
+// requests and errors, the estimated 50th and 99th percentile latency and
+// the bytes transferred since the previous line. Nothing is logged for
+// services without RPCs in the interval. Logging runs until Handler.Close is
+// called.
+func WithREDLog(logger *slog.Logger, interval time.Duration) Option {
+	checkOption(logger != nil, "WithREDLog", "nil logger")
+	checkOption(interval > 0, "WithREDLog", "interval must be positive")
+	return func(o *options) {
+		o.redLogger = logger
+		o.redInterval = interval
+	}
+}
+
+// WithDeadlineOvershootHook calls fn for every server RPC whose handling
+// time exceeded the deadline of the incoming request, regardless of its
+// code. Such RPCs are also counted in DeadlineOvershoots. ctx is the context
+// of the RPC. fn runs on the completion path of the RPC and must be fast.
+func WithDeadlineOvershootHook(fn func(ctx context.Context, info DeadlineOvershoot)) Option {
+	checkOption(fn != nil, "WithDeadlineOvershootHook", "nil function")
+	return func(o *options) {
+		o.deadlineOvershootHook = fn
+	}
+}
+
+// WithPendingWatchdog calls fn when the number of RPCs in flight of a method
+// exceeds limit, for example to dump goroutines while the backlog lasts.
+// fn is called from a new goroutine, with panics recovered, at most once
+// per method per cooldown, which defaults to a minute. The count is only
+// checked as RPCs begin, when it crosses the limit. A limit of zero
+// disables the watchdog for methods without their own limit.
+func WithPendingWatchdog(limit int, fn func(service, method string, pending int)) Option {
+	checkOption(fn != nil, "WithPendingWatchdog", "nil function")
+	checkOption(limit >= 0, "WithPendingWatchdog", "negative limit")
+	return func(o *options) {
+		o.watchdogLimit = limit
+		o.watchdogFn = fn
+	}
+}
+
+// WithPendingWatchdogLimit overrides the limit of WithPendingWatchdog for
+// the given method.
+func WithPendingWatchdogLimit(service, method string, limit int) Option {
+	checkOption(limit >= 0, "WithPendingWatchdogLimit", "negative limit")
+	return func(o *options) {
+		if o.watchdogMethods == nil {
+			o.watchdogMethods = make(map[rpcName]int)
+		}
+		o.watchdogMethods[rpcName{server: service, method: method}] = limit
+	}
+}
+
+// WithPendingWatchdogCooldown sets the minimum time between two calls of the
+// function of WithPendingWatchdog for the same method.
+func WithPendingWatchdogCooldown(d time.Duration) Option {
+	checkOption(d > 0, "WithPendingWatchdogCooldown", "cooldown must be positive")
+	return func(o *options) {
+		o.watchdogCooldown = d
+	}
+}
+
+// WithInFlightRegistry keeps track of every RPC in flight, with its peer and
+// deadline, for Handler.InFlightRPCs and InFlightHandler. Tracking takes a
+// short lock as RPCs begin and end.
+func WithInFlightRegistry() Option {
+	return func(o *options) {
+		o.inflightRegistry = true
+	}
+}
+
+// WithConnChurn detects spikes of connections opened, which often reveal
+// load balancer misconfigurations before errors do. Each spike is counted
+// in ConnChurnSpikes and reported to cfg.Callback once.
+func WithConnChurn(cfg ChurnConfig) Option {
+	return func(o *options) {
+		o.churn = &cfg
+	}
+}
+
+// WithSelfMetrics records metrics about the data the handler drops or cannot
+// attribute on m.
+func WithSelfMetrics(m *SelfMetrics) Option {
+	return func(o *options) {
+		o.self = m
+	}
+}
+
+// WithRPCTypeLabel adds a type label to ReqsPending, ReqsStarted, ReqsTotal,
+// Latency, MsgsSent and MsgsRecv, one of unary, client_stream,
+// server_stream and bidi, so that the latency of streams is not mixed with
+// that of unary RPCs. The metrics must be created with the type label; pass
+// the option to InitializeMetrics too.
+func WithRPCTypeLabel() Option {
+	return func(o *options) {
+		o.typeLabel = true
+	}
+}
+
+// WithFailFastLabel adds a fail_fast label to the ReqsTotal and Latency of
+// clients, true unless the RPC was made with grpc.WaitForReady(true), so
+// that RPCs waiting for a connection to become ready can be told apart from
+// the ones failing fast. Servers do not know how the RPC was made and are
+// not affected. The client metrics must be created with the label.
+func WithFailFastLabel() Option {
+	return func(o *options) {
+		o.failFastLabel = true
+	}
+}
+
+// WithPeerIdentityLabel adds a peer label to the ReqsTotal and Latency of
+// servers, with the identity fn extracts from the peer of the RPC, such as
+// the SPIFFE ID or the common name of its TLS certificate, so that requests
+// can be told apart by calling workload. The identities are to be of bounded
+// cardinality. RPCs on insecure connections and the ones fn returns no
+// identity for are labeled unknown. Clients are not affected. The server
+// metrics must be created with the label.
+func WithPeerIdentityLabel(fn func(*peer.Peer) string) Option {
+	checkOption(fn != nil, "WithPeerIdentityLabel", "nil function")
+	return func(o *options) {
+		o.peerIdentity = fn
+	}
+}
+
+// TLSPeerIdentity returns the SPIFFE ID of the peer of a TLS connection, the
+// first spiffe URI SAN of its leaf certificate, or the common name of the
+// certificate if it has none, for WithPeerIdentityLabel. It returns "" for
+// other peers.
+func TLSPeerIdentity(p *peer.Peer) string {
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return ""
+	}
+	leaf := info.State.PeerCertificates[0]
+	for _, u := range leaf.URIs {
+		if u.Scheme == "spiffe" {
+			return u.String()
+		}
+	}
+	return leaf.Subject.CommonName
+}
+
+// peerIdentityLabel returns the peer label of the RPC of ctx.
+func (o *options) peerIdentityLabel(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.AuthInfo == nil {
+		return "unknown"
+	}
+	if p.AuthInfo.AuthType() == "insecure" {
+		return "unknown"
+	}
+	if id := o.peerIdentity(p); id != "" {
+		return sanitizeLabelValue(id)
+	}
+	return "unknown"
+}
+
+// WithFilter records only the RPCs for which fn, called once per RPC with
+// its service and method label values, returns true. Other RPCs are not
+// recorded at all, neither in metrics nor in InFlight and the hooks.
+func WithFilter(fn func(service, method string) bool) Option {
+	checkOption(fn != nil, "WithFilter", "nil function")
+	return func(o *options) {
+		o.filter = fn
+	}
+}
+
+// ExcludeServices is like WithFilter, excluding the RPCs of the given
+// services, for example "grpc.health.v1.Health".
+func ExcludeServices(services ...string) Option {
+	excluded := make(map[string]bool, len(services))
+	for _, s := range services {
+		excluded[s] = true
+	}
+	return WithFilter(func(service, _ string) bool {
+		return !excluded[service]
+	})
+}
+
+// WithConstLabels adds the given labels to every metric recorded, for
+// example to tell apart environments or logical services. The metrics must be
+// created with the labels. With Prometheus, prometheus.WrapRegistererWith
+// adds constant labels without this option.
+func WithConstLabels(labels map[string]string) Option {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	flat := make([]string, 0, 2*len(labels))
+	for _, name := range names {
+		flat = append(flat, name, labels[name])
+	}
+	return func(o *options) {
+		o.constLabels = flat
+	}
+}
+
+// WithPayloadSampling makes the payload observations of the byte
+// histograms, BytesSent, BytesRecv, MsgBytesSent and MsgBytesRecv, sample 1
+// out of every n payload events of the handler, to cut their cost on
+// servers handling many messages. The observations are not scaled, so their
+// count is to be multiplied by n to estimate the number of messages. Header
+// and trailer observations, counters and the accounting of RPCs are not
+// affected. Values of n below 2 observe every payload, as by default.
+func WithPayloadSampling(n int) Option {
+	return func(o *options) {
+		o.payloadSampling = n
+	}
+}
+
+// WithConnPeerLabel adds a peer label to ConnsOpen and ConnsTotal, with the
+// value fn returns for the remote address of the connection. To bound
+// cardinality, fn should return the host only, like PeerHost, or coarser.
+func WithConnPeerLabel(fn func(addr net.Addr) string) Option {
+	checkOption(fn != nil, "WithConnPeerLabel", "nil function")
+	return func(o *options) {
+		o.connPeerLabel = fn
+	}
+}
+
+// WithConnTransportLabel adds a transport label to ConnsOpen and ConnsTotal,
+// with the network of the local address of the connection, such as tcp or
+// unix. This tells apart the connections of servers listening on several
+// transports.
+func WithConnTransportLabel() Option {
+	return func(o *options) {
+		o.connTransportLabel = true
+	}
+}
+
+// WithTarget adds a target label with the given value to ConnsOpen,
+// ConnsTotal and ConnDuration. It is meant for clients dialing several
+// backends, with a DialOption per backend sharing the same Metrics, so that
+// the connections to each can be told apart. To label the RPC metrics with
+// the target as well, use WithConstLabels instead.
+func WithTarget(target string) Option {
+	return func(o *options) {
+		o.connTarget = sanitizeLabelValue(target)
+	}
+}
+
+// WithCodeMapper sets the value of the code label of ReqsTotal and Latency to
+// the one fn returns for the code of the RPC, for example to collapse codes
+// into fewer values with CodeClass. Hooks and RPC summaries still see the
+// code itself. The value is computed once per method and code, so fn must
+// always return the same value for a code.
+func WithCodeMapper(fn func(codes.Code) string) Option {
+	checkOption(fn != nil, "WithCodeMapper", "nil function")
+	return func(o *options) {
+		o.codeMapper = fn
+	}
+}
+
+// CodeClass maps code to its class, for use with WithCodeMapper: ok,
+// canceled, client_error or server_error. Codes are classified like their HTTP
+// equivalents, so that client_error comprises InvalidArgument, NotFound,
+// AlreadyExists, PermissionDenied, ResourceExhausted, FailedPrecondition,
+// Aborted, OutOfRange and Unauthenticated, and server_error the rest.
+func CodeClass(code codes.Code) string {
+	switch code {
+	case codes.OK:
+		return "ok"
+	case codes.Canceled:
+		return "canceled"
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists,
+		codes.PermissionDenied, codes.ResourceExhausted, codes.FailedPrecondition,
+		codes.Aborted, codes.OutOfRange, codes.Unauthenticated:
+		return "client_error"
+	default:
+		return "server_error"
+	}
+}
+
+// PeerHost returns the host of addr without the port, for use with
+// WithConnPeerLabel.
+func PeerHost(addr net.Addr) string {
+	return remoteHost(addr)
+}
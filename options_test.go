@@ -0,0 +1,90 @@
+package grpcmon_test
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+func TestOptionsInvalid(t *testing.T) {
+	logger := slog.Default()
+	for name, fn := range map[string]func() grpcmon.Option{
+		"WithFilter":                  func() grpcmon.Option { return grpcmon.WithFilter(nil) },
+		"WithOnRPCEnd":                func() grpcmon.Option { return grpcmon.WithOnRPCEnd(nil) },
+		"WithFailure":                 func() grpcmon.Option { return grpcmon.WithFailure(nil) },
+		"WithCodeMapper":              func() grpcmon.Option { return grpcmon.WithCodeMapper(nil) },
+		"WithConnPeerLabel":           func() grpcmon.Option { return grpcmon.WithConnPeerLabel(nil) },
+		"WithPeerIdentityLabel":       func() grpcmon.Option { return grpcmon.WithPeerIdentityLabel(nil) },
+		"WithDeadlineOvershootHook":   func() grpcmon.Option { return grpcmon.WithDeadlineOvershootHook(nil) },
+		"WithCollector":               func() grpcmon.Option { return grpcmon.WithCollector(nil) },
+		"WithSlowRPCHook":             func() grpcmon.Option { return grpcmon.WithSlowRPCHook(time.Second, nil) },
+		"WithSlowRPCThreshold":        func() grpcmon.Option { return grpcmon.WithSlowRPCThreshold("s", "m", -time.Second) },
+		"WithStreamAge":               func() grpcmon.Option { return grpcmon.WithStreamAge(time.Second, 0) },
+		"WithLatencyUnit":             func() grpcmon.Option { return grpcmon.WithLatencyUnit(0) },
+		"WithDropPolicy":              func() grpcmon.Option { return grpcmon.WithDropPolicy(grpcmon.DropPolicy(7)) },
+		"WithErrorLog":                func() grpcmon.Option { return grpcmon.WithErrorLog(logger, 0) },
+		"WithRollingWindow":           func() grpcmon.Option { return grpcmon.WithRollingWindow(0, time.Minute) },
+		"WithErrorRate":               func() grpcmon.Option { return grpcmon.WithErrorRate(-time.Second) },
+		"WithREDLog":                  func() grpcmon.Option { return grpcmon.WithREDLog(nil, time.Minute) },
+		"WithPendingWatchdog":         func() grpcmon.Option { return grpcmon.WithPendingWatchdog(-1, func(string, string, int) {}) },
+		"WithPendingWatchdogLimit":    func() grpcmon.Option { return grpcmon.WithPendingWatchdogLimit("s", "m", -1) },
+		"WithPendingWatchdogCooldown": func() grpcmon.Option { return grpcmon.WithPendingWatchdogCooldown(0) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				r := recover()
+				if msg, _ := r.(string); !strings.HasPrefix(msg, "grpcmon: "+name+": ") {
+					t.Errorf("recovered %v, want a panic naming %s", r, name)
+				}
+			}()
+			fn()
+		})
+	}
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	var summaries []grpcmon.RPCSummary
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithOnRPCEnd(func(_ context.Context, s grpcmon.RPCSummary) {
+		summaries = append(summaries, s)
+	}))
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+
+	method := []string{"service", "grpcmontest.Test", "method", "Method", "code", "OK"}
+	if got := rec.Observations(grpcmontest.Latency, method...); !reflect.DeepEqual(got, []float64{0.003}) {
+		t.Errorf("latency observations = %v, want seconds [0.003]", got)
+	}
+	if len(summaries) != 1 || summaries[0].Code != "OK" {
+		t.Errorf("summaries = %v, want one OK", summaries)
+	}
+}
+
+func TestOptionsCombined(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	var calls []string
+	h := grpcmon.ServerStatsHandler(m,
+		grpcmon.ExcludeServices("grpcmontest.Test"),
+		grpcmon.WithLatencyUnit(time.Second),
+		grpcmon.WithOnRPCEnd(func(context.Context, grpcmon.RPCSummary) { calls = append(calls, "first") }),
+		// The later filter and unit replace the earlier ones, while hooks add up.
+		grpcmon.WithFilter(func(string, string) bool { return true }),
+		grpcmon.WithLatencyUnit(time.Millisecond),
+		grpcmon.WithOnRPCEnd(func(context.Context, grpcmon.RPCSummary) { calls = append(calls, "second") }),
+		grpcmon.WithCodeMapper(grpcmon.CodeClass),
+	)
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(false))
+
+	method := []string{"service", "grpcmontest.Test", "method", "Method", "code", "ok"}
+	if got := rec.Observations(grpcmontest.Latency, method...); !reflect.DeepEqual(got, []float64{3}) {
+		t.Errorf("latency observations = %v, want milliseconds [3]\n%s", got, rec)
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("hooks called = %v, want %v", calls, want)
+	}
+}
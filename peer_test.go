@@ -0,0 +1,130 @@
+package grpcmon_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate signed by ca, as described by tmpl.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestPeerIdentityLabel(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, &x509.Certificate{
+		DNSNames:    []string{"bufconn"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	serverCreds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	})
+	spiffe, _ := url.Parse("spiffe://example.org/ns/default/sa/frontend")
+
+	for _, tt := range []struct {
+		name   string
+		client *x509.Certificate
+		want   string
+	}{
+		{"spiffe", &x509.Certificate{Subject: pkix.Name{CommonName: "frontend-1"}, URIs: []*url.URL{spiffe}}, spiffe.String()},
+		{"common name", &x509.Certificate{Subject: pkix.Name{CommonName: "batch"}}, "batch"},
+		{"none", &x509.Certificate{}, "unknown"},
+		{"insecure", nil, "unknown"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []grpcmontest.HarnessOption{grpcmontest.MonitorOptions(grpcmon.WithPeerIdentityLabel(grpcmon.TLSPeerIdentity))}
+			if tt.client != nil {
+				tt.client.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+				clientCreds := credentials.NewTLS(&tls.Config{
+					Certificates: []tls.Certificate{ca.issue(t, tt.client)},
+					RootCAs:      ca.pool,
+				})
+				opts = append(opts,
+					grpcmontest.ServerOptions(grpc.Creds(serverCreds)),
+					grpcmontest.DialOptions(grpc.WithTransportCredentials(clientCreds)),
+				)
+			}
+			h := grpcmontest.NewHarness(t, opts...)
+			pb.RegisterFrontendServer(h.Server, &frontend{})
+			if _, err := pb.NewFrontendClient(h.Conn()).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+				t.Fatal(err)
+			}
+			h.Stop()
+
+			labels := []string{"service", "frontend.Frontend", "method", "Query", "code", "OK", "peer", tt.want}
+			if got := h.ServerRecorder.CounterValue(grpcmontest.ReqsTotal, labels...); got != 1 {
+				t.Errorf("server requests total of peer %s = %v, want 1\n%s", tt.want, got, h.ServerRecorder)
+			}
+			if got := h.ServerRecorder.HistogramCount(grpcmontest.Latency, labels...); got != 1 {
+				t.Errorf("server latency observations of peer %s = %d, want 1", tt.want, got)
+			}
+			if got := h.ClientRecorder.CounterValue(grpcmontest.ReqsTotal, labels[:6]...); got != 1 {
+				t.Errorf("client requests total = %v, want 1 without the peer label", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package grpcmon
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// pendingCounts counts the RPCs in flight per method and in total.
+type pendingCounts struct {
+	m     sync.Map // rpcName -> *pendingCount
+	total atomic.Int64
+}
+
+// pendingCount counts the RPCs in flight of a method.
+type pendingCount struct {
+	n atomic.Int64
+	// max is the highest n since it was last reset.
+	max atomic.Int64
+}
+
+// raise raises the high-water mark of c to n, unless it is higher already.
+func (c *pendingCount) raise(n int64) bool {
+	return raiseMax(&c.max, n)
+}
+
+// raiseMax raises the high-water mark max to n, unless it is higher already,
+// and reports whether it did.
+func raiseMax(max *atomic.Int64, n int64) bool {
+	for {
+		m := max.Load()
+		if n <= m {
+			return false
+		}
+		if max.CompareAndSwap(m, n) {
+			return true
+		}
+	}
+}
+
+// add adds delta to the count of the given method and returns the new
+// count, and whether it raised the high-water mark of the method.
+func (p *pendingCounts) add(name rpcName, delta int64) (int64, bool) {
+	v, ok := p.m.Load(name)
+	if !ok {
+		v, _ = p.m.LoadOrStore(name, new(pendingCount))
+	}
+	p.total.Add(delta)
+	c := v.(*pendingCount)
+	n := c.n.Add(delta)
+	return n, delta > 0 && c.raise(n)
+}
+
+// get returns the count of the given method.
+func (p *pendingCounts) get(name rpcName) int64 {
+	v, ok := p.m.Load(name)
+	if !ok {
+		return 0
+	}
+	return v.(*pendingCount).n.Load()
+}
+
+// snapshot returns the methods with RPCs in flight and their counts.
+func (p *pendingCounts) snapshot() map[rpcName]int64 {
+	res := make(map[rpcName]int64)
+	p.m.Range(func(k, v interface{}) bool {
+		if n := v.(*pendingCount).n.Load(); n != 0 {
+			res[k.(rpcName)] = n
+		}
+		return true
+	})
+	return res
+}
+
+// resetMax calls fn with the high-water mark of each method that had RPCs in
+// flight since the previous call, and resets the marks to the current counts,
+// which are passed to fn as well.
+func (p *pendingCounts) resetMax(fn func(name rpcName, max, n int64)) {
+	p.m.Range(func(k, v interface{}) bool {
+		c := v.(*pendingCount)
+		n := c.n.Load()
+		max := c.max.Swap(n)
+		// RPCs that began since n was loaded raise the mark again.
+		if now := c.n.Load(); now > n && c.raise(now) {
+			n = now
+		}
+		if max > 0 {
+			fn(k.(rpcName), max, n)
+		}
+		return true
+	})
+}
+
+// InFlight returns the number of RPCs of the given method in flight, as
+// recorded in ReqsPending. It does not lock and is cheap enough to be called
+// on every RPC, for example by concurrency limiters.
+func (h *Handler) InFlight(service, method string) int {
+	return int(h.pending.get(rpcName{server: service, method: method}))
+}
+
+// PendingMax is the highest number of RPCs of a method in flight at once
+// over a period, as returned by Handler.PendingMax.
+type PendingMax struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	Max     int64  `json:"max"`
+}
+
+// PendingMax returns the highest number of RPCs of each method in flight at
+// once since the previous call, which point-in-time ReqsPending scrapes miss,
+// sorted by service and method, and resets these high-water marks to the
+// numbers of RPCs in flight, as is ReqsPendingMax. Methods without RPCs in
+// flight since the previous call are omitted. Calling it periodically, as on
+// every scrape, reports the peak concurrency of each period.
+func (h *Handler) PendingMax() []PendingMax {
+	m := h.server
+	if h.isClient {
+		m = h.client
+	}
+	var res []PendingMax
+	h.pending.resetMax(func(name rpcName, max, n int64) {
+		res = append(res, PendingMax{Service: name.server, Method: name.method, Max: max})
+		if m.ReqsPendingMax != nil {
+			m.ReqsPendingMax.With("service", name.server, "method", name.method).Set(float64(n))
+		}
+	})
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Service != res[j].Service {
+			return res[i].Service < res[j].Service
+		}
+		return res[i].Method < res[j].Method
+	})
+	return res
+}
+
+// InFlightTotal returns the number of RPCs in flight across all methods.
+func (h *Handler) InFlightTotal() int {
+	return int(h.pending.total.Load())
+}
@@ -0,0 +1,84 @@
+package grpcmon_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+func TestPendingMax(t *testing.T) {
+	const n = 100
+	m, rec := grpcmontest.NewRecorder()
+	sh := grpcmon.ServerStatsHandler(m)
+	srv := grpc.NewServer(grpc.StatsHandler(sh))
+	fe := &blockingFrontend{release: make(chan struct{})}
+	pb.RegisterFrontendServer(srv, fe)
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	defer srv.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewFrontendClient(conn)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Query(context.Background(), &pb.QueryRequest{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); sh.InFlight("frontend.Frontend", "Query") < n && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	close(fe.release)
+	wg.Wait()
+
+	method := []string{"service", "frontend.Frontend", "method", "Query"}
+	if got := rec.GaugeValue(grpcmontest.ReqsPending, method...); got != 0 {
+		t.Errorf("requests pending = %v, want 0", got)
+	}
+	want := []grpcmon.PendingMax{{Service: "frontend.Frontend", Method: "Query", Max: n}}
+	if got := sh.PendingMax(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingMax = %v, want %v", got, want)
+	}
+	// Reading the marks resets them.
+	if got := rec.GaugeValue(grpcmontest.ReqsPendingMax, method...); got != 0 {
+		t.Errorf("requests pending max after reset = %v, want 0", got)
+	}
+	if got := sh.PendingMax(); got != nil {
+		t.Errorf("PendingMax after reset = %v, want none", got)
+	}
+
+	if _, err := client.Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.GaugeValue(grpcmontest.ReqsPendingMax, method...); got != 1 {
+		t.Errorf("requests pending max = %v, want 1", got)
+	}
+	want[0].Max = 1
+	if got := sh.PendingMax(); !reflect.DeepEqual(got, want) {
+		t.Errorf("PendingMax = %v, want %v", got, want)
+	}
+}
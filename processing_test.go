@@ -0,0 +1,74 @@
+package grpcmon_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+type sleepingFrontend struct {
+	d time.Duration
+}
+
+func (f *sleepingFrontend) Query(context.Context, *pb.QueryRequest) (*pb.QueryResponse, error) {
+	time.Sleep(f.d)
+	return &pb.QueryResponse{}, nil
+}
+
+func TestProcessingTime(t *testing.T) {
+	const sleep = 50 * time.Millisecond
+	h := grpcmontest.NewHarness(t)
+	pb.RegisterFrontendServer(h.Server, &sleepingFrontend{d: sleep})
+	if _, err := pb.NewFrontendClient(h.Conn()).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	labels := []string{"service", "frontend.Frontend", "method", "Query", "code", "OK"}
+	processing := h.ServerRecorder.Observations(grpcmontest.ProcessingTime, labels...)
+	latency := h.ServerRecorder.Observations(grpcmontest.Latency, labels...)
+	if len(processing) != 1 || len(latency) != 1 {
+		t.Fatalf("processing time observations = %v, latency observations = %v, want one of each", processing, latency)
+	}
+	if got := processing[0]; got < sleep.Seconds() || got > (2*sleep).Seconds() {
+		t.Errorf("processing time = %v, want about %v", got, sleep.Seconds())
+	}
+	if latency[0] < processing[0] {
+		t.Errorf("latency = %v, want at least the processing time %v", latency[0], processing[0])
+	}
+	if got := h.ClientRecorder.Observations(grpcmontest.ProcessingTime, labels...); got != nil {
+		t.Errorf("client processing time observations = %v, want none", got)
+	}
+}
+
+func TestProcessingTimeShapes(t *testing.T) {
+	for _, tt := range []struct {
+		seq  grpcmontest.Sequence
+		code string
+		want []float64
+	}{
+		{grpcmontest.UnaryOK(false), "OK", []float64{0.001}},
+		{grpcmontest.ServerStream(false, 3), "OK", []float64{0.001}},
+		// From the first request to the response.
+		{grpcmontest.ClientStream(false, 3), "OK", []float64{0.003}},
+		{grpcmontest.BidiStream(false, 3), "OK", []float64{0.001}},
+		// No response was sent.
+		{grpcmontest.UnaryError(false, codes.Internal), "Internal", nil},
+	} {
+		t.Run(tt.seq.Name, func(t *testing.T) {
+			m, rec := grpcmontest.NewRecorder()
+			grpcmontest.Replay(grpcmon.ServerStatsHandler(m), tt.seq)
+			labels := []string{"service", "grpcmontest.Test", "method", "Method", "code", tt.code}
+			if got := rec.Observations(grpcmontest.ProcessingTime, labels...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("processing time observations = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package grpcmon
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// redLogger aggregates the RPCs of each service and periodically logs a
+// summary of the rate, errors and duration of the RPCs since the previous
+// summary.
+type redLogger struct {
+	logger   *slog.Logger
+	interval time.Duration
+	client   bool
+	self     *SelfMetrics
+
+	mu       sync.Mutex
+	services map[string]*redTotals
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// redTotals aggregates the RPCs of a service within an interval.
+type redTotals struct {
+	slot
+	bytesSent int64
+	bytesRecv int64
+}
+
+func newREDLogger(logger *slog.Logger, interval time.Duration, client bool) *redLogger {
+	l := &redLogger{
+		logger:   logger,
+		interval: interval,
+		client:   client,
+		services: make(map[string]*redTotals),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// observe records an RPC of the given service.
+func (l *redLogger) observe(service string, d time.Duration, failed bool, sent, recv int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.services[service]
+	if !ok {
+		if len(l.services) >= maxRollingMethods {
+			l.self.labelOverflow()
+			return
+		}
+		t = &redTotals{}
+		l.services[service] = t
+	}
+	t.observe(d.Seconds(), failed)
+	t.bytesSent += sent
+	t.bytesRecv += recv
+}
+
+func (l *redLogger) run() {
+	defer close(l.done)
+	t := time.NewTicker(l.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			l.flush()
+			return
+		case <-t.C:
+			l.flush()
+		}
+	}
+}
+
+// flush logs a line per service with RPCs since the previous flush, in the
+// order of service names.
+func (l *redLogger) flush() {
+	l.mu.Lock()
+	services := l.services
+	if len(services) > 0 {
+		l.services = make(map[string]*redTotals, len(services))
+	}
+	l.mu.Unlock()
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := services[name]
+		l.logger.LogAttrs(context.Background(), slog.LevelInfo, "gRPC requests",
+			slog.Bool("client", l.client),
+			slog.String("service", name),
+			slog.Int64("requests", t.count),
+			slog.Int64("errors", t.errors),
+			slog.Duration("p50", seconds(t.quantile(0.5))),
+			slog.Duration("p99", seconds(t.quantile(0.99))),
+			slog.Int64("bytes_sent", t.bytesSent),
+			slog.Int64("bytes_recv", t.bytesRecv),
+		)
+	}
+}
+
+// close logs the RPCs since the previous flush and stops logging.
+func (l *redLogger) close() {
+	l.once.Do(func() { close(l.stop) })
+	<-l.done
+}
+
+// Close stops the background work of the handler, logging the summary of
+// the last interval set with WithREDLog. The handler keeps recording
+// metrics.
+func (h *Handler) Close() {
+	if h.red != nil {
+		h.red.close()
+	}
+}
@@ -0,0 +1,50 @@
+package grpcmon
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestREDLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	l := newREDLogger(logger, time.Hour, false)
+	l.observe("b", 20*time.Millisecond, true, 1, 2)
+	l.observe("a", 5*time.Millisecond, false, 10, 20)
+	l.observe("a", 5*time.Millisecond, true, 30, 40)
+	l.flush()
+	want := "level=INFO msg=\"gRPC requests\" client=false service=a requests=2 errors=1 p50=3.75ms p99=4.975ms bytes_sent=40 bytes_recv=60\n" +
+		"level=INFO msg=\"gRPC requests\" client=false service=b requests=1 errors=1 p50=15ms p99=19.9ms bytes_sent=1 bytes_recv=2\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Nothing is logged without traffic, including on close.
+	buf.Reset()
+	l.flush()
+	l.close()
+	l.close()
+	if buf.Len() != 0 {
+		t.Errorf("logged without traffic:\n%s", buf.String())
+	}
+}
+
+func TestREDLoggerCloseFlushes(t *testing.T) {
+	var buf bytes.Buffer
+	h := newHandler(&Metrics{}, false, []Option{WithREDLog(slog.New(slog.NewTextHandler(&buf, nil)), time.Hour)})
+	h.red.observe("s", time.Millisecond, false, 0, 0)
+	h.Close()
+	if !strings.Contains(buf.String(), "service=s requests=1 errors=0") {
+		t.Errorf("missing summary in:\n%s", buf.String())
+	}
+}
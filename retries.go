@@ -0,0 +1,91 @@
+package grpcmon
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithFinalAttemptOnly records only the final attempt of client calls that
+// grpc-go retries, transparently or by the retry policy of the service
+// config, in ReqsTotal and Latency, so that failed attempts followed by a
+// successful one do not count as failed requests. Since whether an attempt is
+// the final one is only known once the call is done, they are recorded
+// shortly after it. The other metrics and the attempts of servers are not
+// affected.
+func WithFinalAttemptOnly() Option {
+	return func(o *options) {
+		o.finalAttemptOnly = true
+	}
+}
+
+// clientCalls tracks the attempts of client calls. The attempts of a call
+// are told apart by the Done channel of their context, which is the one of
+// the context grpc-go creates for the call and cancels once it is done.
+type clientCalls struct {
+	mu    sync.Mutex
+	calls map[<-chan struct{}]*clientCall
+}
+
+// clientCall holds the state of a call across its attempts.
+type clientCall struct {
+	// done is set once the context of the call is done.
+	done bool
+	// end records the end of the last attempt, with WithFinalAttemptOnly.
+	end func()
+}
+
+// begin returns the call of the attempt beginning with ctx, and whether the
+// attempt is a retry. It returns nil for contexts that are never done.
+func (cc *clientCalls) begin(ctx context.Context) (c *clientCall, retry bool) {
+	done := ctx.Done()
+	if done == nil {
+		return nil, false
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if c := cc.calls[done]; c != nil {
+		// The end of the previous attempt is superseded.
+		c.end = nil
+		return c, true
+	}
+	c = new(clientCall)
+	cc.calls[done] = c
+	context.AfterFunc(ctx, func() {
+		cc.mu.Lock()
+		delete(cc.calls, done)
+		c.done = true
+		end := c.end
+		c.end = nil
+		cc.mu.Unlock()
+		if end != nil {
+			end()
+		}
+	})
+	return c, false
+}
+
+// end records the end of an attempt of c with fn, once it is known to be
+// the final attempt.
+func (cc *clientCalls) end(c *clientCall, fn func()) {
+	cc.mu.Lock()
+	if !c.done {
+		c.end = fn
+		fn = nil
+	}
+	cc.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// recordEnd records the ReqsTotal and Latency of an RPC that ended after d,
+// if timed.
+func (h *Handler) recordEnd(cm *codeMetrics, d time.Duration, timed bool) {
+	if cm.latency != nil && timed {
+		cm.latency.Observe(h.opts.inUnit(d))
+	}
+	if cm.reqsTotal != nil {
+		cm.reqsTotal.Add(1)
+	}
+}
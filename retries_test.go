@@ -0,0 +1,106 @@
+package grpcmon_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+// flaky fails the given number of calls with Unavailable before succeeding.
+type flaky struct {
+	fails atomic.Int64
+}
+
+var flakyDesc = grpc.ServiceDesc{
+	ServiceName: "grpcmontest.Flaky",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Call",
+		Handler: func(srv interface{}, _ context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			v := new(wrapperspb.StringValue)
+			if err := dec(v); err != nil {
+				return nil, err
+			}
+			if srv.(*flaky).fails.Add(-1) >= 0 {
+				return nil, status.Error(codes.Unavailable, "try again")
+			}
+			return v, nil
+		},
+	}},
+}
+
+const flakyServiceConfig = `{"methodConfig": [{
+	"name": [{"service": "grpcmontest.Flaky"}],
+	"retryPolicy": {
+		"maxAttempts": 3,
+		"initialBackoff": "0.001s",
+		"maxBackoff": "0.001s",
+		"backoffMultiplier": 1,
+		"retryableStatusCodes": ["UNAVAILABLE"]
+	}
+}]}`
+
+func TestRetries(t *testing.T) {
+	for _, finalOnly := range []bool{false, true} {
+		var opts []grpcmon.Option
+		if finalOnly {
+			opts = append(opts, grpcmon.WithFinalAttemptOnly())
+		}
+		h := grpcmontest.NewHarness(t,
+			grpcmontest.MonitorOptions(opts...),
+			grpcmontest.DialOptions(grpc.WithDefaultServiceConfig(flakyServiceConfig)),
+		)
+		srv := new(flaky)
+		srv.fails.Store(2)
+		h.Server.RegisterService(&flakyDesc, srv)
+		if err := h.Conn().Invoke(context.Background(), "/grpcmontest.Flaky/Call", wrapperspb.String("x"), new(wrapperspb.StringValue)); err != nil {
+			t.Fatal(err)
+		}
+		h.Stop()
+
+		method := []string{"service", "grpcmontest.Flaky", "method", "Call"}
+		rec := h.ClientRecorder
+		if got := rec.CounterValue(grpcmontest.Retries, method...); got != 2 {
+			t.Errorf("final only %v: retries = %v, want 2", finalOnly, got)
+		}
+		wantFailed := 2.0
+		if finalOnly {
+			wantFailed = 0
+		}
+		ok := append(method[:4:4], "code", "OK")
+		for deadline := time.Now().Add(5 * time.Second); rec.CounterValue(grpcmontest.ReqsTotal, ok...) == 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		if got := rec.CounterValue(grpcmontest.ReqsTotal, ok...); got != 1 {
+			t.Errorf("final only %v: succeeded requests = %v, want 1", finalOnly, got)
+		}
+		if got, want := rec.HistogramCount(grpcmontest.Latency, ok...), 1; got != want {
+			t.Errorf("final only %v: succeeded latencies = %v, want %v", finalOnly, got, want)
+		}
+		if got := rec.CounterValue(grpcmontest.ReqsTotal, append(method[:4:4], "code", "Unavailable")...); got != wantFailed {
+			t.Errorf("final only %v: failed requests = %v, want %v", finalOnly, got, wantFailed)
+		}
+		if got := h.ServerRecorder.CounterValue(grpcmontest.ReqsTotal, append(method[:4:4], "code", "Unavailable")...); got != 2 {
+			t.Errorf("final only %v: failed server requests = %v, want 2", finalOnly, got)
+		}
+	}
+}
+
+func TestFinalAttemptOnlyWithoutRetries(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ClientStatsHandler(m, grpcmon.WithFinalAttemptOnly())
+	grpcmontest.Replay(h, grpcmontest.UnaryOK(true))
+	rec.AssertCounterDelta(t, grpcmontest.ReqsTotal, nil, 1)
+	if got := rec.CounterValue(grpcmontest.Retries, "service", "grpcmontest.Test", "method", "Method"); got != 0 {
+		t.Errorf("retries = %v, want 0", got)
+	}
+}
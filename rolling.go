@@ -0,0 +1,198 @@
+package grpcmon
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRollingMethods is the maximum number of methods tracked in a rolling
+// window. RPCs of further methods are not tracked.
+const maxRollingMethods = 1000
+
+// rolling aggregates the RPCs of each method over a window made of a ring of
+// fixed-size slots, so that memory is bounded and old data ages out.
+type rolling struct {
+	width time.Duration
+	slots int
+	now   func() time.Time
+	self  *SelfMetrics
+
+	mu      sync.RWMutex
+	methods map[rpcName]*methodRing
+}
+
+func newRolling(slots int, width time.Duration) *rolling {
+	return &rolling{
+		width:   width,
+		slots:   slots,
+		now:     time.Now,
+		methods: make(map[rpcName]*methodRing),
+	}
+}
+
+// methodRing holds the slots of a method.
+type methodRing struct {
+	mu    sync.Mutex
+	slots []slot
+}
+
+// slot aggregates the RPCs that ended during one slot width.
+type slot struct {
+	// index is the number of slot widths since the Unix epoch at the start
+	// of the slot.
+	index   int64
+	count   int64
+	errors  int64
+	sum     float64
+	sumSq   float64
+	max     float64
+	buckets [len(rollingBuckets) + 1]int64
+}
+
+// rollingBuckets are the upper bounds in seconds of the latency buckets of a
+// slot, which estimate percentiles. They are the initial
+// DefaultLatencyBuckets.
+var rollingBuckets = [...]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func (s *slot) add(o *slot) {
+	s.count += o.count
+	s.errors += o.errors
+	s.sum += o.sum
+	s.sumSq += o.sumSq
+	if o.max > s.max {
+		s.max = o.max
+	}
+	for i, n := range o.buckets {
+		s.buckets[i] += n
+	}
+}
+
+// quantile estimates the q-quantile of the latencies in s, in seconds, by
+// interpolating within the bucket it falls into.
+func (s *slot) quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := q * float64(s.count)
+	var seen int64
+	for i, n := range s.buckets {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = rollingBuckets[i-1]
+		}
+		upper := s.max
+		if i < len(rollingBuckets) && rollingBuckets[i] < upper {
+			upper = rollingBuckets[i]
+		}
+		if upper < lower {
+			return upper
+		}
+		return lower + (upper-lower)*(rank-float64(seen))/float64(n)
+	}
+	return s.max
+}
+
+// observe records an RPC of the given method that took d and failed if
+// failed is set.
+func (r *rolling) observe(name rpcName, d time.Duration, failed bool) {
+	r.mu.RLock()
+	ring, ok := r.methods[name]
+	r.mu.RUnlock()
+	if !ok {
+		r.mu.Lock()
+		if ring, ok = r.methods[name]; !ok {
+			if len(r.methods) >= maxRollingMethods {
+				r.mu.Unlock()
+				r.self.labelOverflow()
+				return
+			}
+			ring = &methodRing{slots: make([]slot, r.slots)}
+			r.methods[name] = ring
+		}
+		r.mu.Unlock()
+	}
+
+	index := r.now().UnixNano() / int64(r.width)
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	s := &ring.slots[index%int64(r.slots)]
+	if s.index != index {
+		*s = slot{index: index}
+	}
+	s.observe(d.Seconds(), failed)
+}
+
+// observe adds an RPC that took secs seconds to s.
+func (s *slot) observe(secs float64, failed bool) {
+	s.count++
+	if failed {
+		s.errors++
+	}
+	s.sum += secs
+	s.sumSq += secs * secs
+	if secs > s.max {
+		s.max = secs
+	}
+	i := 0
+	for i < len(rollingBuckets) && secs > rollingBuckets[i] {
+		i++
+	}
+	s.buckets[i]++
+}
+
+// snapshot returns the aggregate of every method over the window, skipping
+// methods without RPCs in it.
+func (r *rolling) snapshot() map[rpcName]slot {
+	current := r.now().UnixNano() / int64(r.width)
+	r.mu.RLock()
+	rings := make(map[rpcName]*methodRing, len(r.methods))
+	for name, ring := range r.methods {
+		rings[name] = ring
+	}
+	r.mu.RUnlock()
+
+	res := make(map[rpcName]slot)
+	for name, ring := range rings {
+		var total slot
+		ring.mu.Lock()
+		for i := range ring.slots {
+			if s := &ring.slots[i]; s.index > current-int64(r.slots) && s.index <= current {
+				total.add(s)
+			}
+		}
+		ring.mu.Unlock()
+		if total.count > 0 {
+			res[name] = total
+		}
+	}
+	return res
+}
+
+// split returns the aggregate of the current slot of the given method and
+// that of the rest of the window, and reports whether the method is
+// tracked.
+func (r *rolling) split(name rpcName) (current, rest slot, ok bool) {
+	index := r.now().UnixNano() / int64(r.width)
+	r.mu.RLock()
+	ring, ok := r.methods[name]
+	r.mu.RUnlock()
+	if !ok {
+		return slot{}, slot{}, false
+	}
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	for i := range ring.slots {
+		s := &ring.slots[i]
+		switch {
+		case s.index == index:
+			current.add(s)
+		case s.index > index-int64(r.slots) && s.index < index:
+			rest.add(s)
+		}
+	}
+	return current, rest, true
+}
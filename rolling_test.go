@@ -0,0 +1,129 @@
+package grpcmon
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics/generic"
+)
+
+func TestRollingWindow(t *testing.T) {
+	h := newHandler(&Metrics{}, false, []Option{WithRollingWindow(3, time.Minute)})
+	now := time.Unix(6000, 0)
+	h.rolling.now = func() time.Time { return now }
+
+	fast := rpcName{server: "s", method: "Fast"}
+	slow := rpcName{server: "s", method: "Slow"}
+	for i := 0; i < 100; i++ {
+		h.rolling.observe(fast, 2*time.Millisecond, false)
+	}
+	h.rolling.observe(slow, 2*time.Second, true)
+	now = now.Add(time.Minute)
+	h.rolling.observe(slow, 4*time.Second, false)
+
+	top := h.TopSlowest(5)
+	if len(top) != 2 || top[0].Method != "Slow" || top[1].Method != "Fast" {
+		t.Fatalf("got %+v, want Slow before Fast", top)
+	}
+	if got := top[0]; got.Count != 2 || got.Mean != 3*time.Second || got.Max != 4*time.Second {
+		t.Errorf("got %+v, want 2 RPCs with 3s mean and 4s max", got)
+	}
+	if got := top[1].P50; got <= time.Millisecond || got > 2500*time.Microsecond {
+		t.Errorf("fast p50 = %v, want within its bucket", got)
+	}
+	if got := h.TopSlowest(1); len(got) != 1 {
+		t.Errorf("got %d methods, want 1", len(got))
+	}
+
+	// Fast ages out of the window first.
+	now = now.Add(2 * time.Minute)
+	top = h.TopSlowest(5)
+	if len(top) != 1 || top[0].Method != "Slow" || top[0].Count != 1 {
+		t.Errorf("got %+v after 3 minutes, want the last Slow RPC only", top)
+	}
+	now = now.Add(time.Minute)
+	if top := h.TopSlowest(5); len(top) != 0 {
+		t.Errorf("got %+v after 4 minutes, want nothing", top)
+	}
+}
+
+func TestRollingWindowMaxMethods(t *testing.T) {
+	r := newRolling(1, time.Minute)
+	overflow := generic.NewCounter("overflow")
+	r.self = &SelfMetrics{LabelOverflow: overflow}
+	for i := 0; i < maxRollingMethods+10; i++ {
+		r.observe(rpcName{server: "s", method: strings.Repeat("m", i+1)}, time.Millisecond, false)
+	}
+	if got := len(r.snapshot()); got != maxRollingMethods {
+		t.Errorf("tracked %d methods, want %d", got, maxRollingMethods)
+	}
+	if got := overflow.Value(); got != 10 {
+		t.Errorf("overflow = %v, want 10", got)
+	}
+}
+
+func TestTopSlowestWithoutWindow(t *testing.T) {
+	if got := newHandler(&Metrics{}, false, nil).TopSlowest(5); got != nil {
+		t.Errorf("got %+v, want nil", got)
+	}
+}
+
+func TestTopSlowestHandler(t *testing.T) {
+	h := newHandler(&Metrics{}, false, []Option{WithRollingWindow(1, time.Minute)})
+	h.rolling.observe(rpcName{server: "s", method: "m"}, time.Second, false)
+
+	w := httptest.NewRecorder()
+	TopSlowestHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/?format=json&n=1", nil))
+	var got []MethodLatency
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Method != "m" || got[0].Max != time.Second {
+		t.Errorf("got %+v", got)
+	}
+
+	w = httptest.NewRecorder()
+	TopSlowestHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); !strings.HasPrefix(body, "SERVICE") || !strings.Contains(body, "1s") {
+		t.Errorf("unexpected text output:\n%s", body)
+	}
+
+	w = httptest.NewRecorder()
+	TopSlowestHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/?n=x", nil))
+	if w.Code != 400 {
+		t.Errorf("status = %d for invalid n, want 400", w.Code)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	h := newHandler(&Metrics{}, false, []Option{WithRollingWindow(2, 30*time.Second)})
+	h.rolling.observe(rpcName{server: "s", method: "a"}, 10*time.Millisecond, false)
+	h.rolling.observe(rpcName{server: "s", method: "a"}, 10*time.Millisecond, true)
+	h.pending.add(rpcName{server: "s", method: "a"}, 1)
+	h.pending.add(rpcName{server: "s", method: "b"}, 2)
+
+	w := httptest.NewRecorder()
+	DebugHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/?format=json", nil))
+	var got []MethodStats
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %+v, want 2 methods", got)
+	}
+	if a := got[0]; a.Method != "a" || a.Rate != 2.0/60 || a.ErrorRatio != 0.5 || a.Pending != 1 || a.P99 <= 5*time.Millisecond || a.P99 > 10*time.Millisecond {
+		t.Errorf("got %+v for a", a)
+	}
+	if b := got[1]; b.Method != "b" || b.Rate != 0 || b.Pending != 2 {
+		t.Errorf("got %+v for b", b)
+	}
+
+	w = httptest.NewRecorder()
+	DebugHandler(h).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if body := w.Body.String(); !strings.Contains(body, "<td>50.00%</td>") || !strings.Contains(body, "Over the last 1m0s") {
+		t.Errorf("unexpected HTML:\n%s", body)
+	}
+}
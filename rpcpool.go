@@ -0,0 +1,130 @@
+package grpcmon
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/stats"
+)
+
+// rpcInfoPool holds the rpcInfo values of RPCs that ended.
+var rpcInfoPool = sync.Pool{New: func() interface{} { return new(rpcInfo) }}
+
+// rpcContext is the context of an RPC returned by TagRPC. It carries the
+// rpcInfo of the RPC as its own value, saving the allocation of
+// context.WithValue.
+//
+// The rpcInfo is returned to rpcInfoPool once the RPC ended and no event is
+// being handled, but the context may outlive it, for example when a stream
+// is used concurrently with its end. Hence the rpcInfo is only accessed
+// through acquire, which fails for RPCs that ended.
+//
+// Several handlers may tag the same RPC, for example when a client
+// connection is dialed with several of them, or a handler is embedded in
+// another one whose TagRPC wraps the context before or after calling it.
+// Each finds its own rpcContext among those of the context by its handler.
+type rpcContext struct {
+	context.Context
+	// handler is the handler that tagged the RPC.
+	handler *Handler
+	// info is nil for RPCs excluded by WithFilter, which are not recorded
+	// at all.
+	info *rpcInfo
+	// gen is the generation of info the RPC has.
+	gen uint64
+	// tag is passed to end at the end of the RPC, see TagRPCFunc.
+	tag interface{}
+	end func(tag interface{}, service, method string, s *stats.End)
+}
+
+// newRPCContext returns the context of a new RPC of the given method, with
+// parent ctx.
+func (h *Handler) newRPCContext(ctx context.Context, server, method, peer string) *rpcContext {
+	v := rpcInfoPool.Get().(*rpcInfo)
+	v.server, v.method, v.peer = server, method, peer
+	// Publishes the fields above to acquire.
+	v.refs.Store(1)
+	return &rpcContext{Context: ctx, handler: h, info: v, gen: v.gen.Load()}
+}
+
+// Value implements the context.Context interface.
+func (c *rpcContext) Value(key interface{}) interface{} {
+	if key == &rpcInfoKey {
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+// rpcContext returns the rpcContext of ctx tagged by h.
+func (h *Handler) rpcContext(ctx context.Context) (*rpcContext, bool) {
+	for {
+		c, ok := ctx.Value(&rpcInfoKey).(*rpcContext)
+		if !ok || c.handler == h {
+			return c, ok
+		}
+		ctx = c.Context
+	}
+}
+
+// filtered reports whether the RPC is excluded by WithFilter.
+func (c *rpcContext) filtered() bool {
+	return c.info == nil
+}
+
+// acquire returns the rpcInfo of the RPC, or nil if the RPC is filtered or
+// its rpcInfo was released. A non-nil rpcInfo must be released.
+func (c *rpcContext) acquire() *rpcInfo {
+	v := c.info
+	if v == nil {
+		return nil
+	}
+	for {
+		n := v.refs.Load()
+		if n <= 0 {
+			return nil
+		}
+		if v.refs.CompareAndSwap(n, n+1) {
+			break
+		}
+	}
+	// The rpcInfo may have been reused by another RPC in the meantime.
+	if v.gen.Load() != c.gen {
+		v.release()
+		return nil
+	}
+	return v
+}
+
+// release drops a reference to v, returning it to rpcInfoPool with the last
+// one.
+func (v *rpcInfo) release() {
+	if v.refs.Add(-1) != 0 {
+		return
+	}
+	v.reset()
+	rpcInfoPool.Put(v)
+}
+
+// reset clears v for another RPC. Fields are reset one by one rather than
+// by assigning a zero rpcInfo, since stale contexts may read refs and gen
+// concurrently.
+func (v *rpcInfo) reset() {
+	v.gen.Add(1)
+	v.server, v.method, v.peer = "", "", ""
+	v.begun.Store(nil)
+	v.bytesSent.Store(0)
+	v.bytesRecv.Store(0)
+	v.msgsSent.Store(0)
+	v.msgsRecv.Store(0)
+	v.ended.Store(false)
+	v.responded.Store(false)
+	v.picked.Store(false)
+	v.trailed.Store(false)
+	v.lastRecv.Store(0)
+	v.lastSent.Store(0)
+	v.firstRecv.Store(0)
+	v.firstSent.Store(0)
+	v.methods.Store(nil)
+	v.override.Store(nil)
+	v.trace.Store(nil)
+}
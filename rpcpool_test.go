@@ -0,0 +1,110 @@
+package grpcmon_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/stats"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+)
+
+// TestEventsAfterEnd sends events on the context of an RPC that ended while
+// other RPCs reuse its state, which must not be affected.
+func TestEventsAfterEnd(t *testing.T) {
+	const n = 100
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithSelfMetrics(rec.SelfMetrics()))
+	events := grpcmontest.UnaryOK(false).RPCs[0].Events
+	rpc := func() context.Context {
+		ctx := h.TagRPC(context.Background(), &stats.RPCTagInfo{FullMethodName: grpcmontest.Method})
+		for _, ev := range events {
+			h.HandleRPC(ctx, ev)
+		}
+		return ctx
+	}
+	ended := rpc()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			grpcmon.OverrideMethod(ended, "grpcmontest.Stale", "Stale")
+			h.HandleRPC(ended, &stats.OutPayload{Length: 1, WireLength: 6})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			rpc()
+		}
+	}()
+	wg.Wait()
+
+	method := []string{"service", "grpcmontest.Test", "method", "Method"}
+	if got := rec.CounterValue(grpcmontest.MsgsSent, method...); got != n+1 {
+		t.Errorf("messages sent = %v, want %d", got, n+1)
+	}
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, append(method, "code", "OK")...); got != n+1 {
+		t.Errorf("requests total = %v, want %d", got, n+1)
+	}
+	if got := rec.GaugeValue(grpcmontest.ReqsPending, method...); got != 0 {
+		t.Errorf("requests pending = %v, want 0", got)
+	}
+	if got := rec.CounterValue(grpcmontest.UnattributedEvents); got != n {
+		t.Errorf("unattributed events = %v, want %d", got, n)
+	}
+	if got := rec.CounterValue(grpcmontest.MsgsSent, "service", "grpcmontest.Stale", "method", "Stale"); got != 0 {
+		t.Errorf("messages sent under the stale override = %v, want 0", got)
+	}
+}
+
+// TestDuplicateEnd checks that only the first End event of an RPC is
+// recorded.
+func TestDuplicateEnd(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithSelfMetrics(rec.SelfMetrics()))
+	grpcmontest.Replay(h, grpcmontest.DuplicateEnd(false))
+
+	method := []string{"service", "grpcmontest.Test", "method", "Method"}
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, append(method, "code", "OK")...); got != 1 {
+		t.Errorf("requests total = %v, want 1", got)
+	}
+	if got := rec.GaugeValue(grpcmontest.ReqsPending, method...); got != 0 {
+		t.Errorf("requests pending = %v, want 0", got)
+	}
+	if got := rec.CounterValue(grpcmontest.UnattributedEvents); got != 1 {
+		t.Errorf("unattributed events = %v, want 1", got)
+	}
+}
+
+// TestUntaggedContext checks that the Begin and End events of RPCs whose
+// context was replaced are recorded under the unknown method, and counted as
+// unattributed like their other events.
+func TestUntaggedContext(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmon.ServerStatsHandler(m, grpcmon.WithSelfMetrics(rec.SelfMetrics()))
+	for _, ev := range grpcmontest.UnaryOK(false).RPCs[0].Events {
+		h.HandleRPC(context.Background(), ev)
+	}
+
+	unknown := []string{"service", "unknown", "method", "unknown"}
+	if got := rec.CounterValue(grpcmontest.ReqsTotal, append(unknown, "code", "OK")...); got != 1 {
+		t.Errorf("requests total = %v, want 1", got)
+	}
+	if got := rec.HistogramCount(grpcmontest.Latency, append(unknown, "code", "OK")...); got != 1 {
+		t.Errorf("latency observations = %d, want 1", got)
+	}
+	if got := rec.GaugeValue(grpcmontest.ReqsPending, unknown...); got != 0 {
+		t.Errorf("requests pending = %v, want 0", got)
+	}
+	if got := rec.CounterValue(grpcmontest.MsgsSent, unknown...); got != 0 {
+		t.Errorf("messages sent = %v, want 0", got)
+	}
+	if got, want := rec.CounterValue(grpcmontest.UnattributedEvents), float64(len(grpcmontest.UnaryOK(false).RPCs[0].Events)); got != want {
+		t.Errorf("unattributed events = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,243 @@
+// Package rules generates Prometheus recording and alerting rules for the
+// metrics recorded by grpcmon.
+//
+// Like the generated dashboards, the rules are built from the configured
+// metric and label names, so they stay correct when metrics are registered
+// under a different namespace, subsystem or name.
+package rules // import "github.com/Bo0mer/grpcmon/rules"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"go.yaml.in/yaml/v3"
+)
+
+// Config describes the metrics rules are generated for and the alert
+// thresholds. Zero fields take the documented defaults, and those of the
+// preset for names.
+type Config struct {
+	// Preset selects the default names of the metrics and labels.
+	Preset Preset
+	// Namespace and Subsystem prefix metric names as in
+	// <namespace>_<subsystem>_<name>. Default to "grpc" and "server".
+	Namespace string
+	Subsystem string
+	// Names are the names of the metrics without prefix.
+	Names Names
+	// Labels are the names of the labels.
+	Labels Labels
+	// OK is the code label value of successful requests, which
+	// grpcmon.WithCodeMapper may change, for example to "ok" with
+	// grpcmon.CodeClass. Defaults to "OK".
+	OK string
+	// RateInterval is the range of rate queries. Defaults to 5m.
+	RateInterval time.Duration
+
+	// ErrorRatio is the ratio of failed requests of a method above which
+	// an alert fires. Defaults to 0.05.
+	ErrorRatio float64
+	// LatencyP99 is the 99th percentile latency of a method above which an
+	// alert fires. Defaults to 1s.
+	LatencyP99 time.Duration
+	// Pending is the number of pending requests of a method above which an
+	// alert fires. Defaults to 100.
+	Pending float64
+	// For is how long a threshold must be exceeded before an alert fires.
+	// Defaults to 10m.
+	For time.Duration
+}
+
+// Preset is a set of default metric and label names.
+type Preset int
+
+const (
+	// Default takes the names of the metrics of grpcprom.NewServerMetrics
+	// and grpcprom.NewClientMetrics.
+	Default Preset = iota
+	// Legacy takes the go-grpc-prometheus names of the metrics created
+	// with grpcprom.WithLegacyNames. Lacking a pending requests gauge, the
+	// pending requests alert counts the requests started and not handled.
+	Legacy
+)
+
+// Names are the names of the metrics, without namespace and subsystem.
+// Empty names take the defaults of the preset, as follows for Default and
+// Legacy.
+type Names struct {
+	ReqsPending string // "requests_pending", none.
+	ReqsStarted string // None, "started_total". Only queried without ReqsPending.
+	ReqsTotal   string // "requests_total", "handled_total".
+	Latency     string // "latency_seconds", "handling_seconds".
+}
+
+// Labels are the names of the labels. Empty names take the defaults of the
+// preset, as follows for Default and Legacy.
+type Labels struct {
+	Service string // "service", "grpc_service".
+	Method  string // "method", "grpc_method".
+	Code    string // "code", "grpc_code".
+}
+
+func orDefault(p *string, def string) {
+	if *p == "" {
+		*p = def
+	}
+}
+
+func (c *Config) setDefaults() {
+	orDefault(&c.Namespace, "grpc")
+	orDefault(&c.Subsystem, "server")
+	orDefault(&c.OK, "OK")
+	if c.Preset == Legacy {
+		orDefault(&c.Names.ReqsStarted, "started_total")
+		orDefault(&c.Names.ReqsTotal, "handled_total")
+		orDefault(&c.Names.Latency, "handling_seconds")
+		orDefault(&c.Labels.Service, "grpc_service")
+		orDefault(&c.Labels.Method, "grpc_method")
+		orDefault(&c.Labels.Code, "grpc_code")
+	} else {
+		orDefault(&c.Names.ReqsPending, "requests_pending")
+		orDefault(&c.Names.ReqsTotal, "requests_total")
+		orDefault(&c.Names.Latency, "latency_seconds")
+		orDefault(&c.Labels.Service, "service")
+		orDefault(&c.Labels.Method, "method")
+		orDefault(&c.Labels.Code, "code")
+	}
+	if c.RateInterval == 0 {
+		c.RateInterval = 5 * time.Minute
+	}
+	if c.ErrorRatio == 0 {
+		c.ErrorRatio = 0.05
+	}
+	if c.LatencyP99 == 0 {
+		c.LatencyP99 = time.Second
+	}
+	if c.Pending == 0 {
+		c.Pending = 100
+	}
+	if c.For == 0 {
+		c.For = 10 * time.Minute
+	}
+}
+
+// File is a Prometheus rule file.
+type File struct {
+	Groups []Group `yaml:"groups"`
+}
+
+// Group is a group of rules.
+type Group struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is a recording or alerting rule.
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Generate returns a Prometheus rule file for the metrics described by cfg.
+// It records the per-method request rate, error ratio and latency
+// percentiles, and alerts on the error ratio, the 99th percentile latency
+// and the number of pending requests, if the names of the metrics counting
+// them are known.
+func Generate(cfg Config) ([]byte, error) {
+	f, err := Rules(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Rules returns the rules Generate encodes.
+func Rules(cfg Config) (File, error) {
+	cfg.setDefaults()
+	if cfg.Labels.Service == cfg.Labels.Method || cfg.Labels.Method == cfg.Labels.Code || cfg.Labels.Service == cfg.Labels.Code {
+		return File{}, errors.New("rules: label names must be distinct")
+	}
+	if cfg.ErrorRatio < 0 || cfg.ErrorRatio > 1 {
+		return File{}, fmt.Errorf("rules: error ratio %v out of range [0, 1]", cfg.ErrorRatio)
+	}
+
+	prefix := cfg.Namespace + "_" + cfg.Subsystem
+	metric := func(name string) string { return prefix + "_" + name }
+	interval := model.Duration(cfg.RateInterval).String()
+	by := cfg.Labels.Service + ", " + cfg.Labels.Method
+	total := metric(cfg.Names.ReqsTotal)
+
+	requests := prefix + ":requests:rate" + interval
+	errorRatio := prefix + ":errors:ratio_rate" + interval
+	latency := func(q string) string { return prefix + ":latency_seconds:p" + q + "_rate" + interval }
+
+	rules := []Rule{
+		{
+			Record: requests,
+			Expr:   fmt.Sprintf("sum by (%s) (rate(%s[%s]))", by, total, interval),
+		},
+		{
+			Record: errorRatio,
+			Expr: fmt.Sprintf(`sum by (%s) (rate(%s{%s!=%q}[%s])) / sum by (%s) (rate(%s[%s]))`,
+				by, total, cfg.Labels.Code, cfg.OK, interval, by, total, interval),
+		},
+	}
+	for _, q := range []string{"50", "90", "99"} {
+		rules = append(rules, Rule{
+			Record: latency(q),
+			Expr: fmt.Sprintf("histogram_quantile(0.%s, sum by (%s, le) (rate(%s_bucket[%s])))",
+				q, by, metric(cfg.Names.Latency), interval),
+		})
+	}
+
+	forDuration := model.Duration(cfg.For).String()
+	method := fmt.Sprintf("{{ $labels.%s }}/{{ $labels.%s }}", cfg.Labels.Service, cfg.Labels.Method)
+	alert := func(name, expr, summary string) Rule {
+		return Rule{
+			Alert:       name,
+			Expr:        expr,
+			For:         forDuration,
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"summary": summary},
+		}
+	}
+	rules = append(rules,
+		alert("GRPCHighErrorRatio",
+			fmt.Sprintf("%s > %s", errorRatio, formatFloat(cfg.ErrorRatio)),
+			fmt.Sprintf("gRPC %s %s fails {{ $value | humanizePercentage }} of requests.", cfg.Subsystem, method)),
+		alert("GRPCHighLatency",
+			fmt.Sprintf("%s > %s", latency("99"), formatFloat(cfg.LatencyP99.Seconds())),
+			fmt.Sprintf("gRPC %s %s has a p99 latency of {{ $value | humanizeDuration }}.", cfg.Subsystem, method)),
+	)
+	var pending string
+	switch {
+	case cfg.Names.ReqsPending != "":
+		pending = fmt.Sprintf("sum by (%s) (%s)", by, metric(cfg.Names.ReqsPending))
+	case cfg.Names.ReqsStarted != "":
+		pending = fmt.Sprintf("(sum by (%s) (%s) - sum by (%s) (%s))", by, metric(cfg.Names.ReqsStarted), by, total)
+	}
+	if pending != "" {
+		rules = append(rules, alert("GRPCHighPendingRequests",
+			fmt.Sprintf("%s > %s", pending, formatFloat(cfg.Pending)),
+			fmt.Sprintf("gRPC %s %s has {{ $value }} pending requests.", cfg.Subsystem, method)))
+	}
+	return File{Groups: []Group{{Name: "grpcmon." + prefix, Rules: rules}}}, nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,190 @@
+package rules_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"go.yaml.in/yaml/v3"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	"github.com/Bo0mer/grpcmon/grpcprom"
+	"github.com/Bo0mer/grpcmon/rules"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+var (
+	recordName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	alertName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// validate checks f the way promtool check rules does, short of parsing
+// the expressions.
+func validate(t *testing.T, f rules.File) {
+	t.Helper()
+	if len(f.Groups) == 0 {
+		t.Fatal("no rule groups")
+	}
+	recorded := make(map[string]bool)
+	for _, g := range f.Groups {
+		if g.Name == "" {
+			t.Error("group without name")
+		}
+		for _, r := range g.Rules {
+			switch {
+			case r.Record != "" && r.Alert != "":
+				t.Errorf("rule %q both records and alerts", r.Record)
+			case r.Record != "":
+				if !recordName.MatchString(r.Record) {
+					t.Errorf("invalid recording rule name %q", r.Record)
+				}
+				if r.For != "" || len(r.Annotations) > 0 {
+					t.Errorf("recording rule %q has alerting fields", r.Record)
+				}
+				recorded[r.Record] = true
+			case r.Alert != "":
+				if !alertName.MatchString(r.Alert) {
+					t.Errorf("invalid alert name %q", r.Alert)
+				}
+				if _, err := model.ParseDuration(r.For); err != nil {
+					t.Errorf("alert %q: invalid for: %v", r.Alert, err)
+				}
+			default:
+				t.Error("rule neither records nor alerts")
+			}
+			if strings.Count(r.Expr, "(") != strings.Count(r.Expr, ")") || strings.Count(r.Expr, "{") != strings.Count(r.Expr, "}") {
+				t.Errorf("unbalanced expression %q", r.Expr)
+			}
+		}
+	}
+	// Alerts on recorded series must refer to series that are recorded.
+	for _, r := range f.Groups[0].Rules {
+		if r.Alert == "" {
+			continue
+		}
+		if name := strings.Fields(r.Expr)[0]; strings.Contains(name, ":") && !recorded[name] {
+			t.Errorf("alert %q uses unrecorded series %q", r.Alert, name)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  rules.Config
+	}{
+		{"default", rules.Config{}},
+		{"custom", rules.Config{
+			Namespace:    "payments",
+			Subsystem:    "client",
+			Names:        rules.Names{ReqsTotal: "calls_total"},
+			Labels:       rules.Labels{Service: "grpc_service", Method: "grpc_method", Code: "grpc_code"},
+			OK:           "ok",
+			RateInterval: time.Minute,
+			ErrorRatio:   0.01,
+			LatencyP99:   250 * time.Millisecond,
+			Pending:      20,
+			For:          5 * time.Minute,
+		}},
+		{"legacy", rules.Config{Preset: rules.Legacy}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := rules.Generate(tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var f rules.File
+			dec := yaml.NewDecoder(bytes.NewReader(got))
+			dec.KnownFields(true)
+			if err := dec.Decode(&f); err != nil {
+				t.Fatalf("generated invalid YAML: %v", err)
+			}
+			validate(t, f)
+
+			path := filepath.Join("testdata", tc.name+".yaml")
+			if *update {
+				if err := os.WriteFile(path, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("rules differ from %s (run with -update to update):\n%s", path, got)
+			}
+		})
+	}
+}
+
+func TestGenerateInvalidConfig(t *testing.T) {
+	for _, cfg := range []rules.Config{
+		{Labels: rules.Labels{Code: "service"}},
+		{ErrorRatio: 2},
+	} {
+		if _, err := rules.Generate(cfg); err == nil {
+			t.Errorf("got nil error for %+v", cfg)
+		}
+	}
+}
+
+func TestRulesQueryRecordedMetrics(t *testing.T) {
+	metricName := regexp.MustCompile(`grpc_server_[a-z_]+`)
+	for _, tc := range []struct {
+		name    string
+		preset  rules.Preset
+		opts    []grpcprom.Option
+		monOpts []grpcmon.Option
+	}{
+		{"default", rules.Default, nil, nil},
+		{"legacy", rules.Legacy, []grpcprom.Option{grpcprom.WithLegacyNames()}, []grpcmon.Option{grpcmon.WithRPCTypeLabel()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			m, err := grpcprom.NewServerMetrics(reg, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			grpcmontest.Replay(grpcmon.ServerStatsHandler(m.Metrics, tc.monOpts...), grpcmontest.UnaryOK(false))
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make(map[string]bool)
+			for _, mf := range mfs {
+				names[mf.GetName()] = true
+				names[mf.GetName()+"_bucket"] = true
+			}
+
+			f, err := rules.Rules(rules.Config{Preset: tc.preset})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var alerts int
+			for _, r := range f.Groups[0].Rules {
+				if r.Alert != "" {
+					alerts++
+				}
+				for _, name := range metricName.FindAllString(r.Expr, -1) {
+					if !names[name] {
+						t.Errorf("%s%s queries %s, which is not recorded", r.Record, r.Alert, name)
+					}
+				}
+			}
+			if alerts != 3 {
+				t.Errorf("got %d alerts, want 3", alerts)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package grpcmon
+
+import metrics "github.com/go-kit/kit/metrics"
+
+// SelfMetrics holds metrics about the instrumentation itself, which reveal
+// the data grpcmon drops or cannot attribute. Nil fields are not recorded.
+// See WithSelfMetrics.
+type SelfMetrics struct {
+	_ struct{}
+
+	// DroppedObservations counts the data dropped by bounded queues. Its
+	// reason label is one of the Drop constants.
+	DroppedObservations metrics.Counter
+	// SinkErrors counts the panics recovered from hooks and callbacks.
+	SinkErrors metrics.Counter
+	// UnattributedEvents counts the RPC events that cannot be attributed to
+	// an RPC, because its context was not tagged or it ended already. Of
+	// these, only the Begin and End events of untagged RPCs are recorded,
+	// under the unknown service and method. It also counts the ConnEnd
+	// events of connections whose ConnBegin event was not seen, which are
+	// not recorded.
+	UnattributedEvents metrics.Counter
+	// LabelOverflow counts the RPCs and connections that are not tracked
+	// because the number of distinct methods, services or hosts reached a
+	// limit.
+	LabelOverflow metrics.Counter
+}
+
+// Reasons of DroppedObservations.
+const (
+	// DropSlowRPCQueue is the reason of slow RPCs dropped because the hook
+	// of WithSlowRPCHook fell behind.
+	DropSlowRPCQueue = "slow_rpc_queue"
+	// DropSubscriber is the reason of RPC summaries dropped because a
+	// subscriber fell behind.
+	DropSubscriber = "subscriber"
+	// DropCapture is the reason of events of captured RPCs beyond the
+	// capture limit.
+	DropCapture = "capture"
+)
+
+func (s *SelfMetrics) dropped(reason string) {
+	if s != nil && s.DroppedObservations != nil {
+		s.DroppedObservations.With("reason", reason).Add(1)
+	}
+}
+
+func (s *SelfMetrics) sinkError() {
+	if s != nil && s.SinkErrors != nil {
+		s.SinkErrors.Add(1)
+	}
+}
+
+func (s *SelfMetrics) unattributed() {
+	if s != nil && s.UnattributedEvents != nil {
+		s.UnattributedEvents.Add(1)
+	}
+}
+
+func (s *SelfMetrics) labelOverflow() {
+	if s != nil && s.LabelOverflow != nil {
+		s.LabelOverflow.Add(1)
+	}
+}
+
+// recoverSinkError recovers from a panic and counts it on s. It must be
+// deferred directly.
+func (s *SelfMetrics) recoverSinkError() {
+	if recover() != nil {
+		s.sinkError()
+	}
+}
@@ -0,0 +1,138 @@
+package grpcmon_test
+
+import (
+	"context"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// testService is a service with one method of each RPC shape. All of them
+// echo back the messages they receive.
+type testService struct {
+	// err, if not nil, is returned by every method once the request has
+	// been consumed.
+	err error
+	// block, if not nil, is waited on, or for the RPC to be canceled, before
+	// responding.
+	block chan struct{}
+	// started, if not nil, receives a value once per RPC when the request
+	// has been consumed.
+	started chan struct{}
+}
+
+var testServiceDesc = grpc.ServiceDesc{
+	ServiceName: "test.Test",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Unary", Handler: testUnaryHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "ClientStream", Handler: testClientStreamHandler, ClientStreams: true},
+		{StreamName: "ServerStream", Handler: testServerStreamHandler, ServerStreams: true},
+		{StreamName: "Bidi", Handler: testBidiHandler, ClientStreams: true, ServerStreams: true},
+	},
+}
+
+func registerTestService(s *grpc.Server, srv *testService) {
+	s.RegisterService(&testServiceDesc, srv)
+}
+
+func (s *testService) wait(ctx context.Context) error {
+	if s.started != nil {
+		s.started <- struct{}{}
+	}
+	if s.block == nil {
+		return s.err
+	}
+	select {
+	case <-s.block:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func testUnaryHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrapperspb.BytesValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		if err := srv.(*testService).wait(ctx); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+	if interceptor == nil {
+		return handler(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Test/Unary"}
+	return interceptor(ctx, in, info, handler)
+}
+
+func testClientStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	var last *wrapperspb.BytesValue
+	for {
+		in := new(wrapperspb.BytesValue)
+		if err := stream.RecvMsg(in); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		last = in
+	}
+	if err := srv.(*testService).wait(stream.Context()); err != nil {
+		return err
+	}
+	if last == nil {
+		last = &wrapperspb.BytesValue{}
+	}
+	return stream.SendMsg(last)
+}
+
+// testServerStreamHandler sends back the request as many times as it is long.
+func testServerStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	in := new(wrapperspb.BytesValue)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+	if err := srv.(*testService).wait(stream.Context()); err != nil {
+		return err
+	}
+	for range in.Value {
+		if err := stream.SendMsg(in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testBidiHandler(srv interface{}, stream grpc.ServerStream) error {
+	if err := srv.(*testService).wait(stream.Context()); err != nil {
+		return err
+	}
+	for {
+		in := new(wrapperspb.BytesValue)
+		if err := stream.RecvMsg(in); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(in); err != nil {
+			return err
+		}
+	}
+}
+
+// newStream starts a stream for the named method of the test service.
+func newStream(ctx context.Context, conn *grpc.ClientConn, method string) (grpc.ClientStream, error) {
+	for i := range testServiceDesc.Streams {
+		desc := &testServiceDesc.Streams[i]
+		if desc.StreamName == method {
+			return conn.NewStream(ctx, desc, "/test.Test/"+method)
+		}
+	}
+	panic("unknown method " + method)
+}
@@ -0,0 +1,80 @@
+package grpcmon
+
+import "google.golang.org/grpc/stats"
+
+// eventKinds is a set of the kinds of RPC events between Begin and End,
+// which handlers skip when they record nothing for them.
+type eventKinds uint8
+
+const (
+	inHeaderEvents eventKinds = 1 << iota
+	inPayloadEvents
+	inTrailerEvents
+	outHeaderEvents
+	outPayloadEvents
+	outTrailerEvents
+)
+
+// kindOf returns the kind of stat, or zero for Begin, End and unknown
+// events, which are never skipped.
+func kindOf(stat stats.RPCStats) eventKinds {
+	switch stat.(type) {
+	case *stats.InHeader:
+		return inHeaderEvents
+	case *stats.InPayload:
+		return inPayloadEvents
+	case *stats.InTrailer:
+		return inTrailerEvents
+	case *stats.OutHeader:
+		return outHeaderEvents
+	case *stats.OutPayload:
+		return outPayloadEvents
+	case *stats.OutTrailer:
+		return outTrailerEvents
+	}
+	return 0
+}
+
+// skippable returns the kinds of events of the given side h records nothing
+// for with m. The sizes and message counts of RPCs are accounted for in
+// every event when the options of h need them.
+func (h *Handler) skippable(m *Metrics, client bool) eventKinds {
+	if len(h.opts.onRPCEnd) > 0 || h.slow != nil || h.red != nil || h.opts.collector != nil {
+		return 0
+	}
+	var skip eventKinds
+	if m.BytesRecv == nil && m.BytesRecvTotal == nil {
+		skip |= inHeaderEvents | inTrailerEvents
+		if m.MsgsRecv == nil && m.MsgBytesRecv == nil && m.InterMsgGap == nil &&
+			(!client || m.TTFB == nil) && (client || m.ProcessingTime == nil) {
+			skip |= inPayloadEvents
+		}
+	}
+	if m.BytesSent == nil && m.BytesSentTotal == nil {
+		if !client || m.PickLatency == nil {
+			skip |= outHeaderEvents
+		}
+		if client || m.ClientCancellations == nil {
+			skip |= outTrailerEvents
+		}
+		if m.MsgsSent == nil && m.MsgBytesSent == nil && m.InterMsgGap == nil &&
+			(client || m.TTFB == nil && m.ProcessingTime == nil) {
+			skip |= outPayloadEvents
+		}
+	}
+	return skip
+}
+
+// skips reports whether h records nothing for stat. Events are not skipped
+// while RPCs are captured or summaries are subscribed to, which need all of
+// them.
+func (h *Handler) skips(stat stats.RPCStats) bool {
+	skip := h.serverSkip
+	if stat.IsClient() {
+		skip = h.clientSkip
+	}
+	if skip == 0 || skip&kindOf(stat) == 0 {
+		return false
+	}
+	return h.capturing.Load() == nil && !h.subs.active()
+}
@@ -0,0 +1,156 @@
+package grpcmon
+
+import (
+	"sync"
+	"time"
+)
+
+// Objective is a service level objective of the methods it matches.
+type Objective struct {
+	// Service and Method select the methods the objective applies to, by
+	// their label values. An empty Method matches all methods of Service,
+	// and an objective with both empty matches any method not matched by
+	// another objective.
+	Service string
+	Method  string
+	// Target is the ratio of RPCs that must be good, for example 0.999.
+	Target float64
+	// Latency, if not zero, is the latency above which an RPC is bad even
+	// if it did not fail.
+	Latency time.Duration
+}
+
+// sloWindows are the windows burn rates are computed over, as rings of
+// slots.
+var sloWindows = []struct {
+	name  string
+	width time.Duration
+	slots int
+}{
+	{"5m", 10 * time.Second, 30},
+	{"1h", time.Minute, 60},
+	{"6h", 5 * time.Minute, 72},
+}
+
+// sloTracker classifies RPCs as good or bad according to objectives and
+// tracks the ratio of bad ones over the sloWindows.
+type sloTracker struct {
+	objectives map[rpcName]Objective
+	now        func() time.Time
+	self       *SelfMetrics
+
+	mu      sync.Mutex
+	methods map[rpcName]*sloState
+}
+
+func newSLOTracker(objectives []Objective) *sloTracker {
+	t := &sloTracker{
+		objectives: make(map[rpcName]Objective),
+		now:        time.Now,
+		methods:    make(map[rpcName]*sloState),
+	}
+	for _, o := range objectives {
+		t.objectives[rpcName{server: o.Service, method: o.Method}] = o
+	}
+	return t
+}
+
+// objective returns the objective of the given method, if any.
+func (t *sloTracker) objective(name rpcName) (Objective, bool) {
+	if o, ok := t.objectives[name]; ok {
+		return o, true
+	}
+	if o, ok := t.objectives[rpcName{server: name.server}]; ok {
+		return o, true
+	}
+	o, ok := t.objectives[rpcName{}]
+	return o, ok
+}
+
+type sloState struct {
+	mu    sync.Mutex
+	rings []countRing
+}
+
+// countRing counts good and bad events over a window made of slots.
+type countRing struct {
+	width time.Duration
+	slots []countSlot
+}
+
+type countSlot struct {
+	index     int64
+	good, bad int64
+}
+
+// add counts an event at now and returns the totals over the window.
+func (r *countRing) add(now time.Time, bad bool) (good, badTotal int64) {
+	index := now.UnixNano() / int64(r.width)
+	s := &r.slots[index%int64(len(r.slots))]
+	if s.index != index {
+		*s = countSlot{index: index}
+	}
+	if bad {
+		s.bad++
+	} else {
+		s.good++
+	}
+	for i := range r.slots {
+		if s := &r.slots[i]; s.index > index-int64(len(r.slots)) {
+			good += s.good
+			badTotal += s.bad
+		}
+	}
+	return good, badTotal
+}
+
+// observe records an RPC of the given method and updates the metrics of its
+// objective on m, if it has one.
+func (t *sloTracker) observe(m *Metrics, name rpcName, d time.Duration, failed bool) {
+	o, ok := t.objective(name)
+	if !ok {
+		return
+	}
+	bad := failed || (o.Latency > 0 && d > o.Latency)
+	if m.SLOEvents != nil {
+		result := "good"
+		if bad {
+			result = "bad"
+		}
+		m.SLOEvents.With("service", name.server, "method", name.method, "result", result).Add(1)
+	}
+
+	t.mu.Lock()
+	st, ok := t.methods[name]
+	if !ok {
+		if len(t.methods) >= maxRollingMethods {
+			t.mu.Unlock()
+			t.self.labelOverflow()
+			return
+		}
+		st = &sloState{}
+		for _, w := range sloWindows {
+			st.rings = append(st.rings, countRing{width: w.width, slots: make([]countSlot, w.slots)})
+		}
+		t.methods[name] = st
+	}
+	t.mu.Unlock()
+
+	now := t.now()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for i := range st.rings {
+		good, badTotal := st.rings[i].add(now, bad)
+		if m.SLOBurnRate == nil {
+			continue
+		}
+		// The burn rate is the ratio of bad events relative to the error
+		// budget. A target of 100% has no budget, so any bad event burns it
+		// at an infinite rate; report the bad ratio instead.
+		rate := float64(badTotal) / float64(good+badTotal)
+		if budget := 1 - o.Target; budget > 0 {
+			rate /= budget
+		}
+		m.SLOBurnRate.With("service", name.server, "method", name.method, "window", sloWindows[i].name).Set(rate)
+	}
+}
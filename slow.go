@@ -0,0 +1,90 @@
+package grpcmon
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// SlowRPC describes an RPC that took longer than the slow RPC threshold.
+type SlowRPC struct {
+	// Client reports whether the RPC was made by a client.
+	Client bool
+	// Service, Method and Code are the values of the labels the RPC was
+	// recorded under.
+	Service string
+	Method  string
+	Code    string
+	// Duration is the latency of the RPC.
+	Duration time.Duration
+	// BytesSent and BytesRecv are the wire sizes of all frames sent and
+	// received.
+	BytesSent int64
+	BytesRecv int64
+	// Peer is the address of the remote end, or nil if unknown.
+	Peer net.Addr
+}
+
+// maxSlowRPCQueue is the number of slow RPCs that can wait for the hook
+// before further ones are dropped.
+const maxSlowRPCQueue = 128
+
+// slowRPCHook calls a user function with the RPCs slower than a threshold.
+// Calls are made one at a time from a worker goroutine, so that a slow
+// function does not hold up the completion of RPCs. The worker only runs
+// while there are slow RPCs queued.
+type slowRPCHook struct {
+	threshold time.Duration
+	methods   map[rpcName]time.Duration
+	fn        func(SlowRPC)
+	self      *SelfMetrics
+
+	mu      sync.Mutex
+	queue   []SlowRPC
+	running bool
+}
+
+// thresholdFor returns the threshold of the given method.
+func (s *slowRPCHook) thresholdFor(service, method string) time.Duration {
+	if d, ok := s.methods[rpcName{server: service, method: method}]; ok {
+		return d
+	}
+	return s.threshold
+}
+
+// enqueue queues info for the hook, dropping it if the queue is full.
+func (s *slowRPCHook) enqueue(info SlowRPC) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) >= maxSlowRPCQueue {
+		s.self.dropped(DropSlowRPCQueue)
+		return
+	}
+	s.queue = append(s.queue, info)
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+}
+
+// run calls the hook with queued RPCs until the queue is empty.
+func (s *slowRPCHook) run() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		info := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		s.call(info)
+	}
+}
+
+// call calls the hook, recovering from any panic.
+func (s *slowRPCHook) call(info SlowRPC) {
+	defer s.self.recoverSinkError()
+	s.fn(info)
+}
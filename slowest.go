@@ -0,0 +1,91 @@
+package grpcmon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// MethodLatency summarizes the latency of a method over the rolling window.
+type MethodLatency struct {
+	Service string        `json:"service"`
+	Method  string        `json:"method"`
+	Count   int64         `json:"count"`
+	Mean    time.Duration `json:"mean"`
+	P50     time.Duration `json:"p50"`
+	P99     time.Duration `json:"p99"`
+	Max     time.Duration `json:"max"`
+}
+
+// TopSlowest returns up to n methods with the highest 99th percentile
+// latency over the rolling window, slowest first. Percentiles are estimated
+// from buckets with the default latency bucket bounds. It returns nil unless
+// WithRollingWindow is used.
+func (h *Handler) TopSlowest(n int) []MethodLatency {
+	if h.rolling == nil {
+		return nil
+	}
+	var res []MethodLatency
+	for name, s := range h.rolling.snapshot() {
+		res = append(res, MethodLatency{
+			Service: name.server,
+			Method:  name.method,
+			Count:   s.count,
+			Mean:    seconds(s.sum / float64(s.count)),
+			P50:     seconds(s.quantile(0.5)),
+			P99:     seconds(s.quantile(0.99)),
+			Max:     seconds(s.max),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].P99 != res[j].P99 {
+			return res[i].P99 > res[j].P99
+		}
+		if res[i].Mean != res[j].Mean {
+			return res[i].Mean > res[j].Mean
+		}
+		return res[i].Service+"/"+res[i].Method < res[j].Service+"/"+res[j].Method
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// TopSlowestHandler returns an http.Handler that renders the result of
+// h.TopSlowest as a text table, or as JSON if the format query parameter is
+// "json". The n query parameter sets the number of methods, 10 by default.
+func TopSlowestHandler(h *Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := 10
+		if s := r.URL.Query().Get("n"); s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 1 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+			n = v
+		}
+		top := h.TopSlowest(n)
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(top)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "SERVICE\tMETHOD\tCOUNT\tMEAN\tP50\tP99\tMAX")
+		for _, m := range top {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%v\t%v\t%v\t%v\n", m.Service, m.Method, m.Count, m.Mean, m.P50, m.P99, m.Max)
+		}
+		tw.Flush()
+	})
+}
@@ -0,0 +1,96 @@
+package grpcmon
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// connStreams tracks the streams open on the connections of a server, for
+// StreamsPerConnMax.
+type connStreams struct {
+	// max is the highest number of streams open at once on a connection
+	// since it was last reset.
+	max atomic.Int64
+
+	mu sync.Mutex
+	// conns are the connections open since the handler was attached.
+	conns map[*connInfo]struct{}
+}
+
+func newConnStreams() *connStreams {
+	return &connStreams{conns: make(map[*connInfo]struct{})}
+}
+
+// add adds info to the open connections.
+func (s *connStreams) add(info *connInfo) {
+	s.mu.Lock()
+	s.conns[info] = struct{}{}
+	s.mu.Unlock()
+}
+
+// remove removes info from the open connections.
+func (s *connStreams) remove(info *connInfo) {
+	s.mu.Lock()
+	delete(s.conns, info)
+	s.mu.Unlock()
+}
+
+// resetMax resets the high-water mark to the number of streams open on the
+// busiest connection, and returns the mark and the number.
+func (s *connStreams) resetMax() (max, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for info := range s.conns {
+		if v := info.streams.Load(); v > n {
+			n = v
+		}
+	}
+	return s.max.Swap(n), n
+}
+
+// connInfo returns the connInfo of ctx tagged by h, or nil.
+func (h *Handler) connInfo(ctx context.Context) *connInfo {
+	info, _ := ctx.Value(connInfoKey{h}).(*connInfo)
+	return info
+}
+
+// openStream counts a stream opened on the server connection of ctx, and
+// returns the connection for closeStream, or nil if it is not known.
+func (h *Handler) openStream(ctx context.Context, m *Metrics) *connInfo {
+	info := h.connInfo(ctx)
+	if info == nil {
+		return nil
+	}
+	n := info.streams.Add(1)
+	raiseMax(&info.streamsMax, n)
+	if raiseMax(&h.streams.max, n) && m.StreamsPerConnMax != nil {
+		m.StreamsPerConnMax.Set(float64(n))
+	}
+	return info
+}
+
+// closeStream counts a stream closed on info.
+func closeStream(info *connInfo) {
+	if info != nil {
+		info.streams.Add(-1)
+	}
+}
+
+// StreamsPerConnMax returns the highest number of streams open at once on a
+// server connection since the previous call, and resets this high-water mark
+// to the number of streams open on the busiest connection, as is
+// StreamsPerConnMax. Calling it periodically reports the peak of each period.
+//
+// Client handlers return zero: gRPC does not derive the contexts of client
+// RPCs from the one of their connection, so their streams are not counted.
+func (h *Handler) StreamsPerConnMax() int {
+	if h.streams == nil {
+		return 0
+	}
+	max, n := h.streams.resetMax()
+	if m := h.server; m.StreamsPerConnMax != nil {
+		m.StreamsPerConnMax.Set(float64(n))
+	}
+	return int(max)
+}
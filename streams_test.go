@@ -0,0 +1,111 @@
+package grpcmon_test
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+func TestStreamsPerConn(t *testing.T) {
+	const n = 50
+	m, rec := grpcmontest.NewRecorder()
+	sh := grpcmon.ServerStatsHandler(m)
+	srv := grpc.NewServer(grpc.StatsHandler(sh))
+	fe := &blockingFrontend{release: make(chan struct{})}
+	pb.RegisterFrontendServer(srv, fe)
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	defer srv.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewFrontendClient(conn)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Query(context.Background(), &pb.QueryRequest{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); sh.InFlightTotal() < n && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got := rec.GaugeValue(grpcmontest.StreamsPerConnMax); got != n {
+		t.Errorf("streams per connection max = %v, want %v", got, n)
+	}
+	// Reading the mark resets it to the streams still open.
+	if got := sh.StreamsPerConnMax(); got != n {
+		t.Errorf("StreamsPerConnMax = %v, want %v", got, n)
+	}
+	close(fe.release)
+	wg.Wait()
+	if got := sh.StreamsPerConnMax(); got != n {
+		t.Errorf("StreamsPerConnMax after reset = %v, want %v", got, n)
+	}
+	if got := rec.GaugeValue(grpcmontest.StreamsPerConnMax); got != 0 {
+		t.Errorf("streams per connection max after reset = %v, want 0", got)
+	}
+	if got := sh.StreamsPerConnMax(); got != 0 {
+		t.Errorf("StreamsPerConnMax after second reset = %v, want 0", got)
+	}
+
+	if _, err := client.Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.GaugeValue(grpcmontest.StreamsPerConnMax); got != 1 {
+		t.Errorf("streams per connection max = %v, want 1", got)
+	}
+	if got := rec.Observations(grpcmontest.ConnStreams); got != nil {
+		t.Errorf("connection streams observations of open connection = %v, want none", got)
+	}
+
+	conn.Close()
+	srv.Stop()
+	for deadline := time.Now().Add(5 * time.Second); rec.Observations(grpcmontest.ConnStreams) == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := rec.Observations(grpcmontest.ConnStreams), []float64{n}; !reflect.DeepEqual(got, want) {
+		t.Errorf("connection streams observations = %v, want %v", got, want)
+	}
+}
+
+func TestStreamsPerConnClient(t *testing.T) {
+	h := grpcmontest.NewHarness(t)
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+	if _, err := pb.NewFrontendClient(h.Conn()).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	if got := h.ServerRecorder.Observations(grpcmontest.ConnStreams); !reflect.DeepEqual(got, []float64{1}) {
+		t.Errorf("server connection streams observations = %v, want [1]", got)
+	}
+	if got := h.ClientRecorder.GaugeValue(grpcmontest.StreamsPerConnMax); got != 0 {
+		t.Errorf("client streams per connection max = %v, want 0", got)
+	}
+	if got := h.ClientRecorder.Observations(grpcmontest.ConnStreams); got != nil {
+		t.Errorf("client connection streams observations = %v, want none", got)
+	}
+}
@@ -0,0 +1,130 @@
+package grpcmon
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DropPolicy determines which summary is dropped when a subscriber falls
+// behind. See Handler.Subscribe.
+type DropPolicy int
+
+const (
+	// DropNewest drops the summary that does not fit in the buffer.
+	DropNewest DropPolicy = iota
+	// DropOldest makes room for a new summary by dropping the oldest
+	// buffered one.
+	DropOldest
+)
+
+// Subscribe returns a channel on which a summary of every RPC completed from
+// now on is delivered, and a function that cancels the subscription and
+// closes the channel. The channel buffers up to buffer summaries; when it is
+// full, summaries are dropped according to the policy set with
+// WithDropPolicy and counted by SubscriberDrops. Delivery never blocks the
+// RPC. Multiple subscriptions may be active at a time.
+func (h *Handler) Subscribe(buffer int) (<-chan RPCSummary, func()) {
+	sub := &subscriber{ch: make(chan RPCSummary, buffer), policy: h.opts.dropPolicy}
+	h.subs.add(sub)
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			h.subs.remove(sub)
+			sub.close()
+		})
+	}
+}
+
+// subscribers is a copy-on-write list of subscribers, so that publishing
+// does not need to lock.
+type subscribers struct {
+	mu   sync.Mutex
+	list atomic.Pointer[[]*subscriber]
+}
+
+func (s *subscribers) active() bool {
+	l := s.list.Load()
+	return l != nil && len(*l) > 0
+}
+
+func (s *subscribers) add(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l []*subscriber
+	if old := s.list.Load(); old != nil {
+		l = append(l, *old...)
+	}
+	l = append(l, sub)
+	s.list.Store(&l)
+}
+
+func (s *subscribers) remove(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l []*subscriber
+	for _, v := range *s.list.Load() {
+		if v != sub {
+			l = append(l, v)
+		}
+	}
+	s.list.Store(&l)
+}
+
+// publish delivers sum to all subscribers, counting drops on m.
+func (s *subscribers) publish(sum RPCSummary, m *Metrics, self *SelfMetrics) {
+	l := s.list.Load()
+	if l == nil {
+		return
+	}
+	for _, sub := range *l {
+		if sub.send(sum) {
+			continue
+		}
+		if m.SubscriberDrops != nil {
+			m.SubscriberDrops.Add(1)
+		}
+		self.dropped(DropSubscriber)
+	}
+}
+
+type subscriber struct {
+	policy DropPolicy
+
+	mu     sync.Mutex
+	ch     chan RPCSummary
+	closed bool
+}
+
+// send delivers sum without blocking and reports whether nothing was
+// dropped.
+func (s *subscriber) send(sum RPCSummary) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return true
+	}
+	select {
+	case s.ch <- sum:
+		return true
+	default:
+	}
+	if s.policy != DropOldest {
+		return false
+	}
+	select {
+	case <-s.ch:
+	default:
+	}
+	select {
+	case s.ch <- sum:
+	default:
+	}
+	return false
+}
+
+func (s *subscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.ch)
+}
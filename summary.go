@@ -0,0 +1,31 @@
+package grpcmon
+
+import "time"
+
+// RPCSummary summarizes a completed RPC.
+type RPCSummary struct {
+	// Client reports whether the RPC was made by a client.
+	Client bool
+	// Service, Method and Code are the values of the labels the RPC was
+	// recorded under.
+	Service string
+	Method  string
+	Code    string
+	// Err is the error the RPC ended with, or nil.
+	Err error
+	// BeginTime and EndTime are the times the RPC began and ended.
+	BeginTime time.Time
+	EndTime   time.Time
+	// MsgsSent and MsgsRecv are the number of messages sent and received.
+	MsgsSent int64
+	MsgsRecv int64
+	// BytesSent and BytesRecv are the wire sizes of all frames sent and
+	// received.
+	BytesSent int64
+	BytesRecv int64
+}
+
+// Duration returns the time between the beginning and the end of the RPC.
+func (s RPCSummary) Duration() time.Duration {
+	return s.EndTime.Sub(s.BeginTime)
+}
@@ -0,0 +1,27 @@
+package grpcmon
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UnknownServiceHandler returns a gRPC ServerOption like
+// grpc.UnknownServiceHandler, that counts the calls to services and methods
+// the server does not implement in the UnknownCalls metric of m, labeled with
+// the service called, so that clients speaking the wrong version of an API
+// stand out. The calls are then handled by fallback or, if it is nil,
+// failed with the Unimplemented code, as gRPC does without the option.
+func UnknownServiceHandler(m *Metrics, fallback grpc.StreamHandler) grpc.ServerOption {
+	return grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		fullMethod, _ := grpc.MethodFromServerStream(stream)
+		if m.UnknownCalls != nil {
+			service, _ := ParseFullMethod(fullMethod)
+			m.UnknownCalls.With("service", service).Add(1)
+		}
+		if fallback != nil {
+			return fallback(srv, stream)
+		}
+		return status.Errorf(codes.Unimplemented, "unknown method %s", fullMethod)
+	})
+}
@@ -0,0 +1,57 @@
+package grpcmon_test
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/Bo0mer/grpcmon"
+	"github.com/Bo0mer/grpcmon/grpcmontest"
+	pb "github.com/Bo0mer/grpcmon/testdata/frontend"
+)
+
+func TestUnknownServiceHandler(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	h := grpcmontest.NewHarness(t, grpcmontest.ServerOptions(grpcmon.UnknownServiceHandler(m, nil)))
+	pb.RegisterFrontendServer(h.Server, &frontend{})
+	call := func(method string) error {
+		return h.Conn().Invoke(context.Background(), method, wrapperspb.String("x"), new(wrapperspb.StringValue))
+	}
+	for _, method := range []string{"/frontend.v2.Frontend/Query", "/frontend.v2.Frontend/Search", "/frontend.Frontend/Search"} {
+		if err := call(method); status.Code(err) != codes.Unimplemented {
+			t.Errorf("%s: error = %v, want Unimplemented", method, err)
+		}
+	}
+	if _, err := pb.NewFrontendClient(h.Conn()).Query(context.Background(), &pb.QueryRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	h.Stop()
+
+	rec.AssertCounterDelta(t, grpcmontest.UnknownCalls, map[string]string{"service": "frontend.v2.Frontend"}, 2)
+	rec.AssertCounterDelta(t, grpcmontest.UnknownCalls, map[string]string{"service": "frontend.Frontend"}, 1)
+}
+
+func TestUnknownServiceHandlerFallback(t *testing.T) {
+	m, rec := grpcmontest.NewRecorder()
+	fallback := func(_ interface{}, stream grpc.ServerStream) error {
+		v := new(wrapperspb.StringValue)
+		if err := stream.RecvMsg(v); err != nil {
+			return err
+		}
+		return stream.SendMsg(v)
+	}
+	h := grpcmontest.NewHarness(t, grpcmontest.ServerOptions(grpcmon.UnknownServiceHandler(m, fallback)))
+	reply := new(wrapperspb.StringValue)
+	if err := h.Conn().Invoke(context.Background(), "/proxied.Service/Method", wrapperspb.String("x"), reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Value != "x" {
+		t.Errorf("reply = %q, want the fallback echo", reply.Value)
+	}
+	h.Stop()
+	rec.AssertCounterDelta(t, grpcmontest.UnknownCalls, map[string]string{"service": "proxied.Service"}, 1)
+}
@@ -0,0 +1,54 @@
+package grpcmon
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultWatchdogCooldown is the default minimum time between two calls of
+// the pending watchdog for the same method.
+const defaultWatchdogCooldown = time.Minute
+
+// pendingWatchdog calls a user function when the number of RPCs in flight of
+// a method exceeds its limit.
+type pendingWatchdog struct {
+	limit    int64
+	methods  map[rpcName]int
+	cooldown time.Duration
+	fn       func(service, method string, pending int)
+	now      func() time.Time
+	self     *SelfMetrics
+
+	last sync.Map // rpcName -> *atomic.Int64, Unix nanoseconds of the last call
+}
+
+func (w *pendingWatchdog) limitFor(name rpcName) int64 {
+	if l, ok := w.methods[name]; ok {
+		return int64(l)
+	}
+	return w.limit
+}
+
+// check calls the function if n, the count of the given method after adding
+// one, has just crossed the limit and the method is not cooling down.
+func (w *pendingWatchdog) check(name rpcName, n int64) {
+	limit := w.limitFor(name)
+	if limit <= 0 || n != limit+1 {
+		return
+	}
+	v, ok := w.last.Load(name)
+	if !ok {
+		v, _ = w.last.LoadOrStore(name, new(atomic.Int64))
+	}
+	last := v.(*atomic.Int64)
+	now := w.now().UnixNano()
+	prev := last.Load()
+	if prev != 0 && now-prev < int64(w.cooldown) || !last.CompareAndSwap(prev, now) {
+		return
+	}
+	go func() {
+		defer w.self.recoverSinkError()
+		w.fn(name.server, name.method, int(n))
+	}()
+}
@@ -0,0 +1,53 @@
+package grpcmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingWatchdog(t *testing.T) {
+	calls := make(chan int, 10)
+	h := newHandler(&Metrics{}, false, []Option{
+		WithPendingWatchdog(2, func(service, method string, pending int) {
+			if service != "s" {
+				t.Errorf("called for %s/%s", service, method)
+			}
+			calls <- pending
+		}),
+		WithPendingWatchdogLimit("s", "off", 0),
+		WithPendingWatchdogCooldown(time.Minute),
+	})
+	now := time.Unix(1000, 0)
+	h.watchdog.now = func() time.Time { return now }
+	name := rpcName{server: "s", method: "m"}
+	for n := int64(1); n <= 5; n++ {
+		h.watchdog.check(name, n)
+		h.watchdog.check(rpcName{server: "s", method: "off"}, n)
+	}
+	if got := <-calls; got != 3 {
+		t.Errorf("called with %d, want 3", got)
+	}
+
+	// Crossing again is ignored while cooling down.
+	h.watchdog.check(name, 3)
+	now = now.Add(time.Minute)
+	h.watchdog.check(name, 3)
+	if got := <-calls; got != 3 {
+		t.Errorf("called with %d, want 3", got)
+	}
+	select {
+	case n := <-calls:
+		t.Errorf("unexpected call with %d", n)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestPendingWatchdogRecovers(t *testing.T) {
+	done := make(chan struct{})
+	h := newHandler(&Metrics{}, false, []Option{WithPendingWatchdog(1, func(string, string, int) {
+		defer close(done)
+		panic("boom")
+	})})
+	h.watchdog.check(rpcName{server: "s", method: "m"}, 2)
+	<-done
+}